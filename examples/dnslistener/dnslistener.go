@@ -50,6 +50,7 @@ func main() {
 	// start packet processing goroutine
 	go func() {
 		buffer := make([]byte, packet.EthMaxSize)
+		destinations := make(map[string]bool) // destination names already printed; key is mac and name
 		for {
 			n, _, err := s.ReadFrom(buffer)
 			if err != nil {
@@ -79,6 +80,15 @@ func main() {
 					fmt.Println("error processing arp packet", err)
 				}
 
+			case packet.PayloadTCP, packet.PayloadSSL, packet.PayloadHTTP:
+				// print the name each host resolved for new destinations
+				if name, found := dnshandler.DestinationName(frame); found && !destinations[string(frame.SrcAddr.MAC)+name] {
+					if len(destinations) > 1024 {
+						destinations = make(map[string]bool)
+					}
+					destinations[string(frame.SrcAddr.MAC)+name] = true
+					fmt.Printf("host mac=%s ip=%s connected to name=%s ip=%s\n", frame.SrcAddr.MAC, frame.SrcAddr.IP, name, frame.DstAddr.IP)
+				}
 			}
 		}
 	}()
@@ -155,6 +155,11 @@ func (h *Handler) processClientPacket(host *packet.Host, req packet.DHCP4) error
 		return err
 	}
 
+	// A reply to one of our clients?
+	if h.processClientReply(req) {
+		return nil
+	}
+
 	options := req.ParseOptions()
 	t := options[packet.DHCP4OptionDHCPMessageType]
 	if len(t) != 1 {
@@ -0,0 +1,140 @@
+package dhcp4_spoofer
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+// maxProbeAttempts is the number of addresses to probe before giving up on a discover.
+const maxProbeAttempts = 4
+
+// declinedClientID returns the lease table key for a declined IP.
+func declinedClientID(ip netip.Addr) []byte {
+	return append([]byte("declined-"), ip.AsSlice()...)
+}
+
+// markDeclined marks the IP as in use by another host for the conflict cool-down period.
+// The declined entry is kept in the lease table with Addr.MAC set to the conflicting mac, if known,
+// so that allocIPOffer will not offer the IP.
+func (h *Handler) markDeclined(ip netip.Addr, mac net.HardwareAddr) *Lease {
+	clientID := declinedClientID(ip)
+	lease := h.table[string(clientID)]
+	if lease == nil {
+		lease = &Lease{ClientID: clientID}
+		h.table[string(clientID)] = lease
+	}
+	lease.subnet = h.net1
+	if h.net2.LAN.Contains(ip) {
+		lease.subnet = h.net2
+	}
+	lease.State = StateDeclined
+	lease.Addr = packet.Addr{MAC: packet.CopyMAC(mac), IP: ip}
+	lease.IPOffer = netip.Addr{}
+	lease.DHCPExpiry = time.Now().Add(h.conflictCooldown)
+	h.storeLease(lease)
+	if Logger.IsInfo() {
+		Logger.Msg("address conflict - ip declined").IP("ip", ip).MAC("mac", mac).Time("until", lease.DHCPExpiry).Write()
+	}
+	return lease
+}
+
+// conflictHost returns the mac of another host using ip. It returns found true if ip is in use by
+// a host other than mac.
+func (h *Handler) conflictHost(ip netip.Addr, mac net.HardwareAddr) (conflict net.HardwareAddr, found bool) {
+	host := h.session.FindIP(ip)
+	if host == nil || bytes.Equal(host.MACEntry.MAC, mac) {
+		return nil, false
+	}
+	return host.MACEntry.MAC, true
+}
+
+// sendARPProbe sends an ARP probe for ip from mac. Any host using the IP will reply and
+// the session will add the host to the host table.
+func (h *Handler) sendARPProbe(mac net.HardwareAddr, ip netip.Addr) (err error) {
+	b := packet.EtherBufferPool.Get().(*[packet.EthMaxSize]byte)
+	defer packet.EtherBufferPool.Put(b)
+	ether := packet.Ether(b[0:])
+	ether = packet.EncodeEther(ether, syscall.ETH_P_ARP, mac, packet.EthernetBroadcast)
+	arp := packet.EncodeARP(ether.Payload(), packet.ARPOperationRequest,
+		packet.Addr{MAC: mac, IP: packet.IPv4zero}, packet.Addr{MAC: packet.EthernetZero, IP: ip})
+	if ether, err = ether.SetPayload(arp); err != nil {
+		return err
+	}
+	_, err = h.session.Conn.WriteTo(ether, &packet.Addr{MAC: packet.EthernetBroadcast})
+	return err
+}
+
+// validProbe returns the lease if the probe for clientID is still current.
+// The handler lock must be held.
+func (h *Handler) validProbe(clientID []byte, xid []byte) *Lease {
+	lease := h.table[string(clientID)]
+	if lease == nil || lease.State != StateDiscover || !bytes.Equal(lease.XID, xid) || !lease.IPOffer.IsValid() {
+		return nil
+	}
+	return lease
+}
+
+// probeOffer checks that the offered IP is not in use before sending the offer to the client.
+//
+// It must run in a goroutine because ProcessPacket is called from the session read loop
+// which must continue to process packets to receive the ARP reply. If the IP is in use, the IP is
+// marked declined and a new IP is probed.
+func (h *Handler) probeOffer(clientID []byte, xid []byte, req packet.DHCP4, dstAddr packet.Addr) {
+	for i := 0; i < maxProbeAttempts; i++ {
+		h.Lock()
+		lease := h.validProbe(clientID, xid)
+		if lease == nil { // a new discover or request changed the lease
+			h.Unlock()
+			return
+		}
+		ip, mac := lease.IPOffer, packet.CopyMAC(lease.Addr.MAC)
+		h.Unlock()
+
+		if Logger.IsDebug() {
+			Logger.Msg("probing ip").IP("ip", ip).Write()
+		}
+		if err := h.sendARPProbe(h.session.NICInfo.HostAddr4.MAC, ip); err != nil {
+			Logger.Msg("failed to send arp probe").IP("ip", ip).Error(err).Write()
+		}
+		pingOK := false
+		if h.probePing {
+			pingOK = h.session.Ping(packet.Addr{MAC: packet.EthernetBroadcast, IP: ip}, h.probeTimeout) == nil
+		} else {
+			select {
+			case <-time.After(h.probeTimeout):
+			case <-h.closeChan:
+				return
+			}
+		}
+
+		h.Lock()
+		if lease = h.validProbe(clientID, xid); lease == nil || lease.IPOffer != ip {
+			h.Unlock()
+			return
+		}
+		conflict, found := h.conflictHost(ip, mac)
+		if found || (pingOK && h.session.FindIP(ip) == nil) {
+			h.markDeclined(ip, conflict)
+			lease.IPOffer = netip.Addr{}
+			if err := h.allocIPOffer(lease, netip.Addr{}); err != nil {
+				Logger.Msg("discover all ips allocated, failing silently").Error(err).Write()
+				h.delete(lease)
+				h.Unlock()
+				return
+			}
+			h.Unlock()
+			continue
+		}
+		response := h.offerPacket(lease, req, req.ParseOptions())
+		h.Unlock()
+
+		h.sendReply(dstAddr, response)
+		return
+	}
+	Logger.Msg("discover too many conflicts, failing silently").ByteArray("clientid", clientID).Write()
+}
@@ -0,0 +1,171 @@
+package dhcp4_spoofer
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+func newARPReplyFrame(sender packet.Addr, target packet.Addr) packet.Ether {
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_ARP, sender.MAC, target.MAC)
+	arp := packet.EncodeARP(ether.Payload(), packet.ARPOperationReply, sender, target)
+	ether, err := ether.SetPayload(arp)
+	if err != nil {
+		panic(err)
+	}
+	return ether
+}
+
+func TestHandler_ConflictDetection(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := setupTestHandler()
+	defer tc.Close()
+
+	var err error
+	tc.h.Close()
+	store := NewMemoryStore()
+	config := Config{NetfilterIP: netip.PrefixFrom(hostIP4, 25), DNSServer: dnsIP4, LeaseStore: store,
+		ProbeTimeout: time.Millisecond * 30, ConflictCooldown: time.Minute}
+	if tc.h, err = config.New(tc.session); err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer tc.h.Close()
+
+	clientMAC := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x08, 0x01}
+	staticMAC := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x08, 0x02}
+	srcAddr := packet.Addr{MAC: clientMAC, IP: packet.IPv4zero, Port: packet.DHCP4ClientPort}
+
+	frame, err := tc.session.Parse(newDHCP4DiscoverFrame(srcAddr, "client", []byte("conflict")))
+	if err != nil {
+		t.Fatal("invalid frame", err)
+	}
+	if err := tc.h.ProcessPacket(frame); err != nil {
+		t.Fatal("process packet", err)
+	}
+
+	// offer is delayed until the probe completes
+	select {
+	case <-tc.notifyReply:
+		t.Fatal("unexpected offer before probe")
+	default:
+	}
+	tc.h.Lock()
+	probeIP := tc.h.table[string(clientMAC)].IPOffer
+	tc.h.Unlock()
+	if !probeIP.IsValid() {
+		t.Fatal("invalid probe ip")
+	}
+
+	// static host replies to the arp probe
+	if _, err := tc.session.Parse(newARPReplyFrame(packet.Addr{MAC: staticMAC, IP: probeIP}, packet.Addr{MAC: hostMAC, IP: packet.IPv4zero})); err != nil {
+		t.Fatal("invalid arp frame", err)
+	}
+
+	var offerIP netip.Addr
+	select {
+	case p := <-tc.notifyReply:
+		offerIP = packet.DHCP4(packet.UDP(packet.IP4(packet.Ether(p).Payload()).Payload()).Payload()).YIAddr()
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("missing offer")
+	}
+	if offerIP == probeIP || !offerIP.IsValid() {
+		t.Fatalf("invalid offer ip=%s conflict ip=%s", offerIP, probeIP)
+	}
+
+	tc.h.Lock()
+	declined := tc.h.findByIP(probeIP)
+	if declined == nil || declined.State != StateDeclined || !bytes.Equal(declined.Addr.MAC, staticMAC) {
+		t.Errorf("invalid declined lease %+v", declined)
+	}
+	if lease := tc.h.table[string(clientMAC)]; lease == nil || lease.State != StateDiscover || lease.IPOffer != offerIP {
+		t.Errorf("invalid client lease %+v", lease)
+	}
+	tc.h.Unlock()
+
+	// declined ip survives a restart
+	restarted, err := config.New(tc.session)
+	if err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	if l := restarted.findByIP(probeIP); l == nil || l.State != StateDeclined || !bytes.Equal(l.Addr.MAC, staticMAC) {
+		t.Errorf("declined lease not restored %+v", l)
+	}
+	restarted.Close()
+
+	// declined ip is released after the cool down period
+	tc.h.MinuteTicker(time.Now().Add(time.Minute * 2))
+	tc.h.Lock()
+	if l := tc.h.findByIP(probeIP); l != nil {
+		t.Errorf("declined lease not freed %+v", l)
+	}
+	tc.h.Unlock()
+	if table, _ := store.Load(); len(table.Leases) != 0 {
+		t.Errorf("declined lease not deleted from store %+v", table.Leases)
+	}
+}
+
+func TestHandler_allocIPOfferDeclined(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := setupTestHandler()
+	defer tc.Close()
+
+	tc.h.Lock()
+	defer tc.h.Unlock()
+
+	// a free lease with the same ip must not hide the declined lease
+	declinedIP := netip.MustParseAddr("192.168.0.10")
+	tc.h.markDeclined(declinedIP, net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x08, 0x02})
+	for i := 0; i < 8; i++ {
+		free := tc.h.findOrCreate(tc.h.net1, []byte{0x00, 0x02, 0x03, 0x04, 0x08, byte(0x10 + i)}, mac1, "free")
+		free.Addr.IP = declinedIP
+	}
+
+	lease := tc.h.findOrCreate(tc.h.net1, mac2, mac2, "client")
+	for i := 0; i < 8; i++ {
+		tc.h.net1.nextIP = declinedIP
+		if err := tc.h.allocIPOffer(lease, declinedIP); err != nil || lease.IPOffer == declinedIP {
+			t.Fatalf("declined ip offered ip=%s err=%v", lease.IPOffer, err)
+		}
+	}
+}
+
+func TestHandler_findByMACDeclined(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := setupTestHandler()
+	defer tc.Close()
+
+	// the conflicting host holds a lease of its own
+	newDHCPHost(t, tc, mac1, "conflict")
+	tc.h.Lock()
+	ip := tc.h.table[string(mac1)].Addr.IP
+	for i := 0; i < 8; i++ {
+		tc.h.markDeclined(netip.AddrFrom4([4]byte{192, 168, 0, byte(20 + i)}), mac1)
+	}
+	for i := 0; i < 8; i++ {
+		if lease := tc.h.findByMAC(mac1); lease == nil || lease.State != StateAllocated || lease.Addr.IP != ip {
+			t.Fatalf("invalid lease %s", lease)
+		}
+	}
+	tc.h.Unlock()
+
+	if err := tc.h.ExpireLease(mac1); err != nil {
+		t.Fatal(err)
+	}
+	tc.h.Lock()
+	defer tc.h.Unlock()
+	if lease := tc.h.table[string(mac1)]; lease.State != StateFree {
+		t.Errorf("lease not expired %s", lease)
+	}
+	for i := 0; i < 8; i++ {
+		if lease := tc.h.findByIP(netip.AddrFrom4([4]byte{192, 168, 0, byte(20 + i)})); lease == nil || lease.State != StateDeclined {
+			t.Errorf("declined hold changed %s", lease)
+		}
+	}
+}
@@ -27,9 +27,9 @@ func (h *Handler) handleDecline(p packet.DHCP4, options packet.DHCP4Options) (d
 	serverIP, _ := netip.AddrFromSlice(options[packet.DHCP4OptionServerIdentifier])
 	clientID := getClientID(p, options)
 
-	lease := h.findOrCreate(clientID, p.CHAddr(), "")
+	lease := h.findOrCreate(h.clientSubnet(p, options), clientID, p.CHAddr(), "")
 
-	if lease.subnet.DHCPServer != serverIP {
+	if lease != nil && lease.subnet.DHCPServer != serverIP {
 		Logger.Msg("decline for another server - ignore").ByteArray("clientid", clientID).IP("ip", reqIP).IP("serverIP", serverIP).Write()
 		return nil
 	}
@@ -44,9 +44,17 @@ func (h *Handler) handleDecline(p packet.DHCP4, options packet.DHCP4Options) (d
 	}
 
 	Logger.Msg("decline").ByteArray("clientid", clientID).IP("serverIP", serverIP).IP("ip", lease.Addr.IP).Write()
+
+	// rfc2131: the server MUST mark the network address as not available
+	conflict, _ := h.conflictHost(lease.Addr.IP, lease.Addr.MAC)
+	h.markDeclined(lease.Addr.IP, conflict)
+
+	declined := *lease // notify with the declined ip
 	lease.State = StateFree
 	lease.Addr.IP = netip.Addr{}
 	lease.IPOffer = netip.Addr{}
+	h.storeLease(lease)
+	h.notifyLease(LeaseDecline, &declined)
 	return nil
 }
 
@@ -64,11 +72,18 @@ func (h *Handler) handleRelease(p packet.DHCP4, options packet.DHCP4Options) (d
 	serverIP, _ := netip.AddrFromSlice(options[packet.DHCP4OptionServerIdentifier])
 	clientID := getClientID(p, options)
 
-	lease := h.findOrCreate(clientID, p.CHAddr(), "")
-	if lease.subnet.DHCPServer != serverIP || lease == nil || lease.Addr.IP != reqIP {
+	lease := h.findOrCreate(h.clientSubnet(p, options), clientID, p.CHAddr(), "")
+	if lease == nil || lease.subnet.DHCPServer != serverIP || lease.Addr.IP != reqIP {
 		Logger.Msg("release - discard invalid packet").ByteArray("clientid", clientID).IP("serverIP", serverIP).IP("reqip", reqIP).Write()
 		return nil
 	}
 	Logger.Msg("release").ByteArray("clientid", clientID).IP("ip", lease.Addr.IP).MAC("mac", lease.Addr.MAC).ByteArray("xid", p.XId()).Write()
+
+	released := *lease // notify with the released ip
+	lease.State = StateFree
+	lease.Addr.IP = netip.Addr{}
+	lease.IPOffer = netip.Addr{}
+	h.storeLease(lease)
+	h.notifyLease(LeaseRelease, &released)
 	return nil
 }
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
-	"os"
 	"testing"
 	"time"
 
@@ -15,7 +14,6 @@ import (
 func Test_declineSimple(t *testing.T) {
 	packet.Logger.SetLevel(fastlog.LevelError)
 	Logger.SetLevel(fastlog.LevelError)
-	os.Remove(testDHCPFilename)
 	tc := setupTestHandler()
 	defer tc.Close()
 
@@ -41,7 +39,6 @@ func Test_declineSimple(t *testing.T) {
 }
 func Test_DeclineFromAnotherServer(t *testing.T) {
 	Logger.SetLevel(fastlog.LevelError)
-	os.Remove(testDHCPFilename)
 	tc := setupTestHandler()
 	defer tc.Close()
 
@@ -15,6 +15,7 @@
 package dhcp4_spoofer
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
@@ -54,19 +55,43 @@ type Config struct {
 	Mode          Mode
 	NetfilterIP   netip.Prefix
 	DNSServer     netip.Addr
-	LeaseFilename string
+	LeaseFilename string          // lease file used when LeaseStore is nil
+	LeaseStore    LeaseStore      // lease persistence; default to a FileStore or MemoryStore if LeaseFilename is empty
+	EventChan     chan LeaseEvent // optional channel to receive lease events; events are dropped if the channel is full
+	LeaseScript   string          // optional command to run on lease events; see runLeaseScript
+
+	// Address conflict detection
+	ProbeTimeout     time.Duration // time to wait for an ARP probe reply before offering a new IP; zero disables probing
+	ProbePing        bool          // also send an ICMP echo to the IP during the probe
+	ConflictCooldown time.Duration // time a conflicting or declined IP is not offered; default to 10 minutes
+
+	RelaySubnets []RelaySubnet // remote subnets served via a dhcp relay agent
+
+	// Option profiles
+	Profiles     []OptionProfile // named option profiles
+	ProfileRules []ProfileRule   // select the profiles sent to each client by subnet, stage, mac or vendor class
 }
 
 // Handler is the main dhcp4 handler
 type Handler struct {
-	session   *packet.Session   // engine handler
-	mode      Mode              // operating mode: primary, secondary, nice
-	filename  string            // leases filename
-	closed    bool              // indicates that Close() function was called
-	closeChan chan bool         // channel to close underlying goroutines
-	table     map[string]*Lease // in memory lease table
-	net1      *dhcpSubnet       // home LAN
-	net2      *dhcpSubnet       // netfilter LAN - a subnet of net1
+	session          *packet.Session        // engine handler
+	mode             Mode                   // operating mode: primary, secondary, nice
+	store            LeaseStore             // lease persistence
+	eventChan        chan LeaseEvent        // lease events for the caller
+	scriptChan       chan LeaseEvent        // lease events queued for the lease script
+	probeTimeout     time.Duration          // conflict detection probe timeout; zero if disabled
+	probePing        bool                   // ping IP during probe
+	conflictCooldown time.Duration          // time to hold declined IPs
+	closed           bool                   // indicates that Close() function was called
+	closeChan        chan bool              // channel to close underlying goroutines
+	table            map[string]*Lease      // in memory lease table
+	net1             *dhcpSubnet            // home LAN
+	net2             *dhcpSubnet            // netfilter LAN - a subnet of net1
+	relays           []relaySubnet          // remote subnets served via relay agents
+	clients          map[string]*Client     // dhcp clients by mac
+	profiles         []profileRule          // option profile rules sorted by specificity
+	reservations     map[string]Reservation // fixed IP reservations by mac
+	moved            map[string]*dhcpSubnet // subnet overrides by mac set via MoveClient
 	sync.Mutex
 }
 
@@ -79,10 +104,24 @@ func New(session *packet.Session) (handler *Handler, err error) {
 
 // New accepts a configuration structure and return a dhcp handler with two internal subnets.
 func (config Config) New(session *packet.Session) (h *Handler, err error) {
-	h = &Handler{table: map[string]*Lease{}}
+	h = &Handler{table: map[string]*Lease{}, clients: map[string]*Client{}, moved: map[string]*dhcpSubnet{}}
 	h.session = session
-	h.filename = config.LeaseFilename
+	h.store = config.LeaseStore
+	if h.store == nil {
+		if config.LeaseFilename != "" {
+			h.store = NewFileStore(config.LeaseFilename)
+		} else {
+			h.store = NewMemoryStore()
+		}
+	}
 	h.closeChan = make(chan bool)
+	h.eventChan = config.EventChan
+	h.probeTimeout = config.ProbeTimeout
+	h.probePing = config.ProbePing
+	h.conflictCooldown = config.ConflictCooldown
+	if h.conflictCooldown <= 0 {
+		h.conflictCooldown = time.Minute * 10
+	}
 
 	if Logger.IsDebug() {
 		Logger.Msg("new dhcp4 handler").Sprintf("config", config).Write()
@@ -126,15 +165,26 @@ func (config Config) New(session *packet.Session) (h *Handler, err error) {
 		// FirstIP:    net.ParseIP("192.168.0.10"),
 	}
 
-	// Reset leases if error or config has changed
-	h.net1, h.net2, h.table, err = h.loadConfig(h.filename)
+	if h.profiles, err = newProfileRules(config.Profiles, config.ProfileRules); err != nil {
+		return nil, err
+	}
+
+	// Relay subnets must be set before loading the lease table
+	if h.relays, err = newRelaySubnets(config.RelaySubnets, session.NICInfo.HomeLAN4, session.NICInfo.HostAddr4.IP, config.DNSServer); err != nil {
+		return nil, err
+	}
+
+	// Reset subnets if error or config has changed
+	table, err := h.store.Load()
+	if err == nil {
+		h.net1, h.net2, h.table, err = h.loadTable(table)
+	}
 	if err != nil || h.net1 == nil || h.net2 == nil || h.table == nil ||
 		configChanged(homeSubnet, h.net1.SubnetConfig) || configChanged(netfilterSubnet, h.net2.SubnetConfig) {
 
-		if err != nil && !os.IsNotExist(err) {
-			Logger.Msg("invalid config file. resetting...").String("filename", h.filename).Write()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			Logger.Msg("invalid config file. resetting...").Error(err).Write()
 		}
-		h.table = make(map[string]*Lease)
 
 		// net1 is home LAN
 		h.net1, err = newSubnet(homeSubnet)
@@ -147,13 +197,24 @@ func (config Config) New(session *packet.Session) (h *Handler, err error) {
 		if err != nil {
 			return nil, fmt.Errorf("netfilter config : %w", err)
 		}
+
+		// migrate leases that are still valid in the new subnets
+		h.table = h.newLeaseTable(table.Leases, h.net1, h.net2)
+		if len(table.Leases) > 0 && Logger.IsInfo() {
+			Logger.Msg("migrated leases").Int("total", len(table.Leases)).Int("migrated", len(h.table)).Write()
+		}
 	}
 	h.net1.ID = "net1"
 	h.net2.ID = "net2"
 
 	// Add static and classless route options
 	h.net2.appendRouteOptions(h.net1.DefaultGW, net.CIDRMask(h.net1.LAN.Bits(), 32-h.net1.LAN.Bits()), h.net2.DefaultGW)
-	h.saveConfig(h.filename)
+	h.loadReservations(table.Reservations)
+	h.saveConfig()
+	if config.LeaseScript != "" {
+		h.scriptChan = make(chan LeaseEvent, 64)
+		go h.scriptLoop(config.LeaseScript)
+	}
 	if Logger.IsInfo() {
 		Logger.Msg("subnet 1").Sprintf("config", h.net1).Write()
 		Logger.Msg("subnet 2").Sprintf("config", h.net2).Write()
@@ -168,7 +229,7 @@ func (h *Handler) Close() error {
 	}
 	h.closed = true
 	close(h.closeChan)
-	return nil
+	return h.store.Close()
 }
 
 // MinuteTicker perform checks and free leases as required.
@@ -225,7 +286,7 @@ func (h *Handler) StartHunt(addr packet.Addr) error {
 	h.Lock() // local handler lock
 	defer h.Unlock()
 
-	if lease := h.findByIP(addr.IP); lease != nil && lease.subnet.Stage != packet.StageRedirected {
+	if lease := h.findByIP(addr.IP); lease != nil && lease.State != StateDeclined && lease.subnet.Stage != packet.StageRedirected {
 		// Fake a dhcp release so router will force the client to discover when it attempts to reconnect
 		if h.mode == ModeSecondaryServer || h.mode == ModeSecondaryServerNice {
 			h.forceRelease(lease.ClientID, h.net1.DefaultGW, lease.Addr.MAC, lease.Addr.IP, nil)
@@ -281,16 +342,47 @@ func (h *Handler) ProcessPacket(frame packet.Frame) error {
 
 	var response packet.DHCP4
 
+	// If IP not available, broadcast
+	var dstAddr packet.Addr
+	giaddr := dhcpFrame.GIAddr()
+	relayed := !giaddr.IsUnspecified()
+	if relayed {
+		// rfc2131: reply to the relay agent on the server port
+		dstAddr = packet.Addr{MAC: frame.SrcAddr.MAC, IP: giaddr, Port: packet.DHCP4ServerPort}
+	} else if frame.SrcAddr.IP == packet.IPv4zero || dhcpFrame.Broadcast() {
+		dstAddr = packet.Addr{MAC: packet.EthBroadcast, IP: packet.IPv4bcast, Port: packet.DHCP4ClientPort}
+	} else {
+		dstAddr = packet.Addr{MAC: frame.SrcAddr.MAC, IP: frame.SrcAddr.IP, Port: packet.DHCP4ClientPort}
+	}
+
+	var relayInfo []byte
+	var flags uint16
+	if relayed {
+		h.Lock()
+		subnet := h.clientSubnet(dhcpFrame, options)
+		h.Unlock()
+		if subnet == nil {
+			if Logger.IsInfo() {
+				Logger.Msg("relay packet for unknown subnet - ignore").IP("giaddr", giaddr).ByteArray("relayinfo", options[packet.DHCP4OptionRelayAgentInformation]).Write()
+			}
+			return nil
+		}
+		relayInfo = packet.CopyBytes(options[packet.DHCP4OptionRelayAgentInformation])
+		flags = dhcpFrame.Flags()
+	}
+
 	h.Lock()
 	switch reqType {
 	case packet.DHCP4Discover:
-		response = h.handleDiscover(dhcpFrame, options)
+		response = h.handleDiscover(dhcpFrame, options, dstAddr)
 	case packet.DHCP4Request:
 		response = h.handleRequest(frame.Host, dhcpFrame, options, frame.SrcAddr.IP)
 	case packet.DHCP4Decline:
 		response = h.handleDecline(dhcpFrame, options)
 	case packet.DHCP4Release:
 		response = h.handleRelease(dhcpFrame, options)
+	case packet.DHCP4Inform:
+		response = h.handleInform(dhcpFrame, options)
 	case packet.DHCP4Offer:
 		fmt.Println("dhcp4: error got dhcp offer")
 	default:
@@ -299,21 +391,23 @@ func (h *Handler) ProcessPacket(frame packet.Frame) error {
 	h.Unlock()
 
 	if response != nil {
-		var dstAddr packet.Addr
-		// If IP not available, broadcast
-		if frame.SrcAddr.IP == packet.IPv4zero || dhcpFrame.Broadcast() {
-			dstAddr = packet.Addr{MAC: packet.EthBroadcast, IP: packet.IPv4bcast, Port: packet.DHCP4ClientPort}
-		} else {
-			dstAddr = packet.Addr{MAC: frame.SrcAddr.MAC, IP: frame.SrcAddr.IP, Port: packet.DHCP4ClientPort}
-		}
-		if Logger.IsDebug() {
-			Logger.Msg("send reply to").Struct(dstAddr).Struct(response).Write()
-		}
-		srcAddr := packet.Addr{MAC: h.session.NICInfo.HostAddr4.MAC, IP: h.session.NICInfo.HostAddr4.IP, Port: packet.DHCP4ServerPort}
-		if err := sendDHCP4Packet(h.session.Conn, srcAddr, dstAddr, response); err != nil {
-			Logger.Msg("send packet failed").Error(err).Write()
-			return err
+		if relayed {
+			response = relayReply(response, giaddr, flags, relayInfo)
 		}
+		return h.sendReply(dstAddr, response)
+	}
+	return nil
+}
+
+// sendReply sends the dhcp response from our host to dstAddr.
+func (h *Handler) sendReply(dstAddr packet.Addr, response packet.DHCP4) error {
+	if Logger.IsDebug() {
+		Logger.Msg("send reply to").Struct(dstAddr).Struct(response).Write()
+	}
+	srcAddr := packet.Addr{MAC: h.session.NICInfo.HostAddr4.MAC, IP: h.session.NICInfo.HostAddr4.IP, Port: packet.DHCP4ServerPort}
+	if err := sendDHCP4Packet(h.session.Conn, srcAddr, dstAddr, response); err != nil {
+		Logger.Msg("send packet failed").Error(err).Write()
+		return err
 	}
 	return nil
 }
@@ -5,7 +5,6 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net/netip"
-	"os"
 	"testing"
 	"time"
 
@@ -219,7 +218,6 @@ func TestHandler_handleRequest(t *testing.T) {
 	}
 
 	Logger.SetLevel(fastlog.LevelError)
-	os.Remove(testDHCPFilename)
 	tc := setupTestHandler()
 	defer tc.Close()
 
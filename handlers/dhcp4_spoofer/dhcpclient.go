@@ -0,0 +1,571 @@
+package dhcp4_spoofer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+// ClientState is the rfc2131 dhcp client state
+type ClientState int
+
+// DHCP4 client states
+const (
+	ClientInit ClientState = iota + 1
+	ClientSelecting
+	ClientRequesting
+	ClientBound
+	ClientRenewing
+	ClientRebinding
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case ClientInit:
+		return "init"
+	case ClientSelecting:
+		return "selecting"
+	case ClientRequesting:
+		return "requesting"
+	case ClientBound:
+		return "bound"
+	case ClientRenewing:
+		return "renewing"
+	case ClientRebinding:
+		return "rebinding"
+	}
+	return "invalid"
+}
+
+// ClientLease is the lease obtained by a Client.
+type ClientLease struct {
+	State      ClientState
+	MAC        net.HardwareAddr
+	IP         netip.Prefix // leased address and subnet mask
+	Router     netip.Addr
+	DNSServers []netip.Addr
+	DomainName string
+	ServerID   netip.Addr
+	Duration   time.Duration // lease time
+	T1         time.Duration // renewal time
+	T2         time.Duration // rebinding time
+	Acquired   time.Time
+}
+
+func (l ClientLease) String() string {
+	line := Logger.Msg("")
+	return l.FastLog(line).ToString()
+}
+
+func (l ClientLease) FastLog(line *fastlog.Line) *fastlog.Line {
+	line.String("state", l.State.String())
+	line.MAC("mac", l.MAC)
+	line.String("ip", l.IP.String())
+	line.IP("router", l.Router)
+	line.IP("server", l.ServerID)
+	line.String("duration", l.Duration.String())
+	return line
+}
+
+// ClientConfig contains the dhcp client configuration.
+type ClientConfig struct {
+	MAC      net.HardwareAddr // client mac; default to our host mac
+	Name     string           // hostname option
+	ClientID []byte           // optional client identifier option
+
+	// NIC is the interface to configure with the leased address using packet.LinuxConfigureInterface.
+	// It is only used when the client mac is our host mac.
+	NIC string
+
+	// Notify is called when a lease is bound, renewed or lost. A lost lease has state ClientInit.
+	// Notify is called from the client goroutine and must not block.
+	Notify func(ClientLease)
+
+	RetransmitTimeout time.Duration // initial retransmission timeout; default to 4 seconds, doubling up to 64 seconds
+	ProbeTimeout      time.Duration // time to wait for an ARP reply before binding the address; default to 1 second
+	DeclineWait       time.Duration // time to wait before restarting after a conflict; default to 10 seconds
+}
+
+// Client is a dhcp4 client that obtains and maintains a lease for our host or a virtual mac.
+//
+// The client implements the rfc2131 state machine:
+//
+//	INIT -> SELECTING -> REQUESTING -> BOUND -> RENEWING (T1) -> REBINDING (T2) -> INIT (expiry)
+//
+// Replies are received via the handler ProcessPacket.
+type Client struct {
+	h           *Handler
+	mac         net.HardwareAddr
+	name        string
+	clientID    []byte
+	nic         string
+	notify      func(ClientLease)
+	retransmit  time.Duration
+	probe       time.Duration
+	declineWait time.Duration
+	replyChan   chan packet.DHCP4
+	closeChan   chan bool
+	wg          sync.WaitGroup
+
+	// state is protected by the mutex
+	mutex   sync.Mutex
+	state   ClientState
+	xid     []byte
+	retries int
+	offer   ClientLease
+	lease   ClientLease
+}
+
+// dhcp client constants - rfc2131
+const (
+	clientMaxRetransmit  = time.Second * 64
+	clientMaxRequests    = 4
+	clientMinRenewRetry  = time.Second * 60
+	clientReplyQueueSize = 16
+)
+
+// NewClient starts a dhcp client for the configured mac.
+func (h *Handler) NewClient(config ClientConfig) (*Client, error) {
+	c := &Client{h: h, name: config.Name, nic: config.NIC, notify: config.Notify}
+	c.mac = packet.CopyMAC(config.MAC)
+	if c.mac == nil {
+		c.mac = packet.CopyMAC(h.session.NICInfo.HostAddr4.MAC)
+	}
+	c.clientID = packet.CopyBytes(config.ClientID)
+	c.retransmit = config.RetransmitTimeout
+	if c.retransmit <= 0 {
+		c.retransmit = time.Second * 4
+	}
+	c.probe = config.ProbeTimeout
+	if c.probe <= 0 {
+		c.probe = time.Second
+	}
+	c.declineWait = config.DeclineWait
+	if c.declineWait <= 0 {
+		c.declineWait = time.Second * 10
+	}
+	c.replyChan = make(chan packet.DHCP4, clientReplyQueueSize)
+	c.closeChan = make(chan bool)
+	c.state = ClientInit
+
+	h.Lock()
+	if _, found := h.clients[string(c.mac)]; found {
+		h.Unlock()
+		return nil, fmt.Errorf("dhcp client for mac=%s already exist: %w", c.mac, packet.ErrInvalidParam)
+	}
+	h.clients[string(c.mac)] = c
+	h.Unlock()
+
+	c.wg.Add(1)
+	go c.run()
+	return c, nil
+}
+
+// Close stops the client and releases the lease if bound.
+func (c *Client) Close() error {
+	c.h.Lock()
+	if c.h.clients[string(c.mac)] != c {
+		c.h.Unlock()
+		return nil
+	}
+	delete(c.h.clients, string(c.mac))
+	c.h.Unlock()
+
+	close(c.closeChan)
+	c.wg.Wait()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state == ClientBound || c.state == ClientRenewing || c.state == ClientRebinding {
+		c.state = ClientInit
+		return c.sendRelease()
+	}
+	return nil
+}
+
+// State returns the current client state.
+func (c *Client) State() ClientState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state
+}
+
+// Lease returns the current lease; the lease state is ClientInit if no lease is bound.
+func (c *Client) Lease() ClientLease {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lease := c.lease
+	lease.State = c.state
+	return lease
+}
+
+// processClientReply forwards a reply to our dhcp client, if any.
+// It returns true if the packet is for one of our clients.
+func (h *Handler) processClientReply(p packet.DHCP4) bool {
+	h.Lock()
+	c := h.clients[string(p.CHAddr())]
+	h.Unlock()
+	if c == nil || p.OpCode() != packet.DHCP4BootReply {
+		return false
+	}
+	// the packet buffer is reused by the session; send a copy
+	select {
+	case c.replyChan <- packet.DHCP4(packet.CopyBytes(p)):
+	default:
+		Logger.Msg("client reply queue is full").MAC("mac", c.mac).Write()
+	}
+	return true
+}
+
+// run is the client state machine. It runs until the client or the handler are closed.
+func (c *Client) run() {
+	defer c.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case <-c.h.closeChan:
+			return
+		case p := <-c.replyChan:
+			c.mutex.Lock()
+			next := c.processReply(p)
+			c.mutex.Unlock()
+			if next > 0 {
+				resetTimer(timer, next)
+			}
+		case <-timer.C:
+			c.mutex.Lock()
+			next := c.timeout()
+			c.mutex.Unlock()
+			resetTimer(timer, next)
+		}
+	}
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// backoff returns the rfc2131 exponential retransmission delay.
+func (c *Client) backoff() time.Duration {
+	d := c.retransmit << c.retries
+	if d > clientMaxRetransmit || d <= 0 {
+		d = clientMaxRetransmit
+	}
+	return d
+}
+
+// renewRetry returns the time to wait before retransmitting a renew or rebind request:
+// one half of the remaining time until deadline, down to a minimum of 60 seconds.
+func renewRetry(now time.Time, deadline time.Time) time.Duration {
+	remaining := deadline.Sub(now)
+	if remaining/2 < clientMinRenewRetry {
+		return remaining
+	}
+	return remaining / 2
+}
+
+// timeout handles a timer event and returns the next timeout. The client mutex must be held.
+func (c *Client) timeout() time.Duration {
+	now := time.Now()
+	switch c.state {
+	case ClientInit:
+		return c.startDiscover()
+
+	case ClientSelecting:
+		c.retries++
+		c.sendDiscover()
+		return c.backoff()
+
+	case ClientRequesting:
+		c.retries++
+		if c.retries >= clientMaxRequests {
+			Logger.Msg("client request timeout - restarting").MAC("mac", c.mac).Write()
+			return c.startDiscover()
+		}
+		c.sendRequest(c.offer.IP.Addr(), c.offer.ServerID)
+		return c.backoff()
+
+	case ClientBound, ClientRenewing:
+		t2 := c.lease.Acquired.Add(c.lease.T2)
+		if now.Before(t2) {
+			if c.state != ClientRenewing {
+				c.setState(ClientRenewing)
+			}
+			c.sendRequest(netip.Addr{}, netip.Addr{})
+			return renewRetry(now, t2)
+		}
+		c.setState(ClientRebinding)
+		fallthrough
+
+	case ClientRebinding:
+		expiry := c.lease.Acquired.Add(c.lease.Duration)
+		if now.Before(expiry) {
+			c.sendRequest(netip.Addr{}, netip.Addr{})
+			return renewRetry(now, expiry)
+		}
+		Logger.Msg("client lease expired").Struct(c.lease).Write()
+		c.lost()
+		return c.startDiscover()
+	}
+	return c.backoff()
+}
+
+// processReply handles a server reply and returns the next timeout or zero to keep the current timer.
+// The client mutex must be held.
+func (c *Client) processReply(p packet.DHCP4) time.Duration {
+	if err := p.IsValid(); err != nil || !bytes.Equal(p.XId(), c.xid) {
+		return 0
+	}
+	options := p.ParseOptions()
+	t := options[packet.DHCP4OptionDHCPMessageType]
+	if len(t) != 1 {
+		return 0
+	}
+	serverID, _ := netip.AddrFromSlice(options[packet.DHCP4OptionServerIdentifier])
+
+	switch packet.DHCP4MessageType(t[0]) {
+	case packet.DHCP4Offer:
+		if c.state != ClientSelecting || !serverID.Is4() {
+			return 0
+		}
+		// accept the first offer
+		c.offer = parseClientLease(p, options)
+		if Logger.IsInfo() {
+			Logger.Msg("client offer").Struct(c.offer).Write()
+		}
+		c.setState(ClientRequesting)
+		c.retries = 0
+		c.sendRequest(c.offer.IP.Addr(), c.offer.ServerID)
+		return c.backoff()
+
+	case packet.DHCP4ACK:
+		if c.state != ClientRequesting && c.state != ClientRenewing && c.state != ClientRebinding {
+			return 0
+		}
+		lease := parseClientLease(p, options)
+		if !lease.IP.IsValid() || lease.Duration <= 0 {
+			Logger.Msg("client invalid ack").Struct(lease).Write()
+			return 0
+		}
+		if c.state == ClientRequesting {
+			// rfc2131: the client SHOULD perform a check on the suggested address to ensure that
+			// the address is not already in use.
+			if conflict, found := c.probeAddr(lease.IP.Addr()); found {
+				Logger.Msg("client address in use - declining").IP("ip", lease.IP.Addr()).MAC("conflict", conflict).Write()
+				c.sendDecline(lease.IP.Addr(), lease.ServerID)
+				c.setState(ClientInit)
+				return c.declineWait
+			}
+		}
+		return c.bind(lease)
+
+	case packet.DHCP4NAK:
+		if c.state != ClientRequesting && c.state != ClientRenewing && c.state != ClientRebinding {
+			return 0
+		}
+		Logger.Msg("client nak - restarting").MAC("mac", c.mac).String("state", c.state.String()).Write()
+		if c.state != ClientRequesting {
+			c.lost()
+		}
+		return c.startDiscover()
+	}
+	return 0
+}
+
+// probeAddr sends an ARP probe for ip and waits for a reply.
+// The client mutex is held while waiting; replies are queued in the reply channel.
+func (c *Client) probeAddr(ip netip.Addr) (conflict net.HardwareAddr, found bool) {
+	if err := c.h.sendARPProbe(c.mac, ip); err != nil {
+		Logger.Msg("client failed to send arp probe").IP("ip", ip).Error(err).Write()
+	}
+	select {
+	case <-time.After(c.probe):
+	case <-c.closeChan:
+	case <-c.h.closeChan:
+	}
+	return c.h.conflictHost(ip, c.mac)
+}
+
+// bind sets the new lease and returns the time to T1.
+func (c *Client) bind(lease ClientLease) time.Duration {
+	previous := c.lease
+	c.lease = lease
+	c.setState(ClientBound)
+	if Logger.IsInfo() {
+		Logger.Msg("client lease bound").Struct(c.lease).Write()
+	}
+
+	// configure our interface if the address changed
+	if c.nic != "" && bytes.Equal(c.mac, c.h.session.NICInfo.HostAddr4.MAC) && previous.IP != lease.IP {
+		hostIP := previous.IP
+		if !hostIP.IsValid() {
+			hostIP = netip.PrefixFrom(c.h.session.NICInfo.HostAddr4.IP, c.h.session.NICInfo.HomeLAN4.Bits())
+		}
+		if hostIP.Addr() != lease.IP.Addr() {
+			if err := packet.LinuxConfigureInterface(c.nic, hostIP, lease.IP, netip.PrefixFrom(lease.Router, 32)); err != nil {
+				Logger.Msg("client failed to configure interface").String("nic", c.nic).Error(err).Write()
+			}
+		}
+	}
+	c.notifyLease()
+	return c.lease.T1
+}
+
+// lost clears the current lease and notifies the caller.
+func (c *Client) lost() {
+	c.setState(ClientInit)
+	c.notifyLease()
+	c.lease = ClientLease{}
+}
+
+func (c *Client) notifyLease() {
+	if c.notify == nil {
+		return
+	}
+	lease := c.lease
+	lease.State = c.state
+	c.notify(lease)
+}
+
+func (c *Client) setState(state ClientState) {
+	if Logger.IsDebug() {
+		Logger.Msg("client state").MAC("mac", c.mac).String("from", c.state.String()).String("to", state.String()).Write()
+	}
+	c.state = state
+}
+
+// startDiscover starts a new negotiation with a new transaction id.
+func (c *Client) startDiscover() time.Duration {
+	c.xid = mustXID(nil)
+	c.retries = 0
+	c.offer = ClientLease{}
+	c.setState(ClientSelecting)
+	c.sendDiscover()
+	return c.backoff()
+}
+
+func parseClientLease(p packet.DHCP4, options packet.DHCP4Options) ClientLease {
+	lease := ClientLease{MAC: packet.CopyMAC(p.CHAddr()), Acquired: time.Now()}
+	bits := 32
+	if mask := options[packet.DHCP4OptionSubnetMask]; len(mask) == 4 {
+		bits, _ = net.IPMask(mask).Size()
+	}
+	lease.IP = netip.PrefixFrom(p.YIAddr(), bits)
+	if router := options[packet.DHCP4OptionRouter]; len(router) >= 4 {
+		lease.Router = netip.AddrFrom4(*(*[4]byte)(router[:4]))
+	}
+	for dns := options[packet.DHCP4OptionDomainNameServer]; len(dns) >= 4; dns = dns[4:] {
+		lease.DNSServers = append(lease.DNSServers, netip.AddrFrom4(*(*[4]byte)(dns[:4])))
+	}
+	lease.DomainName = string(options[packet.DHCP4OptionDomainName])
+	lease.ServerID, _ = netip.AddrFromSlice(options[packet.DHCP4OptionServerIdentifier])
+	if v := options[packet.DHCP4OptionIPAddressLeaseTime]; len(v) == 4 {
+		lease.Duration = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	lease.T1 = lease.Duration / 2
+	if v := options[packet.DHCP4OptionRenewalTimeValue]; len(v) == 4 {
+		lease.T1 = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	lease.T2 = lease.Duration * 7 / 8
+	if v := options[packet.DHCP4OptionRebindingTimeValue]; len(v) == 4 {
+		lease.T2 = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	return lease
+}
+
+func (c *Client) options(msgType packet.DHCP4MessageType) packet.DHCP4Options {
+	options := packet.DHCP4Options{}
+	if c.name != "" && msgType != packet.DHCP4Decline && msgType != packet.DHCP4Release {
+		options[packet.DHCP4OptionHostName] = []byte(c.name)
+	}
+	if len(c.clientID) > 0 {
+		options[packet.DHCP4OptionClientIdentifier] = c.clientID
+	}
+	if msgType == packet.DHCP4Discover || msgType == packet.DHCP4Request {
+		options[packet.DHCP4OptionParameterRequestList] = []byte{
+			byte(packet.DHCP4OptionSubnetMask), byte(packet.DHCP4OptionRouter),
+			byte(packet.DHCP4OptionDomainNameServer), byte(packet.DHCP4OptionDomainName),
+			byte(packet.DHCP4OptionIPAddressLeaseTime), byte(packet.DHCP4OptionRenewalTimeValue), byte(packet.DHCP4OptionRebindingTimeValue),
+		}
+	}
+	return options
+}
+
+// send encodes and sends a client packet from ciaddr. The broadcast flag is set if ciaddr is not valid.
+func (c *Client) send(msgType packet.DHCP4MessageType, ciaddr netip.Addr, options packet.DHCP4Options, dstAddr packet.Addr) error {
+	b := packet.EtherBufferPool.Get().(*[packet.EthMaxSize]byte)
+	defer packet.EtherBufferPool.Put(b)
+	broadcast := !ciaddr.IsValid() // we don't have an address yet
+	if broadcast {
+		ciaddr = packet.IPv4zero
+	}
+	p := packet.EncodeDHCP4(b[0:], packet.DHCP4BootRequest, msgType, c.mac, ciaddr, packet.IPv4zero, c.xid, broadcast, options, nil)
+	srcAddr := packet.Addr{MAC: c.mac, IP: ciaddr, Port: packet.DHCP4ClientPort}
+	if Logger.IsDebug() {
+		Logger.Msg("client send").Struct(dstAddr).Struct(p).Write()
+	}
+	return sendDHCP4Packet(c.h.session.Conn, srcAddr, dstAddr, p)
+}
+
+var clientBroadcast = packet.Addr{MAC: packet.EthBroadcast, IP: packet.IPv4bcast, Port: packet.DHCP4ServerPort}
+
+func (c *Client) sendDiscover() error {
+	return c.send(packet.DHCP4Discover, netip.Addr{}, c.options(packet.DHCP4Discover), clientBroadcast)
+}
+
+// sendRequest sends a request in selecting state if reqIP is valid or a renewing or rebinding request otherwise.
+func (c *Client) sendRequest(reqIP netip.Addr, serverID netip.Addr) error {
+	options := c.options(packet.DHCP4Request)
+	if reqIP.IsValid() {
+		options[packet.DHCP4OptionRequestedIPAddress] = reqIP.AsSlice()
+		options[packet.DHCP4OptionServerIdentifier] = serverID.AsSlice()
+		return c.send(packet.DHCP4Request, netip.Addr{}, options, clientBroadcast)
+	}
+	if c.state == ClientRenewing {
+		return c.send(packet.DHCP4Request, c.lease.IP.Addr(), options, c.serverAddr())
+	}
+	return c.send(packet.DHCP4Request, c.lease.IP.Addr(), options, clientBroadcast)
+}
+
+func (c *Client) sendDecline(ip netip.Addr, serverID netip.Addr) error {
+	options := c.options(packet.DHCP4Decline)
+	options[packet.DHCP4OptionRequestedIPAddress] = ip.AsSlice()
+	options[packet.DHCP4OptionServerIdentifier] = serverID.AsSlice()
+	return c.send(packet.DHCP4Decline, netip.Addr{}, options, clientBroadcast)
+}
+
+func (c *Client) sendRelease() error {
+	options := c.options(packet.DHCP4Release)
+	options[packet.DHCP4OptionServerIdentifier] = c.lease.ServerID.AsSlice()
+	return c.send(packet.DHCP4Release, c.lease.IP.Addr(), options, c.serverAddr())
+}
+
+// serverAddr returns the unicast address of the lease server.
+func (c *Client) serverAddr() packet.Addr {
+	addr := packet.Addr{MAC: packet.EthBroadcast, IP: c.lease.ServerID, Port: packet.DHCP4ServerPort}
+	if host := c.h.session.FindIP(c.lease.ServerID); host != nil {
+		addr.MAC = host.MACEntry.MAC
+	} else if c.lease.ServerID == c.h.session.NICInfo.RouterAddr4.IP {
+		addr.MAC = c.h.session.NICInfo.RouterAddr4.MAC
+	} else if c.lease.ServerID == c.h.session.NICInfo.HostAddr4.IP {
+		addr.MAC = c.h.session.NICInfo.HostAddr4.MAC
+	}
+	return addr
+}
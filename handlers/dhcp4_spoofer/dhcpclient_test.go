@@ -0,0 +1,156 @@
+package dhcp4_spoofer
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+// clientLoop feeds the packets sent by our client back to the handler so the handler server
+// can answer our own client. onARP is called for arp probes sent by the client.
+func clientLoop(t *testing.T, conn net.PacketConn, h *Handler, mac net.HardwareAddr, onARP func(packet.ARP)) {
+	buf := make([]byte, packet.EthMaxSize)
+	for {
+		n, _, _ := conn.ReadFrom(buf)
+		if n == 0 { // closed
+			return
+		}
+		frame, err := h.session.Parse(buf[:n])
+		if err != nil {
+			t.Error("invalid frame", err)
+			continue
+		}
+		switch frame.PayloadID {
+		case packet.PayloadARP:
+			if arp := packet.ARP(frame.Payload()); bytes.Equal(arp.SrcMAC(), mac) && onARP != nil {
+				onARP(arp)
+			}
+		case packet.PayloadDHCP4:
+			if !bytes.Equal(packet.DHCP4(frame.Payload()).CHAddr(), mac) { // ignore attack packets
+				continue
+			}
+			if err := h.ProcessPacket(frame); err != nil {
+				t.Error("process packet", err)
+			}
+		}
+	}
+}
+
+func setupClientTest(t *testing.T) (h *Handler, inConn net.PacketConn, outConn net.PacketConn) {
+	inConn, outConn = packet.TestNewBufferedConn()
+	nicInfo := &packet.NICInfo{RouterAddr4: routerAddr, HostAddr4: hostAddr, HomeLAN4: homeLAN}
+	session, err := packet.Config{Conn: inConn, NICInfo: nicInfo}.NewSession("")
+	if err != nil {
+		t.Fatal("cannot create session", err)
+	}
+	config := Config{Mode: ModePrimaryServer, NetfilterIP: netip.PrefixFrom(hostIP4, 25), DNSServer: dnsIP4, LeaseStore: NewMemoryStore()}
+	if h, err = config.New(session); err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	return h, inConn, outConn
+}
+
+func waitLease(t *testing.T, leases chan ClientLease, state ClientState) ClientLease {
+	t.Helper()
+	select {
+	case lease := <-leases:
+		if lease.State != state {
+			t.Fatalf("invalid lease state want=%s got=%s", state, lease)
+		}
+		return lease
+	case <-time.After(time.Second * 3):
+		t.Fatalf("lease timeout state=%s", state)
+	}
+	return ClientLease{}
+}
+
+func TestClient_Lease(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	h, inConn, outConn := setupClientTest(t)
+	defer inConn.Close()
+	defer h.Close()
+	h.net1.Duration = time.Second * 2 // renew after 1 second
+
+	clientMAC := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0a, 0x01}
+	go clientLoop(t, outConn, h, clientMAC, nil)
+
+	leases := make(chan ClientLease, 8)
+	c, err := h.NewClient(ClientConfig{MAC: clientMAC, Name: "virtual", Notify: func(l ClientLease) { leases <- l },
+		RetransmitTimeout: time.Millisecond * 100, ProbeTimeout: time.Millisecond * 10})
+	if err != nil {
+		t.Fatal("cannot create client", err)
+	}
+	if _, err := h.NewClient(ClientConfig{MAC: clientMAC}); err == nil {
+		t.Error("expected duplicated client error")
+	}
+
+	lease := waitLease(t, leases, ClientBound)
+	if !homeLAN.Contains(lease.IP.Addr()) || lease.IP.Bits() != 24 || lease.Router != routerIP4 || lease.ServerID != hostIP4 ||
+		len(lease.DNSServers) != 1 || lease.DNSServers[0] != dnsIP4 || lease.T1 != time.Second {
+		t.Errorf("invalid lease %s", lease)
+	}
+	h.Lock()
+	if l := h.table[string(clientMAC)]; l == nil || l.State != StateAllocated || l.Addr.IP != lease.IP.Addr() || l.Name != "virtual" {
+		t.Errorf("invalid server lease %+v", l)
+	}
+	h.Unlock()
+
+	// renew at T1
+	renewed := waitLease(t, leases, ClientBound)
+	if renewed.IP != lease.IP || !renewed.Acquired.After(lease.Acquired) {
+		t.Errorf("invalid renew %s", renewed)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Error("close failed", err)
+	}
+	if c.State() != ClientInit {
+		t.Error("invalid state after close", c.State())
+	}
+	time.Sleep(time.Millisecond * 20)
+}
+
+func TestClient_Conflict(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	h, inConn, outConn := setupClientTest(t)
+	defer inConn.Close()
+	defer h.Close()
+
+	clientMAC := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0a, 0x02}
+	otherMAC := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0a, 0x03}
+
+	// another host replies to the first probe
+	var conflictIP netip.Addr
+	go clientLoop(t, outConn, h, clientMAC, func(arp packet.ARP) {
+		if conflictIP.IsValid() {
+			return
+		}
+		conflictIP = arp.DstIP()
+		if _, err := h.session.Parse(newARPReplyFrame(packet.Addr{MAC: otherMAC, IP: conflictIP}, packet.Addr{MAC: clientMAC, IP: packet.IPv4zero})); err != nil {
+			t.Error("invalid arp frame", err)
+		}
+	})
+
+	leases := make(chan ClientLease, 8)
+	c, err := h.NewClient(ClientConfig{MAC: clientMAC, Notify: func(l ClientLease) { leases <- l },
+		RetransmitTimeout: time.Millisecond * 100, ProbeTimeout: time.Millisecond * 20, DeclineWait: time.Millisecond * 50})
+	if err != nil {
+		t.Fatal("cannot create client", err)
+	}
+	defer c.Close()
+
+	lease := waitLease(t, leases, ClientBound)
+	if !conflictIP.IsValid() || lease.IP.Addr() == conflictIP {
+		t.Errorf("invalid lease after conflict ip=%s conflict=%s", lease.IP, conflictIP)
+	}
+	h.Lock()
+	if l := h.findByIP(conflictIP); l == nil || l.State != StateDeclined {
+		t.Errorf("conflict ip not declined %+v", l)
+	}
+	h.Unlock()
+}
@@ -35,7 +35,10 @@ import (
 //    addresses; the address is selected based on the subnet from which
 //    the message was received (if 'giaddr' is 0) or on the address of
 //    the relay agent that forwarded the message ('giaddr' when not 0).
-func (h *Handler) handleDiscover(p packet.DHCP4, options packet.DHCP4Options) (d packet.DHCP4) {
+//
+// If conflict detection is enabled, a new address is probed before the offer is sent. In this case
+// handleDiscover returns nil and the offer is sent to dstAddr when the probe completes.
+func (h *Handler) handleDiscover(p packet.DHCP4, options packet.DHCP4Options, dstAddr packet.Addr) (d packet.DHCP4) {
 
 	clientID := getClientID(p, options)
 	reqIP, _ := netip.AddrFromSlice(options[packet.DHCP4OptionRequestedIPAddress])
@@ -45,10 +48,12 @@ func (h *Handler) handleDiscover(p packet.DHCP4, options packet.DHCP4Options) (d
 		Logger.Msg("discover rcvd").ByteArray("xid", p.XId()).ByteArray("clientid", clientID).IP("ip", reqIP).String("name", name).Uint16("secs", p.Secs()).Write()
 	}
 
-	lease := h.findOrCreate(clientID, p.CHAddr(), name)
+	subnet := h.clientSubnet(p, options)
+	relay := h.isRelay(subnet)
+	lease := h.findOrCreate(subnet, clientID, p.CHAddr(), name)
 
 	// Exhaust all IPs for a few seconds
-	if true {
+	if !relay { // remote subnets have their own dhcp server
 		// Always attack: new mode 4 April 21 ;
 		// if h.mode == ModeSecondaryServer || (h.mode == ModeSecondaryServerNice && lease.subnet.Stage == packet.StageRedirected) {
 		if Logger.IsInfo() {
@@ -95,8 +100,24 @@ func (h *Handler) handleDiscover(p packet.DHCP4, options packet.DHCP4Options) (d
 	lease.XID = packet.CopyBytes(p.XId())
 	lease.OfferExpiry = now.Add(time.Second * 5)
 
+	// Probe new addresses before offering; the client current address does not need probing
+	// Relay subnets are not on the LAN and cannot be probed.
+	if h.probeTimeout > 0 && !relay && lease.IPOffer != lease.Addr.IP {
+		go h.probeOffer(lease.ClientID, lease.XID, packet.DHCP4(packet.CopyBytes(p)), dstAddr)
+		return nil
+	}
+	return h.offerPacket(lease, p, options)
+}
+
+// offerPacket returns the offer for the lease IPOffer.
+// It reuses the buffer updating fields as required returning the same slice with updated len.
+func (h *Handler) offerPacket(lease *Lease, p packet.DHCP4, options packet.DHCP4Options) packet.DHCP4 {
+	clientID := lease.ClientID
+	reqIP, _ := netip.AddrFromSlice(options[packet.DHCP4OptionRequestedIPAddress])
+	name := string(options[packet.DHCP4OptionHostName])
+
 	// Offer options
-	opts := lease.subnet.CopyOptions()
+	opts := h.replyOptions(lease.subnet, lease.Addr.MAC, options)
 	opts[packet.DHCP4OptionIPAddressLeaseTime] = packet.OptionsLeaseTime(lease.subnet.Duration) // rfc: must include
 
 	// keep chAddr, ciAddr, xid
@@ -110,14 +131,17 @@ func (h *Handler) handleDiscover(p packet.DHCP4, options packet.DHCP4Options) (d
 	//  The server is likely to send offer before us, so send a kill packet
 	//  assuming the other server offered the requested IP - guess
 	//
-	if h.mode == ModeSecondaryServer || (h.mode == ModeSecondaryServerNice && lease.subnet.Stage == packet.StageRedirected) {
+	relay := h.isRelay(lease.subnet)
+	if !relay && (h.mode == ModeSecondaryServer || (h.mode == ModeSecondaryServerNice && lease.subnet.Stage == packet.StageRedirected)) {
 		if reqIP.IsValid() && !reqIP.IsUnspecified() {
 			h.forceDecline(lease.ClientID, h.net1.DefaultGW, lease.Addr.MAC, reqIP, p.XId())
 		}
 	}
 
 	// Set the IP4 offer to be later checked in ARP ACD
-	h.session.SetDHCPv4IPOffer(lease.Addr.MAC, lease.IPOffer, packet.NameEntry{Type: module, Name: name})
+	if !relay {
+		h.session.SetDHCPv4IPOffer(lease.Addr.MAC, lease.IPOffer, packet.NameEntry{Type: module, Name: name})
+	}
 	if Logger.IsInfo() {
 		Logger.Msg("discover offer OK").ByteArray("xid", p.XId()).ByteArray("clientid", clientID).IP("ip", lease.IPOffer).String("subnet", lease.subnet.ID).Write()
 	}
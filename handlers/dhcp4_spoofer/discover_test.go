@@ -3,7 +3,6 @@ package dhcp4_spoofer
 import (
 	"net"
 	"net/netip"
-	"os"
 	"syscall"
 	"testing"
 	"time"
@@ -22,7 +21,6 @@ func TestDHCPHandler_handleDiscover(t *testing.T) {
 	options[packet.DHCP4OptionCode(packet.DHCP4OptionParameterRequestList)] = []byte{byte(packet.DHCP4OptionDomainNameServer)}
 
 	Logger.SetLevel(fastlog.LevelError)
-	os.Remove(testDHCPFilename)
 	tc := setupTestHandler()
 	defer tc.Close()
 
@@ -109,7 +107,6 @@ func TestDHCPHandler_handleDiscoverCaptured(t *testing.T) {
 
 	// packet.DebugIP4 = true
 	Logger.SetLevel(fastlog.LevelError)
-	os.Remove(testDHCPFilename)
 	tc := setupTestHandler()
 	defer tc.Close()
 
@@ -153,7 +150,6 @@ func TestDHCPHandler_exhaust(t *testing.T) {
 
 	packet.Logger.SetLevel(fastlog.LevelError)
 	Logger.SetLevel(fastlog.LevelError)
-	os.Remove(testDHCPFilename)
 	tc := setupTestHandler()
 	defer tc.Close()
 
@@ -0,0 +1,159 @@
+package dhcp4_spoofer
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+// LeaseEventType identifies a lease lifecycle event
+type LeaseEventType int
+
+// Lease lifecycle events
+const (
+	LeaseCommit   LeaseEventType = iota + 1 // a new lease was acknowledged
+	LeaseRenew                              // an allocated lease was acknowledged again; renewing, rebinding or rebooting
+	LeaseExpire                             // the lease expired without renewal
+	LeaseDecline                            // the client declined the address
+	LeaseRelease                            // the client released the address
+	LeaseNAK                                // the request was not acknowledged
+	LeaseReassign                           // the allocated address was changed with ReassignLease
+)
+
+func (e LeaseEventType) String() string {
+	switch e {
+	case LeaseCommit:
+		return "commit"
+	case LeaseRenew:
+		return "renew"
+	case LeaseExpire:
+		return "expire"
+	case LeaseDecline:
+		return "decline"
+	case LeaseRelease:
+		return "release"
+	case LeaseNAK:
+		return "nak"
+	case LeaseReassign:
+		return "reassign"
+	}
+	return "invalid"
+}
+
+// LeaseEvent is sent to the event channel and the lease script on lease changes.
+type LeaseEvent struct {
+	Type     LeaseEventType
+	Time     time.Time
+	Lease    Lease            // copy of the lease at the time of the event
+	ClientID []byte           // dhcp client id
+	Name     string           // hostname from dhcp client
+	Stage    packet.HuntStage // stage of the lease subnet: normal or redirected
+	SubnetID string           // net1 or net2
+}
+
+func (e LeaseEvent) String() string {
+	line := Logger.Msg("")
+	return e.FastLog(line).ToString()
+}
+
+func (e LeaseEvent) FastLog(line *fastlog.Line) *fastlog.Line {
+	line.String("event", e.Type.String())
+	line.ByteArray("clientid", e.ClientID)
+	line.Struct(e.Lease.Addr)
+	line.String("name", e.Name)
+	line.String("stage", e.Stage.String())
+	line.String("subnet_id", e.SubnetID)
+	return line
+}
+
+// scriptTimeout is the maximum time the lease script can run for.
+const scriptTimeout = time.Second * 10
+
+// notifyLease sends the lease event to the event channel and the lease script.
+// The handler lock must be held.
+func (h *Handler) notifyLease(eventType LeaseEventType, lease *Lease) {
+	if h.eventChan == nil && h.scriptChan == nil {
+		return
+	}
+	event := LeaseEvent{Type: eventType, Time: time.Now(), Lease: copyLease(*lease), ClientID: packet.CopyBytes(lease.ClientID), Name: lease.Name}
+	if lease.subnet != nil {
+		event.Stage = lease.subnet.Stage
+		event.SubnetID = lease.subnet.ID
+	}
+	if Logger.IsDebug() {
+		Logger.Msg("lease event").Struct(event).Write()
+	}
+
+	// never block the handler
+	if h.eventChan != nil {
+		if len(h.eventChan) < cap(h.eventChan) {
+			h.eventChan <- event
+		} else {
+			Logger.Msg("lease event channel is full").Int("len", len(h.eventChan)).Struct(event).Write()
+		}
+	}
+	if h.scriptChan != nil {
+		if len(h.scriptChan) < cap(h.scriptChan) {
+			h.scriptChan <- event
+		} else {
+			Logger.Msg("lease script queue is full").Int("len", len(h.scriptChan)).Struct(event).Write()
+		}
+	}
+}
+
+// scriptLoop runs the lease script for each event in order.
+func (h *Handler) scriptLoop(script string) {
+	for {
+		select {
+		case event := <-h.scriptChan:
+			if err := runLeaseScript(script, event); err != nil {
+				Logger.Msg("lease script failed").String("script", script).Struct(event).Error(err).Write()
+			}
+		case <-h.closeChan:
+			return
+		}
+	}
+}
+
+// runLeaseScript executes the external command in a similar fashion to
+// dnsmasq --dhcp-script. The command is invoked with the arguments
+//
+//	<event> <mac> <ip> <hostname>
+//
+// where event is one of commit, renew, expire, decline, release, nak or reassign.
+// Additional details are passed in the environment: DHCP4_CLIENT_ID (hex),
+// DHCP4_STAGE, DHCP4_SUBNET and DHCP4_LEASE_EXPIRES (unix seconds).
+func runLeaseScript(script string, event LeaseEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+
+	ip := event.Lease.Addr.IP
+	if !ip.IsValid() {
+		ip = event.Lease.IPOffer
+	}
+	ipStr := ""
+	if ip.IsValid() {
+		ipStr = ip.String()
+	}
+	expires := int64(0)
+	if !event.Lease.DHCPExpiry.IsZero() {
+		expires = event.Lease.DHCPExpiry.Unix()
+	}
+	cmd := exec.CommandContext(ctx, script, event.Type.String(), event.Lease.Addr.MAC.String(), ipStr, event.Name)
+	cmd.Env = append(os.Environ(),
+		"DHCP4_CLIENT_ID="+hex.EncodeToString(event.ClientID),
+		"DHCP4_STAGE="+event.Stage.String(),
+		"DHCP4_SUBNET="+event.SubnetID,
+		fmt.Sprintf("DHCP4_LEASE_EXPIRES=%d", expires),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
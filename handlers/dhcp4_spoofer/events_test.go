@@ -0,0 +1,148 @@
+package dhcp4_spoofer
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+func TestHandler_LeaseEvents(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := setupTestHandler()
+	defer tc.Close()
+
+	dir := t.TempDir()
+	script := dir + "/script.sh"
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$1 $2 $3 $4 $DHCP4_SUBNET\" >> "+dir+"/out.txt\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	events := make(chan LeaseEvent, 16)
+	tc.h.Close()
+	store := NewMemoryStore()
+	config := Config{NetfilterIP: netip.PrefixFrom(hostIP4, 25), DNSServer: dnsIP4, LeaseStore: store, EventChan: events, LeaseScript: script}
+	if tc.h, err = config.New(tc.session); err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer tc.h.Close()
+
+	eventMAC1 := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x07, 0x01}
+	eventMAC2 := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x07, 0x02}
+	eventMAC3 := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x07, 0x03}
+	eventMAC4 := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x07, 0x04}
+	srcAddr := packet.Addr{MAC: eventMAC1, IP: packet.IPv4zero, Port: packet.DHCP4ClientPort}
+	dstAddr := packet.Addr{MAC: hostMAC, IP: hostIP4, Port: packet.DHCP4ServerPort}
+
+	process := func(ether packet.Ether) {
+		frame, err := tc.session.Parse(ether)
+		if err != nil {
+			t.Fatal("invalid frame", err)
+		}
+		if err := tc.h.ProcessPacket(frame); err != nil {
+			t.Fatal("process packet", err)
+		}
+		select {
+		case <-tc.notifyReply:
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+
+	checkEvent := func(want LeaseEventType, mac net.HardwareAddr, name string) (e LeaseEvent) {
+		t.Helper()
+		select {
+		case e = <-events:
+			if e.Type != want || !bytes.Equal(e.Lease.Addr.MAC, mac) || !bytes.Equal(e.ClientID, mac) ||
+				e.Name != name || e.Stage != packet.StageNormal || e.SubnetID != "net1" {
+				t.Errorf("invalid event want=%s got=%s", want, e)
+			}
+		case <-time.After(time.Millisecond * 100):
+			t.Errorf("missing event %s", want)
+		}
+		return e
+	}
+
+	// commit
+	xid := newDHCPHost(t, tc, eventMAC1, "host1")
+	ip := tc.h.table[string(eventMAC1)].Addr.IP
+	checkEvent(LeaseCommit, eventMAC1, "host1")
+
+	// renew - repeated select for the same ip
+	process(newDHCP4RequestFrame(srcAddr, dstAddr, "host1", hostIP4, ip, xid))
+	checkEvent(LeaseRenew, eventMAC1, "host1")
+
+	// decline
+	process(newDHCP4DeclineFrame(srcAddr, dstAddr, ip, hostIP4, xid))
+	if e := checkEvent(LeaseDecline, eventMAC1, "host1"); e.Lease.Addr.IP != ip {
+		t.Errorf("invalid decline ip want=%s got=%s", ip, e.Lease.Addr.IP)
+	}
+
+	// nak - select with invalid ip
+	srcAddr.MAC = eventMAC2
+	process(newDHCP4RequestFrame(srcAddr, dstAddr, "host2", hostIP4, ip5, []byte("nak")))
+	checkEvent(LeaseNAK, eventMAC2, "host2")
+
+	// release
+	xid4 := newDHCPHost(t, tc, eventMAC4, "host4")
+	ip4 := tc.h.table[string(eventMAC4)].Addr.IP
+	checkEvent(LeaseCommit, eventMAC4, "host4")
+	process(newDHCP4ReleaseFrame(packet.Addr{MAC: eventMAC4, IP: ip4, Port: packet.DHCP4ClientPort}, dstAddr, hostIP4, xid4))
+	if e := checkEvent(LeaseRelease, eventMAC4, "host4"); e.Lease.Addr.IP != ip4 {
+		t.Errorf("invalid release ip want=%s got=%s", ip4, e.Lease.Addr.IP)
+	}
+	if l := tc.h.table[string(eventMAC4)]; l.State != StateFree || l.Addr.IP.IsValid() {
+		t.Errorf("released lease not free %s", l)
+	}
+	table, _ := store.Load()
+	for _, l := range table.Leases {
+		if bytes.Equal(l.ClientID, eventMAC4) {
+			t.Errorf("released lease not deleted from store %s", l)
+		}
+	}
+
+	// expire; the released lease does not expire again
+	newDHCPHost(t, tc, eventMAC3, "host3")
+	checkEvent(LeaseCommit, eventMAC3, "host3")
+	tc.h.MinuteTicker(time.Now().Add(time.Hour * 5))
+	checkEvent(LeaseExpire, eventMAC3, "host3")
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %s", e)
+	default:
+	}
+
+	// script runs in order
+	var out []byte
+	for i := 0; i < 100; i++ {
+		if out, _ = os.ReadFile(dir + "/out.txt"); bytes.Count(out, []byte("\n")) == 8 {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	want := []string{"commit", "renew", "decline", "nak", "commit", "release", "commit", "expire"}
+	if len(lines) != len(want) {
+		t.Fatalf("invalid script output want=%d got=%d: %s", len(want), len(lines), out)
+	}
+	for i := range want {
+		if !strings.HasPrefix(lines[i], want[i]+" ") {
+			t.Errorf("invalid script event want=%s got=%s", want[i], lines[i])
+		}
+	}
+	if lines[0] != "commit "+eventMAC1.String()+" "+ip.String()+" host1 net1" {
+		t.Errorf("invalid script args %s", lines[0])
+	}
+	if lines[2] != "decline "+eventMAC1.String()+" "+ip.String()+" host1 net1" {
+		t.Errorf("invalid decline script args %s", lines[2])
+	}
+	if lines[5] != "release "+eventMAC4.String()+" "+ip4.String()+" host4 net1" {
+		t.Errorf("invalid release script args %s", lines[5])
+	}
+}
@@ -0,0 +1,41 @@
+package dhcp4_spoofer
+
+import (
+	"github.com/irai/packet"
+)
+
+// handleInform replies to a client that already has an IP address and is asking for local configuration parameters.
+//
+// RFC 2131 4.3.5: The server responds to a DHCPINFORM message by sending a DHCPACK message
+// directly to the address given in the 'ciaddr' field of the DHCPINFORM message. The server
+// MUST NOT send a lease expiration time to the client and SHOULD NOT fill in 'yiaddr'.
+//
+// In nice mode, we only reply to captured clients and leave the home dhcp server to
+// reply to all other clients.
+func (h *Handler) handleInform(p packet.DHCP4, options packet.DHCP4Options) (d packet.DHCP4) {
+	ciaddr := p.CIAddr()
+	if Logger.IsInfo() {
+		Logger.Msg("inform rcvd").ByteArray("xid", p.XId()).MAC("mac", p.CHAddr()).IP("ciaddr", ciaddr).Write()
+	}
+	if ciaddr.IsUnspecified() {
+		Logger.Msg("inform - discard packet without ciaddr").ByteArray("xid", p.XId()).MAC("mac", p.CHAddr()).Write()
+		return nil
+	}
+
+	subnet := h.clientSubnet(p, options)
+	if subnet == nil || !subnet.LAN.Contains(ciaddr) {
+		Logger.Msg("inform - ciaddr not in subnet").ByteArray("xid", p.XId()).IP("ciaddr", ciaddr).Write()
+		return nil
+	}
+	if h.mode == ModeSecondaryServerNice && subnet == h.net1 {
+		return nil
+	}
+
+	opts := h.replyOptions(subnet, p.CHAddr(), options)
+	delete(opts, packet.DHCP4OptionIPAddressLeaseTime) // rfc: must not include
+	ret := packet.EncodeDHCP4(p, packet.DHCP4BootReply, packet.DHCP4ACK, nil, ciaddr, packet.IPv4zero, nil, false, opts, options[packet.DHCP4OptionParameterRequestList])
+	if Logger.IsDebug() {
+		Logger.Msg("inform ack options sent").ByteArray("xid", p.XId()).Sprintf("options", ret.ParseOptions()).Write()
+	}
+	return ret
+}
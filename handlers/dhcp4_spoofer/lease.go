@@ -19,6 +19,7 @@ const (
 	StateFree      State = 0
 	StateDiscover  State = 1
 	StateAllocated State = 2
+	StateDeclined  State = 3 // IP in use by another host; Addr.MAC holds the conflicting mac if known
 )
 
 func (e State) String() string {
@@ -27,6 +28,8 @@ func (e State) String() string {
 		return "allocated"
 	case StateDiscover:
 		return "discovery"
+	case StateDeclined:
+		return "declined"
 	}
 	return "free"
 }
@@ -56,6 +59,9 @@ func (l Lease) FastLog(line *fastlog.Line) *fastlog.Line {
 	line.Struct(l.Addr)
 	line.String("name", l.Name)
 	line.IP("offer", l.IPOffer)
+	if l.subnet == nil {
+		return line
+	}
 	line.String("capture", l.subnet.Stage.String())
 	line.IP("gw", l.subnet.DefaultGW)
 	line.String("subnet", l.subnet.LAN.String())
@@ -72,23 +78,34 @@ func (h *Handler) findByIP(ip netip.Addr) *Lease {
 	return nil
 }
 
+// ipHeld returns true if ip is held by a lease of a client other than clientID. A declined ip is held
+// for every client. All leases are checked as a free lease may have the same ip as a declined lease.
+func (h *Handler) ipHeld(ip netip.Addr, clientID []byte) bool {
+	for _, v := range h.table {
+		if v.Addr.IP != ip || v.State == StateFree {
+			continue
+		}
+		if v.State == StateDeclined || !bytes.Equal(v.ClientID, clientID) {
+			return true
+		}
+	}
+	return false
+}
+
+// findByMAC returns the lease for mac. Declined entries are skipped as they hold the mac of the
+// conflicting host, not its lease.
 func (h *Handler) findByMAC(mac net.HardwareAddr) *Lease {
 	for _, v := range h.table {
-		if bytes.Equal(v.Addr.MAC, mac) {
+		if v.State != StateDeclined && bytes.Equal(v.Addr.MAC, mac) {
 			return v
 		}
 	}
 	return nil
 }
 
-func (h *Handler) findOrCreate(clientID []byte, mac net.HardwareAddr, name string) *Lease {
-	var captured bool
-	subnet := h.net1
-	if captured = h.session.IsCaptured(mac); captured {
-		subnet = h.net2
-	}
-
+func (h *Handler) findOrCreate(subnet *dhcpSubnet, clientID []byte, mac net.HardwareAddr, name string) *Lease {
 	lease := h.table[string(clientID)]
+	replaced := lease != nil
 	if lease != nil {
 		if name != "" && lease.Name != name {
 			lease.Name = name
@@ -111,6 +128,9 @@ func (h *Handler) findOrCreate(clientID []byte, mac net.HardwareAddr, name strin
 	lease.subnet = subnet
 	lease.Name = name
 	h.table[string(lease.ClientID)] = lease
+	if replaced {
+		h.storeLease(lease)
+	}
 	if Logger.IsDebug() {
 		Logger.Msg("new lease allocated").Struct(lease).Write()
 	}
@@ -123,8 +143,19 @@ func (h *Handler) delete(lease *Lease) {
 
 // allocIPOffer allocates a free IP to the lease entry
 func (h *Handler) allocIPOffer(lease *Lease, reqIP netip.Addr) error {
-	if reqIP.Is4() {
-		if l := h.findByIP(reqIP); l == nil || l.State == StateFree || bytes.Equal(l.ClientID, lease.ClientID) {
+	// reserved IP takes precedence over requested IP
+	if ip := h.reservedIP(lease.Addr.MAC, lease.subnet); ip.IsValid() {
+		if _, found := h.conflictHost(ip, lease.Addr.MAC); !found {
+			lease.IPOffer = ip
+			if Logger.IsInfo() {
+				Logger.Msg("offer reserved").IP("ip", lease.IPOffer).Write()
+			}
+			return nil
+		}
+	}
+
+	if reqIP.Is4() && !h.reservationConflict(reqIP, lease.Addr.MAC) {
+		if !h.ipHeld(reqIP, lease.ClientID) {
 			if h.session.FindIP(reqIP) == nil {
 				lease.IPOffer = reqIP
 				if Logger.IsInfo() {
@@ -139,7 +170,8 @@ func (h *Handler) allocIPOffer(lease *Lease, reqIP netip.Addr) error {
 	var ip netip.Addr
 	for lease.subnet.nextIP.Less(lease.subnet.broadcast) {
 		// for tmpIP.IsValid() {
-		if l := h.findByIP(lease.subnet.nextIP); l == nil || l.State == StateFree {
+		if !h.ipHeld(lease.subnet.nextIP, nil) && !lease.subnet.reserved(lease.subnet.nextIP) &&
+			!h.reservationConflict(lease.subnet.nextIP, lease.Addr.MAC) {
 			if h.session.FindIP(lease.subnet.nextIP) == nil {
 				ip = lease.subnet.nextIP
 				lease.subnet.nextIP = lease.subnet.nextIP.Next()
@@ -156,7 +188,8 @@ func (h *Handler) allocIPOffer(lease *Lease, reqIP netip.Addr) error {
 	// search across full subnet in case other IPs were freed
 	lease.subnet.nextIP = lease.subnet.FirstIP
 	for lease.subnet.nextIP.Less(lease.subnet.broadcast) {
-		if l := h.findByIP(lease.subnet.nextIP); l == nil || l.State == StateFree {
+		if !h.ipHeld(lease.subnet.nextIP, nil) && !lease.subnet.reserved(lease.subnet.nextIP) &&
+			!h.reservationConflict(lease.subnet.nextIP, lease.Addr.MAC) {
 			if h.session.FindIP(lease.subnet.nextIP) == nil {
 				ip = lease.subnet.nextIP
 				lease.subnet.nextIP = lease.subnet.nextIP.Next()
@@ -177,11 +210,25 @@ func (h *Handler) allocIPOffer(lease *Lease, reqIP netip.Addr) error {
 
 func (h *Handler) freeLeases(now time.Time) error {
 	for _, lease := range h.table {
+		if lease.State == StateDeclined && lease.DHCPExpiry.Before(now) {
+			if Logger.IsInfo() {
+				Logger.Msg("freeing declined ip").Struct(lease).Write()
+			}
+			lease.State = StateFree
+			h.storeLease(lease)
+			h.delete(lease)
+			continue
+		}
 		if lease.State != StateFree && lease.DHCPExpiry.Before(now) {
 			if Logger.IsInfo() {
 				Logger.Msg("freeing lease").Struct(lease).Write()
 			}
+			allocated := lease.State == StateAllocated
 			lease.State = StateFree
+			h.storeLease(lease)
+			if allocated { // offers not taken do not generate events
+				h.notifyLease(LeaseExpire, lease)
+			}
 		}
 	}
 	return nil
@@ -0,0 +1,452 @@
+package dhcp4_spoofer
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+// Reservation allocates a fixed IP to a client mac.
+type Reservation struct {
+	MAC  net.HardwareAddr
+	IP   netip.Addr
+	Name string `yaml:",omitempty"`
+}
+
+func copyReservations(list []Reservation) []Reservation {
+	if len(list) == 0 {
+		return nil
+	}
+	ret := make([]Reservation, 0, len(list))
+	for _, r := range list {
+		r.MAC = packet.CopyMAC(r.MAC)
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// LeaseInfo is a copy of a lease and its subnet returned by Leases.
+type LeaseInfo struct {
+	Lease    Lease
+	SubnetID string           // net1, net2 or relay subnet id
+	Stage    packet.HuntStage // stage of the lease subnet
+	Reserved bool             // the client mac has a reservation
+}
+
+// LeaseFilter selects the leases returned by Leases. Empty fields match any lease.
+type LeaseFilter struct {
+	States   []State          // lease states
+	SubnetID string           // net1, net2 or relay subnet id
+	MAC      net.HardwareAddr // client mac
+	Prefix   netip.Prefix     // lease IP or offer in prefix
+	Name     string           // case insensitive substring of the client name
+}
+
+func (f LeaseFilter) match(lease *Lease) bool {
+	if len(f.States) > 0 {
+		found := false
+		for _, s := range f.States {
+			if s == lease.State {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.SubnetID != "" && (lease.subnet == nil || lease.subnet.ID != f.SubnetID) {
+		return false
+	}
+	if f.MAC != nil && !bytes.Equal(f.MAC, lease.Addr.MAC) {
+		return false
+	}
+	if f.Prefix.IsValid() && !f.Prefix.Contains(lease.Addr.IP) && !f.Prefix.Contains(lease.IPOffer) {
+		return false
+	}
+	if f.Name != "" && !strings.Contains(strings.ToLower(lease.Name), strings.ToLower(f.Name)) {
+		return false
+	}
+	return true
+}
+
+// Leases returns a copy of the leases matching filter sorted by IP.
+func (h *Handler) Leases(filter LeaseFilter) []LeaseInfo {
+	h.Lock()
+	defer h.Unlock()
+
+	list := []LeaseInfo{}
+	for _, lease := range h.table {
+		if !filter.match(lease) {
+			continue
+		}
+		info := LeaseInfo{Lease: copyLease(*lease)}
+		if lease.subnet != nil {
+			info.SubnetID = lease.subnet.ID
+			info.Stage = lease.subnet.Stage
+		}
+		_, info.Reserved = h.reservations[string(lease.Addr.MAC)]
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Lease.Addr.IP == list[j].Lease.Addr.IP {
+			return bytes.Compare(list[i].Lease.ClientID, list[j].Lease.ClientID) < 0
+		}
+		return list[i].Lease.Addr.IP.Less(list[j].Lease.Addr.IP)
+	})
+	return list
+}
+
+// ExpireLease frees the lease for mac. The client will receive a NAK when it next renews
+// and must discover again.
+func (h *Handler) ExpireLease(mac net.HardwareAddr) error {
+	h.Lock()
+	defer h.Unlock()
+	lease := h.findByMAC(mac)
+	if lease == nil {
+		return fmt.Errorf("lease mac=%s: %w", mac, packet.ErrNotFound)
+	}
+	h.expire(lease)
+	return nil
+}
+
+// expire frees the lease and notifies the expire event if the lease was allocated.
+// The handler lock must be held.
+func (h *Handler) expire(lease *Lease) {
+	if Logger.IsInfo() {
+		Logger.Msg("expire lease").Struct(lease).Write()
+	}
+	allocated := lease.State == StateAllocated
+	lease.State = StateFree
+	lease.IPOffer = netip.Addr{}
+	lease.DHCPExpiry = time.Now()
+	h.storeLease(lease)
+	if allocated {
+		h.notifyLease(LeaseExpire, lease)
+	}
+}
+
+// ReassignLease changes the IP allocated to mac. The client will receive a NAK
+// when it next renews and will be offered the new IP on discover.
+func (h *Handler) ReassignLease(mac net.HardwareAddr, ip netip.Addr) error {
+	h.Lock()
+	defer h.Unlock()
+	lease := h.findByMAC(mac)
+	if lease == nil || lease.State != StateAllocated {
+		return fmt.Errorf("allocated lease mac=%s: %w", mac, packet.ErrNotFound)
+	}
+	if err := h.validIP(lease.subnet, ip, mac); err != nil {
+		return err
+	}
+	if Logger.IsInfo() {
+		Logger.Msg("reassign lease").Struct(lease).IP("newip", ip).Write()
+	}
+	lease.Addr.IP = ip
+	lease.IPOffer = netip.Addr{}
+	h.storeLease(lease)
+	h.notifyLease(LeaseReassign, lease)
+	return nil
+}
+
+// validIP returns nil if ip can be allocated to mac in subnet.
+// The handler lock must be held.
+func (h *Handler) validIP(subnet *dhcpSubnet, ip netip.Addr, mac net.HardwareAddr) error {
+	if !ip.Is4() || !subnet.LAN.Contains(ip) || subnet.reserved(ip) {
+		return fmt.Errorf("ip=%s not valid in subnet=%s: %w", ip, subnet.LAN, packet.ErrInvalidIP)
+	}
+	for _, l := range h.table {
+		if l.Addr.IP == ip && l.State != StateFree && !bytes.Equal(l.Addr.MAC, mac) {
+			return fmt.Errorf("ip=%s in use by %s: %w", ip, l.Addr.MAC, packet.ErrInvalidIP)
+		}
+	}
+	if h.reservationConflict(ip, mac) {
+		return fmt.Errorf("ip=%s reserved for another client: %w", ip, packet.ErrInvalidIP)
+	}
+	if other, found := h.conflictHost(ip, mac); found {
+		return fmt.Errorf("ip=%s in use by host %s: %w", ip, other, packet.ErrInvalidIP)
+	}
+	return nil
+}
+
+// MoveClient moves the client to the subnet with subnetID, net1 or net2, regardless of
+// the capture state. An empty subnetID removes the override. The current lease is expired
+// if it is in a different subnet so that the client obtains a new IP when it renews.
+func (h *Handler) MoveClient(mac net.HardwareAddr, subnetID string) error {
+	h.Lock()
+	defer h.Unlock()
+
+	var subnet *dhcpSubnet
+	switch subnetID {
+	case "":
+		delete(h.moved, string(mac))
+	case h.net1.ID:
+		subnet = h.net1
+	case h.net2.ID:
+		subnet = h.net2
+	default:
+		return fmt.Errorf("subnet id=%s: %w", subnetID, packet.ErrInvalidParam)
+	}
+	if subnet != nil {
+		h.moved[string(mac)] = subnet
+	}
+	if Logger.IsInfo() {
+		Logger.Msg("move client").MAC("mac", mac).String("subnet_id", subnetID).Write()
+	}
+
+	if subnet == nil {
+		subnet = h.net1
+		if h.session.IsCaptured(mac) {
+			subnet = h.net2
+		}
+	}
+	if lease := h.findByMAC(mac); lease != nil && lease.subnet != subnet && lease.State != StateFree {
+		h.expire(lease)
+	}
+	return nil
+}
+
+// Reserve allocates a fixed IP to the mac. The IP must be in net1 or net2 and not allocated
+// to another client.
+func (h *Handler) Reserve(r Reservation) error {
+	h.Lock()
+	defer h.Unlock()
+	if len(r.MAC) != 6 {
+		return fmt.Errorf("reservation mac=%s: %w", r.MAC, packet.ErrInvalidParam)
+	}
+	subnet := h.net1
+	if h.net2.LAN.Contains(r.IP) {
+		subnet = h.net2
+	}
+	if err := h.validIP(subnet, r.IP, r.MAC); err != nil {
+		return err
+	}
+	r.MAC = packet.CopyMAC(r.MAC)
+	h.reservations[string(r.MAC)] = r
+	if Logger.IsInfo() {
+		Logger.Msg("reserve ip").MAC("mac", r.MAC).IP("ip", r.IP).String("name", r.Name).Write()
+	}
+	return h.saveConfig()
+}
+
+// Unreserve removes the reservation for mac.
+func (h *Handler) Unreserve(mac net.HardwareAddr) error {
+	h.Lock()
+	defer h.Unlock()
+	if _, found := h.reservations[string(mac)]; !found {
+		return fmt.Errorf("reservation mac=%s: %w", mac, packet.ErrNotFound)
+	}
+	delete(h.reservations, string(mac))
+	return h.saveConfig()
+}
+
+// Reservations returns the list of reservations sorted by IP.
+func (h *Handler) Reservations() []Reservation {
+	h.Lock()
+	defer h.Unlock()
+	return h.reservationList()
+}
+
+func (h *Handler) reservationList() []Reservation {
+	list := make([]Reservation, 0, len(h.reservations))
+	for _, r := range h.reservations {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP.Less(list[j].IP) })
+	return copyReservations(list)
+}
+
+// loadReservations sets the reservations that are still valid in net1 or net2.
+func (h *Handler) loadReservations(list []Reservation) {
+	h.reservations = make(map[string]Reservation, len(list))
+	ips := map[netip.Addr]bool{}
+	for _, r := range list {
+		subnet := h.net1
+		if h.net2.LAN.Contains(r.IP) {
+			subnet = h.net2
+		}
+		if len(r.MAC) != 6 || !subnet.LAN.Contains(r.IP) || subnet.reserved(r.IP) || ips[r.IP] {
+			Logger.Msg("invalid reservation - ignoring").MAC("mac", r.MAC).IP("ip", r.IP).Write()
+			continue
+		}
+		ips[r.IP] = true
+		h.reservations[string(r.MAC)] = r
+	}
+}
+
+// reservedIP returns the IP reserved for mac if it is in subnet.
+func (h *Handler) reservedIP(mac net.HardwareAddr, subnet *dhcpSubnet) netip.Addr {
+	if r, found := h.reservations[string(mac)]; found && subnet.LAN.Contains(r.IP) {
+		return r.IP
+	}
+	return netip.Addr{}
+}
+
+// reservationConflict returns true if ip is reserved for a mac other than mac.
+func (h *Handler) reservationConflict(ip netip.Addr, mac net.HardwareAddr) bool {
+	for _, r := range h.reservations {
+		if r.IP == ip && !bytes.Equal(r.MAC, mac) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subnets returns a copy of the subnet configurations: net1, net2 and the relay subnets.
+func (h *Handler) Subnets() []SubnetConfig {
+	h.Lock()
+	defer h.Unlock()
+	list := []SubnetConfig{h.net1.SubnetConfig, h.net2.SubnetConfig}
+	for _, r := range h.relays {
+		list = append(list, r.SubnetConfig)
+	}
+	return list
+}
+
+// ReconfigureSubnet changes the subnet configuration with id. Zero fields in config keep the
+// current value. The home LAN prefix cannot change and net2 must be in the home LAN.
+//
+// Leases that are no longer valid are expired. The new configuration is saved to the lease store;
+// note that the Config passed to New takes precedence on restart if they differ.
+func (h *Handler) ReconfigureSubnet(id string, config SubnetConfig) error {
+	h.Lock()
+	defer h.Unlock()
+
+	relay := -1
+	var current *dhcpSubnet
+	switch id {
+	case h.net1.ID:
+		current = h.net1
+	case h.net2.ID:
+		current = h.net2
+	default:
+		for i := range h.relays {
+			if h.relays[i].ID == id {
+				current, relay = h.relays[i].dhcpSubnet, i
+			}
+		}
+	}
+	if current == nil {
+		return fmt.Errorf("subnet id=%s: %w", id, packet.ErrNotFound)
+	}
+
+	// keep current values
+	config.ID = id
+	if !config.LAN.IsValid() {
+		config.LAN = current.LAN
+	}
+	if !config.DefaultGW.IsValid() {
+		config.DefaultGW = current.DefaultGW
+	}
+	if !config.DHCPServer.IsValid() {
+		config.DHCPServer = current.DHCPServer
+	}
+	if !config.DNSServer.IsValid() {
+		config.DNSServer = current.DNSServer
+	}
+	if !config.FirstIP.IsValid() && config.LAN == current.LAN {
+		config.FirstIP = current.FirstIP
+	}
+	if config.Duration == 0 {
+		config.Duration = current.Duration
+	}
+	if config.Stage == packet.StageNoChange {
+		config.Stage = current.Stage
+	}
+
+	subnet, err := newSubnet(config)
+	if err != nil {
+		return fmt.Errorf("subnet id=%s: %w: %s", id, packet.ErrInvalidParam, err)
+	}
+	net1, net2 := h.net1, h.net2
+	switch {
+	case current == h.net1:
+		if subnet.LAN != h.net1.LAN {
+			return fmt.Errorf("home lan cannot change: %w", packet.ErrInvalidParam)
+		}
+		net1 = subnet
+	case current == h.net2:
+		if !h.net1.LAN.Contains(subnet.LAN.Addr()) || subnet.LAN.Bits() <= h.net1.LAN.Bits() {
+			return fmt.Errorf("net2 %s must be in home lan %s: %w", subnet.LAN, h.net1.LAN, packet.ErrInvalidParam)
+		}
+		net2 = subnet
+	default:
+		if subnet.LAN.Overlaps(h.net1.LAN) {
+			return fmt.Errorf("relay subnet %s overlaps home lan %s: %w", subnet.LAN, h.net1.LAN, packet.ErrInvalidParam)
+		}
+		for i, r := range h.relays {
+			if i != relay && r.LAN.Overlaps(subnet.LAN) && len(r.circuitID) == 0 && len(h.relays[relay].circuitID) == 0 {
+				return fmt.Errorf("relay subnet %s overlaps relay subnet %s: %w", subnet.LAN, r.LAN, packet.ErrInvalidParam)
+			}
+		}
+	}
+
+	// net2 route options depend on net1; recreate net2 options
+	if net2, err = newSubnet(net2.SubnetConfig); err != nil {
+		return fmt.Errorf("subnet id=%s: %w: %s", h.net2.ID, packet.ErrInvalidParam, err)
+	}
+	net2.appendRouteOptions(net1.DefaultGW, net.CIDRMask(net1.LAN.Bits(), 32-net1.LAN.Bits()), net2.DefaultGW)
+	if Logger.IsInfo() {
+		Logger.Msg("reconfigure subnet").String("subnet_id", id).Sprintf("config", subnet.SubnetConfig).Write()
+	}
+
+	// replace the subnet pointers
+	replace := func(s *dhcpSubnet) *dhcpSubnet {
+		switch s {
+		case h.net1:
+			return net1
+		case h.net2:
+			return net2
+		case current:
+			return subnet
+		}
+		return s
+	}
+	for k, v := range h.moved {
+		h.moved[k] = replace(v)
+	}
+	if relay >= 0 {
+		h.relays[relay].dhcpSubnet = subnet
+	}
+	old := h.table
+	leases := make([]Lease, 0, len(old))
+	for _, v := range old {
+		leases = append(leases, *v)
+	}
+	table := h.newLeaseTable(leases, net1, net2)
+
+	// keep offers in progress if the offer is still valid in the new subnet; newLeaseTable
+	// only keeps allocated leases and declined addresses
+	for k, v := range old {
+		if v.State != StateDiscover || table[k] != nil {
+			continue
+		}
+		lease := *v
+		lease.subnet = replace(v.subnet)
+		if !lease.subnet.LAN.Contains(lease.IPOffer) || lease.subnet.reserved(lease.IPOffer) {
+			continue
+		}
+		table[k] = &lease
+	}
+	h.net1, h.net2 = net1, net2
+	h.table = table
+
+	// expire leases not valid in the new configuration or that changed subnet
+	for k, v := range old {
+		if v.State != StateAllocated {
+			continue
+		}
+		if lease := h.table[k]; lease == nil {
+			v.State = StateFree
+			h.notifyLease(LeaseExpire, v)
+		} else if lease.subnet.ID != v.subnet.ID {
+			h.expire(lease)
+		}
+	}
+	return h.saveConfig()
+}
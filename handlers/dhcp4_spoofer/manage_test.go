@@ -0,0 +1,246 @@
+package dhcp4_spoofer
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+func setupManageTest(t *testing.T, store LeaseStore) *testContext {
+	tc := setupTestHandler()
+	tc.h.Close()
+	var err error
+	config := Config{Mode: ModePrimaryServer, NetfilterIP: netip.PrefixFrom(hostIP4, 25), DNSServer: dnsIP4, LeaseStore: store}
+	if tc.h, err = config.New(tc.session); err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	return tc
+}
+
+func TestHandler_ManageLeases(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := setupManageTest(t, NewMemoryStore())
+	defer tc.Close()
+	defer tc.h.Close()
+
+	macA := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0c, 0x01}
+	macB := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0c, 0x02}
+	newDHCPHost(t, tc, macA, "laptop")
+	newDHCPHost(t, tc, macB, "phone")
+
+	if list := tc.h.Leases(LeaseFilter{}); len(list) != 2 || !list[0].Lease.Addr.IP.Less(list[1].Lease.Addr.IP) || list[0].SubnetID != "net1" {
+		t.Fatalf("invalid lease list %+v", list)
+	}
+	if list := tc.h.Leases(LeaseFilter{Name: "PHONE", States: []State{StateAllocated}}); len(list) != 1 || list[0].Lease.Name != "phone" {
+		t.Errorf("invalid name filter %+v", list)
+	}
+	if list := tc.h.Leases(LeaseFilter{SubnetID: "net2"}); len(list) != 0 {
+		t.Errorf("invalid subnet filter %+v", list)
+	}
+	ipA := tc.h.Leases(LeaseFilter{MAC: macA})[0].Lease.Addr.IP
+	if list := tc.h.Leases(LeaseFilter{Prefix: netip.PrefixFrom(ipA, 32)}); len(list) != 1 || list[0].Lease.Addr.IP != ipA {
+		t.Errorf("invalid prefix filter %+v", list)
+	}
+
+	// reassign
+	ipB := tc.h.Leases(LeaseFilter{MAC: macB})[0].Lease.Addr.IP
+	if err := tc.h.ReassignLease(macA, ipB); !errors.Is(err, packet.ErrInvalidIP) {
+		t.Error("expected ip in use error", err)
+	}
+	if err := tc.h.ReassignLease(macA, routerIP4); !errors.Is(err, packet.ErrInvalidIP) {
+		t.Error("expected reserved ip error", err)
+	}
+	if err := tc.h.ReassignLease(macA, netip.MustParseAddr("10.0.0.1")); !errors.Is(err, packet.ErrInvalidIP) {
+		t.Error("expected invalid subnet error", err)
+	}
+	newIP := netip.MustParseAddr("192.168.0.200")
+	events := make(chan LeaseEvent, 4)
+	tc.h.Lock()
+	tc.h.eventChan = events
+	tc.h.Unlock()
+	if err := tc.h.ReassignLease(macA, newIP); err != nil {
+		t.Fatal("reassign failed", err)
+	}
+	select {
+	case e := <-events:
+		if e.Type != LeaseReassign || e.Lease.Addr.IP != newIP {
+			t.Errorf("invalid reassign event %s", e)
+		}
+	default:
+		t.Error("missing reassign event")
+	}
+	if list := tc.h.Leases(LeaseFilter{MAC: macA}); len(list) != 1 || list[0].Lease.Addr.IP != newIP {
+		t.Errorf("invalid reassigned lease %+v", list)
+	}
+
+	// expire
+	if err := tc.h.ExpireLease(mac5); !errors.Is(err, packet.ErrNotFound) {
+		t.Error("expected not found error", err)
+	}
+	if err := tc.h.ExpireLease(macB); err != nil {
+		t.Fatal("expire failed", err)
+	}
+	if list := tc.h.Leases(LeaseFilter{States: []State{StateAllocated}}); len(list) != 1 || list[0].Lease.Addr.IP != newIP {
+		t.Errorf("invalid lease list after expire %+v", list)
+	}
+	if err := tc.h.ReassignLease(macB, newIP.Next()); !errors.Is(err, packet.ErrNotFound) {
+		t.Error("expected not found error for free lease", err)
+	}
+}
+
+func TestHandler_ManageReservations(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	store := NewMemoryStore()
+	tc := setupManageTest(t, store)
+	defer tc.Close()
+
+	macA := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0d, 0x01}
+	macB := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0d, 0x02}
+	reservedIP := netip.MustParseAddr("192.168.0.50")
+
+	if err := tc.h.Reserve(Reservation{MAC: macA, IP: hostIP4}); !errors.Is(err, packet.ErrInvalidIP) {
+		t.Error("expected reserved ip error", err)
+	}
+	if err := tc.h.Reserve(Reservation{MAC: macA, IP: reservedIP, Name: "printer"}); err != nil {
+		t.Fatal("reserve failed", err)
+	}
+	if err := tc.h.Reserve(Reservation{MAC: macB, IP: reservedIP}); !errors.Is(err, packet.ErrInvalidIP) {
+		t.Error("expected ip reserved for another client", err)
+	}
+
+	// client receives the reserved ip
+	newDHCPHost(t, tc, macA, "printer")
+	if list := tc.h.Leases(LeaseFilter{MAC: macA}); len(list) != 1 || list[0].Lease.Addr.IP != reservedIP || !list[0].Reserved {
+		t.Fatalf("invalid reserved lease %+v", list)
+	}
+
+	// reservations persist in the store
+	tc.h.Close()
+	var err error
+	config := Config{Mode: ModePrimaryServer, NetfilterIP: netip.PrefixFrom(hostIP4, 25), DNSServer: dnsIP4, LeaseStore: store}
+	if tc.h, err = config.New(tc.session); err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer tc.h.Close()
+	if list := tc.h.Reservations(); len(list) != 1 || list[0].IP != reservedIP || list[0].Name != "printer" {
+		t.Fatalf("invalid reservations after reload %+v", list)
+	}
+
+	if err := tc.h.Unreserve(macA); err != nil {
+		t.Error("unreserve failed", err)
+	}
+	if err := tc.h.Unreserve(macA); !errors.Is(err, packet.ErrNotFound) {
+		t.Error("expected not found error", err)
+	}
+	if list := tc.h.Reservations(); len(list) != 0 {
+		t.Errorf("invalid reservations %+v", list)
+	}
+}
+
+func TestHandler_ManageMoveClient(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := setupManageTest(t, NewMemoryStore())
+	defer tc.Close()
+	defer tc.h.Close()
+
+	macA := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0e, 0x01}
+	newDHCPHost(t, tc, macA, "tv")
+
+	if err := tc.h.MoveClient(macA, "invalid"); !errors.Is(err, packet.ErrInvalidParam) {
+		t.Error("expected invalid subnet error", err)
+	}
+	if err := tc.h.MoveClient(macA, "net2"); err != nil {
+		t.Fatal("move failed", err)
+	}
+	if list := tc.h.Leases(LeaseFilter{MAC: macA, States: []State{StateAllocated}}); len(list) != 0 {
+		t.Errorf("lease not expired after move %+v", list)
+	}
+
+	// new lease is in net2 although the client is not captured
+	newDHCPHost(t, tc, macA, "tv")
+	list := tc.h.Leases(LeaseFilter{MAC: macA})
+	if len(list) != 1 || list[0].SubnetID != "net2" || list[0].Stage != packet.StageRedirected || !tc.h.net2.LAN.Contains(list[0].Lease.Addr.IP) {
+		t.Fatalf("invalid lease after move %+v", list)
+	}
+
+	// clearing the override moves the client back to net1
+	if err := tc.h.MoveClient(macA, ""); err != nil {
+		t.Fatal("move failed", err)
+	}
+	newDHCPHost(t, tc, macA, "tv")
+	if list := tc.h.Leases(LeaseFilter{MAC: macA}); len(list) != 1 || list[0].SubnetID != "net1" {
+		t.Errorf("invalid lease after clear %+v", list)
+	}
+}
+
+func TestHandler_ManageReconfigure(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := setupManageTest(t, NewMemoryStore())
+	defer tc.Close()
+	defer tc.h.Close()
+
+	macA := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0f, 0x01}
+	macB := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0f, 0x02}
+	newDHCPHost(t, tc, macA, "a")
+	tc.session.Capture(macB)
+	newDHCPHost(t, tc, macB, "b")
+
+	if err := tc.h.ReconfigureSubnet("invalid", SubnetConfig{}); !errors.Is(err, packet.ErrNotFound) {
+		t.Error("expected not found error", err)
+	}
+	if err := tc.h.ReconfigureSubnet("net1", SubnetConfig{LAN: netip.MustParsePrefix("10.0.0.0/24")}); !errors.Is(err, packet.ErrInvalidParam) {
+		t.Error("expected home lan error", err)
+	}
+	if err := tc.h.ReconfigureSubnet("net2", SubnetConfig{LAN: netip.MustParsePrefix("10.0.0.0/25")}); !errors.Is(err, packet.ErrInvalidParam) {
+		t.Error("expected net2 outside home lan error", err)
+	}
+
+	// declined address and offer in progress
+	declinedIP, offerIP := netip.MustParseAddr("192.168.0.20"), netip.MustParseAddr("192.168.0.21")
+	tc.h.Lock()
+	tc.h.markDeclined(declinedIP, nil)
+	offer := tc.h.findOrCreate(tc.h.net1, []byte("offer"), net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0f, 0x03}, "c")
+	offer.State, offer.IPOffer, offer.XID = StateDiscover, offerIP, []byte("xid")
+	tc.h.Unlock()
+
+	// change net1 duration and dns; leases are kept
+	if err := tc.h.ReconfigureSubnet("net1", SubnetConfig{Duration: time.Hour, DNSServer: netip.MustParseAddr("9.9.9.9")}); err != nil {
+		t.Fatal("reconfigure failed", err)
+	}
+	if list := tc.h.Leases(LeaseFilter{States: []State{StateDeclined}}); len(list) != 1 || list[0].Lease.Addr.IP != declinedIP {
+		t.Errorf("declined address not kept %+v", list)
+	}
+	if list := tc.h.Leases(LeaseFilter{States: []State{StateDiscover}}); len(list) != 1 || list[0].Lease.IPOffer != offerIP || list[0].SubnetID != "net1" {
+		t.Errorf("offer not kept %+v", list)
+	}
+	subnets := tc.h.Subnets()
+	if len(subnets) != 2 || subnets[0].Duration != time.Hour || subnets[0].DNSServer != netip.MustParseAddr("9.9.9.9") || subnets[0].LAN != homeLAN {
+		t.Errorf("invalid subnets %+v", subnets)
+	}
+	if list := tc.h.Leases(LeaseFilter{States: []State{StateAllocated}}); len(list) != 2 {
+		t.Errorf("invalid leases after reconfigure %+v", list)
+	}
+
+	// shrink net2 so that the captured lease is no longer valid
+	ipB := tc.h.Leases(LeaseFilter{MAC: macB})[0].Lease.Addr.IP
+	lan := netip.MustParsePrefix("192.168.0.192/26")
+	if lan.Contains(ipB) {
+		lan = netip.MustParsePrefix("192.168.0.128/26")
+	}
+	if err := tc.h.ReconfigureSubnet("net2", SubnetConfig{LAN: lan, DefaultGW: lan.Addr().Next()}); err != nil {
+		t.Fatal("reconfigure net2 failed", err)
+	}
+	if list := tc.h.Leases(LeaseFilter{MAC: macB, States: []State{StateAllocated}}); len(list) != 0 {
+		t.Errorf("net2 lease not expired %+v", list)
+	}
+	tc.h.Lock()
+	if tc.h.net2.LAN != lan || tc.h.net2.options[packet.DHCP4OptionClasslessRouteFormat] == nil {
+		t.Errorf("invalid net2 %+v", tc.h.net2)
+	}
+	tc.h.Unlock()
+}
@@ -0,0 +1,188 @@
+package dhcp4_spoofer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/irai/packet"
+)
+
+// OptionProfile is a named set of dhcp options sent to clients in addition to the
+// subnet options. Empty fields are not sent; DNSServers overrides the subnet DNS server.
+type OptionProfile struct {
+	Name           string
+	DNSServers     []netip.Addr // option 6
+	NTPServers     []netip.Addr // option 42
+	DomainName     string       // option 15
+	DomainSearch   []string     // option 119
+	WPAD           string       // option 252; proxy auto-config url
+	MTU            uint16       // option 26
+	VendorSpecific []byte       // option 43; opaque vendor specific information
+}
+
+// ProfileRule selects an option profile for matching clients. Empty fields match any client.
+//
+// When more than one rule matches a client, the options of the more specific rules override
+// the less specific ones: a MAC rule (reservation) takes precedence over a VendorClass rule, which
+// takes precedence over a subnet or stage rule.
+type ProfileRule struct {
+	Profile     string           // name of the profile to apply
+	SubnetID    string           // net1, net2 or relay subnet id
+	Stage       packet.HuntStage // StageNormal or StageRedirected; StageNoChange to match any
+	MAC         net.HardwareAddr // reservation for a single client
+	VendorClass string           // vendor class identifier prefix (option 60); i.e. "MSFT", "android-dhcp"
+}
+
+// profileRule holds a validated rule and the encoded profile options
+type profileRule struct {
+	ProfileRule
+	options packet.DHCP4Options
+}
+
+func (r ProfileRule) specificity() int {
+	switch {
+	case r.MAC != nil:
+		return 3
+	case r.VendorClass != "":
+		return 2
+	case r.SubnetID != "" || r.Stage != packet.StageNoChange:
+		return 1
+	}
+	return 0
+}
+
+// encode returns the dhcp options for the profile.
+func (p OptionProfile) encode() (packet.DHCP4Options, error) {
+	options := packet.DHCP4Options{}
+	if len(p.DNSServers) > 0 {
+		options[packet.DHCP4OptionDomainNameServer] = encodeAddrList(p.DNSServers)
+	}
+	if len(p.NTPServers) > 0 {
+		options[packet.DHCP4OptionNTPServers] = encodeAddrList(p.NTPServers)
+	}
+	if p.DomainName != "" {
+		options[packet.DHCP4OptionDomainName] = []byte(p.DomainName)
+	}
+	if len(p.DomainSearch) > 0 {
+		b, err := encodeDomainSearch(p.DomainSearch)
+		if err != nil {
+			return nil, err
+		}
+		options[packet.DHCP4OptionDomainSearch] = b
+	}
+	if p.WPAD != "" {
+		options[packet.DHCP4OptionWPAD] = []byte(p.WPAD)
+	}
+	if p.MTU != 0 {
+		if p.MTU < 68 {
+			return nil, fmt.Errorf("invalid mtu=%d: %w", p.MTU, packet.ErrInvalidParam)
+		}
+		mtu := make([]byte, 2)
+		binary.BigEndian.PutUint16(mtu, p.MTU)
+		options[packet.DHCP4OptionInterfaceMTU] = mtu
+	}
+	if len(p.VendorSpecific) > 0 {
+		options[packet.DHCP4OptionVendorSpecific] = packet.CopyBytes(p.VendorSpecific)
+	}
+	for code, v := range options {
+		if len(v) > 255 {
+			return nil, fmt.Errorf("option %d too long len=%d: %w", code, len(v), packet.ErrInvalidParam)
+		}
+	}
+	return options, nil
+}
+
+func encodeAddrList(list []netip.Addr) []byte {
+	b := make([]byte, 0, len(list)*4)
+	for _, ip := range list {
+		if ip.Is4() {
+			b = append(b, ip.AsSlice()...)
+		}
+	}
+	return b
+}
+
+// encodeDomainSearch encodes the domain list in dns wire format without compression - rfc3397.
+func encodeDomainSearch(domains []string) ([]byte, error) {
+	var b []byte
+	for _, domain := range domains {
+		for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain search %q: %w", domain, packet.ErrInvalidParam)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+		b = append(b, 0)
+	}
+	return b, nil
+}
+
+// newProfileRules validates the rules and encodes the profile options.
+// Rules are sorted by specificity so that options of more specific rules are applied last.
+func newProfileRules(profiles []OptionProfile, rules []ProfileRule) ([]profileRule, error) {
+	encoded := make(map[string]packet.DHCP4Options, len(profiles))
+	for _, p := range profiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("profile name missing: %w", packet.ErrInvalidParam)
+		}
+		if _, found := encoded[p.Name]; found {
+			return nil, fmt.Errorf("duplicated profile name=%s: %w", p.Name, packet.ErrInvalidParam)
+		}
+		options, err := p.encode()
+		if err != nil {
+			return nil, fmt.Errorf("profile name=%s: %w", p.Name, err)
+		}
+		encoded[p.Name] = options
+	}
+
+	list := make([]profileRule, 0, len(rules))
+	for _, r := range rules {
+		options, found := encoded[r.Profile]
+		if !found {
+			return nil, fmt.Errorf("profile name=%s not found: %w", r.Profile, packet.ErrInvalidParam)
+		}
+		r.MAC = packet.CopyMAC(r.MAC)
+		if len(r.MAC) == 0 {
+			r.MAC = nil
+		}
+		list = append(list, profileRule{ProfileRule: r, options: options})
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].specificity() < list[j].specificity() })
+	return list, nil
+}
+
+func (r profileRule) match(subnet *dhcpSubnet, mac net.HardwareAddr, vendorClass []byte) bool {
+	if r.SubnetID != "" && r.SubnetID != subnet.ID {
+		return false
+	}
+	if r.Stage != packet.StageNoChange && r.Stage != subnet.Stage {
+		return false
+	}
+	if r.MAC != nil && !bytes.Equal(r.MAC, mac) {
+		return false
+	}
+	if r.VendorClass != "" && !bytes.HasPrefix(vendorClass, []byte(r.VendorClass)) {
+		return false
+	}
+	return true
+}
+
+// replyOptions returns the subnet options merged with the options of all matching profiles.
+func (h *Handler) replyOptions(subnet *dhcpSubnet, mac net.HardwareAddr, options packet.DHCP4Options) packet.DHCP4Options {
+	opts := subnet.CopyOptions()
+	vendorClass := options[packet.DHCP4OptionVendorClassIdentifier]
+	for _, r := range h.profiles {
+		if r.match(subnet, mac, vendorClass) {
+			for k, v := range r.options {
+				opts[k] = v
+			}
+		}
+	}
+	return opts
+}
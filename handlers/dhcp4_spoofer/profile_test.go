@@ -0,0 +1,219 @@
+package dhcp4_spoofer
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+var (
+	testProfiles = []OptionProfile{
+		{Name: "captured", DNSServers: []netip.Addr{netip.MustParseAddr("1.1.1.1")}, WPAD: "http://wpad/wpad.dat"},
+		{Name: "windows", NTPServers: []netip.Addr{netip.MustParseAddr("192.168.0.2"), netip.MustParseAddr("192.168.0.3")}, DomainSearch: []string{"home.lan", "example.com."}},
+		{Name: "printer", DNSServers: []netip.Addr{netip.MustParseAddr("9.9.9.9")}, MTU: 1400, VendorSpecific: []byte{1, 2, 0xaa, 0xbb}},
+	}
+	testProfileRules = []ProfileRule{
+		{Profile: "printer", MAC: net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0b, 0x03}},
+		{Profile: "windows", VendorClass: "MSFT"},
+		{Profile: "captured", Stage: packet.StageRedirected},
+	}
+)
+
+func TestHandler_Profiles(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := setupTestHandler()
+	defer tc.Close()
+
+	var err error
+	tc.h.Close()
+	config := Config{NetfilterIP: netip.PrefixFrom(hostIP4, 25), DNSServer: dnsIP4, LeaseStore: NewMemoryStore(), Profiles: testProfiles, ProfileRules: testProfileRules}
+	if tc.h, err = config.New(tc.session); err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer tc.h.Close()
+
+	normalMAC := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0b, 0x01}
+	printerMAC := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0b, 0x03}
+	windows := packet.DHCP4Options{packet.DHCP4OptionVendorClassIdentifier: []byte("MSFT 5.0")}
+
+	tests := []struct {
+		name    string
+		subnet  *dhcpSubnet
+		mac     net.HardwareAddr
+		options packet.DHCP4Options
+		want    packet.DHCP4Options
+		missing []packet.DHCP4OptionCode
+	}{
+		{name: "normal", subnet: tc.h.net1, mac: normalMAC, options: packet.DHCP4Options{},
+			want:    packet.DHCP4Options{packet.DHCP4OptionDomainNameServer: dnsIP4.AsSlice(), packet.DHCP4OptionRouter: routerIP4.AsSlice()},
+			missing: []packet.DHCP4OptionCode{packet.DHCP4OptionWPAD, packet.DHCP4OptionNTPServers, packet.DHCP4OptionInterfaceMTU}},
+		{name: "captured", subnet: tc.h.net2, mac: normalMAC, options: packet.DHCP4Options{},
+			want:    packet.DHCP4Options{packet.DHCP4OptionDomainNameServer: {1, 1, 1, 1}, packet.DHCP4OptionWPAD: []byte("http://wpad/wpad.dat"), packet.DHCP4OptionRouter: hostIP4.AsSlice()},
+			missing: []packet.DHCP4OptionCode{packet.DHCP4OptionNTPServers}},
+		{name: "windows captured", subnet: tc.h.net2, mac: normalMAC, options: windows,
+			want: packet.DHCP4Options{packet.DHCP4OptionDomainNameServer: {1, 1, 1, 1}, packet.DHCP4OptionNTPServers: {192, 168, 0, 2, 192, 168, 0, 3},
+				packet.DHCP4OptionDomainSearch: []byte("\x04home\x03lan\x00\x07example\x03com\x00")}},
+		{name: "printer reservation", subnet: tc.h.net2, mac: printerMAC, options: packet.DHCP4Options{},
+			want: packet.DHCP4Options{packet.DHCP4OptionDomainNameServer: {9, 9, 9, 9}, packet.DHCP4OptionInterfaceMTU: {0x05, 0x78},
+				packet.DHCP4OptionVendorSpecific: {1, 2, 0xaa, 0xbb}, packet.DHCP4OptionWPAD: []byte("http://wpad/wpad.dat")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tc.h.replyOptions(tt.subnet, tt.mac, tt.options)
+			for code, v := range tt.want {
+				if !bytes.Equal(opts[code], v) {
+					t.Errorf("invalid option %d want=%v got=%v", code, v, opts[code])
+				}
+			}
+			for _, code := range tt.missing {
+				if _, found := opts[code]; found {
+					t.Errorf("unexpected option %d", code)
+				}
+			}
+		})
+	}
+
+	// profile options are sent in the offer
+	srcAddr := packet.Addr{MAC: printerMAC, IP: packet.IPv4zero, Port: packet.DHCP4ClientPort}
+	frame, err := tc.session.Parse(newDHCP4DiscoverFrame(srcAddr, "printer", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.h.ProcessPacket(frame); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-tc.notifyReply:
+		options := packet.DHCP4(packet.UDP(packet.IP4(packet.Ether(p).Payload()).Payload()).Payload()).ParseOptions()
+		if !bytes.Equal(options[packet.DHCP4OptionDomainNameServer], []byte{9, 9, 9, 9}) || !bytes.Equal(options[packet.DHCP4OptionInterfaceMTU], []byte{0x05, 0x78}) {
+			t.Errorf("invalid offer options %v", options)
+		}
+	case <-time.After(time.Millisecond * 50):
+		t.Fatal("missing offer")
+	}
+}
+
+func TestHandler_ProfileConfig(t *testing.T) {
+	if _, err := newProfileRules(testProfiles, []ProfileRule{{Profile: "invalid"}}); !errors.Is(err, packet.ErrInvalidParam) {
+		t.Error("expected invalid profile error", err)
+	}
+	if _, err := newProfileRules([]OptionProfile{{Name: "a"}, {Name: "a"}}, nil); !errors.Is(err, packet.ErrInvalidParam) {
+		t.Error("expected duplicated profile error", err)
+	}
+	if _, err := newProfileRules([]OptionProfile{{Name: "a", DomainSearch: []string{"invalid..com"}}}, nil); !errors.Is(err, packet.ErrInvalidParam) {
+		t.Error("expected invalid domain error", err)
+	}
+	rules, err := newProfileRules(testProfiles, testProfileRules)
+	if err != nil || len(rules) != 3 || rules[0].Profile != "captured" || rules[2].Profile != "printer" {
+		t.Errorf("invalid rule order %+v", rules)
+	}
+}
+
+func newDHCP4InformFrame(src packet.Addr, xid []byte) packet.Ether {
+	options := packet.DHCP4Options{}
+	options[packet.DHCP4OptionParameterRequestList] = []byte{byte(packet.DHCP4OptionDomainNameServer), byte(packet.DHCP4OptionWPAD)}
+
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, src.MAC, hostMAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 50, src.IP, hostIP4)
+	udp := packet.EncodeUDP(ip4.Payload(), src.Port, packet.DHCP4ServerPort)
+	dhcp := packet.EncodeDHCP4(udp.Payload(), packet.DHCP4BootRequest, packet.DHCP4Inform, src.MAC, src.IP, packet.IPv4zero, xid, false, options, options[packet.DHCP4OptionParameterRequestList])
+	udp = udp.SetPayload(dhcp)
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	var err error
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		panic(err)
+	}
+	return ether
+}
+
+func TestHandler_Inform(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := setupTestHandler()
+	defer tc.Close()
+
+	var err error
+	tc.h.Close()
+	config := Config{Mode: ModePrimaryServer, NetfilterIP: netip.PrefixFrom(hostIP4, 25), DNSServer: dnsIP4, LeaseStore: NewMemoryStore(),
+		Profiles: testProfiles, ProfileRules: testProfileRules}
+	if tc.h, err = config.New(tc.session); err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer tc.h.Close()
+
+	informMAC := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x0b, 0x05}
+	informIP := netip.MustParseAddr("192.168.0.140")
+	src := packet.Addr{MAC: informMAC, IP: informIP, Port: packet.DHCP4ClientPort}
+
+	inform := func() packet.Frame {
+		t.Helper()
+		frame, err := tc.session.Parse(newDHCP4InformFrame(src, []byte("inf1")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.h.ProcessPacket(frame); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case p := <-tc.notifyReply:
+			frame, err := tc.session.Parse(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return frame
+		case <-time.After(time.Millisecond * 50):
+		}
+		return packet.Frame{}
+	}
+
+	// normal client
+	frame := inform()
+	if frame.PayloadID != packet.PayloadDHCP4 {
+		t.Fatal("missing inform reply")
+	}
+	if !bytes.Equal(frame.DstAddr.MAC, informMAC) || frame.DstAddr.IP != informIP || frame.DstAddr.Port != packet.DHCP4ClientPort {
+		t.Errorf("invalid inform dst %s", frame.DstAddr)
+	}
+	ack := packet.DHCP4(frame.Payload())
+	options := ack.ParseOptions()
+	if mt := options[packet.DHCP4OptionDHCPMessageType]; len(mt) != 1 || packet.DHCP4MessageType(mt[0]) != packet.DHCP4ACK {
+		t.Fatalf("invalid message type %v", mt)
+	}
+	if ack.CIAddr() != informIP || !ack.YIAddr().IsUnspecified() || !bytes.Equal(ack.XId(), []byte("inf1")) {
+		t.Errorf("invalid inform ack ciaddr=%s yiaddr=%s", ack.CIAddr(), ack.YIAddr())
+	}
+	if _, found := options[packet.DHCP4OptionIPAddressLeaseTime]; found {
+		t.Error("inform ack must not include lease time")
+	}
+	if !bytes.Equal(options[packet.DHCP4OptionServerIdentifier], hostIP4.AsSlice()) || !bytes.Equal(options[packet.DHCP4OptionDomainNameServer], dnsIP4.AsSlice()) {
+		t.Errorf("invalid inform options %v", options)
+	}
+	if len(tc.h.table) != 0 {
+		t.Error("inform must not create a lease", len(tc.h.table))
+	}
+
+	// captured client receives the captured profile
+	tc.session.Capture(informMAC)
+	frame = inform()
+	if frame.PayloadID != packet.PayloadDHCP4 {
+		t.Fatal("missing captured inform reply")
+	}
+	options = packet.DHCP4(frame.Payload()).ParseOptions()
+	if !bytes.Equal(options[packet.DHCP4OptionDomainNameServer], []byte{1, 1, 1, 1}) || string(options[packet.DHCP4OptionWPAD]) != "http://wpad/wpad.dat" {
+		t.Errorf("invalid captured inform options %v", options)
+	}
+
+	// nice mode does not reply to normal clients
+	tc.session.Release(informMAC)
+	tc.h.SetMode(ModeSecondaryServerNice)
+	if frame = inform(); frame.PayloadID == packet.PayloadDHCP4 {
+		t.Error("unexpected inform reply in nice mode")
+	}
+}
@@ -0,0 +1,172 @@
+package dhcp4_spoofer
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+
+	"github.com/irai/packet"
+)
+
+// RelaySubnet configures a remote subnet served via a DHCP relay agent.
+//
+// A relayed packet is matched to the subnet with the same option 82 circuit id, if CircuitID is set,
+// or else to the subnet containing the relay agent address (giaddr).
+type RelaySubnet struct {
+	SubnetConfig        // remote subnet; DHCPServer and DNSServer default to our host and the handler DNS server
+	CircuitID    []byte // option 82 circuit id; nil to match by giaddr only
+}
+
+// relaySubnet holds a relay subnet and its circuit id
+type relaySubnet struct {
+	*dhcpSubnet
+	circuitID []byte
+}
+
+// relay agent information sub options - rfc3046
+const (
+	relayAgentCircuitID = 1
+	relayAgentRemoteID  = 2
+)
+
+// newRelaySubnets validates the relay configuration. Relay subnets must not overlap the home LAN.
+func newRelaySubnets(configs []RelaySubnet, homeLAN netip.Prefix, dhcpServer netip.Addr, dnsServer netip.Addr) (relays []relaySubnet, err error) {
+	for i, config := range configs {
+		if !config.LAN.IsValid() || config.LAN.Overlaps(homeLAN) {
+			return nil, fmt.Errorf("relay subnet %s overlaps home lan %s: %w", config.LAN, homeLAN, packet.ErrInvalidIP)
+		}
+		for _, r := range relays {
+			if r.LAN.Overlaps(config.LAN) && len(r.circuitID) == 0 && len(config.CircuitID) == 0 {
+				return nil, fmt.Errorf("duplicated relay subnet %s: %w", config.LAN, packet.ErrInvalidIP)
+			}
+		}
+		if !config.DHCPServer.IsValid() {
+			config.DHCPServer = dhcpServer
+		}
+		if !config.DNSServer.IsValid() {
+			config.DNSServer = dnsServer
+		}
+		if config.Stage == packet.StageNoChange {
+			config.Stage = packet.StageNormal
+		}
+		subnet, err := newSubnet(config.SubnetConfig)
+		if err != nil {
+			return nil, fmt.Errorf("relay config %s: %w", config.LAN, err)
+		}
+		subnet.ID = config.ID
+		if subnet.ID == "" {
+			subnet.ID = fmt.Sprintf("relay%d", i+1)
+		}
+		relays = append(relays, relaySubnet{dhcpSubnet: subnet, circuitID: packet.CopyBytes(config.CircuitID)})
+	}
+	return relays, nil
+}
+
+// relayAgentSubOption returns the sub option from the relay agent information option (82).
+func relayAgentSubOption(info []byte, code byte) []byte {
+	for len(info) >= 2 {
+		n := int(info[1])
+		if len(info) < 2+n {
+			return nil
+		}
+		if info[0] == code {
+			return info[2 : 2+n]
+		}
+		info = info[2+n:]
+	}
+	return nil
+}
+
+// isRelay returns true if the subnet is a remote relay subnet.
+func (h *Handler) isRelay(subnet *dhcpSubnet) bool {
+	return subnet != h.net1 && subnet != h.net2
+}
+
+// relaySubnetFor returns the relay subnet containing ip or nil if none.
+func (h *Handler) relaySubnetFor(ip netip.Addr) *dhcpSubnet {
+	for _, r := range h.relays {
+		if r.LAN.Contains(ip) {
+			return r.dhcpSubnet
+		}
+	}
+	return nil
+}
+
+// clientSubnet returns the subnet to allocate the client from.
+//
+// Relayed packets are allocated from the relay subnet matching the circuit id or giaddr;
+// it returns nil if there is no match. Unicast renew packets from remote clients
+// don't have giaddr and are matched by ciaddr. All other packets are allocated from
+// net1 or net2 depending on the capture state.
+func (h *Handler) clientSubnet(p packet.DHCP4, options packet.DHCP4Options) *dhcpSubnet {
+	giaddr := p.GIAddr()
+	if giaddr.IsUnspecified() {
+		if ciaddr := p.CIAddr(); !ciaddr.IsUnspecified() && !h.net1.LAN.Contains(ciaddr) {
+			if subnet := h.relaySubnetFor(ciaddr); subnet != nil {
+				return subnet
+			}
+		}
+		if subnet, found := h.moved[string(p.CHAddr())]; found {
+			return subnet
+		}
+		if h.session.IsCaptured(p.CHAddr()) {
+			return h.net2
+		}
+		return h.net1
+	}
+
+	circuitID := relayAgentSubOption(options[packet.DHCP4OptionRelayAgentInformation], relayAgentCircuitID)
+	var match *dhcpSubnet
+	for _, r := range h.relays {
+		if len(r.circuitID) > 0 {
+			if bytes.Equal(r.circuitID, circuitID) {
+				return r.dhcpSubnet
+			}
+			continue
+		}
+		if match == nil && r.LAN.Contains(giaddr) {
+			match = r.dhcpSubnet
+		}
+	}
+	return match
+}
+
+// relayReply sets the relay fields in the response.
+// rfc2131: the server copies giaddr and flags from the request; rfc3046: the server echoes the
+// relay agent information option back to the relay agent.
+func relayReply(p packet.DHCP4, giaddr netip.Addr, flags uint16, relayInfo []byte) packet.DHCP4 {
+	p.SetGIAddr(giaddr)
+	p.SetFlags(flags)
+	if len(relayInfo) == 0 {
+		return p
+	}
+
+	// find end option
+	opts := p[240:]
+	pos := 0
+	for pos < len(opts) && packet.DHCP4OptionCode(opts[pos]) != packet.DHCP4End {
+		if packet.DHCP4OptionCode(opts[pos]) == packet.DHCP4Pad {
+			pos++
+			continue
+		}
+		if pos+1 >= len(opts) {
+			break
+		}
+		pos = pos + 2 + int(opts[pos+1])
+	}
+	n := 240 + pos
+	if n+2+len(relayInfo)+1 > cap(p) {
+		Logger.Msg("no space for relay agent information").Int("len", len(relayInfo)).Write()
+		return p
+	}
+	p = p[:cap(p)]
+	p[n] = byte(packet.DHCP4OptionRelayAgentInformation)
+	p[n+1] = byte(len(relayInfo))
+	n = n + 2 + copy(p[n+2:], relayInfo)
+	p[n] = byte(packet.DHCP4End)
+	n++
+	for ; n < 300; n++ {
+		p[n] = 0x00
+	}
+	return p[:n]
+}
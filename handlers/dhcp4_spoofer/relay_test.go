@@ -0,0 +1,187 @@
+package dhcp4_spoofer
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+var (
+	relayMAC  = net.HardwareAddr{0x00, 0x77, 0x77, 0x77, 0x77, 0x77}
+	relayLAN  = netip.MustParsePrefix("10.0.1.0/24")
+	relayGW   = netip.MustParseAddr("10.0.1.1")
+	relayLAN2 = netip.MustParsePrefix("10.0.2.0/24")
+	relayGW2  = netip.MustParseAddr("10.0.2.1")
+)
+
+// newRelayFrame returns a dhcp packet forwarded by a relay agent to our host.
+func newRelayFrame(mt packet.DHCP4MessageType, chaddr net.HardwareAddr, giaddr netip.Addr, xid []byte, options packet.DHCP4Options) packet.Ether {
+	options[packet.DHCP4OptionParameterRequestList] = []byte{byte(packet.DHCP4OptionServerIdentifier), byte(packet.DHCP4OptionDomainNameServer)}
+
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, relayMAC, hostMAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 50, giaddr, hostIP4)
+	udp := packet.EncodeUDP(ip4.Payload(), packet.DHCP4ServerPort, packet.DHCP4ServerPort)
+	dhcp := packet.EncodeDHCP4(udp.Payload(), packet.DHCP4BootRequest, mt, chaddr, packet.IPv4zero, packet.IPv4zero, xid, true, options, options[packet.DHCP4OptionParameterRequestList])
+	dhcp.SetGIAddr(giaddr)
+	udp = udp.SetPayload(dhcp)
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	var err error
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		panic(err)
+	}
+	return ether
+}
+
+func TestHandler_Relay(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := setupTestHandler()
+	defer tc.Close()
+
+	var err error
+	tc.h.Close()
+	config := Config{NetfilterIP: netip.PrefixFrom(hostIP4, 25), DNSServer: dnsIP4, LeaseStore: NewMemoryStore(),
+		RelaySubnets: []RelaySubnet{
+			{SubnetConfig: SubnetConfig{LAN: relayLAN, DefaultGW: relayGW}},
+			{SubnetConfig: SubnetConfig{LAN: relayLAN2, DefaultGW: relayGW2}, CircuitID: []byte("port2")},
+		}}
+	if tc.h, err = config.New(tc.session); err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer tc.h.Close()
+
+	clientMAC := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x09, 0x01}
+	client2MAC := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x09, 0x02}
+
+	process := func(ether packet.Ether) packet.Frame {
+		t.Helper()
+		frame, err := tc.session.Parse(ether)
+		if err != nil {
+			t.Fatal("invalid frame", err)
+		}
+		if err := tc.h.ProcessPacket(frame); err != nil {
+			t.Fatal("process packet", err)
+		}
+		select {
+		case p := <-tc.notifyReply:
+			if frame, err = tc.session.Parse(p); err != nil || frame.PayloadID != packet.PayloadDHCP4 {
+				t.Fatal("invalid reply", err, frame.PayloadID)
+			}
+			return frame
+		case <-time.After(time.Millisecond * 50):
+		}
+		return packet.Frame{}
+	}
+
+	checkReply := func(frame packet.Frame, mt packet.DHCP4MessageType, giaddr netip.Addr, relayInfo []byte) packet.DHCP4 {
+		t.Helper()
+		if frame.PayloadID != packet.PayloadDHCP4 {
+			t.Fatal("missing reply")
+		}
+		if !bytes.Equal(frame.DstAddr.MAC, relayMAC) || frame.DstAddr.IP != giaddr || frame.DstAddr.Port != packet.DHCP4ServerPort {
+			t.Errorf("invalid relay dst %s", frame.DstAddr)
+		}
+		dhcp := packet.DHCP4(frame.Payload())
+		options := dhcp.ParseOptions()
+		if t := options[packet.DHCP4OptionDHCPMessageType]; len(t) != 1 || packet.DHCP4MessageType(t[0]) != mt {
+			return dhcp
+		}
+		if dhcp.GIAddr() != giaddr || !dhcp.Broadcast() {
+			t.Errorf("invalid giaddr=%s broadcast=%v", dhcp.GIAddr(), dhcp.Broadcast())
+		}
+		if !bytes.Equal(options[packet.DHCP4OptionRelayAgentInformation], relayInfo) {
+			t.Errorf("invalid relay agent information %x", options[packet.DHCP4OptionRelayAgentInformation])
+		}
+		return dhcp
+	}
+
+	// discover via relay matching giaddr
+	relayInfo := []byte{relayAgentCircuitID, 5, 'p', 'o', 'r', 't', '1'}
+	options := packet.DHCP4Options{packet.DHCP4OptionRelayAgentInformation: relayInfo}
+	offer := checkReply(process(newRelayFrame(packet.DHCP4Discover, clientMAC, relayGW, []byte("r1"), options)), packet.DHCP4Offer, relayGW, relayInfo)
+	ip := offer.YIAddr()
+	if !relayLAN.Contains(ip) || ip == relayGW {
+		t.Fatal("invalid offer", ip)
+	}
+	if router := offer.ParseOptions()[packet.DHCP4OptionRouter]; !bytes.Equal(router, relayGW.AsSlice()) {
+		t.Errorf("invalid router %v", router)
+	}
+	if tc.session.DHCPv4IPOffer(clientMAC).IsValid() {
+		t.Error("relay offer must not update session")
+	}
+
+	// request via relay
+	options = packet.DHCP4Options{
+		packet.DHCP4OptionRelayAgentInformation: relayInfo,
+		packet.DHCP4OptionRequestedIPAddress:    ip.AsSlice(),
+		packet.DHCP4OptionServerIdentifier:      hostIP4.AsSlice(),
+	}
+	checkReply(process(newRelayFrame(packet.DHCP4Request, clientMAC, relayGW, []byte("r1"), options)), packet.DHCP4ACK, relayGW, relayInfo)
+	if lease := tc.h.table[string(clientMAC)]; lease == nil || lease.State != StateAllocated || lease.Addr.IP != ip || lease.subnet.ID != "relay1" {
+		t.Fatalf("invalid relay lease %+v", lease)
+	}
+
+	// circuit id selects the subnet
+	relayInfo2 := []byte{relayAgentCircuitID, 5, 'p', 'o', 'r', 't', '2', relayAgentRemoteID, 1, 'x'}
+	options = packet.DHCP4Options{packet.DHCP4OptionRelayAgentInformation: relayInfo2}
+	offer = checkReply(process(newRelayFrame(packet.DHCP4Discover, client2MAC, relayGW, []byte("r2"), options)), packet.DHCP4Offer, relayGW, relayInfo2)
+	if !relayLAN2.Contains(offer.YIAddr()) {
+		t.Fatal("invalid circuit id offer", offer.YIAddr())
+	}
+
+	// unknown giaddr
+	options = packet.DHCP4Options{}
+	if frame := process(newRelayFrame(packet.DHCP4Discover, client2MAC, netip.MustParseAddr("10.0.3.1"), []byte("r3"), options)); frame.PayloadID == packet.PayloadDHCP4 {
+		t.Error("unexpected reply for unknown relay")
+	}
+}
+
+func TestHandler_RelayReconfigure(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := setupTestHandler()
+	defer tc.Close()
+
+	var err error
+	tc.h.Close()
+	config := Config{NetfilterIP: netip.PrefixFrom(hostIP4, 25), DNSServer: dnsIP4, LeaseStore: NewMemoryStore(),
+		RelaySubnets: []RelaySubnet{
+			{SubnetConfig: SubnetConfig{LAN: relayLAN, DefaultGW: relayGW}},
+			{SubnetConfig: SubnetConfig{LAN: relayLAN2, DefaultGW: relayGW2}},
+		}}
+	if tc.h, err = config.New(tc.session); err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer tc.h.Close()
+
+	if err := tc.h.ReconfigureSubnet("relay2", SubnetConfig{LAN: relayLAN, DefaultGW: relayGW}); !errors.Is(err, packet.ErrInvalidParam) {
+		t.Error("expected relay overlap error", err)
+	}
+	lan := netip.MustParsePrefix("10.0.3.0/24")
+	if err := tc.h.ReconfigureSubnet("relay2", SubnetConfig{LAN: lan, DefaultGW: lan.Addr().Next()}); err != nil {
+		t.Fatal("reconfigure relay failed", err)
+	}
+	if subnets := tc.h.Subnets(); len(subnets) != 4 || subnets[3].LAN != lan {
+		t.Errorf("invalid subnets %+v", subnets)
+	}
+}
+
+func TestHandler_RelayConfig(t *testing.T) {
+	_, err := newRelaySubnets([]RelaySubnet{{SubnetConfig: SubnetConfig{LAN: netip.MustParsePrefix("192.168.0.0/25"), DefaultGW: ip1}}}, homeLAN, hostIP4, dnsIP4)
+	if err == nil {
+		t.Error("expected error for relay subnet overlapping home lan")
+	}
+	relays, err := newRelaySubnets([]RelaySubnet{{SubnetConfig: SubnetConfig{LAN: relayLAN, DefaultGW: relayGW}}}, homeLAN, hostIP4, dnsIP4)
+	if err != nil || len(relays) != 1 {
+		t.Fatal("invalid relay config", err)
+	}
+	if relays[0].DHCPServer != hostIP4 || relays[0].DNSServer != dnsIP4 || relays[0].Stage != packet.StageNormal || relays[0].ID != "relay1" {
+		t.Errorf("invalid relay defaults %+v", relays[0].SubnetConfig)
+	}
+}
@@ -115,12 +115,13 @@ func (h *Handler) handleRequest(host *packet.Host, p packet.DHCP4, options packe
 	}
 
 	captured := h.session.IsCaptured(p.CHAddr())
-	subnet := h.net1
-	if captured {
-		subnet = h.net2
-	}
+	subnet := h.clientSubnet(p, options)
+	relay := h.isRelay(subnet)
+
+	// attack the home dhcp server; remote subnets have their own dhcp server
+	attack := !relay && (h.mode == ModeSecondaryServer || (h.mode == ModeSecondaryServerNice && captured))
 
-	lease := h.findOrCreate(clientID, p.CHAddr(), nameEntry.Name)
+	lease := h.findOrCreate(subnet, clientID, p.CHAddr(), nameEntry.Name)
 
 	// Main switch
 	switch operation {
@@ -132,27 +133,31 @@ func (h *Handler) handleRequest(host *packet.Host, p packet.DHCP4, options packe
 			if lease.State != StateDiscover {
 				lease.State = StateFree
 				lease.Addr.IP = netip.Addr{}
+				h.storeLease(lease)
 			}
 
-			if h.mode == ModeSecondaryServer || (h.mode == ModeSecondaryServerNice && captured) {
+			if attack {
 				// The client is attempting to confirm an offer with another server
 				// Send a nack to client
 				Logger.Msg("request NACK - select is for another server").ByteArray("xid", p.XId()).IP("serverIP", serverIP).Uint16("secs", p.Secs()).Write()
-				return nakPacket(p, subnet.DHCPServer.AsSlice(), clientID)
+				return h.nakLease(lease, p, subnet.DHCPServer.AsSlice(), clientID)
 			}
 
 			// almost always a new host IP
-			h.session.DHCPv4Update(p.CHAddr(), reqIP, nameEntry)
+			if !relay {
+				h.session.DHCPv4Update(p.CHAddr(), reqIP, nameEntry)
+			}
 			Logger.Msg("ignore select for another server").ByteArray("xid", p.XId()).IP("serverIP", serverIP).Write()
 
 			return nil // request not for us - silently discard packet
 		}
 
 		if !bytes.Equal(lease.Addr.MAC, p.CHAddr()) || // invalid hardware
+			lease.State == StateFree || // no offer for this client
 			(lease.State == StateDiscover && (!bytes.Equal(lease.XID, p.XId()) || lease.IPOffer != reqIP)) || // invalid discover request
 			(lease.State == StateAllocated && lease.Addr.IP != reqIP) { // invalid request - iphone send duplicate select packets - let it pass
 			Logger.Msg("request NACK - select invalid parameters").ByteArray("xid", p.XId()).ByteArray("lxid", lease.XID).IP("leaseIP", lease.Addr.IP).Write()
-			return nakPacket(p, subnet.DHCPServer.AsSlice(), clientID)
+			return h.nakLease(lease, p, subnet.DHCPServer.AsSlice(), clientID)
 		}
 		if Logger.IsInfo() {
 			Logger.Msg("request ACK - select").ByteArray("xid", p.XId()).ByteArray("clientid", clientID).IP("ip", reqIP).String("subnet", lease.subnet.ID).Write()
@@ -165,7 +170,7 @@ func (h *Handler) handleRequest(host *packet.Host, p packet.DHCP4, options packe
 			lease.Addr.IP != reqIP || !bytes.Equal(lease.Addr.MAC, p.CHAddr()) ||
 			lease.DHCPExpiry.Before(time.Now()) {
 			Logger.Msg("request NACK - renew invalid or expired lease").ByteArray("xid", p.XId()).IP("gw", subnet.DefaultGW).Write()
-			return nakPacket(p, subnet.DHCPServer.AsSlice(), clientID)
+			return h.nakLease(lease, p, subnet.DHCPServer.AsSlice(), clientID)
 		}
 		if Logger.IsInfo() {
 			Logger.Msg("request ACK - renewing").ByteArray("xid", p.XId()).IP("ip", reqIP).Write()
@@ -178,12 +183,14 @@ func (h *Handler) handleRequest(host *packet.Host, p packet.DHCP4, options packe
 		//  - client does not send discover packet
 
 		// Update session with DHCP details - almost always a new host IP will be setup
-		h.session.DHCPv4Update(p.CHAddr(), reqIP, nameEntry)
+		if !relay {
+			h.session.DHCPv4Update(p.CHAddr(), reqIP, nameEntry)
+		}
 
 		if lease.State == StateFree {
 			Logger.Msg("client lease does not exist").ByteArray("xid", p.XId()).IP("ip", reqIP).Write()
 
-			if h.mode == ModeSecondaryServer || (h.mode == ModeSecondaryServerNice && captured) {
+			if attack {
 				// Attempt to force other dhcp server to release the IP
 				// Send a DECLINE packet to home router in case server responded with ACK
 				// Do not use RELEASE as the server can still reuse the parameters and does not issue a NAK later
@@ -192,7 +199,7 @@ func (h *Handler) handleRequest(host *packet.Host, p packet.DHCP4, options packe
 				// always NACK so next attempt may trigger discover
 				// also, it must return nack if moving form net2 to net1
 				// in the iPhone case, this causes the iPhone to retry discover
-				return nakPacket(p, h.net1.DefaultGW.AsSlice(), clientID)
+				return h.nakLease(lease, p, h.net1.DefaultGW.AsSlice(), clientID)
 			}
 		}
 
@@ -201,7 +208,7 @@ func (h *Handler) handleRequest(host *packet.Host, p packet.DHCP4, options packe
 			!subnet.LAN.Contains(lease.Addr.IP) {
 			Logger.Msg("request NACK - rebooting").ByteArray("xid", p.XId()).IP("ip", reqIP).Write()
 
-			if h.mode == ModeSecondaryServer || (h.mode == ModeSecondaryServerNice && captured) {
+			if attack {
 				// Attempt to force other dhcp server to release the IP
 				// Send a DECLINE packet to home router in case server responded with ACK
 				// Do not use RELEASE as the server can still reuse the parameters and does not issue a NAK later
@@ -210,7 +217,7 @@ func (h *Handler) handleRequest(host *packet.Host, p packet.DHCP4, options packe
 
 			// We have the lease but the IP or MAC don't match
 			// Send NACK
-			return nakPacket(p, subnet.DHCPServer.AsSlice(), clientID)
+			return h.nakLease(lease, p, subnet.DHCPServer.AsSlice(), clientID)
 		}
 
 		if Logger.IsInfo() {
@@ -227,6 +234,10 @@ func (h *Handler) handleRequest(host *packet.Host, p packet.DHCP4, options packe
 	}
 
 	// successful request
+	event := LeaseCommit
+	if lease.State == StateAllocated {
+		event = LeaseRenew
+	}
 	lease.Name = nameEntry.Name
 	if lease.State == StateDiscover {
 		lease.Addr.IP = lease.IPOffer
@@ -241,7 +252,7 @@ func (h *Handler) handleRequest(host *packet.Host, p packet.DHCP4, options packe
 	}
 
 	// Ack Options - same as offer options
-	opts := lease.subnet.CopyOptions()
+	opts := h.replyOptions(lease.subnet, lease.Addr.MAC, options)
 	opts[packet.DHCP4OptionIPAddressLeaseTime] = packet.OptionsLeaseTime(lease.subnet.Duration) // rfc: must include
 	ret := packet.EncodeDHCP4(p, packet.DHCP4BootReply, packet.DHCP4ACK, nil, netip.Addr{}, lease.Addr.IP, nil, false, opts, options[packet.DHCP4OptionParameterRequestList])
 
@@ -251,14 +262,23 @@ func (h *Handler) handleRequest(host *packet.Host, p packet.DHCP4, options packe
 		l.Write()
 	}
 
-	h.saveConfig(h.filename)
+	h.storeLease(lease)
+	h.notifyLease(event, lease)
 
 	// Update session with DHCP details - almost always a new host IP will be setup
-	h.session.DHCPv4Update(lease.Addr.MAC, lease.Addr.IP, nameEntry)
+	if !relay {
+		h.session.DHCPv4Update(lease.Addr.MAC, lease.Addr.IP, nameEntry)
+	}
 
 	return ret
 }
 
+// nakLease notifies a NAK event for the lease and returns a NACK reply packet.
+func (h *Handler) nakLease(lease *Lease, req packet.DHCP4, serverID, clientID []byte) packet.DHCP4 {
+	h.notifyLease(LeaseNAK, lease)
+	return nakPacket(req, serverID, clientID)
+}
+
 // nakPacket returns a NACK reply packet.
 // It reuses the buffer updating fields as required returning the same slice with updated len.
 func nakPacket(req packet.DHCP4, serverID, clientID []byte) packet.DHCP4 {
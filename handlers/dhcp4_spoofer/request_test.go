@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
-	"os"
 	"testing"
 	"time"
 
@@ -16,8 +15,8 @@ import (
 func Test_requestSimple(t *testing.T) {
 	packet.Logger.SetLevel(fastlog.LevelDebug)
 	Logger.SetLevel(fastlog.LevelError)
-	os.Remove(testDHCPFilename)
-	tc := setupTestHandler()
+	filename := t.TempDir() + "/dhcpleases.yaml"
+	tc := setupTestHandlerStore(NewFileStore(filename))
 	defer tc.Close()
 
 	tests := []struct {
@@ -57,12 +56,25 @@ func Test_requestSimple(t *testing.T) {
 			}
 		})
 	}
+
+	// leases are in the lease file
+	table, err := NewFileStore(filename).Load()
+	if err != nil {
+		t.Fatal("cannot load lease file", err)
+	}
+	if len(table.Leases) != 2 || table.Net1 == nil || table.Net2 == nil {
+		t.Fatalf("invalid lease file %+v", table)
+	}
+	for _, l := range table.Leases {
+		if l.State != StateAllocated || (!bytes.Equal(l.Addr.MAC, mac1) && !bytes.Equal(l.Addr.MAC, mac2)) || !l.Addr.IP.IsValid() {
+			t.Errorf("invalid lease in file %s", l)
+		}
+	}
 }
 
 func Test_requestCaptured(t *testing.T) {
 	packet.Logger.SetLevel(fastlog.LevelDebug)
 	Logger.SetLevel(fastlog.LevelError)
-	os.Remove(testDHCPFilename)
 	tc := setupTestHandler()
 	defer tc.Close()
 
@@ -140,7 +152,6 @@ func Test_requestExhaust(t *testing.T) {
 
 	packet.Logger.SetLevel(fastlog.LevelError)
 	Logger.SetLevel(fastlog.LevelError)
-	os.Remove(testDHCPFilename)
 	tc := setupTestHandler()
 	defer tc.Close()
 
@@ -171,7 +182,6 @@ func Test_requestExhaust(t *testing.T) {
 
 func Test_requestAnotherHost(t *testing.T) {
 	Logger.SetLevel(fastlog.LevelError)
-	os.Remove(testDHCPFilename)
 	tc := setupTestHandler()
 	defer tc.Close()
 
@@ -247,6 +257,33 @@ func Test_requestAnotherHost(t *testing.T) {
 	checkLeaseTable(t, tc, 0, 1, 0)
 }
 
+func Test_requestAnotherServerStore(t *testing.T) {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := setupTestHandler()
+	defer tc.Close()
+
+	mac := net.HardwareAddr{0x00, 0xff, 0xaa, 0xbb, 0x05, 0x06}
+	xid := newDHCPHost(t, tc, mac, "host")
+	if table, _ := tc.h.store.Load(); len(table.Leases) != 1 {
+		t.Fatalf("lease not stored %+v", table.Leases)
+	}
+
+	// client selects the home router; the lease is freed and removed from the store
+	srcAddr := packet.Addr{MAC: mac, IP: packet.IPv4zero, Port: packet.DHCP4ClientPort}
+	dstAddr := packet.Addr{MAC: packet.EthernetBroadcast, IP: packet.IPv4zero, Port: packet.DHCP4ServerPort}
+	frame, err := tc.session.Parse(newDHCP4RequestFrame(srcAddr, dstAddr, "host", routerIP4, ip3, xid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tc.h.ProcessPacket(frame); err != nil {
+		t.Fatal(err)
+	}
+	checkLeaseTable(t, tc, 0, 0, 1)
+	if table, _ := tc.h.store.Load(); len(table.Leases) != 0 {
+		t.Errorf("free lease not deleted from store %+v", table.Leases)
+	}
+}
+
 func exhaustAllIPs(t *testing.T, tc *testContext, mac net.HardwareAddr) {
 	// will skip x.0, hostIP, routerIP and x.255
 	for i := 0; i < 252; i++ {
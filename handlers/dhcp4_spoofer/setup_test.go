@@ -71,6 +71,9 @@ func readResponse(tc *testContext) error {
 			s := fmt.Sprintf("error ether client packet %s", ether)
 			panic(s)
 		}
+		if ether.EtherType() != syscall.ETH_P_IP { // arp probes
+			continue
+		}
 
 		dhcp4Frame := packet.DHCP4(packet.UDP(packet.IP4(packet.Ether(buf).Payload()).Payload()).Payload())
 		options := dhcp4Frame.ParseOptions()
@@ -110,6 +113,10 @@ func readResponse(tc *testContext) error {
 }
 
 func setupTestHandler() *testContext {
+	return setupTestHandlerStore(NewMemoryStore())
+}
+
+func setupTestHandlerStore(store LeaseStore) *testContext {
 
 	var err error
 
@@ -137,9 +144,9 @@ func setupTestHandler() *testContext {
 	}
 
 	config := Config{
-		NetfilterIP:   netip.PrefixFrom(hostIP4, 25),
-		DNSServer:     dnsIP4,
-		LeaseFilename: testDHCPFilename,
+		NetfilterIP: netip.PrefixFrom(hostIP4, 25),
+		DNSServer:   dnsIP4,
+		LeaseStore:  store,
 	}
 	tc.h, err = config.New(tc.session)
 	// tc.h, err = Config{ClientConn: tc.clientInConn}.New(tc.session, net.IPNet{IP: hostIP4, Mask: net.IPv4Mask(255, 255, 255, 128)}, dnsIP4, testDHCPFilename)
@@ -264,6 +271,25 @@ func newDHCP4DeclineFrame(src packet.Addr, dst packet.Addr, declineIP netip.Addr
 	return ether
 }
 
+func newDHCP4ReleaseFrame(src packet.Addr, dst packet.Addr, serverIP netip.Addr, xid []byte) packet.Ether {
+	options := packet.DHCP4Options{}
+	options[packet.DHCP4OptionParameterRequestList] = []byte{byte(packet.DHCP4OptionServerIdentifier)}
+	options[packet.DHCP4OptionServerIdentifier] = serverIP.AsSlice()
+
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, src.MAC, dst.MAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 50, src.IP, dst.IP)
+	udp := packet.EncodeUDP(ip4.Payload(), src.Port, dst.Port)
+	dhcp := packet.EncodeDHCP4(udp.Payload(), packet.DHCP4BootRequest, packet.DHCP4Release, src.MAC, src.IP, packet.IPv4zero, xid, false, options, options[packet.DHCP4OptionParameterRequestList])
+	udp = udp.SetPayload(dhcp)
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	var err error
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		panic(err)
+	}
+	return ether
+}
+
 func newDHCP4DiscoverFrame(src packet.Addr, name string, xid []byte) packet.Ether {
 	if xid == nil {
 		xid = make([]byte, 4)
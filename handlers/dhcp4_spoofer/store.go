@@ -0,0 +1,419 @@
+package dhcp4_spoofer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/irai/packet"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// LeaseTable holds the persistent state of the dhcp handler: the two subnet
+// configurations, the allocated leases, the declined addresses and the address reservations.
+type LeaseTable struct {
+	Net1         *SubnetConfig
+	Net2         *SubnetConfig
+	Leases       []Lease
+	Reservations []Reservation `yaml:",omitempty"`
+}
+
+// LeaseStore is the persistence interface for the lease table.
+//
+// Save writes a full snapshot of the table. Update and Delete record a single
+// lease change and may be journaled by the implementation.
+// Load returns the table with all changes applied; it returns an error wrapping
+// os.ErrNotExist if nothing was ever saved.
+type LeaseStore interface {
+	Load() (LeaseTable, error)
+	Save(table LeaseTable) error
+	Update(lease Lease) error
+	Delete(clientID []byte) error
+	Close() error
+}
+
+var (
+	_ LeaseStore = &MemoryStore{}
+	_ LeaseStore = &FileStore{}
+)
+
+// MemoryStore is a LeaseStore that keeps the table in memory only.
+// It is useful for tests and for running without persistent storage.
+type MemoryStore struct {
+	mutex        sync.Mutex
+	exist        bool
+	net1         *SubnetConfig
+	net2         *SubnetConfig
+	leases       map[string]Lease
+	reservations []Reservation
+}
+
+// NewMemoryStore returns an empty in memory lease store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{leases: make(map[string]Lease)}
+}
+
+// Load returns a copy of the stored table.
+func (s *MemoryStore) Load() (LeaseTable, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.exist {
+		return LeaseTable{}, fmt.Errorf("memory store empty: %w", os.ErrNotExist)
+	}
+	return s.table(), nil
+}
+
+// Save replaces the stored table.
+func (s *MemoryStore) Save(table LeaseTable) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setTable(table)
+	return nil
+}
+
+// Update adds or replaces the lease.
+func (s *MemoryStore) Update(lease Lease) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.update(lease)
+	return nil
+}
+
+// Delete removes the lease for clientID.
+func (s *MemoryStore) Delete(clientID []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.delete(clientID)
+	return nil
+}
+
+// Close is a no op for the memory store.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) table() LeaseTable {
+	table := LeaseTable{}
+	if s.net1 != nil {
+		n := *s.net1
+		table.Net1 = &n
+	}
+	if s.net2 != nil {
+		n := *s.net2
+		table.Net2 = &n
+	}
+	for _, v := range s.leases {
+		table.Leases = append(table.Leases, copyLease(v))
+	}
+	table.Reservations = copyReservations(s.reservations)
+	// sorted by IP and client id to generate stable files
+	sort.Slice(table.Leases, func(i, j int) bool {
+		if table.Leases[i].Addr.IP == table.Leases[j].Addr.IP {
+			return bytes.Compare(table.Leases[i].ClientID, table.Leases[j].ClientID) < 0
+		}
+		return table.Leases[i].Addr.IP.Less(table.Leases[j].Addr.IP)
+	})
+	return table
+}
+
+func (s *MemoryStore) setTable(table LeaseTable) {
+	s.exist = true
+	s.net1, s.net2 = nil, nil
+	if table.Net1 != nil {
+		n := *table.Net1
+		s.net1 = &n
+	}
+	if table.Net2 != nil {
+		n := *table.Net2
+		s.net2 = &n
+	}
+	s.leases = make(map[string]Lease, len(table.Leases))
+	for _, v := range table.Leases {
+		s.update(v)
+	}
+	s.reservations = copyReservations(table.Reservations)
+}
+
+func (s *MemoryStore) update(lease Lease) {
+	s.exist = true
+	s.leases[string(lease.ClientID)] = copyLease(lease)
+}
+
+func (s *MemoryStore) delete(clientID []byte) bool {
+	if _, ok := s.leases[string(clientID)]; !ok {
+		return false
+	}
+	delete(s.leases, string(clientID))
+	return true
+}
+
+// copyLease returns a deep copy of lease without the reference to the handler subnet.
+func copyLease(lease Lease) Lease {
+	lease.ClientID = packet.CopyBytes(lease.ClientID)
+	lease.Addr.MAC = packet.CopyMAC(lease.Addr.MAC)
+	lease.XID = packet.CopyBytes(lease.XID)
+	lease.subnet = nil
+	return lease
+}
+
+// journalCompactSize is the number of journal entries that trigger a new snapshot.
+const journalCompactSize = 128
+
+// journal operations
+const (
+	journalUpdate = "update"
+	journalDelete = "delete"
+)
+
+// journalEntry is a single line in the journal file.
+type journalEntry struct {
+	Op       string
+	ClientID []byte `json:",omitempty"`
+	Lease    *Lease `json:",omitempty"`
+}
+
+// FileStore is a crash safe LeaseStore backed by a yaml file.
+//
+// Snapshots are written to a temporary file that is renamed over the lease file
+// so the file is never left half written. Single lease changes are appended
+// to a journal file (filename + ".journal") which is replayed on Load and
+// discarded on the next snapshot. A partially written journal line, say on power
+// failure, is ignored on replay.
+type FileStore struct {
+	mem      MemoryStore
+	filename string
+	journal  *os.File
+	entries  int // number of journal entries since last snapshot
+	mutex    sync.Mutex
+}
+
+// NewFileStore returns a file backed lease store. The file is not accessed until Load or Save.
+func NewFileStore(filename string) *FileStore {
+	return &FileStore{filename: filename, mem: MemoryStore{leases: make(map[string]Lease)}}
+}
+
+func (s *FileStore) journalName() string {
+	return s.filename + ".journal"
+}
+
+// Load reads the last snapshot and replays the journal.
+func (s *FileStore) Load() (LeaseTable, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.mem.exist = false
+	s.mem.net1, s.mem.net2 = nil, nil
+	s.mem.leases = make(map[string]Lease)
+	s.mem.reservations = nil
+
+	source, err := os.ReadFile(s.filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return LeaseTable{}, err
+	}
+	if err == nil {
+		table := LeaseTable{}
+		if err := yaml.Unmarshal(source, &table); err != nil {
+			return LeaseTable{}, fmt.Errorf("invalid lease file %s: %w", s.filename, err)
+		}
+		s.mem.setTable(table)
+	}
+
+	torn, err := s.replay()
+	if err != nil {
+		return LeaseTable{}, err
+	}
+	if !s.mem.exist {
+		return LeaseTable{}, fmt.Errorf("lease file %s: %w", s.filename, os.ErrNotExist)
+	}
+	// compact now so new entries are not appended after an invalid line
+	if torn {
+		if err := s.snapshot(); err != nil {
+			return LeaseTable{}, err
+		}
+	}
+	return s.mem.table(), nil
+}
+
+// replay applies the journal entries to the in memory table. It returns true if
+// the journal contains an invalid entry.
+func (s *FileStore) replay() (torn bool, err error) {
+	f, err := os.Open(s.journalName())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	s.entries = 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), 64*1024)
+	for scanner.Scan() {
+		entry := journalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// torn write at the end of the journal; the remaining entries are lost
+			Logger.Msg("invalid journal entry - ignoring remaining entries").String("filename", s.journalName()).Error(err).Write()
+			torn = true
+			break
+		}
+		switch {
+		case entry.Op == journalUpdate && entry.Lease != nil:
+			s.mem.update(*entry.Lease)
+		case entry.Op == journalDelete:
+			s.mem.delete(entry.ClientID)
+		}
+		s.entries++
+	}
+	return torn, scanner.Err()
+}
+
+// Save writes a new snapshot and discards the journal.
+func (s *FileStore) Save(table LeaseTable) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.mem.setTable(table)
+	return s.snapshot()
+}
+
+// Update appends the lease to the journal.
+func (s *FileStore) Update(lease Lease) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.mem.update(lease)
+	l := copyLease(lease)
+	return s.append(journalEntry{Op: journalUpdate, Lease: &l})
+}
+
+// Delete appends a lease removal to the journal.
+func (s *FileStore) Delete(clientID []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.mem.delete(clientID) {
+		return nil
+	}
+	return s.append(journalEntry{Op: journalDelete, ClientID: clientID})
+}
+
+// Close closes the journal file.
+func (s *FileStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.journal == nil {
+		return nil
+	}
+	err := s.journal.Close()
+	s.journal = nil
+	return err
+}
+
+func (s *FileStore) append(entry journalEntry) error {
+	if s.entries >= journalCompactSize {
+		return s.snapshot()
+	}
+	if s.journal == nil {
+		f, err := os.OpenFile(s.journalName(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.journal = f
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := s.journal.Write(b); err != nil {
+		return err
+	}
+	s.entries++
+	return s.journal.Sync()
+}
+
+// snapshot atomically replaces the lease file with the current table and
+// removes the journal.
+func (s *FileStore) snapshot() error {
+	stream, err := yaml.Marshal(s.mem.table())
+	if err != nil {
+		return fmt.Errorf("cannot marshal lease file %s: %w", s.filename, err)
+	}
+	if err := writeFileAtomic(s.filename, stream); err != nil {
+		return fmt.Errorf("cannot write lease file %s: %w", s.filename, err)
+	}
+
+	// The snapshot contains all journal entries; a crash before the journal
+	// is removed will replay the same entries which is harmless.
+	if s.journal != nil {
+		s.journal.Close()
+		s.journal = nil
+	}
+	if err := os.Remove(s.journalName()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.entries = 0
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and
+// renames it to filename so readers see either the old or the new content.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// sync the directory to persist the rename
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// storeLease records a lease change in the lease store. Only allocated leases and declined
+// addresses are persisted.
+func (h *Handler) storeLease(lease *Lease) {
+	var err error
+	if lease.State == StateAllocated || lease.State == StateDeclined {
+		err = h.store.Update(*lease)
+	} else {
+		err = h.store.Delete(lease.ClientID)
+	}
+	if err != nil {
+		Logger.Msg("failed to store lease").ByteArray("clientid", lease.ClientID).Error(err).Write()
+	}
+}
+
+// saveConfig writes a full snapshot of the handler state to the lease store.
+func (h *Handler) saveConfig() error {
+	if err := h.store.Save(h.leaseTable()); err != nil {
+		Logger.Msg("failed to save lease table").Error(err).Write()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package dhcp4_spoofer
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+func testLease(mac []byte, ip netip.Addr, name string) Lease {
+	return Lease{ClientID: mac, State: StateAllocated, Addr: packet.Addr{MAC: mac, IP: ip}, Name: name, DHCPExpiry: time.Now().Add(time.Hour).Round(time.Second)}
+}
+
+var (
+	storeMAC1 = net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x06, 0x01}
+	storeMAC2 = net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x06, 0x02}
+	storeMAC3 = net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x06, 0x03}
+	storeMAC4 = net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x06, 0x04}
+	storeMAC5 = net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x06, 0x05}
+)
+
+func testLeaseTable() LeaseTable {
+	net1 := SubnetConfig{LAN: homeLAN, DefaultGW: routerIP4, DHCPServer: hostIP4, DNSServer: dnsIP4, FirstIP: ip1, Duration: time.Hour * 4, Stage: packet.StageNormal}
+	net2 := SubnetConfig{LAN: netip.PrefixFrom(hostIP4, 25).Masked(), DefaultGW: hostIP4, DHCPServer: hostIP4, DNSServer: packet.DNSv4CloudFlareFamily1,
+		FirstIP: hostIP4, Duration: time.Hour * 4, Stage: packet.StageRedirected}
+	return LeaseTable{Net1: &net1, Net2: &net2, Leases: []Lease{testLease(storeMAC1, ip1, "mac1"), testLease(storeMAC2, ip2, "mac2")}}
+}
+
+func TestFileStore_Journal(t *testing.T) {
+	filename := t.TempDir() + "/dhcpconfig.yaml"
+
+	store := NewFileStore(filename)
+	if _, err := store.Load(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected not exist error", err)
+	}
+	if err := store.Save(testLeaseTable()); err != nil {
+		t.Fatal("cannot save", err)
+	}
+	if err := store.Update(testLease(storeMAC3, ip3, "mac3")); err != nil {
+		t.Fatal("cannot update", err)
+	}
+	if err := store.Delete(storeMAC1); err != nil {
+		t.Fatal("cannot delete", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal("cannot close", err)
+	}
+
+	// simulate a crash: the snapshot does not contain the journal changes
+	if _, err := os.Stat(filename + ".journal"); err != nil {
+		t.Fatal("missing journal", err)
+	}
+
+	store = NewFileStore(filename)
+	table, err := store.Load()
+	if err != nil {
+		t.Fatal("cannot load", err)
+	}
+	if table.Net1 == nil || table.Net1.LAN != homeLAN || table.Net2 == nil || table.Net2.DefaultGW != hostIP4 {
+		t.Errorf("invalid subnets net1=%+v net2=%+v", table.Net1, table.Net2)
+	}
+	if n := len(table.Leases); n != 2 {
+		t.Fatalf("invalid leases want=%d got=%d", 2, n)
+	}
+	if !bytes.Equal(table.Leases[0].ClientID, storeMAC2) || table.Leases[1].Addr.IP != ip3 || table.Leases[1].Name != "mac3" {
+		t.Errorf("invalid leases %+v", table.Leases)
+	}
+
+	// a snapshot discards the journal
+	if err := store.Save(table); err != nil {
+		t.Fatal("cannot save", err)
+	}
+	if _, err := os.Stat(filename + ".journal"); !errors.Is(err, os.ErrNotExist) {
+		t.Error("journal not removed", err)
+	}
+}
+
+func TestFileStore_TornJournal(t *testing.T) {
+	filename := t.TempDir() + "/dhcpconfig.yaml"
+
+	store := NewFileStore(filename)
+	if err := store.Save(testLeaseTable()); err != nil {
+		t.Fatal("cannot save", err)
+	}
+	if err := store.Update(testLease(storeMAC3, ip3, "mac3")); err != nil {
+		t.Fatal("cannot update", err)
+	}
+	store.Close()
+
+	// partial write of the last entry
+	f, err := os.OpenFile(filename+".journal", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"Op":"update","Lease":{"ClientID":"AAIDBAUE`))
+	f.Close()
+
+	store = NewFileStore(filename)
+	table, err := store.Load()
+	if err != nil {
+		t.Fatal("cannot load", err)
+	}
+	if n := len(table.Leases); n != 3 {
+		t.Fatalf("invalid leases want=%d got=%d", 3, n)
+	}
+
+	// new entries are readable after the torn entry
+	if err := store.Update(testLease(storeMAC4, ip4, "mac4")); err != nil {
+		t.Fatal("cannot update", err)
+	}
+	store.Close()
+	table, err = NewFileStore(filename).Load()
+	if err != nil {
+		t.Fatal("cannot load", err)
+	}
+	if n := len(table.Leases); n != 4 {
+		t.Fatalf("invalid leases want=%d got=%d", 4, n)
+	}
+}
+
+func TestHandler_MigrateLeases(t *testing.T) {
+	tc := setupTestHandler()
+	defer tc.Close()
+
+	// previous config with a different dns server and first ip
+	table := testLeaseTable()
+	table.Net1.DNSServer = netip.MustParseAddr("1.1.1.1")
+	table.Net1.FirstIP = netip.MustParseAddr("192.168.0.100")
+	table.Leases = append(table.Leases,
+		testLease(storeMAC3, routerIP4, "router"),                        // reserved address
+		testLease(storeMAC4, netip.MustParseAddr("192.168.1.10"), "out"), // not in lan
+		testLease(storeMAC5, ip1, "duplicated"),                          // duplicated ip
+	)
+	store := NewMemoryStore()
+	store.Save(table)
+
+	config := Config{NetfilterIP: netip.PrefixFrom(hostIP4, 25), DNSServer: dnsIP4, LeaseStore: store}
+	h, err := config.New(tc.session)
+	if err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer h.Close()
+
+	if h.net1.DNSServer != dnsIP4 || h.net1.FirstIP != ip1 {
+		t.Errorf("config not changed net1=%+v", h.net1.SubnetConfig)
+	}
+	if n := len(h.table); n != 2 {
+		t.Fatalf("invalid migrated leases want=%d got=%d", 2, n)
+	}
+	if l := h.findByIP(ip1); l == nil || l.Name != "mac1" || l.subnet != h.net1 {
+		t.Errorf("invalid lease ip1 %+v", l)
+	}
+	if l := h.findByIP(ip2); l == nil || l.Name != "mac2" {
+		t.Errorf("invalid lease ip2 %+v", l)
+	}
+
+	// new config and migrated leases are saved
+	if table, err = store.Load(); err != nil {
+		t.Fatal("cannot load", err)
+	}
+	if table.Net1.DNSServer != dnsIP4 || len(table.Leases) != 2 {
+		t.Errorf("invalid saved table %+v", table)
+	}
+}
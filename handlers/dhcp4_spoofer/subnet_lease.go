@@ -2,10 +2,8 @@ package dhcp4_spoofer
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/netip"
-	"os"
 	"time"
 
 	"github.com/irai/packet"
@@ -141,131 +139,136 @@ func (h *dhcpSubnet) appendRouteOptions(ip netip.Addr, mask net.IPMask, routeTo
 	h.options[packet.DHCP4OptionClasslessRouteFormat] = buf
 }
 
-func (handler *Handler) loadConfig(fname string) (net1 *dhcpSubnet, net2 *dhcpSubnet, t map[string]*Lease, err error) {
-	if fname == "" {
-		return
-	}
-	source, err := ioutil.ReadFile(fname)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-	return handler.loadByteArray(source)
-}
-
+// loadByteArray decodes a yaml lease table and validates its content.
 func (handler *Handler) loadByteArray(source []byte) (net1 *dhcpSubnet, net2 *dhcpSubnet, t map[string]*Lease, err error) {
-	table := struct {
-		Net1   *SubnetConfig
-		Net2   *SubnetConfig
-		Leases []Lease
-	}{}
+	table := LeaseTable{}
 
 	// err = yaml.UnmarshalStrict(source, &table)
 	err = yaml.Unmarshal(source, &table)
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	return handler.loadTable(table)
+}
+
+// reserved returns true if ip cannot be allocated to a client.
+// Remote gateways are not in the session host table so must be excluded explicitly.
+func (subnet *dhcpSubnet) reserved(ip netip.Addr) bool {
+	return ip == subnet.DefaultGW || ip == subnet.DHCPServer || ip == subnet.broadcast || ip == subnet.LAN.Addr()
+}
+
+// loadTable validates the subnet configuration and the leases in table.
+func (handler *Handler) loadTable(table LeaseTable) (net1 *dhcpSubnet, net2 *dhcpSubnet, t map[string]*Lease, err error) {
+	if table.Net1 == nil || table.Net2 == nil {
+		return nil, nil, nil, fmt.Errorf("missing subnet config: %w", packet.ErrInvalidParam)
+	}
 
 	// Validate net1 configuration to ensure IPs are good
-	if table.Net1 != nil {
-		net1, err = newSubnet(SubnetConfig{
-			LAN:        table.Net1.LAN,
-			DefaultGW:  table.Net1.DefaultGW,
-			DHCPServer: table.Net1.DHCPServer,
-			DNSServer:  table.Net1.DNSServer,
-			Duration:   table.Net1.Duration,
-			Stage:      table.Net1.Stage,
-			FirstIP:    table.Net1.FirstIP,
-		})
-		if err != nil {
-			return nil, nil, nil, fmt.Errorf("fail to load net1 : %w", err)
-		}
+	net1, err = newSubnet(SubnetConfig{
+		LAN:        table.Net1.LAN,
+		DefaultGW:  table.Net1.DefaultGW,
+		DHCPServer: table.Net1.DHCPServer,
+		DNSServer:  table.Net1.DNSServer,
+		Duration:   table.Net1.Duration,
+		Stage:      table.Net1.Stage,
+		FirstIP:    table.Net1.FirstIP,
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("fail to load net1 : %w", err)
 	}
 
-	if table.Net2 != nil {
-		net2, err = newSubnet(SubnetConfig{
-			LAN:        table.Net2.LAN,
-			DefaultGW:  table.Net2.DefaultGW,
-			DHCPServer: table.Net2.DHCPServer,
-			DNSServer:  table.Net2.DNSServer,
-			Duration:   table.Net2.Duration,
-			Stage:      table.Net2.Stage,
-			FirstIP:    table.Net2.FirstIP,
-		})
-		if err != nil {
-			return nil, nil, nil, fmt.Errorf("fail to load net1 : %w", err)
-		}
+	net2, err = newSubnet(SubnetConfig{
+		LAN:        table.Net2.LAN,
+		DefaultGW:  table.Net2.DefaultGW,
+		DHCPServer: table.Net2.DHCPServer,
+		DNSServer:  table.Net2.DNSServer,
+		Duration:   table.Net2.Duration,
+		Stage:      table.Net2.Stage,
+		FirstIP:    table.Net2.FirstIP,
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("fail to load net2 : %w", err)
 	}
 
+	return net1, net2, handler.newLeaseTable(table.Leases, net1, net2), nil
+}
+
+// newLeaseTable returns a lease table with the leases that are still valid in net1, net2 or a relay subnet.
+// Invalid leases are discarded; this allows leases to survive a change in the subnet config
+// provided the IP is still valid in the new subnet. Declined addresses are kept until the end of
+// the conflict cool-down.
+func (handler *Handler) newLeaseTable(leases []Lease, net1 *dhcpSubnet, net2 *dhcpSubnet) map[string]*Lease {
 	tt := map[string]*Lease{}
+	ips := map[netip.Addr]bool{}
 
 	// Careful: Yaml does not set private fields in unmarshaled structured.
 	//          so the v.subnet is nil and will cause a fatal error
-	if table.Leases != nil {
-		for _, v := range table.Leases {
-			// MUST set v.subnet before printing to avoid fatal error
-			//      when printing v
-			v.subnet = net1
-
-			if v.State != StateAllocated {
-				fmt.Printf("dhcp4: load config invalid state %v \n", v)
-				continue
-			}
+	for _, v := range leases {
+		// MUST set v.subnet before printing to avoid fatal error
+		//      when printing v
+		v.subnet = net1
+
+		if v.State != StateAllocated && v.State != StateDeclined {
+			fmt.Printf("dhcp4: load config invalid state %v \n", v)
+			continue
+		}
+		if v.State == StateDeclined && v.DHCPExpiry.Before(time.Now()) { // conflict cool-down is over
+			continue
+		}
 
-			if !v.Addr.IP.IsValid() || !net1.LAN.Contains(v.Addr.IP) {
-				fmt.Printf("dhcp4: load config invalid LAN %v \n", v)
-				continue
-			}
-			if v.ClientID == nil || len(v.ClientID) == 0 {
-				fmt.Printf("dhcp4: load config invalid clientID %v \n", v)
-				continue
+		if v.Addr.IP.IsValid() && !net1.LAN.Contains(v.Addr.IP) {
+			if relay := handler.relaySubnetFor(v.Addr.IP); relay != nil {
+				v.subnet = relay
 			}
+		}
+		if !v.Addr.IP.IsValid() || !v.subnet.LAN.Contains(v.Addr.IP) {
+			fmt.Printf("dhcp4: load config invalid LAN %v \n", v)
+			continue
+		}
+		if v.ClientID == nil || len(v.ClientID) == 0 {
+			fmt.Printf("dhcp4: load config invalid clientID %v \n", v)
+			continue
+		}
 
-			// if mac is captured, validate the IP is in the net2 subnet
-			if handler.session.IsCaptured(v.Addr.MAC) {
-				if net2.LAN.Contains(v.Addr.IP) {
-					v.subnet = net2
-				}
+		// if mac is captured or moved to net2, validate the IP is in the net2 subnet
+		if handler.session.IsCaptured(v.Addr.MAC) || handler.moved[string(v.Addr.MAC)] == net2 {
+			if net2.LAN.Contains(v.Addr.IP) {
+				v.subnet = net2
 			}
-
-			// copy to final table
-			l := Lease{}
-			l = v
-			tt[string(v.ClientID)] = &l
 		}
-	}
 
-	return net1, net2, tt, nil
-}
+		// reserved addresses may have changed with the new config
+		if v.subnet.reserved(v.Addr.IP) {
+			fmt.Printf("dhcp4: load config reserved IP %v \n", v)
+			continue
+		}
 
-func (h *Handler) saveConfig(fname string) (err error) {
+		// the same IP cannot be allocated to two clients
+		if l := tt[string(v.ClientID)]; l != nil {
+			delete(ips, l.Addr.IP)
+		}
+		if ips[v.Addr.IP] {
+			fmt.Printf("dhcp4: load config duplicated IP %v \n", v)
+			continue
+		}
+		ips[v.Addr.IP] = true
 
-	if fname == "" {
-		return
+		// copy to final table
+		l := Lease{}
+		l = v
+		tt[string(v.ClientID)] = &l
 	}
 
-	table := struct {
-		Net1   *SubnetConfig
-		Net2   *SubnetConfig
-		Leases []Lease
-	}{Net1: &h.net1.SubnetConfig, Net2: &h.net2.SubnetConfig}
+	return tt
+}
 
+// leaseTable returns the handler state to save in the lease store.
+func (h *Handler) leaseTable() LeaseTable {
+	table := LeaseTable{Net1: &h.net1.SubnetConfig, Net2: &h.net2.SubnetConfig, Reservations: h.reservationList()}
 	for _, v := range h.table {
-		if v.State == StateAllocated {
+		if v.State == StateAllocated || v.State == StateDeclined {
 			table.Leases = append(table.Leases, *v)
 		}
 	}
-
-	stream, err := yaml.Marshal(&table)
-	if err != nil {
-		fmt.Printf("error cannot marshall dhcp file: %s error %s", fname, err)
-		return err
-	}
-
-	err = ioutil.WriteFile(fname, stream, os.ModePerm)
-	if err != nil {
-		fmt.Printf("error cannot write dhcp file: %s error %s", fname, err)
-		return err
-	}
-
-	return nil
+	return table
 }
@@ -7,12 +7,9 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
-	"os"
 	"testing"
 )
 
-const testDHCPFilename = "./testDHCPConfig.yml"
-
 var (
 	// test table: add subnet combinations here to test the model
 	//
@@ -25,41 +22,42 @@ func Test_Subnet_Save(t *testing.T) {
 	// Debug = true
 	filename := t.TempDir() + "/dhcpconfig.yaml"
 
-	// delete from previous test
-	os.Remove(testDHCPFilename)
-
 	tc := setupTestHandler()
 	defer tc.Close()
 
 	checkLeaseTable(t, tc, 0, 0, 0)
 
 	// lease 1
-	lease := tc.h.findOrCreate(mac1, mac1, "mac1")
+	lease := tc.h.findOrCreate(tc.h.net1, mac1, mac1, "mac1")
 	tc.h.allocIPOffer(lease, netip.Addr{})
 	lease.State = StateDiscover
 
 	// lease 2
-	lease = tc.h.findOrCreate(mac2, mac2, "mac2")
+	lease = tc.h.findOrCreate(tc.h.net1, mac2, mac2, "mac2")
 	lease.Addr.IP = ip2
 	lease.State = StateAllocated
 
 	// lease 3
-	lease = tc.h.findOrCreate(mac3, mac3, "mac3")
+	lease = tc.h.findOrCreate(tc.h.net1, mac3, mac3, "mac3")
 	tc.h.allocIPOffer(lease, netip.Addr{})
 	lease.Addr.IP = lease.IPOffer
 	// lease.IPOffer = nil
 	lease.State = StateAllocated
 
 	// lease 4
-	tc.h.findOrCreate(mac4, mac4, "mac4")
+	tc.h.findOrCreate(tc.h.net1, mac4, mac4, "mac4")
 
 	checkLeaseTable(t, tc, 2, 1, 1)
 
-	if err := tc.h.saveConfig(filename); err != nil {
+	if err := NewFileStore(filename).Save(tc.h.leaseTable()); err != nil {
 		t.Fatal("cannot save", err)
 	}
 
-	net1, net2, leases, err := tc.h.loadConfig(filename)
+	table, err := NewFileStore(filename).Load()
+	if err != nil {
+		t.Fatalf("unexpected error in lease file %v", err)
+	}
+	net1, net2, leases, err := tc.h.loadTable(table)
 	if err != nil {
 		t.Fatalf("unexpected error in lease file %v", err)
 		return
@@ -0,0 +1,159 @@
+package dns_forwarder
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+const negativeTTL = 60 // seconds to cache negative answers without a SOA record
+
+type cacheKey struct {
+	name   string
+	qType  uint16
+	qClass uint16
+	policy string // host policy mac; empty for the default policy
+	safe   bool   // answer was rewritten for safe search
+	do     bool   // dnssec ok bit; the answer includes signatures
+}
+
+type cacheEntry struct {
+	msg    []byte
+	stored time.Time
+	expire time.Time
+}
+
+// cache holds upstream answers until the minimum TTL in the answer expires.
+type cache struct {
+	table map[cacheKey]*cacheEntry
+	size  int
+}
+
+func newCache(size int) *cache {
+	return &cache{table: make(map[cacheKey]*cacheEntry, size), size: size}
+}
+
+// get returns a copy of the cached answer with the transaction id and the TTLs adjusted
+// for the time in cache. It returns nil if not found or expired.
+func (c *cache) get(key cacheKey, id uint16, now time.Time) []byte {
+	e := c.table[key]
+	if e == nil {
+		return nil
+	}
+	if !now.Before(e.expire) {
+		delete(c.table, key)
+		return nil
+	}
+	msg := packet.CopyBytes(e.msg)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	if elapsed := uint32(now.Sub(e.stored) / time.Second); elapsed > 0 {
+		walkTTL(msg, func(ttl uint32) uint32 {
+			if ttl <= elapsed {
+				return 0
+			}
+			return ttl - elapsed
+		})
+	}
+	return msg
+}
+
+// put stores a copy of the answer if it is cacheable. Only successful and NXDOMAIN answers are cached.
+func (c *cache) put(key cacheKey, msg packet.DNS, maxTTL time.Duration, now time.Time) {
+	if msg.TC() || (msg.ResponseCode() != packet.DNSRCodeSuccess && msg.ResponseCode() != packet.DNSRCodeNameError) {
+		return
+	}
+	ttl, ok := minTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+	duration := time.Duration(ttl) * time.Second
+	if duration > maxTTL {
+		duration = maxTTL
+	}
+	if _, found := c.table[key]; !found && len(c.table) >= c.size {
+		c.purge(now)
+		if len(c.table) >= c.size {
+			c.evict()
+		}
+	}
+	c.table[key] = &cacheEntry{msg: packet.CopyBytes(msg), stored: now, expire: now.Add(duration)}
+}
+
+// purge deletes expired entries.
+func (c *cache) purge(now time.Time) {
+	for k, v := range c.table {
+		if !now.Before(v.expire) {
+			delete(c.table, k)
+		}
+	}
+}
+
+// evict deletes the entry closest to expiry.
+func (c *cache) evict() {
+	var key cacheKey
+	var first *cacheEntry
+	for k, v := range c.table {
+		if first == nil || v.expire.Before(first.expire) {
+			key, first = k, v
+		}
+	}
+	if first != nil {
+		delete(c.table, key)
+	}
+}
+
+// minTTL returns the lowest TTL in the answer. Negative answers use the SOA minimum - RFC 2308.
+func minTTL(msg packet.DNS) (ttl uint32, ok bool) {
+	negative := msg.ANCount() == 0
+	found := false
+	offset, err := msg.AnswerOffset()
+	if err != nil {
+		return 0, false
+	}
+	buffer := make([]byte, 0, 256)
+	count := int(msg.ANCount()) + int(msg.NSCount())
+	for i := 0; i < count; i++ {
+		var rr packet.DNSResourceRecord
+		if rr, offset, err = packet.DecodeRR(msg, offset, buffer); err != nil {
+			return 0, false
+		}
+		t := rr.TTL
+		if negative {
+			if rr.Type != packet.DNSTypeSOA {
+				continue
+			}
+			if soa, err := rr.DecodeSOA(msg, rr.Name[len(rr.Name):]); err == nil && soa.Minimum < t {
+				t = soa.Minimum
+			}
+		}
+		if !found || t < ttl {
+			ttl, found = t, true
+		}
+	}
+	if !found && negative {
+		return negativeTTL, true
+	}
+	return ttl, found
+}
+
+// walkTTL replaces the TTL of all records, excluding the OPT record, with the value returned by f.
+func walkTTL(msg packet.DNS, f func(uint32) uint32) {
+	offset, err := msg.AnswerOffset()
+	if err != nil {
+		return
+	}
+	buffer := make([]byte, 0, 256)
+	count := int(msg.ANCount()) + int(msg.NSCount()) + int(msg.ARCount())
+	for i := 0; i < count; i++ {
+		var rr packet.DNSResourceRecord
+		if rr, offset, err = packet.DecodeRR(msg, offset, buffer); err != nil {
+			return
+		}
+		if rr.Type == packet.DNSTypeOPT {
+			continue
+		}
+		ttlOffset := offset - len(rr.Data) - 6 // ttl(4) and rdata length(2) precede the rdata
+		binary.BigEndian.PutUint32(msg[ttlOffset:ttlOffset+4], f(rr.TTL))
+	}
+}
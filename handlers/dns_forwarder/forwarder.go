@@ -0,0 +1,390 @@
+// Package dns_forwarder implements a local dns forwarder for captured hosts.
+//
+// Captured hosts are given our host as the default gateway by the dhcp4_spoofer handler, so
+// their dns queries arrive at our mac address. The forwarder answers these queries applying
+// per host allow and deny lists and safe search rewrites, caches upstream answers for their
+// TTL and forwards the remaining queries to the upstream resolver. Queries for the local zone are
+// left to the dns_zone handler when Config.LocalZone is set.
+//
+// The forwarder replies using the original destination IP as the source address. The kernel must not
+// also forward udp port 53 traffic from captured hosts, otherwise the host will receive two answers;
+// i.e. iptables -I FORWARD -p udp --dport 53 -j DROP
+package dns_forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+const module = "dnsfwd"
+
+var Logger = fastlog.New(module)
+
+const (
+	maxUDPSize = 1500 - 20 - packet.UDPHeaderLen // largest answer in a single frame; mtu less ip4 and udp headers
+	minUDPSize = 512                             // rfc1035 maximum udp message without edns
+)
+
+// Config holds the forwarder configuration.
+type Config struct {
+	Upstream      netip.AddrPort // upstream resolver; default to the router on port 53
+	Timeout       time.Duration  // upstream timeout; default 2 seconds
+	CacheSize     int            // maximum number of cached answers; default 1024; negative to disable
+	MaxTTL        time.Duration  // maximum time to cache an answer; default 1 hour
+	MaxQueries    int            // maximum number of concurrent upstream queries; default 64
+	DefaultPolicy Policy         // policy for hosts without a host policy
+	HostPolicies  []HostPolicy   // per host policy
+
+	// LocalZone returns true for names answered by a local zone handler, i.e. dns_zone Authoritative.
+	// Queries for these names are ignored so that they are not sent upstream.
+	LocalZone func(name string) bool
+}
+
+// Handler implements the dns forwarder.
+type Handler struct {
+	session   *packet.Session
+	upstream  netip.AddrPort
+	timeout   time.Duration
+	maxTTL    time.Duration
+	cache     *cache
+	queries   chan struct{}     // semaphore limiting concurrent upstream queries
+	policy    Policy            // default policy
+	policies  map[string]Policy // host policies by mac
+	localZone func(name string) bool
+	closed    bool
+	closeChan chan bool
+	sync.Mutex
+}
+
+// New returns a forwarder with the default configuration.
+func New(session *packet.Session) (*Handler, error) {
+	return Config{}.New(session)
+}
+
+// New accepts a configuration structure and returns a forwarder.
+func (config Config) New(session *packet.Session) (h *Handler, err error) {
+	h = &Handler{session: session, closeChan: make(chan bool), policies: map[string]Policy{}}
+	h.upstream = config.Upstream
+	if !h.upstream.IsValid() {
+		h.upstream = netip.AddrPortFrom(session.NICInfo.RouterAddr4.IP, packet.DNSPort)
+	}
+	if !h.upstream.Addr().IsValid() || h.upstream.Port() == 0 {
+		return nil, fmt.Errorf("invalid upstream=%s: %w", h.upstream, packet.ErrInvalidIP)
+	}
+	h.timeout = config.Timeout
+	if h.timeout <= 0 {
+		h.timeout = time.Second * 2
+	}
+	h.maxTTL = config.MaxTTL
+	if h.maxTTL <= 0 {
+		h.maxTTL = time.Hour
+	}
+	if config.MaxQueries <= 0 {
+		config.MaxQueries = 64
+	}
+	h.queries = make(chan struct{}, config.MaxQueries)
+	switch {
+	case config.CacheSize == 0:
+		h.cache = newCache(1024)
+	case config.CacheSize > 0:
+		h.cache = newCache(config.CacheSize)
+	}
+	h.localZone = config.LocalZone
+	h.policy = config.DefaultPolicy.normalise()
+	for _, v := range config.HostPolicies {
+		if len(v.MAC) != 6 {
+			return nil, fmt.Errorf("host policy mac=%s: %w", v.MAC, packet.ErrInvalidMAC)
+		}
+		h.policies[string(v.MAC)] = v.Policy.normalise()
+	}
+	if Logger.IsInfo() {
+		Logger.Msg("new dns forwarder").String("upstream", h.upstream.String()).Int("hostpolicies", len(h.policies)).Write()
+	}
+	return h, nil
+}
+
+// Close the handler and terminate all internal goroutines.
+func (h *Handler) Close() error {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	close(h.closeChan)
+	return nil
+}
+
+// MinuteTicker purges expired cache entries.
+func (h *Handler) MinuteTicker(now time.Time) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.cache != nil {
+		h.cache.purge(now)
+	}
+	return nil
+}
+
+// SetPolicy sets the policy for the host mac.
+func (h *Handler) SetPolicy(mac net.HardwareAddr, policy Policy) error {
+	if len(mac) != 6 {
+		return fmt.Errorf("host policy mac=%s: %w", mac, packet.ErrInvalidMAC)
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.policies[string(mac)] = policy.normalise()
+	return nil
+}
+
+// DeletePolicy removes the host policy; the host will use the default policy.
+func (h *Handler) DeletePolicy(mac net.HardwareAddr) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.policies, string(mac))
+}
+
+// SetDefaultPolicy sets the policy for hosts without a host policy.
+func (h *Handler) SetDefaultPolicy(policy Policy) {
+	h.Lock()
+	defer h.Unlock()
+	h.policy = policy.normalise()
+}
+
+// hostPolicy returns the policy for the host and the cache key for the policy.
+func (h *Handler) hostPolicy(mac net.HardwareAddr) (Policy, string) {
+	if p, found := h.policies[string(mac)]; found {
+		return p, string(mac)
+	}
+	return h.policy, ""
+}
+
+// query holds a copy of the client query as the frame buffer is reused when ProcessPacket returns.
+type query struct {
+	msg     []byte
+	name    string // lower case question name
+	qType   uint16
+	qClass  uint16
+	client  packet.Addr
+	server  packet.Addr // original destination used as source of the answer
+	maxSize int         // maximum answer size accepted by client
+	do      bool        // dnssec ok bit
+}
+
+// ProcessPacket answers udp dns queries from captured hosts. Queries for other hosts,
+// and queries not sent to our mac address, are ignored.
+func (h *Handler) ProcessPacket(frame packet.Frame) error {
+	if frame.PayloadID != packet.PayloadDNS {
+		return packet.ErrParseProtocol
+	}
+	if frame.UDP() == nil || frame.IP4() == nil || frame.DstAddr.Port != packet.DNSPort {
+		return nil // udp ipv4 queries only
+	}
+	p := packet.DNS(frame.Payload())
+	if err := p.IsValid(); err != nil {
+		return err
+	}
+	if p.QR() || p.OpCode() != 0 || p.QDCount() != 1 {
+		return nil
+	}
+	if !bytes.Equal(frame.Ether().Dst(), h.session.NICInfo.HostAddr4.MAC) || !h.session.IsCaptured(frame.SrcAddr.MAC) {
+		return nil
+	}
+
+	buffer := make([]byte, 0, 64)
+	question, _, err := packet.DecodeQuestion(p, 12, buffer)
+	if err != nil {
+		return err
+	}
+	q := query{name: strings.ToLower(string(question.Name)), qType: question.Type, qClass: question.Class, maxSize: minUDPSize}
+	if h.localZone != nil && h.localZone(q.name) {
+		return nil // answered by the local zone handler
+	}
+	q.client = packet.Addr{MAC: packet.CopyMAC(frame.SrcAddr.MAC), IP: frame.SrcAddr.IP, Port: frame.SrcAddr.Port}
+	q.server = packet.Addr{MAC: h.session.NICInfo.HostAddr4.MAC, IP: frame.DstAddr.IP, Port: frame.DstAddr.Port}
+	if opt, found, _ := packet.DecodeOPT(p); found {
+		if int(opt.UDPSize) > q.maxSize {
+			q.maxSize = int(opt.UDPSize)
+		}
+		q.do = opt.DO
+	}
+	if q.maxSize > maxUDPSize {
+		q.maxSize = maxUDPSize
+	}
+
+	h.Lock()
+	if h.closed {
+		h.Unlock()
+		return packet.ErrHandlerClosed
+	}
+	policy, policyKey := h.hostPolicy(q.client.MAC)
+	action := policy.action(q.name)
+	if action == actionBlock {
+		h.Unlock()
+		if Logger.IsInfo() {
+			Logger.Msg("blocked query").Struct(q.client).String("name", q.name).Write()
+		}
+		return h.sendReply(q, h.errorResponse(p, q, packet.DNSRCodeNameError))
+	}
+	var cached []byte
+	key := cacheKey{name: q.name, qType: q.qType, qClass: q.qClass, policy: policyKey, safe: action == actionSafeSearch, do: q.do}
+	if h.cache != nil {
+		cached = h.cache.get(key, p.TransactionID(), time.Now())
+	}
+	h.Unlock()
+
+	if cached != nil {
+		if Logger.IsDebug() {
+			Logger.Msg("cache hit").Struct(q.client).String("name", q.name).Write()
+		}
+		return h.sendReply(q, cached)
+	}
+
+	select {
+	case h.queries <- struct{}{}:
+	default: // upstream is slow or unreachable; fail fast so the client tries another server
+		if Logger.IsInfo() {
+			Logger.Msg("too many upstream queries").Struct(q.client).String("name", q.name).Write()
+		}
+		return h.sendReply(q, h.errorResponse(p, q, packet.DNSRCodeServerFailure))
+	}
+	q.msg = packet.CopyBytes(p)
+	go func() {
+		defer func() { <-h.queries }()
+		var answer packet.DNS
+		var err error
+		if action == actionSafeSearch {
+			answer, err = h.safeSearch(q, policy.safeHost(q.name))
+		} else {
+			answer, err = h.exchange(q.msg)
+		}
+		if err != nil {
+			Logger.Msg("upstream failed").String("name", q.name).Error(err).Write()
+			h.sendReply(q, h.errorResponse(q.msg, q, packet.DNSRCodeServerFailure))
+			return
+		}
+		h.Lock()
+		if h.cache != nil {
+			h.cache.put(key, answer, h.maxTTL, time.Now())
+		}
+		h.Unlock()
+		h.sendReply(q, answer)
+	}()
+	return nil
+}
+
+// errorResponse returns a response with the question and rcode only.
+func (h *Handler) errorResponse(p packet.DNS, q query, rcode int) packet.DNS {
+	var b packet.DNSBuilder
+	flags := packet.DNSFlagQR | packet.DNSFlagRA | (p.Flags() & packet.DNSFlagRD) | uint16(rcode)
+	b.Reset(make([]byte, 0, minUDPSize), p.TransactionID(), flags)
+	b.Question(q.name, q.qType, q.qClass)
+	msg, err := b.Finish()
+	if err != nil { // invalid name; answer without the question
+		b.Reset(make([]byte, 0, 12), p.TransactionID(), flags)
+		msg, _ = b.Finish()
+	}
+	return msg
+}
+
+// exchange sends the query to the upstream resolver and returns the answer.
+// The query is retried over tcp if the udp answer is truncated.
+func (h *Handler) exchange(msg []byte) (packet.DNS, error) {
+	conn, err := net.DialTimeout("udp", h.upstream.String(), h.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(h.timeout))
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		answer := packet.DNS(buf[:n])
+		if answer.IsValid() != nil || !answer.QR() || answer.TransactionID() != binary.BigEndian.Uint16(msg[0:2]) {
+			continue // spurious answer
+		}
+		if answer.TC() {
+			return h.exchangeTCP(msg)
+		}
+		return packet.DNS(packet.CopyBytes(answer)), nil
+	}
+}
+
+func (h *Handler) exchangeTCP(msg []byte) (packet.DNS, error) {
+	conn, err := net.DialTimeout("tcp", h.upstream.String(), h.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(h.timeout))
+	b, err := packet.EncodeDNSTCP(make([]byte, 0, len(msg)+2), msg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, 0xffff+2)
+	for {
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:len(buf)+n]
+		if answer, _, err := packet.DecodeDNSTCP(buf); err == nil {
+			return answer, nil
+		}
+	}
+}
+
+// sendReply sends the answer to the client truncating it if larger than the client maximum size.
+func (h *Handler) sendReply(q query, answer packet.DNS) error {
+	if len(answer) > q.maxSize {
+		off, err := answer.AnswerOffset()
+		if err != nil {
+			return err
+		}
+		truncated := make([]byte, off)
+		copy(truncated, answer[:off])
+		binary.BigEndian.PutUint16(truncated[2:4], answer.Flags()|packet.DNSFlagTC)
+		for i := 6; i < 12; i++ { // zero an, ns and ar count
+			truncated[i] = 0
+		}
+		answer = truncated
+	}
+
+	b := packet.EtherBufferPool.Get().(*[packet.EthMaxSize]byte)
+	defer packet.EtherBufferPool.Put(b)
+	ether := packet.Ether(b[0:])
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, q.server.MAC, q.client.MAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 50, q.server.IP, q.client.IP)
+	udp := packet.EncodeUDP(ip4.Payload(), q.server.Port, q.client.Port)
+	udp, err := udp.AppendPayload(answer)
+	if err != nil {
+		return err
+	}
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		return err
+	}
+	if _, err := h.session.Conn.WriteTo(ether, &q.client); err != nil {
+		Logger.Msg("failed to write").Error(err).Write()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,462 @@
+package dns_forwarder
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+var (
+	hostMAC    = net.HardwareAddr{0x00, 0x55, 0x55, 0x55, 0x55, 0x55}
+	hostIP4    = netip.MustParseAddr("192.168.0.129")
+	routerMAC  = net.HardwareAddr{0x00, 0x66, 0x66, 0x66, 0x66, 0x66}
+	routerIP4  = netip.MustParseAddr("192.168.0.11")
+	homeLAN    = netip.MustParsePrefix("192.168.0.0/24")
+	mac1       = net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x01}
+	mac2       = net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x02}
+	ip1        = netip.MustParseAddr("192.168.0.1")
+	ip2        = netip.MustParseAddr("192.168.0.2")
+	dnsIP4     = packet.DNSv4CloudFlareFamily1
+	answerIP   = netip.MustParseAddr("10.0.0.1")
+	safeIP     = netip.MustParseAddr("216.239.38.120")
+	bigRecords = 40
+)
+
+// resolver is a local stand-in for the upstream resolver.
+type resolver struct {
+	udp   *net.UDPConn
+	tcp   net.Listener
+	count map[string]int
+	sync.Mutex
+}
+
+func (r *resolver) queries(name string) int {
+	r.Lock()
+	defer r.Unlock()
+	return r.count[name]
+}
+
+func (r *resolver) answer(query packet.DNS, tcp bool) packet.DNS {
+	q, _, err := packet.DecodeQuestion(query, 12, nil)
+	if err != nil {
+		return nil
+	}
+	name := string(q.Name)
+	r.Lock()
+	r.count[name]++
+	r.Unlock()
+
+	var b packet.DNSBuilder
+	flags := packet.DNSFlagQR | packet.DNSFlagRD | packet.DNSFlagRA
+	hdr := packet.DNSRRHeader{Name: name, Class: packet.DNSClassINET, TTL: 60}
+	switch name {
+	case "nx.example.com":
+		b.Reset(make([]byte, 0, 512), query.TransactionID(), flags|packet.DNSRCodeNameError)
+		b.Question(name, q.Type, q.Class)
+		b.StartAuthorities()
+		b.SOA(packet.DNSRRHeader{Name: "example.com", Class: packet.DNSClassINET, TTL: 3600}, packet.DNSSOA{MName: "ns.example.com", RName: "admin.example.com", Minimum: 30})
+	case "big.example.com":
+		if !tcp {
+			b.Reset(make([]byte, 0, 512), query.TransactionID(), flags|packet.DNSFlagTC)
+			b.Question(name, q.Type, q.Class)
+			break
+		}
+		b.Reset(make([]byte, 0, 4096), query.TransactionID(), flags)
+		b.Question(name, q.Type, q.Class)
+		for i := 0; i < bigRecords; i++ {
+			b.A(hdr, netip.AddrFrom4([4]byte{10, 0, 1, byte(i)}))
+		}
+	case "forcesafesearch.google.com":
+		b.Reset(make([]byte, 0, 512), query.TransactionID(), flags)
+		b.Question(name, q.Type, q.Class)
+		b.A(hdr, safeIP)
+	default:
+		b.Reset(make([]byte, 0, 512), query.TransactionID(), flags)
+		b.Question(name, q.Type, q.Class)
+		b.A(hdr, answerIP)
+	}
+	msg, _ := b.Finish()
+	return msg
+}
+
+func newResolver(t *testing.T) *resolver {
+	r := &resolver{count: map[string]int{}}
+	var err error
+	if r.udp, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal("cannot listen udp", err)
+	}
+	if r.tcp, err = net.Listen("tcp4", r.udp.LocalAddr().String()); err != nil {
+		t.Fatal("cannot listen tcp", err)
+	}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := r.udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if msg := r.answer(buf[:n], false); msg != nil {
+				r.udp.WriteTo(msg, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := r.tcp.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 4096)
+			n, _ := conn.Read(buf)
+			if query, _, err := packet.DecodeDNSTCP(buf[:n]); err == nil {
+				msg := r.answer(query, true)
+				b, _ := packet.EncodeDNSTCP(make([]byte, 0, len(msg)+2), msg)
+				conn.Write(b)
+			}
+			conn.Close()
+		}
+	}()
+	return r
+}
+
+func (r *resolver) Close() {
+	r.udp.Close()
+	r.tcp.Close()
+}
+
+func (r *resolver) addr() netip.AddrPort {
+	return r.udp.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+type testContext struct {
+	session  *packet.Session
+	h        *Handler
+	resolver *resolver
+	inConn   net.PacketConn
+	replies  chan packet.Frame
+}
+
+func setupTest(t *testing.T, config Config) *testContext {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := &testContext{replies: make(chan packet.Frame, 16)}
+	var outConn net.PacketConn
+	tc.inConn, outConn = packet.TestNewBufferedConn()
+	nicInfo := &packet.NICInfo{RouterAddr4: packet.Addr{MAC: routerMAC, IP: routerIP4}, HostAddr4: packet.Addr{MAC: hostMAC, IP: hostIP4}, HomeLAN4: homeLAN}
+	var err error
+	if tc.session, err = (packet.Config{Conn: tc.inConn, NICInfo: nicInfo}).NewSession(""); err != nil {
+		t.Fatal("cannot create session", err)
+	}
+	tc.resolver = newResolver(t)
+	config.Upstream = tc.resolver.addr()
+	if tc.h, err = config.New(tc.session); err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	go func() {
+		buf := make([]byte, packet.EthMaxSize)
+		for {
+			n, _, _ := outConn.ReadFrom(buf)
+			if n == 0 {
+				return
+			}
+			frame, err := tc.session.Parse(packet.CopyBytes(buf[:n]))
+			if err == nil && frame.PayloadID == packet.PayloadDNS {
+				tc.replies <- frame
+			}
+		}
+	}()
+	return tc
+}
+
+func (tc *testContext) Close() {
+	tc.h.Close()
+	tc.resolver.Close()
+	tc.inConn.Close()
+}
+
+func newQueryFrame(mac net.HardwareAddr, ip netip.Addr, id uint16, name string, qType uint16, opt *packet.DNSOPT) packet.Ether {
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, 512), id, packet.DNSFlagRD)
+	b.Question(name, qType, packet.DNSClassINET)
+	if opt != nil {
+		b.OPT(*opt)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		panic(err)
+	}
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, mac, hostMAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 50, ip, dnsIP4)
+	udp := packet.EncodeUDP(ip4.Payload(), 40000, 53)
+	udp, _ = udp.AppendPayload(msg)
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		panic(err)
+	}
+	return ether
+}
+
+// query sends the query and returns the answer or nil if there is no answer.
+func (tc *testContext) query(t *testing.T, mac net.HardwareAddr, ip netip.Addr, id uint16, name string, opt *packet.DNSOPT) packet.DNS {
+	t.Helper()
+	frame, err := tc.session.Parse(newQueryFrame(mac, ip, id, name, packet.DNSTypeA, opt))
+	if err != nil {
+		t.Fatal("parse query", err)
+	}
+	if err := tc.h.ProcessPacket(frame); err != nil {
+		t.Fatal("process packet", err)
+	}
+	select {
+	case reply := <-tc.replies:
+		if reply.SrcAddr.IP != dnsIP4 || reply.SrcAddr.Port != 53 || !bytes.Equal(reply.SrcAddr.MAC, hostMAC) ||
+			reply.DstAddr.IP != ip || reply.DstAddr.Port != 40000 {
+			t.Errorf("invalid reply addresses src=%s dst=%s", reply.SrcAddr, reply.DstAddr)
+		}
+		answer := packet.DNS(reply.Payload())
+		if answer.TransactionID() != id || !answer.QR() {
+			t.Errorf("invalid answer %s", answer)
+		}
+		return answer
+	case <-time.After(time.Millisecond * 500):
+	}
+	return nil
+}
+
+func firstRR(t *testing.T, p packet.DNS) packet.DNSResourceRecord {
+	t.Helper()
+	offset, err := p.AnswerOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, _, err := packet.DecodeRR(p, offset, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestHandler_Forward(t *testing.T) {
+	tc := setupTest(t, Config{})
+	defer tc.Close()
+	tc.session.Capture(mac1)
+
+	answer := tc.query(t, mac1, ip1, 100, "www.example.com", nil)
+	if answer == nil || answer.ANCount() != 1 || firstRR(t, answer).IP() != answerIP {
+		t.Fatalf("invalid answer %s", answer)
+	}
+
+	// second query is answered from cache
+	answer = tc.query(t, mac1, ip1, 101, "WWW.example.com", nil)
+	if answer == nil || answer.ANCount() != 1 || firstRR(t, answer).IP() != answerIP {
+		t.Fatalf("invalid cached answer %s", answer)
+	}
+	if n := tc.resolver.queries("www.example.com"); n != 1 {
+		t.Errorf("expected cached answer upstream queries=%d", n)
+	}
+
+	// hosts not captured are ignored
+	if answer := tc.query(t, mac2, ip2, 102, "www.example.com", nil); answer != nil {
+		t.Errorf("unexpected answer for host not captured %s", answer)
+	}
+
+	// negative answer
+	answer = tc.query(t, mac1, ip1, 103, "nx.example.com", nil)
+	if answer == nil || answer.ResponseCode() != packet.DNSRCodeNameError || answer.NSCount() != 1 {
+		t.Fatalf("invalid nxdomain %s", answer)
+	}
+	tc.query(t, mac1, ip1, 104, "nx.example.com", nil)
+	if n := tc.resolver.queries("nx.example.com"); n != 1 {
+		t.Errorf("expected cached negative answer upstream queries=%d", n)
+	}
+
+	// answers are cached per host policy and dnssec ok bit
+	tc.session.Capture(mac2)
+	if err := tc.h.SetPolicy(mac2, Policy{}); err != nil {
+		t.Fatal(err)
+	}
+	tc.query(t, mac2, ip2, 105, "www.example.com", nil)
+	tc.query(t, mac1, ip1, 106, "www.example.com", &packet.DNSOPT{UDPSize: 1232, DO: true})
+	if n := tc.resolver.queries("www.example.com"); n != 3 {
+		t.Errorf("invalid cache key upstream queries=%d", n)
+	}
+
+	// upstream queries are limited
+	for i := 0; i < cap(tc.h.queries); i++ {
+		tc.h.queries <- struct{}{}
+	}
+	answer = tc.query(t, mac1, ip1, 107, "new.example.com", nil)
+	if answer == nil || answer.ResponseCode() != packet.DNSRCodeServerFailure {
+		t.Errorf("invalid answer with all upstream queries in use %s", answer)
+	}
+	for i := 0; i < cap(tc.h.queries); i++ {
+		<-tc.h.queries
+	}
+	if answer = tc.query(t, mac1, ip1, 108, "new.example.com", nil); answer == nil || answer.ResponseCode() != packet.DNSRCodeSuccess {
+		t.Errorf("invalid answer %s", answer)
+	}
+}
+
+func TestHandler_LocalZone(t *testing.T) {
+	tc := setupTest(t, Config{LocalZone: func(name string) bool { return name == "printer.lan" }})
+	defer tc.Close()
+	tc.session.Capture(mac1)
+
+	// local zone queries are left to the zone handler
+	if answer := tc.query(t, mac1, ip1, 150, "Printer.LAN", nil); answer != nil {
+		t.Errorf("unexpected answer for local zone %s", answer)
+	}
+	if n := tc.resolver.queries("Printer.LAN"); n != 0 {
+		t.Errorf("local zone query sent upstream queries=%d", n)
+	}
+	if answer := tc.query(t, mac1, ip1, 151, "www.example.com", nil); answer == nil || answer.ANCount() != 1 {
+		t.Errorf("invalid answer %s", answer)
+	}
+}
+
+func TestHandler_Truncated(t *testing.T) {
+	tc := setupTest(t, Config{})
+	defer tc.Close()
+	tc.session.Capture(mac1)
+
+	// large answer is retrieved over tcp and truncated for a client without edns
+	answer := tc.query(t, mac1, ip1, 200, "big.example.com", nil)
+	if answer == nil || !answer.TC() || answer.ANCount() != 0 || answer.QDCount() != 1 {
+		t.Fatalf("invalid truncated answer %s", answer)
+	}
+
+	// client with edns receives the full answer from cache
+	answer = tc.query(t, mac1, ip1, 201, "big.example.com", &packet.DNSOPT{UDPSize: 1232})
+	if answer == nil || answer.TC() || answer.ANCount() != uint16(bigRecords) {
+		t.Fatalf("invalid edns answer %s", answer)
+	}
+}
+
+func TestHandler_Policy(t *testing.T) {
+	tc := setupTest(t, Config{
+		DefaultPolicy: Policy{Deny: []string{"Blocked.com."}},
+		HostPolicies:  []HostPolicy{{MAC: mac2, Policy: Policy{DenyAll: true, Allow: []string{"example.com"}}}},
+	})
+	defer tc.Close()
+	tc.session.Capture(mac1)
+	tc.session.Capture(mac2)
+
+	tests := []struct {
+		name    string
+		mac     net.HardwareAddr
+		ip      netip.Addr
+		qname   string
+		blocked bool
+	}{
+		{name: "deny", mac: mac1, ip: ip1, qname: "blocked.com", blocked: true},
+		{name: "deny subdomain", mac: mac1, ip: ip1, qname: "ads.blocked.com", blocked: true},
+		{name: "suffix not subdomain", mac: mac1, ip: ip1, qname: "notblocked.com", blocked: false},
+		{name: "allow list", mac: mac2, ip: ip2, qname: "www.example.com", blocked: false},
+		{name: "deny all", mac: mac2, ip: ip2, qname: "www.other.org", blocked: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer := tc.query(t, tt.mac, tt.ip, uint16(300+i), tt.qname, nil)
+			if answer == nil {
+				t.Fatal("missing answer")
+			}
+			if blocked := answer.ResponseCode() == packet.DNSRCodeNameError; blocked != tt.blocked {
+				t.Errorf("invalid policy blocked=%v want=%v", blocked, tt.blocked)
+			}
+		})
+	}
+	if n := tc.resolver.queries("blocked.com") + tc.resolver.queries("www.other.org"); n != 0 {
+		t.Errorf("blocked query forwarded upstream=%d", n)
+	}
+
+	// runtime policy change
+	if err := tc.h.SetPolicy(mac1, Policy{}); err != nil {
+		t.Fatal(err)
+	}
+	if answer := tc.query(t, mac1, ip1, 310, "blocked.com", nil); answer == nil || answer.ResponseCode() != packet.DNSRCodeSuccess {
+		t.Errorf("invalid answer after set policy %s", answer)
+	}
+	tc.h.DeletePolicy(mac1)
+	if answer := tc.query(t, mac1, ip1, 311, "blocked.com", nil); answer == nil || answer.ResponseCode() != packet.DNSRCodeNameError {
+		t.Errorf("invalid answer after delete policy %s", answer)
+	}
+}
+
+func TestHandler_SafeSearch(t *testing.T) {
+	tc := setupTest(t, Config{DefaultPolicy: Policy{SafeSearch: true}})
+	defer tc.Close()
+	tc.session.Capture(mac1)
+
+	for i, name := range []string{"www.google.com", "www.google.com.au", "google.co.uk"} {
+		answer := tc.query(t, mac1, ip1, uint16(400+i), name, nil)
+		if answer == nil || answer.ANCount() != 2 {
+			t.Fatalf("invalid safe search answer %s", answer)
+		}
+		offset, _ := answer.AnswerOffset()
+		cname, offset, err := packet.DecodeRR(answer, offset, nil)
+		if err != nil || cname.Type != packet.DNSTypeCNAME || string(cname.Name) != name {
+			t.Fatalf("invalid cname %+v %v", cname, err)
+		}
+		if target, _ := cname.DecodeName(answer, nil); string(target) != "forcesafesearch.google.com" {
+			t.Errorf("invalid cname target %s", target)
+		}
+		a, _, err := packet.DecodeRR(answer, offset, nil)
+		if err != nil || a.IP() != safeIP {
+			t.Errorf("invalid safe ip %s %v", a.IP(), err)
+		}
+	}
+	if n := tc.resolver.queries("www.google.com"); n != 0 {
+		t.Errorf("original name forwarded upstream=%d", n)
+	}
+	p := Policy{SafeSearch: true}
+	for _, name := range []string{"mail.google.com", "google.com.evil.org", "google.evil.com", "www.google.evil.com", "google.co.evil"} {
+		if p.action(name) != actionForward {
+			t.Errorf("invalid safe search match %s", name)
+		}
+	}
+}
+
+func TestCache_TTL(t *testing.T) {
+	c := newCache(2)
+	now := time.Now()
+	msg := func(name string, ttl uint32) packet.DNS {
+		var b packet.DNSBuilder
+		b.Reset(make([]byte, 0, 512), 1, packet.DNSFlagQR)
+		b.Question(name, packet.DNSTypeA, packet.DNSClassINET)
+		b.A(packet.DNSRRHeader{Name: name, Class: packet.DNSClassINET, TTL: ttl}, answerIP)
+		p, _ := b.Finish()
+		return p
+	}
+	key := func(name string) cacheKey {
+		return cacheKey{name: name, qType: packet.DNSTypeA, qClass: packet.DNSClassINET}
+	}
+
+	c.put(key("a"), msg("a", 60), time.Hour, now)
+	got := packet.DNS(c.get(key("a"), 7, now.Add(time.Second*10)))
+	if got == nil || got.TransactionID() != 7 || firstRR(t, got).TTL != 50 {
+		t.Fatalf("invalid cached ttl %s", got)
+	}
+	if c.get(key("a"), 7, now.Add(time.Second*61)) != nil {
+		t.Error("expected expired entry")
+	}
+
+	// max ttl clamps the cache duration
+	c.put(key("b"), msg("b", 3600), time.Second*5, now)
+	if c.get(key("b"), 1, now.Add(time.Second*6)) != nil {
+		t.Error("expected max ttl expiry")
+	}
+
+	// eviction of the entry closest to expiry
+	c.put(key("c"), msg("c", 10), time.Hour, now)
+	c.put(key("d"), msg("d", 100), time.Hour, now)
+	c.put(key("e"), msg("e", 100), time.Hour, now)
+	if len(c.table) != 2 || c.table[key("c")] != nil {
+		t.Errorf("invalid eviction %v", c.table)
+	}
+}
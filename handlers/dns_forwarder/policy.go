@@ -0,0 +1,174 @@
+package dns_forwarder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/irai/packet"
+)
+
+// Policy sets the domains a host can resolve. Domains match the domain and all subdomains.
+//
+// A domain in Allow is always resolved; otherwise a domain in Deny, or any domain if DenyAll is set,
+// is answered with NXDOMAIN.
+type Policy struct {
+	Allow      []string // domains always allowed
+	Deny       []string // domains blocked
+	DenyAll    bool     // block all domains not in Allow
+	SafeSearch bool     // rewrite search engines and youtube to their safe search address
+}
+
+// HostPolicy sets the policy for a single host.
+type HostPolicy struct {
+	MAC    net.HardwareAddr
+	Policy Policy
+}
+
+type action int
+
+const (
+	actionForward action = iota
+	actionBlock
+	actionSafeSearch
+)
+
+// safeSearchHosts maps search engine names to the safe search host name.
+// Google country domains are matched using googleDomains.
+var safeSearchHosts = []struct {
+	names []string
+	safe  string
+}{
+	{names: []string{"www.bing.com", "bing.com"}, safe: "strict.bing.com"},
+	{names: []string{"duckduckgo.com", "www.duckduckgo.com"}, safe: "safe.duckduckgo.com"},
+	{names: []string{"www.youtube.com", "m.youtube.com", "youtubei.googleapis.com", "youtube.googleapis.com", "www.youtube-nocookie.com"}, safe: "restrict.youtube.com"},
+}
+
+const googleSafeSearch = "forcesafesearch.google.com"
+
+// googleDomains is the set of google search domains after "google."; i.e. "com.au" for google.com.au
+var googleDomains = func() map[string]bool {
+	m := map[string]bool{}
+	for _, v := range strings.Fields(`com ad ae com.af com.ag al am co.ao com.ar as at com.au az ba com.bd be bf bg com.bh bi bj
+		com.bn com.bo com.br bs bt co.bw by com.bz ca cat cd cf cg ch ci co.ck cl cm cn com.co co.cr com.cu cv com.cy cz de dj dk
+		dm com.do dz com.ec ee com.eg es com.et fi com.fj fm fr ga ge gg com.gh com.gi gl gm gr com.gt gy com.hk hn hr ht hu co.id
+		ie co.il im co.in iq is it je com.jm jo co.jp co.ke com.kh ki kg co.kr com.kw kz la com.lb li lk co.ls lt lu lv com.ly co.ma
+		md me mg mk ml com.mm mn com.mt mu mv mw com.mx com.my co.mz com.na com.ng com.ni ne nl no com.np nr nu co.nz com.om com.pa
+		com.pe com.pg com.ph com.pk pl pn com.pr ps pt com.py com.qa ro rs ru rw com.sa com.sb sc se com.sg sh si sk com.sl sn so sm
+		sr st com.sv td tg co.th com.tj tl tm tn to com.tr tt com.tw co.tz com.ua co.ug co.uk com.uy co.uz com.vc co.ve co.vi com.vn
+		vu ws co.za co.zm co.zw`) {
+		m[v] = true
+	}
+	return m
+}()
+
+func normaliseDomains(list []string) []string {
+	ret := make([]string, 0, len(list))
+	for _, v := range list {
+		if v = strings.ToLower(strings.Trim(v, ".")); v != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func (p Policy) normalise() Policy {
+	p.Allow = normaliseDomains(p.Allow)
+	p.Deny = normaliseDomains(p.Deny)
+	return p
+}
+
+// matchDomain returns true if name is a domain in list or a subdomain.
+func matchDomain(name string, list []string) bool {
+	for _, d := range list {
+		if name == d || (strings.HasSuffix(name, d) && name[len(name)-len(d)-1] == '.') {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Policy) action(name string) action {
+	name = strings.TrimSuffix(name, ".")
+	if matchDomain(name, p.Allow) {
+		return actionForward
+	}
+	if p.DenyAll || matchDomain(name, p.Deny) {
+		return actionBlock
+	}
+	if p.SafeSearch && p.safeHost(name) != "" {
+		return actionSafeSearch
+	}
+	return actionForward
+}
+
+// safeHost returns the safe search host for name or an empty string if name is not a search engine.
+func (p Policy) safeHost(name string) string {
+	for _, v := range safeSearchHosts {
+		for _, n := range v.names {
+			if name == n {
+				return v.safe
+			}
+		}
+	}
+	if host := strings.TrimPrefix(name, "www."); strings.HasPrefix(host, "google.") && googleDomains[host[len("google."):]] {
+		return googleSafeSearch
+	}
+	return ""
+}
+
+// safeSearch resolves the safe search host and returns an answer for the original question
+// with a CNAME to the safe host followed by the safe host records.
+func (h *Handler) safeSearch(q query, safeHost string) (packet.DNS, error) {
+	id := binary.BigEndian.Uint16(q.msg[0:2])
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, minUDPSize), id, packet.DNSFlagRD)
+	b.Question(safeHost, q.qType, q.qClass)
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := h.exchange(msg)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := upstream.AnswerOffset()
+	if err != nil {
+		return nil, err
+	}
+	if Logger.IsInfo() {
+		Logger.Msg("safe search rewrite").String("name", q.name).String("safe", safeHost).Write()
+	}
+
+	flags := packet.DNSFlagQR | packet.DNSFlagRD | packet.DNSFlagRA | uint16(upstream.ResponseCode())
+	b.Reset(make([]byte, 0, maxUDPSize), id, flags)
+	b.Question(q.name, q.qType, q.qClass)
+	b.StartAnswers()
+	b.CNAME(packet.DNSRRHeader{Name: q.name, Class: packet.DNSClassINET, TTL: 300}, safeHost)
+	buffer := make([]byte, 0, 256)
+	for i := 0; i < int(upstream.ANCount()); i++ {
+		var rr packet.DNSResourceRecord
+		if rr, offset, err = packet.DecodeRR(upstream, offset, buffer); err != nil {
+			return nil, err
+		}
+		hdr := packet.DNSRRHeader{Name: string(rr.Name), Class: rr.Class, TTL: rr.TTL}
+		switch rr.Type {
+		case packet.DNSTypeA:
+			b.A(hdr, rr.IP())
+		case packet.DNSTypeAAAA:
+			b.AAAA(hdr, rr.IP())
+		case packet.DNSTypeCNAME:
+			target, err := rr.DecodeName(upstream, rr.Name[len(rr.Name):])
+			if err != nil {
+				return nil, err
+			}
+			b.CNAME(hdr, string(target))
+		}
+	}
+	answer, err := b.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("safe search answer: %w", err)
+	}
+	return answer, nil
+}
@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/netip"
 	"sync"
+	"time"
 
 	"github.com/irai/packet"
 	"github.com/irai/packet/fastlog"
@@ -29,13 +30,66 @@ type DNSHandler struct {
 	mconn6    *net.UDPConn
 	ssdpconn4 *net.UDPConn
 	mdnsCache map[string]cache
+	history   map[string]*queryLog // per host query history; key is mac
+	table     tableLRU             // DNSTable eviction order and statistics
+	resolver  *Resolver            // reverse dns resolver
+
+	services       map[string]*hostServices // mdns service inventory; key is mac
+	mdnsQueried    map[string]time.Time     // last follow up query time; key is name and type
+	lastBrowse     time.Time                // last service enumeration query; zero if not browsing
+	serviceEvents  chan<- MDNSServiceEvent
+	responder      mdnsResponder               // services published by our host
+	sleepProxy     sleepProxy                  // registrations from sleeping hosts
+	upnp           map[string]*UPNPDescription // upnp description cache; key is USN
+	lastSSDPSearch time.Time                   // last M-SEARCH; zero if not searching
+	llmnr          llmnrState                  // names answered on the LAN
+	httpAgents     map[string]*httpAgent       // last http user agent; key is mac
+	wsd            map[string]*wsdDevice       // wsd metadata requests; key is endpoint address
 }
 
+// Config sets the DNSHandler options.
+type Config struct {
+	TableMaxBytes int       // approximate memory cap for DNSTable; default to DefaultTableMaxBytes
+	Resolver      *Resolver // reverse dns resolver; default to the LAN router followed by CloudFlare
+
+	// MDNSEventChan receives mdns service added, updated and removed events if set.
+	// Events are discarded if the channel is full.
+	MDNSEventChan chan<- MDNSServiceEvent
+
+	// MDNSHostName is the host name published by the mdns responder; default to the os host name.
+	MDNSHostName string
+
+	// LLMNRResponder answers LLMNR queries for the mdns host name label if set.
+	LLMNRResponder bool
+}
+
+// New returns a DNSHandler with the default configuration.
 func New(session *packet.Session) (h *DNSHandler, err error) {
+	return Config{}.New(session)
+}
+
+// New returns a DNSHandler using the configuration.
+func (config Config) New(session *packet.Session) (h *DNSHandler, err error) {
 	h = new(DNSHandler)
 	h.session = session
 	h.DNSTable = make(map[string]packet.DNSEntry, 256)
+	h.table = newTableLRU(config.TableMaxBytes)
+	if h.resolver = config.Resolver; h.resolver == nil {
+		h.resolver = ResolverConfig{Upstreams: []netip.AddrPort{
+			netip.AddrPortFrom(session.NICInfo.RouterAddr4.IP, 53),
+			netip.AddrPortFrom(packet.DNSv4CloudFlare1, 53)}}.New()
+	}
 	h.mdnsCache = make(map[string]cache)
+	h.history = make(map[string]*queryLog)
+	h.services = make(map[string]*hostServices)
+	h.mdnsQueried = make(map[string]time.Time)
+	h.serviceEvents = config.MDNSEventChan
+	h.responder = newMDNSResponder(config.MDNSHostName)
+	h.sleepProxy.hosts = make(map[string]*SleepProxyRegistration)
+	h.upnp = make(map[string]*UPNPDescription)
+	h.httpAgents = make(map[string]*httpAgent)
+	h.wsd = make(map[string]*wsdDevice)
+	h.llmnr = llmnrState{respond: config.LLMNRResponder, owners: make(map[string]*llmnrOwner)}
 
 	// Resgiter for MDNS multicast
 	if h.mconn4, err = net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: mdnsIPv4Addr.IP.AsSlice(), Port: int(mdnsIPv4Addr.Port)}); err != nil {
@@ -53,8 +107,11 @@ func New(session *packet.Session) (h *DNSHandler, err error) {
 }
 
 func (h *DNSHandler) Close() error {
+	h.unpublishMDNS() // send goodbye records
 	h.DNSTable = nil
+	h.table = newTableLRU(h.table.maxBytes)
 	h.mdnsCache = nil
+	h.history = nil
 	return nil
 }
 
@@ -62,39 +119,58 @@ func (h *DNSHandler) Start() error {
 	if err := h.SendNBNSNodeStatus(); err != nil {
 		return err
 	}
+	if err := h.BrowseMDNS(); err != nil {
+		return err
+	}
+	if err := h.SendSSDPSearch(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MinuteTicker expires stale naming state and repeats the periodic mdns and ssdp discovery.
+func (h *DNSHandler) MinuteTicker(now time.Time) error {
+	h.mutex.Lock()
+	h.expireTable(now)
+	h.resolver.Purge(now)
+	h.expireHistory(now)
+	events := h.expireServices(now)
+	h.expireSleepProxy(now)
+	h.expireLLMNR(now)
+	h.expireHTTP(now)
+	h.expireWSD(now)
+	search := h.expireUPNP(now)
+	browse := !h.lastBrowse.IsZero() && now.Sub(h.lastBrowse) >= mdnsBrowseInterval
+	h.mutex.Unlock()
+
+	h.notifyServices(events)
+	if search {
+		if err := h.SendSSDPSearch(); err != nil {
+			return err
+		}
+	}
+	if browse {
+		return h.BrowseMDNS()
+	}
 	return nil
 }
 
-// reverseDNS query the PTR record for ip
+// ReverseDNS returns the PTR names for ip using the handler resolver.
 // return ErrNotFound if there is no PTR record
-func ReverseDNS(ip netip.Addr) error {
+func (h *DNSHandler) ReverseDNS(ip netip.Addr) (names []string, err error) {
 	if Debug {
 		fmt.Printf("dns   : reverse lookup for ip=%s\n", ip)
 	}
-	resolver := &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{}
-			return d.DialContext(ctx, network, net.JoinHostPort(packet.DNSv4CloudFlare1.String(), "53")) //CloudFlare
-		},
-	}
-
-	names, err := resolver.LookupAddr(context.TODO(), ip.String())
-	if err != nil {
-		// errors.As(err, &dnsErr) - as not implemented yet
-		dnsErr, ok := err.(*net.DNSError)
-		if ok && dnsErr.IsNotFound {
-			if Debug {
-				fmt.Printf("dns   : reverse lookup not found for ip=%s: %s %+v\n", ip, err, *dnsErr)
-			}
-			return packet.ErrNotFound
+	if names, _, err = h.resolver.LookupPTR(context.Background(), ip); err != nil {
+		if Debug {
+			fmt.Printf("dns   : reverse lookup failed for ip=%s: %s\n", ip, err)
 		}
-		return err
+		return nil, err
 	}
 	if Debug {
 		Logger.Msg("reverse dns ok").String("ip", ip.String()).StringArray("names", names).Write()
 	}
-	return nil
+	return names, nil
 }
 
 // ProcessDNS parse the DNS packet and record in DNS cache table.
@@ -121,14 +197,14 @@ func (h *DNSHandler) ProcessDNS(frame packet.Frame) (e packet.DNSEntry, err erro
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
+	if p.QR() { // record answer in the history of the host that sent the query
+		h.recordQuery(frame.DstAddr.MAC, question, p, time.Now())
+	}
+
 	e, found := h.DNSTable[string(question.Name)] // lookup directly from []byte to avoid allocation
 	if !found {
 		e = packet.NewDNSEntry()
 		e.Name = string(question.Name)
-		e.IP4Records = make(map[netip.Addr]packet.IPResourceRecord)
-		e.IP6Records = make(map[netip.Addr]packet.IPResourceRecord)
-		e.CNameRecords = make(map[string]packet.NameResourceRecord)
-		e.PTRRecords = make(map[string]packet.IPResourceRecord)
 	}
 
 	var updated bool
@@ -139,8 +215,11 @@ func (h *DNSHandler) ProcessDNS(frame packet.Frame) (e packet.DNSEntry, err erro
 		if Debug {
 			Logger.Msg("entry").Struct(e).Write()
 		}
-		h.DNSTable[e.Name] = e
+		h.storeEntry(e)
 		return e.Copy(), nil // return a copy to avoid race on maps
 	}
+	if found {
+		h.storeEntry(e) // refresh lru position; record expiry was updated in place
+	}
 	return packet.DNSEntry{}, nil
 }
@@ -2,7 +2,9 @@ package dns_naming
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"net"
 	"net/netip"
 	"testing"
@@ -408,18 +410,30 @@ func TestDNS_reverseDNS(t *testing.T) {
 	defer session.Close()
 	go packet.TestReadAndDiscardLoop(clientConn) // MUST read the out conn to avoid blocking the server
 
-	dnsHandler, _ := New(session)
+	server := newPTRServer(t, map[string]string{"118.167.217.172.in-addr.arpa": "syd09s22-in-f22.1e100.net"})
+	defer server.conn.Close()
+	dnsHandler, _ := Config{Resolver: ResolverConfig{Upstreams: []netip.AddrPort{server.addr()}}.New()}.New(session)
 	Debug = true
 
-	if err := ReverseDNS(netip.AddrFrom4([4]byte{172, 217, 167, 118})); err != nil {
-		t.Fatal(err)
+	if names, err := dnsHandler.ReverseDNS(netip.AddrFrom4([4]byte{172, 217, 167, 118})); err != nil || len(names) != 1 || names[0] != "syd09s22-in-f22.1e100.net" {
+		t.Fatalf("invalid reverse dns names=%v err=%v", names, err)
+	}
+	names, err := dnsHandler.LookupPTR(context.Background(), netip.AddrFrom4([4]byte{172, 217, 167, 118}))
+	if err != nil || len(names) != 1 || names[0] != "syd09s22-in-f22.1e100.net" {
+		t.Fatalf("invalid ptr names=%v err=%v", names, err)
 	}
+	if e := dnsHandler.DNSFind("118.167.217.172.in-addr.arpa"); e.PTRRecords["syd09s22-in-f22.1e100.net"].IP != netip.AddrFrom4([4]byte{172, 217, 167, 118}) {
+		t.Fatalf("invalid ptr entry %+v", e)
+	}
+
 	// =13.76.219.18
 	if found := dnsHandler.DNSExist(netip.AddrFrom4([4]byte{13, 76, 219, 18})); found {
 		t.Fatal("invalid entry")
 	}
 
-	dnsHandler.DNSLookupPTR(netip.AddrFrom4([4]byte{13, 76, 219, 18}))
+	if _, err := dnsHandler.LookupPTR(context.Background(), netip.AddrFrom4([4]byte{13, 76, 219, 18})); !errors.Is(err, packet.ErrNotFound) {
+		t.Fatal("invalid error", err)
+	}
 
 	if found := dnsHandler.DNSExist(netip.AddrFrom4([4]byte{13, 76, 219, 18})); !found {
 		dnsHandler.PrintDNSTable()
@@ -433,7 +447,9 @@ func TestDNS_reverseDNS(t *testing.T) {
 		dnsHandler.PrintDNSTable()
 		t.Fatal("invalid entry")
 	}
-
+	if n := server.queries(); n != 2 {
+		t.Fatalf("invalid upstream queries=%d want=2", n)
+	}
 }
 
 // Benchmark_DNSConcurrentAccess test concurrent access performance
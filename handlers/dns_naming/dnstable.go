@@ -1,13 +1,193 @@
 package dns_naming
 
 import (
+	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"net/netip"
+	"sync/atomic"
+	"time"
 
 	"github.com/irai/packet"
 )
 
+// DefaultTableMaxBytes is the default memory cap for DNSTable.
+const DefaultTableMaxBytes = 4 * 1024 * 1024
+
+// approximate memory used by an entry and by each record, excluding strings
+const (
+	entryOverhead  = 8 * 48
+	recordOverhead = 64
+)
+
+// maxPTRNotFound is the maximum number of IPs cached in the ptrentryname pseudo entry.
+const maxPTRNotFound = 256
+
+// DNSTableStats holds DNSTable usage counters.
+type DNSTableStats struct {
+	Entries   int    // number of names in the table
+	Bytes     int    // approximate memory used by the table
+	MaxBytes  int    // memory cap
+	Hits      uint64 // lookups that found a name or ip
+	Misses    uint64 // lookups that did not find a name or ip
+	Evictions uint64 // entries deleted to keep the table under the memory cap
+	Expired   uint64 // records deleted due to TTL expiry
+}
+
+type lruEntry struct {
+	name string
+	size int
+}
+
+// tableLRU keeps DNSTable names in least recently used order.
+type tableLRU struct {
+	list     *list.List
+	index    map[string]*list.Element
+	bytes    int
+	maxBytes int
+	stats    DNSTableStats
+	lookups  *lookupCounters // updated atomically by readers holding the read lock
+}
+
+// lookupCounters is allocated on its own to keep the counters 64 bit aligned for sync/atomic.
+type lookupCounters struct {
+	hits   uint64
+	misses uint64
+}
+
+func newTableLRU(maxBytes int) tableLRU {
+	if maxBytes <= 0 {
+		maxBytes = DefaultTableMaxBytes
+	}
+	return tableLRU{list: list.New(), index: make(map[string]*list.Element, 256), maxBytes: maxBytes, lookups: &lookupCounters{}}
+}
+
+// entrySize returns the approximate memory used by the entry.
+func entrySize(e packet.DNSEntry) int {
+	n := entryOverhead + len(e.Name)
+	for _, v := range e.IP4Records {
+		n += recordOverhead + len(v.Name)
+	}
+	for _, v := range e.IP6Records {
+		n += recordOverhead + len(v.Name)
+	}
+	for _, v := range e.CNameRecords {
+		n += recordOverhead + len(v.Name) + len(v.CName)
+	}
+	for _, v := range e.PTRRecords {
+		n += recordOverhead + len(v.Name)
+	}
+	for _, v := range e.SRVRecords {
+		n += recordOverhead + len(v.Name) + len(v.Target)
+	}
+	for _, v := range e.MXRecords {
+		n += recordOverhead + len(v.Name) + len(v.Host)
+	}
+	for _, v := range e.NSRecords {
+		n += recordOverhead + len(v.Name) + len(v.CName)
+	}
+	for _, v := range e.TXTRecords {
+		n += recordOverhead + len(v.Name)
+		for _, t := range v.TXT {
+			n += len(t) + 16
+		}
+	}
+	return n
+}
+
+// storeEntry saves the entry in DNSTable as the most recently used and evicts the least
+// recently used entries if the table is over the memory cap.
+// Caller must hold the lock.
+func (h *DNSHandler) storeEntry(e packet.DNSEntry) {
+	h.DNSTable[e.Name] = e
+	size := entrySize(e)
+	if el := h.table.index[e.Name]; el != nil {
+		v := el.Value.(*lruEntry)
+		h.table.bytes += size - v.size
+		v.size = size
+		h.table.list.MoveToFront(el)
+	} else {
+		h.table.index[e.Name] = h.table.list.PushFront(&lruEntry{name: e.Name, size: size})
+		h.table.bytes += size
+	}
+	for h.table.bytes > h.table.maxBytes && h.table.list.Len() > 1 {
+		v := h.table.list.Back().Value.(*lruEntry)
+		if Debug {
+			Logger.Msg("evict entry").String("name", v.name).Int("bytes", h.table.bytes).Write()
+		}
+		h.deleteEntry(v.name)
+		h.table.stats.Evictions++
+	}
+}
+
+// deleteEntry removes the entry from DNSTable.
+// Caller must hold the lock.
+func (h *DNSHandler) deleteEntry(name string) {
+	delete(h.DNSTable, name)
+	if el := h.table.index[name]; el != nil {
+		h.table.bytes -= el.Value.(*lruEntry).size
+		h.table.list.Remove(el)
+		delete(h.table.index, name)
+	}
+}
+
+// lookup returns the entry for name after deleting expired records.
+// Caller must hold the lock.
+func (h *DNSHandler) lookup(name string, now time.Time) (packet.DNSEntry, bool) {
+	e, found := h.DNSTable[name]
+	if !found {
+		return packet.DNSEntry{}, false
+	}
+	before := e.Len()
+	left := e.Expire(now)
+	h.table.stats.Expired += uint64(before - left)
+	if left == 0 {
+		h.deleteEntry(name)
+		return packet.DNSEntry{}, false
+	}
+	if el := h.table.index[name]; el != nil {
+		h.table.list.MoveToFront(el)
+	}
+	return e, true
+}
+
+// expireTable deletes expired records and empty entries.
+// Caller must hold the lock.
+func (h *DNSHandler) expireTable(now time.Time) {
+	for name, e := range h.DNSTable {
+		before := e.Len()
+		left := e.Expire(now)
+		if left == before {
+			continue
+		}
+		h.table.stats.Expired += uint64(before - left)
+		if left == 0 {
+			h.deleteEntry(name)
+			continue
+		}
+		if el := h.table.index[name]; el != nil { // resize without changing the lru position
+			v := el.Value.(*lruEntry)
+			size := entrySize(e)
+			h.table.bytes += size - v.size
+			v.size = size
+		}
+	}
+}
+
+// TableStats returns the DNSTable usage counters.
+func (h *DNSHandler) TableStats() DNSTableStats {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	stats := h.table.stats
+	stats.Hits = atomic.LoadUint64(&h.table.lookups.hits)
+	stats.Misses = atomic.LoadUint64(&h.table.lookups.misses)
+	stats.Entries = len(h.DNSTable)
+	stats.Bytes = h.table.bytes
+	stats.MaxBytes = h.table.maxBytes
+	return stats
+}
+
 func (h *DNSHandler) PrintDNSTable() {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
@@ -17,61 +197,129 @@ func (h *DNSHandler) PrintDNSTable() {
 	}
 }
 
+// DNSExist returns true if a DNSTable entry has an unexpired ipv4 record for ip.
+// It does not change the lru order.
 func (h *DNSHandler) DNSExist(ip netip.Addr) bool {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
+	now := time.Now()
 	for _, entry := range h.DNSTable {
-		if _, found := entry.IP4Records[ip]; found {
+		if r, found := entry.IP4Records[ip]; found && !now.After(r.Expire) {
+			atomic.AddUint64(&h.table.lookups.hits, 1)
 			return true
 		}
 	}
+	atomic.AddUint64(&h.table.lookups.misses, 1)
 	return false
 }
 
 func (h *DNSHandler) DNSFind(name string) packet.DNSEntry {
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
-	if e, found := h.DNSTable[name]; found {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if e, found := h.lookup(name, time.Now()); found {
+		atomic.AddUint64(&h.table.lookups.hits, 1)
 		return e.Copy()
 	}
+	atomic.AddUint64(&h.table.lookups.misses, 1)
 	return packet.DNSEntry{}
 }
 
+// DNSLookupPTR looks up the PTR names for ip and stores the result in DNSTable.
+// Use LookupPTR to get the names.
 func (h *DNSHandler) DNSLookupPTR(ip netip.Addr) {
-	if err := ReverseDNS(ip); errors.Is(err, packet.ErrNotFound) {
-		h.mutex.Lock()
-		defer h.mutex.Unlock()
-
-		// cache IPs that do not have a PTR RR to prevent unnecessary lookups;
-		// it is likely the same IP will be used again and again.
-		// TODO: should we block unknown IPs?
-		entry, found := h.DNSTable["ptrentryname"]
+	h.LookupPTR(context.Background(), ip)
+}
+
+// LookupPTR returns the PTR names for ip using the handler resolver; the query is cancelled when ctx is done.
+// Results are stored in DNSTable under the reverse name; IPs without a PTR record are stored in the
+// ptrentryname pseudo entry, up to maxPTRNotFound IPs, and return ErrNotFound.
+func (h *DNSHandler) LookupPTR(ctx context.Context, ip netip.Addr) (names []string, err error) {
+	reverse := packet.DNSReverseName(ip)
+	now := time.Now()
+
+	h.mutex.Lock()
+	if e, found := h.lookup(reverse, now); found && len(e.PTRRecords) > 0 {
+		for _, v := range e.PTRRecords {
+			names = append(names, v.Name)
+		}
+		atomic.AddUint64(&h.table.lookups.hits, 1)
+		h.mutex.Unlock()
+		return names, nil
+	}
+	if e, found := h.lookup("ptrentryname", now); found {
+		_, found4 := e.IP4Records[ip]
+		_, found6 := e.IP6Records[ip]
+		if found4 || found6 {
+			atomic.AddUint64(&h.table.lookups.hits, 1)
+			h.mutex.Unlock()
+			return nil, packet.ErrNotFound
+		}
+	}
+	atomic.AddUint64(&h.table.lookups.misses, 1)
+	h.mutex.Unlock()
+
+	names, ttl, err := h.resolver.LookupPTR(ctx, ip)
+	if err != nil && !errors.Is(err, packet.ErrNotFound) {
+		return nil, err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	record := packet.IPResourceRecord{IP: ip, TTL: uint32(ttl / time.Second), Expire: now.Add(ttl)}
+
+	if len(names) > 0 {
+		entry, found := h.DNSTable[reverse]
 		if !found {
 			entry = packet.NewDNSEntry()
-			entry.Name = "ptrentryname"
-			h.DNSTable["ptrentryname"] = entry
+			entry.Name = reverse
+		}
+		for _, name := range names {
+			record.Name = name
+			entry.PTRRecords[name] = record
 		}
+		h.storeEntry(entry)
+		return names, nil
+	}
+
+	// cache IPs that do not have a PTR RR to prevent unnecessary lookups;
+	// it is likely the same IP will be used again and again.
+	// TODO: should we block unknown IPs?
+	entry, found := h.DNSTable["ptrentryname"]
+	if !found {
+		entry = packet.NewDNSEntry()
+		entry.Name = "ptrentryname"
+	}
+	if Debug {
+		fmt.Printf("dns   : add ptr record not found for ip=%s\n", ip)
+	}
+	if ip.Is4() {
+		entry.IP4Records[ip] = record
+	} else {
+		entry.IP6Records[ip] = record
+	}
+	trimPTRNotFound(entry)
+	h.storeEntry(entry)
+	return nil, packet.ErrNotFound
+}
 
-		// IPv4?
-		if ip.Is4() {
-			_, found = entry.IP4Records[ip]
-			if !found {
-				if Debug {
-					fmt.Printf("dns   : add ptr record not found for ip=%s\n", ip)
-				}
-				entry.IP4Records[ip] = packet.IPResourceRecord{IP: ip}
+// trimPTRNotFound deletes the records closest to expiry until the entry holds
+// at most maxPTRNotFound IPs.
+func trimPTRNotFound(entry packet.DNSEntry) {
+	for len(entry.IP4Records)+len(entry.IP6Records) > maxPTRNotFound {
+		var oldest netip.Addr
+		var expire time.Time
+		for ip, r := range entry.IP4Records {
+			if !oldest.IsValid() || r.Expire.Before(expire) {
+				oldest, expire = ip, r.Expire
 			}
-			return
 		}
-
-		// IPv6?
-		_, found = entry.IP6Records[ip]
-		if !found {
-			if Debug {
-				fmt.Printf("dns   : ptr record not found for ip=%s\n", ip)
+		for ip, r := range entry.IP6Records {
+			if !oldest.IsValid() || r.Expire.Before(expire) {
+				oldest, expire = ip, r.Expire
 			}
-			entry.IP4Records[ip] = packet.IPResourceRecord{IP: ip}
 		}
+		delete(entry.IP4Records, oldest)
+		delete(entry.IP6Records, oldest)
 	}
 }
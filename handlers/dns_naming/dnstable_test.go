@@ -0,0 +1,184 @@
+package dns_naming
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+func TestDNSHandler_TableExpiry(t *testing.T) {
+	session, _ := testSession()
+	defer session.Close()
+	h, err := New(session)
+	if err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer h.Close()
+
+	mac1 := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x01}
+	ip1 := netip.MustParseAddr("192.168.0.1")
+	web := netip.MustParseAddr("142.250.66.238")
+	frame, err := session.Parse(newDNSAnswerFrame(mac1, ip1, 1, "youtube.com", web))
+	if err != nil {
+		t.Fatal("invalid packet", err)
+	}
+	if _, err := h.ProcessDNS(frame); err != nil {
+		t.Fatal("process dns", err)
+	}
+
+	e := h.DNSFind("youtube.com")
+	r, found := e.IP4Records[web]
+	if !found || r.TTL != 60 || time.Until(r.Expire) > time.Second*60 || time.Until(r.Expire) < time.Second*55 {
+		t.Fatalf("invalid record %+v", r)
+	}
+	if !h.DNSExist(web) || h.DNSFind("notfound.com").Name != "" {
+		t.Error("invalid lookup")
+	}
+
+	h.MinuteTicker(time.Now().Add(time.Second * 61))
+	if h.DNSFind("youtube.com").Name != "" || h.DNSExist(web) {
+		t.Error("expected expired entry")
+	}
+	stats := h.TableStats()
+	if stats.Entries != 0 || stats.Bytes != 0 || stats.Expired != 1 || stats.Hits != 2 || stats.Misses != 3 {
+		t.Errorf("invalid stats %+v", stats)
+	}
+
+	// lookup deletes expired records before the minute ticker
+	entry := packet.NewDNSEntry()
+	entry.Name = "old.example.com"
+	entry.IP4Records[web] = packet.IPResourceRecord{Name: entry.Name, IP: web, TTL: 1, Expire: time.Now().Add(-time.Second)}
+	h.mutex.Lock()
+	h.storeEntry(entry)
+	h.mutex.Unlock()
+	if h.DNSFind("old.example.com").Name != "" || h.TableStats().Entries != 0 {
+		t.Error("expected expired entry on lookup")
+	}
+}
+
+func TestDNSHandler_TableLRU(t *testing.T) {
+	session, _ := testSession()
+	defer session.Close()
+
+	newEntry := func(name string, ip netip.Addr) packet.DNSEntry {
+		e := packet.NewDNSEntry()
+		e.Name = name
+		e.IP4Records[ip] = packet.IPResourceRecord{Name: name, IP: ip, TTL: 60, Expire: time.Now().Add(time.Minute)}
+		return e
+	}
+	size := entrySize(newEntry("host0.example.com", netip.AddrFrom4([4]byte{10, 0, 0, 1})))
+
+	h, err := Config{TableMaxBytes: size * 3}.New(session)
+	if err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer h.Close()
+
+	names := []string{"host0.example.com", "host1.example.com", "host2.example.com", "host3.example.com"}
+	for i, name := range names[:3] {
+		h.mutex.Lock()
+		h.storeEntry(newEntry(name, netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})))
+		h.mutex.Unlock()
+	}
+	if stats := h.TableStats(); stats.Entries != 3 || stats.Bytes != size*3 || stats.Evictions != 0 {
+		t.Fatalf("invalid stats %+v", stats)
+	}
+
+	// host0 is the most recently used; host1 is evicted
+	if h.DNSFind(names[0]).Name != names[0] {
+		t.Fatal("missing entry")
+	}
+	h.mutex.Lock()
+	h.storeEntry(newEntry(names[3], netip.AddrFrom4([4]byte{10, 0, 0, 3})))
+	h.mutex.Unlock()
+
+	stats := h.TableStats()
+	if stats.Entries != 3 || stats.Bytes > stats.MaxBytes || stats.Evictions != 1 {
+		t.Errorf("invalid stats %+v", stats)
+	}
+	for i, name := range names {
+		if found := h.DNSFind(name).Name != ""; found != (i != 1) {
+			t.Errorf("invalid entry name=%s found=%v", name, found)
+		}
+	}
+}
+
+func TestDNSHandler_TableConcurrentExist(t *testing.T) {
+	session, _ := testSession()
+	defer session.Close()
+	h, err := New(session)
+	if err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer h.Close()
+
+	web := netip.MustParseAddr("142.250.66.238")
+	entry := packet.NewDNSEntry()
+	entry.Name = "youtube.com"
+	entry.IP4Records[web] = packet.IPResourceRecord{Name: entry.Name, IP: web, TTL: 60, Expire: time.Now().Add(time.Minute)}
+	h.mutex.Lock()
+	h.storeEntry(entry)
+	h.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				h.DNSExist(web)
+				h.DNSExist(netip.MustParseAddr("10.0.0.1"))
+				h.TableStats()
+			}
+		}()
+	}
+	wg.Wait()
+	if stats := h.TableStats(); stats.Hits != 400 || stats.Misses != 400 {
+		t.Errorf("invalid stats %+v", stats)
+	}
+}
+
+func TestDNSHandler_TablePTRNotFound(t *testing.T) {
+	session, _ := testSession()
+	defer session.Close()
+
+	server := newPTRServer(t, map[string]string{})
+	defer server.conn.Close()
+
+	host := packet.NewDNSEntry()
+	host.Name = "host.example.com"
+	host.IP4Records[netip.AddrFrom4([4]byte{10, 0, 0, 1})] = packet.IPResourceRecord{Name: host.Name, IP: netip.AddrFrom4([4]byte{10, 0, 0, 1}), TTL: 60, Expire: time.Now().Add(time.Minute)}
+	maxBytes := entryOverhead + len("ptrentryname") + maxPTRNotFound*recordOverhead + entrySize(host)
+	h, err := Config{TableMaxBytes: maxBytes, Resolver: ResolverConfig{Upstreams: []netip.AddrPort{server.addr()}}.New()}.New(session)
+	if err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer h.Close()
+
+	h.mutex.Lock()
+	h.storeEntry(host)
+	h.mutex.Unlock()
+
+	// the not found entry is capped and does not evict other entries
+	for i := 0; i < maxPTRNotFound+16; i++ {
+		ip := netip.AddrFrom4([4]byte{13, 76, byte(i >> 8), byte(i)})
+		if _, err := h.LookupPTR(context.Background(), ip); !errors.Is(err, packet.ErrNotFound) {
+			t.Fatal("invalid error", err)
+		}
+	}
+	if e := h.DNSFind("ptrentryname"); len(e.IP4Records) != maxPTRNotFound {
+		t.Errorf("invalid ptr not found records=%d", len(e.IP4Records))
+	}
+	if h.DNSFind(host.Name).Name != host.Name {
+		t.Error("entry evicted by ptr not found records")
+	}
+	if stats := h.TableStats(); stats.Evictions != 0 || stats.Bytes > stats.MaxBytes {
+		t.Errorf("invalid stats %+v", stats)
+	}
+}
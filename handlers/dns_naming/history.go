@@ -0,0 +1,168 @@
+package dns_naming
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+const (
+	historyLen    = 128            // queries kept per host
+	historyExpiry = time.Hour * 24 // delete host history after this period without queries
+)
+
+// DNSQuery records a name resolved by a host and the IPs returned in the answer.
+type DNSQuery struct {
+	Name  string
+	Type  uint16
+	RCode int
+	IPs   []netip.Addr // A and AAAA records in the answer section, including CNAME targets
+	Time  time.Time
+}
+
+// queryLog is a fixed size ring buffer of queries for a single host.
+type queryLog struct {
+	mac     net.HardwareAddr
+	entries []DNSQuery
+	next    int
+	last    time.Time
+}
+
+func (l *queryLog) add(q DNSQuery) {
+	if len(l.entries) < historyLen {
+		l.entries = append(l.entries, q)
+	} else {
+		l.entries[l.next] = q
+	}
+	l.next = (l.next + 1) % historyLen
+	l.last = q.Time
+}
+
+// walk calls f for each entry starting from the most recent; it stops if f returns false.
+func (l *queryLog) walk(f func(q *DNSQuery) bool) {
+	n := len(l.entries)
+	for i := 0; i < n; i++ {
+		if !f(&l.entries[(l.next-1-i+n)%n]) {
+			return
+		}
+	}
+}
+
+// recordQuery appends the answer to the query history of the host that sent the query.
+// Caller must hold the lock.
+func (h *DNSHandler) recordQuery(mac net.HardwareAddr, question packet.Question, p packet.DNS, now time.Time) {
+	if len(mac) != 6 || mac[0]&0x01 != 0 { // ignore multicast and broadcast destinations
+		return
+	}
+	q := DNSQuery{Name: string(question.Name), Type: question.Type, RCode: p.ResponseCode(), Time: now}
+	if offset, err := p.AnswerOffset(); err == nil {
+		for i := 0; i < int(p.ANCount()); i++ {
+			var rr packet.DNSResourceRecord
+			if rr, offset, err = packet.DecodeRR(p, offset, nil); err != nil {
+				break
+			}
+			if rr.Type == packet.DNSTypeA || rr.Type == packet.DNSTypeAAAA {
+				if ip := rr.IP(); ip.IsValid() {
+					q.IPs = append(q.IPs, ip)
+				}
+			}
+		}
+	}
+
+	l := h.history[string(mac)]
+	if l == nil {
+		l = &queryLog{mac: packet.CopyBytes(mac), entries: make([]DNSQuery, 0, 16)}
+		h.history[string(mac)] = l
+	}
+	l.add(q)
+	if Logger.IsDebug() {
+		Logger.Msg("host query").MAC("mac", mac).String("name", q.Name).Int("ips", len(q.IPs)).Write()
+	}
+}
+
+// LookupsByMAC returns the queries made by the host, oldest first.
+func (h *DNSHandler) LookupsByMAC(mac net.HardwareAddr) []DNSQuery {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	l := h.history[string(mac)]
+	if l == nil {
+		return nil
+	}
+	list := make([]DNSQuery, len(l.entries))
+	i := len(list)
+	l.walk(func(q *DNSQuery) bool {
+		i--
+		list[i] = *q
+		list[i].IPs = append([]netip.Addr(nil), q.IPs...)
+		return true
+	})
+	return list
+}
+
+// HostsThatResolved returns the mac addresses of hosts that queried name; names are case insensitive.
+func (h *DNSHandler) HostsThatResolved(name string) []net.HardwareAddr {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	var list []net.HardwareAddr
+	for _, l := range h.history {
+		l.walk(func(q *DNSQuery) bool {
+			if strings.EqualFold(q.Name, name) {
+				list = append(list, packet.CopyBytes(l.mac))
+				return false
+			}
+			return true
+		})
+	}
+	return list
+}
+
+// ResolvedName returns the most recent name the host resolved to ip. Use it to
+// correlate the destination of later traffic from the host with the name it looked up.
+func (h *DNSHandler) ResolvedName(mac net.HardwareAddr, ip netip.Addr) (name string, found bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	l := h.history[string(mac)]
+	if l == nil {
+		return "", false
+	}
+	l.walk(func(q *DNSQuery) bool {
+		for _, v := range q.IPs {
+			if v == ip {
+				name, found = q.Name, true
+				return false
+			}
+		}
+		return true
+	})
+	return name, found
+}
+
+// DestinationName returns the name the frame source host resolved to the frame destination IP.
+// Use it in the packet flow to name the destination of tcp and udp traffic; it returns false
+// for destinations in the home LAN and for non unicast destinations.
+func (h *DNSHandler) DestinationName(frame packet.Frame) (name string, found bool) {
+	if !frame.DstAddr.IP.IsGlobalUnicast() || h.session.NICInfo.HomeLAN4.Contains(frame.DstAddr.IP) {
+		return "", false
+	}
+	return h.ResolvedName(frame.SrcAddr.MAC, frame.DstAddr.IP)
+}
+
+// expireHistory deletes the history of hosts that made no queries in the last 24 hours.
+// Caller must hold the lock.
+func (h *DNSHandler) expireHistory(now time.Time) {
+	for k, l := range h.history {
+		if now.Sub(l.last) > historyExpiry {
+			delete(h.history, k)
+		}
+	}
+}
+
+// DeleteHistory removes the query history for the host.
+func (h *DNSHandler) DeleteHistory(mac net.HardwareAddr) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.history, string(mac))
+}
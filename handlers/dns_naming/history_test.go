@@ -0,0 +1,124 @@
+package dns_naming
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+func newDNSAnswerFrame(dstMAC net.HardwareAddr, dstIP netip.Addr, id uint16, name string, ips ...netip.Addr) []byte {
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, 512), id, packet.DNSFlagQR|packet.DNSFlagRD|packet.DNSFlagRA)
+	b.Question(name, packet.DNSTypeA, packet.DNSClassINET)
+	for _, ip := range ips {
+		b.A(packet.DNSRRHeader{Name: name, Class: packet.DNSClassINET, TTL: 60}, ip)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		panic(err)
+	}
+	routerMAC := net.HardwareAddr{0x00, 0x66, 0x66, 0x66, 0x66, 0x66}
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, routerMAC, dstMAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 50, netip.MustParseAddr("192.168.0.11"), dstIP)
+	udp := packet.EncodeUDP(ip4.Payload(), 53, 40000)
+	udp, _ = udp.AppendPayload(msg)
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		panic(err)
+	}
+	return ether
+}
+
+func TestDNSHandler_History(t *testing.T) {
+	session, _ := testSession()
+	defer session.Close()
+	h, err := New(session)
+	if err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	defer h.Close()
+
+	mac1 := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x01}
+	mac2 := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x02}
+	ip1 := netip.MustParseAddr("192.168.0.1")
+	ip2 := netip.MustParseAddr("192.168.0.2")
+	web := netip.MustParseAddr("142.250.66.238")
+	cdn := netip.MustParseAddr("157.240.8.35")
+
+	process := func(b []byte) {
+		frame, err := session.Parse(b)
+		if err != nil {
+			t.Fatal("invalid packet", err)
+		}
+		if _, err := h.ProcessDNS(frame); err != nil {
+			t.Fatal("process dns", err)
+		}
+	}
+	process(newDNSAnswerFrame(mac1, ip1, 1, "youtube.com", web))
+	process(newDNSAnswerFrame(mac1, ip1, 2, "facebook.com", cdn))
+	process(newDNSAnswerFrame(mac2, ip2, 3, "facebook.com", cdn))
+	process(newDNSAnswerFrame(mac2, ip2, 4, "cdn.example.com", cdn)) // same ip for a different name
+
+	list := h.LookupsByMAC(mac1)
+	if len(list) != 2 || list[0].Name != "youtube.com" || list[1].Name != "facebook.com" ||
+		len(list[0].IPs) != 1 || list[0].IPs[0] != web || list[0].Type != packet.DNSTypeA {
+		t.Fatalf("invalid lookups %+v", list)
+	}
+	if list := h.LookupsByMAC(net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x03}); list != nil {
+		t.Errorf("unexpected lookups %+v", list)
+	}
+
+	hosts := h.HostsThatResolved("facebook.com")
+	if len(hosts) != 2 || (!bytes.Equal(hosts[0], mac1) && !bytes.Equal(hosts[1], mac1)) {
+		t.Errorf("invalid hosts %v", hosts)
+	}
+	if hosts := h.HostsThatResolved("youtube.com"); len(hosts) != 1 || !bytes.Equal(hosts[0], mac1) {
+		t.Errorf("invalid hosts %v", hosts)
+	}
+	if hosts := h.HostsThatResolved("YouTube.COM"); len(hosts) != 1 || !bytes.Equal(hosts[0], mac1) {
+		t.Errorf("invalid hosts for mixed case name %v", hosts)
+	}
+
+	// correlate traffic to the name resolved by each host
+	if name, found := h.ResolvedName(mac1, cdn); !found || name != "facebook.com" {
+		t.Errorf("invalid name for mac1 %s", name)
+	}
+	if name, found := h.ResolvedName(mac2, cdn); !found || name != "cdn.example.com" {
+		t.Errorf("invalid name for mac2 %s", name)
+	}
+	if _, found := h.ResolvedName(mac2, web); found {
+		t.Error("unexpected name for ip not resolved by host")
+	}
+
+	// name the destination of later traffic in the packet flow
+	if name, found := h.DestinationName(packet.Frame{SrcAddr: packet.Addr{MAC: mac1, IP: ip1}, DstAddr: packet.Addr{IP: cdn}}); !found || name != "facebook.com" {
+		t.Errorf("invalid destination name %s", name)
+	}
+	if _, found := h.DestinationName(packet.Frame{SrcAddr: packet.Addr{MAC: mac2, IP: ip2}, DstAddr: packet.Addr{IP: ip1}}); found {
+		t.Error("unexpected name for lan destination")
+	}
+
+	// ring buffer keeps the most recent queries
+	for i := 0; i < historyLen+10; i++ {
+		process(newDNSAnswerFrame(mac1, ip1, uint16(100+i), "www.example.com", netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})))
+	}
+	list = h.LookupsByMAC(mac1)
+	if len(list) != historyLen || list[len(list)-1].IPs[0] != netip.AddrFrom4([4]byte{10, 0, 0, historyLen + 9}) ||
+		list[0].IPs[0] != netip.AddrFrom4([4]byte{10, 0, 0, 10}) {
+		t.Fatalf("invalid ring buffer len=%d first=%+v", len(list), list[0])
+	}
+	if _, found := h.ResolvedName(mac1, web); found {
+		t.Error("unexpected name after ring buffer wrap")
+	}
+
+	h.MinuteTicker(time.Now().Add(historyExpiry + time.Minute))
+	if h.LookupsByMAC(mac1) != nil || h.LookupsByMAC(mac2) != nil {
+		t.Error("expected expired history")
+	}
+}
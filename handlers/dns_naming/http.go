@@ -0,0 +1,151 @@
+package dns_naming
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+// Plain HTTP requests
+//
+// IoT devices, smart TVs and game consoles still use plain http for firmware update checks, time and
+// connectivity checks. The User-Agent identifies the operating system and often the device model; i.e.
+//   - Dalvik/2.1.0 (Linux; U; Android 11; SM-G991B Build/RP1A.200720.012)
+//   - Roku/DVP-9.10 (519.10E04111A)
+//   - Mozilla/5.0 (SMART-TV; LINUX; Tizen 5.5) AppleWebKit/537.36
+//
+// A device sends the same User-Agent in every request, so the request is decoded without allocation
+// and the name entry is only built when the host User-Agent changes.
+
+const moduleHTTP = "http"
+
+var LoggerHTTP = fastlog.New(moduleHTTP)
+
+// httpAgent holds the last User-Agent seen for a host.
+type httpAgent struct {
+	userAgent string
+	lastSeen  time.Time
+}
+
+// ProcessHTTP decodes the first segment of a plain http request and updates the host http name entry
+// with the model and operating system in the User-Agent. The returned request is only valid until the
+// frame buffer is reused. Segments that do not start a request return packet.ErrParseProtocol.
+func (h *DNSHandler) ProcessHTTP(frame packet.Frame) (name packet.NameEntry, req packet.HTTPRequest, err error) {
+	if req, err = packet.DecodeHTTPRequest(frame.Payload()); err != nil && !errors.Is(err, packet.ErrFrameLen) {
+		return packet.NameEntry{}, packet.HTTPRequest{}, err
+	}
+	if req.Method == nil { // request line not in this segment
+		return packet.NameEntry{}, packet.HTTPRequest{}, err
+	}
+	if LoggerHTTP.IsDebug() {
+		LoggerHTTP.Msg("request rcvd").Struct(frame.SrcAddr).Struct(req).Write()
+	}
+	if LoggerHTTP.IsInfo() && httpFirmwarePath(req.Path) {
+		LoggerHTTP.Msg("firmware request").Struct(frame.SrcAddr).Bytes("host", req.Host).Bytes("path", req.Path).Bytes("useragent", req.UserAgent).Write()
+	}
+	if len(req.UserAgent) == 0 {
+		return packet.NameEntry{}, req, nil
+	}
+
+	now := time.Now()
+	h.mutex.Lock()
+	agent, found := h.httpAgents[string(frame.SrcAddr.MAC)]
+	if found && agent.userAgent == string(req.UserAgent) {
+		agent.lastSeen = now
+		h.mutex.Unlock()
+		return packet.NameEntry{}, req, nil
+	}
+	agent = &httpAgent{userAgent: string(req.UserAgent), lastSeen: now}
+	h.httpAgents[string(frame.SrcAddr.MAC)] = agent
+	h.mutex.Unlock()
+
+	name = httpNameEntry(agent.userAgent)
+	if frame.Host != nil && (name.Model != "" || name.OS != "" || name.Manufacturer != "") {
+		frame.Host.UpdateHTTPName(name)
+	}
+	return name, req, nil
+}
+
+// expireHTTP deletes the User-Agent of hosts that made no requests in the last 24 hours.
+// Must be called with the mutex locked.
+func (h *DNSHandler) expireHTTP(now time.Time) {
+	for k, v := range h.httpAgents {
+		if now.Sub(v.lastSeen) > historyExpiry {
+			delete(h.httpAgents, k)
+		}
+	}
+}
+
+// httpNameEntry returns the name entry for a User-Agent.
+func httpNameEntry(ua string) (name packet.NameEntry) {
+	name = processUserAgent(ua)
+	name.Type = moduleHTTP
+	switch {
+	case name.Model != "": // iPhone or iPad
+		name.OS = "iOS"
+	case strings.Contains(ua, "Android"):
+		name.OS = "Android"
+		name.Model = androidModel(ua)
+	case strings.Contains(ua, "Tizen"):
+		name.OS = "Tizen"
+		name.Manufacturer = "Samsung"
+	case strings.Contains(ua, "CrOS"):
+		name.OS = "ChromeOS"
+	case strings.Contains(ua, "Mac OS X") || strings.HasPrefix(ua, "macOS"):
+		name.OS = "macOS"
+		name.Manufacturer = "Apple, Inc."
+	case strings.HasPrefix(ua, "Roku"):
+		name.Model = "Roku"
+		name.Manufacturer = "Roku, Inc."
+	case strings.Contains(ua, "PlayStation"):
+		name.Model = "PlayStation"
+		name.Manufacturer = "Sony"
+	case strings.Contains(ua, "Xbox"):
+		name.Model = "Xbox"
+		name.Manufacturer = "Microsoft"
+	}
+	return name
+}
+
+// androidModel returns the device model in an Android User-Agent. The model is the field
+// ending in " Build/..." or the last field after the Android version; Chrome reduces it to "K".
+func androidModel(ua string) string {
+	ua = ua[strings.Index(ua, "Android"):]
+	if n := strings.IndexByte(ua, ')'); n >= 0 {
+		ua = ua[:n]
+	}
+	fields := strings.Split(ua, ";")
+	var model string
+	for _, v := range fields[1:] {
+		v = strings.TrimSpace(v)
+		if n := strings.Index(v, " Build/"); n >= 0 {
+			return v[:n]
+		}
+		if v != "wv" && v != "K" && v != "" {
+			model = v
+		}
+	}
+	return model
+}
+
+// httpFirmwarePath returns true if the request path looks like a firmware download or update check.
+func httpFirmwarePath(path []byte) bool {
+	if n := bytes.IndexByte(path, '?'); n >= 0 {
+		path = path[:n]
+	}
+	for _, v := range [...]string{"firmware", "Firmware", "fwupdate", "fw_update", "/ota/"} {
+		if bytes.Contains(path, []byte(v)) {
+			return true
+		}
+	}
+	for _, v := range [...]string{".bin", ".img", ".fw", ".swu"} {
+		if bytes.HasSuffix(path, []byte(v)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package dns_naming
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+func newTCPFrame(t *testing.T, session *packet.Session, src packet.Addr, dst packet.Addr, payload []byte) packet.Frame {
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, src.MAC, dst.MAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 64, src.IP, dst.IP)
+	tcp := ip4.Payload()[:20+len(payload)]
+	for i := range tcp[:20] {
+		tcp[i] = 0
+	}
+	binary.BigEndian.PutUint16(tcp[0:2], src.Port)
+	binary.BigEndian.PutUint16(tcp[2:4], dst.Port)
+	tcp[12] = 5 << 4 // 20 bytes header
+	tcp[13] = 0x18   // psh ack
+	copy(tcp[20:], payload)
+	ip4 = ip4.SetPayload(tcp, syscall.IPPROTO_TCP)
+	ether, err := ether.SetPayload(ip4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := session.Parse(ether)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func Test_httpNameEntry(t *testing.T) {
+	tests := []struct {
+		ua           string
+		model        string
+		os           string
+		manufacturer string
+	}{
+		{ua: "Dalvik/2.1.0 (Linux; U; Android 11; SM-G991B Build/RP1A.200720.012)", model: "SM-G991B", os: "Android"},
+		{ua: "Mozilla/5.0 (Linux; Android 10; K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36", os: "Android"},
+		{ua: "Mozilla/5.0 (Linux; Android 9; Pixel 3; wv) AppleWebKit/537.36", model: "Pixel 3", os: "Android"},
+		{ua: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15", model: "iPhone", os: "iOS", manufacturer: "Apple, Inc."},
+		{ua: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15", os: "macOS", manufacturer: "Apple, Inc."},
+		{ua: "Mozilla/5.0 (SMART-TV; LINUX; Tizen 5.5) AppleWebKit/537.36", os: "Tizen", manufacturer: "Samsung"},
+		{ua: "Roku/DVP-9.10 (519.10E04111A)", model: "Roku", manufacturer: "Roku, Inc."},
+		{ua: "Microsoft-CryptoAPI/10.0", os: ""},
+		{ua: "Microsoft-Delivery-Optimization/10.0 (Windows NT 10.0)", os: "Windows"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ua, func(t *testing.T) {
+			name := httpNameEntry(tt.ua)
+			if name.Type != moduleHTTP || name.Model != tt.model || name.OS != tt.os || name.Manufacturer != tt.manufacturer {
+				t.Errorf("httpNameEntry() = %+v", name)
+			}
+		})
+	}
+}
+
+func TestDNSHandler_ProcessHTTP(t *testing.T) {
+	session, _ := testSession()
+	defer session.Close()
+	h, _ := New(session)
+	defer h.Close()
+
+	src := packet.Addr{MAC: net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x31}, IP: netip.MustParseAddr("192.168.0.31"), Port: 40000}
+	dst := packet.Addr{MAC: session.NICInfo.RouterAddr4.MAC, IP: netip.MustParseAddr("52.1.2.3"), Port: packet.HTTPPort}
+	request := "GET /firmware/check?model=HS110 HTTP/1.1\r\nHost: update.example.com\r\n" +
+		"User-Agent: Dalvik/2.1.0 (Linux; U; Android 11; SM-G991B Build/RP1A.200720.012)\r\n\r\n"
+	frame := newTCPFrame(t, session, src, dst, []byte(request))
+	if frame.PayloadID != packet.PayloadHTTP || frame.Host == nil {
+		t.Fatalf("invalid frame payloadID=%v", frame.PayloadID)
+	}
+	name, req, err := h.ProcessHTTP(frame)
+	if err != nil || string(req.Host) != "update.example.com" || string(req.Path) != "/firmware/check?model=HS110" || name.Model != "SM-G991B" {
+		t.Fatalf("invalid request %s name=%+v err=%v", req, name, err)
+	}
+	frame.Host.MACEntry.Row.RLock()
+	httpName := frame.Host.MACEntry.HTTPName
+	frame.Host.MACEntry.Row.RUnlock()
+	if httpName.Model != "SM-G991B" || httpName.OS != "Android" {
+		t.Errorf("invalid host http name %+v", httpName)
+	}
+
+	// same user agent does not create a new name entry
+	if name, _, err = h.ProcessHTTP(frame); err != nil || name.Type != "" {
+		t.Errorf("unexpected name %+v err=%v", name, err)
+	}
+
+	// response and continuation segments
+	dst.Port, src.Port = src.Port, packet.HTTPPort
+	response := newTCPFrame(t, session, src, dst, []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	if _, _, err := h.ProcessHTTP(response); !errors.Is(err, packet.ErrParseProtocol) {
+		t.Errorf("unexpected response error=%v", err)
+	}
+
+	h.MinuteTicker(time.Now().Add(historyExpiry + time.Minute))
+	if len(h.httpAgents) != 0 {
+		t.Errorf("http agent not expired %d", len(h.httpAgents))
+	}
+}
@@ -0,0 +1,256 @@
+package dns_naming
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+// Link Local Multicast Name Resolution - RFC 4795
+//
+// LLMNR uses the DNS message format with a few header changes:
+//   - the AA bit is the C (conflict) bit; a querier sets it when it received several answers for
+//     a unique name and a responder sets it when the name is shared
+//   - the RD bit is the T (tentative) bit; set while the responder verifies the name is unique
+//
+// Queries are multicast to 224.0.0.252 or ff02::1:3 port 5355 and responses are unicast to the
+// querier. Windows verifies its host name by querying for it when an address is configured, so a
+// query for a name the host already uses elsewhere is a good indication the host owns the name.
+
+const moduleLLMNR = "llmnr"
+
+var LoggerLLMNR = fastlog.New(moduleLLMNR)
+
+const (
+	llmnrFlagC       = 0x0400 // conflict
+	llmnrFlagT       = 0x0100 // tentative
+	llmnrTTL         = 30     // default ttl - RFC 4795 section 2.8
+	llmnrMaxNames    = 256
+	llmnrOwnerExpiry = time.Minute * 5
+)
+
+// LLMNRConflict reports a name answered by more than one host. Addrs contains our host
+// if the name is our host name.
+type LLMNRConflict struct {
+	Name  string
+	Addrs []packet.Addr
+}
+
+func (c LLMNRConflict) String() string {
+	return LoggerLLMNR.Msg("").Struct(c).ToString()
+}
+
+func (c LLMNRConflict) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.String("name", c.Name)
+	for _, addr := range c.Addrs {
+		l.Struct(addr)
+	}
+	return l
+}
+
+// llmnrOwner is the last host to answer for a name.
+type llmnrOwner struct {
+	addr   packet.Addr
+	expire time.Time
+}
+
+// llmnrState holds the names answered on the LAN.
+type llmnrState struct {
+	respond bool                   // answer queries for our host name
+	owners  map[string]*llmnrOwner // key is lowercase name
+}
+
+// llmnrHostName returns our host name without the .local domain.
+func (h *DNSHandler) llmnrHostName() string {
+	return strings.TrimSuffix(h.responder.hostName, ".local")
+}
+
+// SendLLMNRQuery send a multicast LLMNR query for the address of name.
+func (h *DNSHandler) SendLLMNRQuery(name string) (err error) {
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, 128), uint16(rand.Uint32()), 0)
+	b.Question(name, packet.DNSTypeA, packet.DNSClassINET)
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+	return h.sendMDNS(msg, h.session.NICInfo.HostAddr4, llmnrIPv4Addr)
+}
+
+// ProcessLLMNR processes a LLMNR query or response sent over IPv4 or IPv6.
+//
+// Responses update the LLMNR name of the responding host and queries update the name when the host
+// verifies a name it already uses. The function returns a conflict if another host answered for the same
+// name in the last five minutes or if another host answers for our host name. Queries for our host name
+// are answered if Config.LLMNRResponder is set.
+func (h *DNSHandler) ProcessLLMNR(frame packet.Frame) (name packet.NameEntry, conflicts []LLMNRConflict, err error) {
+	p := packet.DNS(frame.Payload())
+	questions, offset, err := packet.DecodeQuestions(p)
+	if err != nil {
+		return packet.NameEntry{}, nil, err
+	}
+	if p.OpCode() != 0 || bytes.Equal(frame.SrcAddr.MAC, h.session.NICInfo.HostAddr4.MAC) {
+		return packet.NameEntry{}, nil, nil
+	}
+	if LoggerLLMNR.IsDebug() {
+		LoggerLLMNR.Msg("llmnr rcvd").Struct(frame.SrcAddr).Struct(p).Write()
+	}
+	if !p.QR() {
+		return h.processLLMNRQuery(frame, questions)
+	}
+
+	now := time.Now()
+	name.Type = moduleLLMNR
+	buffer := make([]byte, 0, 64)
+	for i := 0; i < int(p.ANCount()); i++ {
+		var rr packet.DNSResourceRecord
+		if rr, offset, err = packet.DecodeRR(p, offset, buffer[:0]); err != nil {
+			return packet.NameEntry{}, conflicts, err
+		}
+		if (rr.Type != packet.DNSTypeA && rr.Type != packet.DNSTypeAAAA) || rr.TTL == 0 {
+			continue
+		}
+		if expire := now.Add(time.Duration(rr.TTL) * time.Second); expire.After(name.Expire) {
+			name.Expire = expire
+		}
+		if strings.EqualFold(name.Name, string(rr.Name)) { // A and AAAA records for the same name
+			continue
+		}
+		name.Name = string(rr.Name)
+		if p.Flags()&(llmnrFlagC|llmnrFlagT) == 0 { // shared names do not conflict and tentative names are not in use yet
+			if c, found := h.llmnrOwner(name.Name, frame.SrcAddr, now); found {
+				conflicts = append(conflicts, c)
+			}
+		}
+	}
+	if name.Name == "" {
+		return packet.NameEntry{}, conflicts, nil
+	}
+	if frame.Host != nil {
+		frame.Host.UpdateLLMNRName(name)
+	}
+	for _, c := range conflicts {
+		LoggerLLMNR.Msg("name conflict").Struct(c).Write()
+	}
+	return name, conflicts, nil
+}
+
+// llmnrOwner records addr as the owner of name and returns a conflict if another host answered
+// for the name before the owner entry expired.
+func (h *DNSHandler) llmnrOwner(name string, addr packet.Addr, now time.Time) (conflict LLMNRConflict, found bool) {
+	key := strings.ToLower(name)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.llmnr.respond && key == strings.ToLower(h.llmnrHostName()) {
+		return LLMNRConflict{Name: name, Addrs: []packet.Addr{h.session.NICInfo.HostAddr4, addr}}, true
+	}
+	owner := h.llmnr.owners[key]
+	if owner != nil && !bytes.Equal(owner.addr.MAC, addr.MAC) && now.Before(owner.expire) {
+		conflict = LLMNRConflict{Name: name, Addrs: []packet.Addr{owner.addr, addr}}
+		found = true
+	}
+	if owner == nil {
+		if len(h.llmnr.owners) >= llmnrMaxNames {
+			return conflict, found
+		}
+		owner = &llmnrOwner{}
+		h.llmnr.owners[key] = owner
+	}
+	owner.addr = packet.Addr{MAC: packet.CopyMAC(addr.MAC), IP: addr.IP}
+	owner.expire = now.Add(llmnrOwnerExpiry)
+	return conflict, found
+}
+
+// processLLMNRQuery learns the name verified by the querier and answers queries for our host name.
+func (h *DNSHandler) processLLMNRQuery(frame packet.Frame, questions []packet.Question) (name packet.NameEntry, conflicts []LLMNRConflict, err error) {
+	p := packet.DNS(frame.Payload())
+	if len(questions) != 1 { // LLMNR queries carry a single question - RFC 4795 section 2.1.1
+		return packet.NameEntry{}, nil, packet.ErrParseFrame
+	}
+	q := questions[0]
+	qname := string(q.Name)
+
+	h.mutex.RLock()
+	ours := h.llmnr.respond && strings.EqualFold(qname, h.llmnrHostName())
+	h.mutex.RUnlock()
+	if ours {
+		if p.Flags()&llmnrFlagC != 0 { // the querier received answers from other hosts - RFC 4795 section 4.1
+			c := LLMNRConflict{Name: qname, Addrs: []packet.Addr{h.session.NICInfo.HostAddr4}}
+			LoggerLLMNR.Msg("name conflict").Struct(c).Write()
+			conflicts = append(conflicts, c)
+		}
+		if err := h.answerLLMNR(frame, q); err != nil {
+			return packet.NameEntry{}, conflicts, err
+		}
+	}
+
+	if frame.Host != nil && hostUsesName(frame.Host, qname) {
+		name = packet.NameEntry{Type: moduleLLMNR, Name: qname, Expire: time.Now().Add(defaultExpiryTime)}
+		frame.Host.UpdateLLMNRName(name)
+	}
+	return name, conflicts, nil
+}
+
+// hostUsesName returns true if the host announced name using another protocol.
+func hostUsesName(host *packet.Host, name string) bool {
+	host.MACEntry.Row.RLock()
+	defer host.MACEntry.Row.RUnlock()
+	for _, n := range []string{host.MACEntry.DHCP4Name.Name, host.MACEntry.NBNSName.Name, strings.TrimSuffix(host.MACEntry.MDNSName.Name, ".local")} {
+		if n != "" && strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerLLMNR sends a unicast response with our addresses to the querier.
+func (h *DNSHandler) answerLLMNR(frame packet.Frame, q packet.Question) error {
+	p := packet.DNS(frame.Payload())
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, 256), p.TransactionID(), packet.DNSFlagQR)
+	b.Question(string(q.Name), q.Type, q.Class)
+	b.StartAnswers()
+	count := 0
+	match := func(rrType uint16) bool { return q.Type == rrType || q.Type == packet.DNSTypeANY }
+	hdr := packet.DNSRRHeader{Name: string(q.Name), Class: packet.DNSClassINET, TTL: llmnrTTL}
+	if ip := h.session.NICInfo.HostAddr4.IP; ip.Is4() && match(packet.DNSTypeA) {
+		b.A(hdr, ip)
+		count++
+	}
+	if lla := h.session.NICInfo.HostLLA; lla.IsValid() && match(packet.DNSTypeAAAA) {
+		b.AAAA(hdr, lla.Addr())
+		count++
+	}
+	if count == 0 { // no records of the requested type; only answer types we own
+		return nil
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+
+	srcAddr := packet.Addr{MAC: h.session.NICInfo.HostAddr4.MAC, IP: h.session.NICInfo.HostAddr4.IP, Port: 5355}
+	if frame.SrcAddr.IP.Is6() {
+		if !h.session.NICInfo.HostLLA.IsValid() {
+			return nil
+		}
+		srcAddr.IP = h.session.NICInfo.HostLLA.Addr()
+	}
+	if LoggerLLMNR.IsDebug() {
+		LoggerLLMNR.Msg("send llmnr answer").Struct(frame.SrcAddr).String("name", string(q.Name)).Int("answers", count).Write()
+	}
+	return h.sendMDNS(msg, srcAddr, frame.SrcAddr)
+}
+
+// expireLLMNR deletes expired name owners. Caller must hold the lock.
+func (h *DNSHandler) expireLLMNR(now time.Time) {
+	for k, v := range h.llmnr.owners {
+		if now.After(v.expire) {
+			delete(h.llmnr.owners, k)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package dns_naming
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+func newLLMNRMessage(t *testing.T, flags uint16, name string, qType uint16, ip netip.Addr) []byte {
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, 256), 0x1234, flags)
+	b.Question(name, qType, packet.DNSClassINET)
+	if ip.IsValid() {
+		b.StartAnswers()
+		if ip.Is4() {
+			b.A(packet.DNSRRHeader{Name: name, Class: packet.DNSClassINET, TTL: 30}, ip)
+		} else {
+			b.AAAA(packet.DNSRRHeader{Name: name, Class: packet.DNSClassINET, TTL: 30}, ip)
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// newUDP6Frame returns an IPv6 udp frame from src to dst with payload.
+func newUDP6Frame(t *testing.T, session *packet.Session, src packet.Addr, dst packet.Addr, payload []byte) packet.Frame {
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IPV6, src.MAC, dst.MAC)
+	ip6 := packet.EncodeIP6(ether.Payload(), 255, src.IP, dst.IP)
+	udp := packet.EncodeUDP(ip6.Payload(), src.Port, dst.Port)
+	udp, err := udp.AppendPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip6 = ip6.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip6); err != nil {
+		t.Fatal(err)
+	}
+	return parseFrame(t, session, ether)
+}
+
+func TestDNSHandler_ProcessLLMNR(t *testing.T) {
+	setFastIntervals()
+	session, clientConn := testSession()
+	defer session.Close()
+	out := readFrames(clientConn)
+	h, err := Config{MDNSHostName: "packetd", LLMNRResponder: true}.New(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	us := packet.Addr{MAC: session.NICInfo.HostAddr4.MAC, IP: session.NICInfo.HostAddr4.IP, Port: 5355}
+	hostA := packet.Addr{MAC: net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x51}, IP: netip.MustParseAddr("192.168.0.51"), Port: 5355}
+	hostB := packet.Addr{MAC: net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x52}, IP: netip.MustParseAddr("192.168.0.52"), Port: 5355}
+	peer := packet.Addr{MAC: net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x53}, IP: netip.MustParseAddr("192.168.0.53"), Port: 50123}
+
+	// response learning
+	frame := newUDPFrame(t, session, hostA, us, newLLMNRMessage(t, packet.DNSFlagQR, "DESKTOP-A", packet.DNSTypeA, hostA.IP))
+	if frame.PayloadID != packet.PayloadLLMNR {
+		t.Fatalf("invalid payloadID=%v", frame.PayloadID)
+	}
+	name, conflicts, err := h.ProcessLLMNR(frame)
+	if err != nil || name.Name != "DESKTOP-A" || name.Type != moduleLLMNR || len(conflicts) != 0 {
+		t.Fatalf("invalid response name=%+v conflicts=%v err=%v", name, conflicts, err)
+	}
+	frame.Host.MACEntry.Row.RLock()
+	llmnrName := frame.Host.MACEntry.LLMNRName
+	frame.Host.MACEntry.Row.RUnlock()
+	if llmnrName.Name != "DESKTOP-A" {
+		t.Errorf("invalid host llmnr name %+v", llmnrName)
+	}
+
+	// ipv6 response from the same host does not conflict
+	lla := packet.Addr{MAC: hostA.MAC, IP: netip.MustParseAddr("fe80::2:3ff:fe04:551"), Port: 5355}
+	frame = newUDP6Frame(t, session, lla, packet.Addr{MAC: us.MAC, IP: netip.MustParseAddr("fe80::1"), Port: 5355},
+		newLLMNRMessage(t, packet.DNSFlagQR, "desktop-a", packet.DNSTypeAAAA, lla.IP))
+	if name, conflicts, err = h.ProcessLLMNR(frame); err != nil || name.Name != "desktop-a" || len(conflicts) != 0 {
+		t.Fatalf("invalid ipv6 response name=%+v conflicts=%v err=%v", name, conflicts, err)
+	}
+
+	// another host answers for the same name
+	frame = newUDPFrame(t, session, hostB, us, newLLMNRMessage(t, packet.DNSFlagQR, "DESKTOP-A", packet.DNSTypeA, hostB.IP))
+	if _, conflicts, err = h.ProcessLLMNR(frame); err != nil || len(conflicts) != 1 || len(conflicts[0].Addrs) != 2 ||
+		!bytes.Equal(conflicts[0].Addrs[0].MAC, hostA.MAC) || !bytes.Equal(conflicts[0].Addrs[1].MAC, hostB.MAC) {
+		t.Fatalf("invalid conflict %v err=%v", conflicts, err)
+	}
+
+	// shared name with the conflict bit set
+	frame = newUDPFrame(t, session, hostA, us, newLLMNRMessage(t, packet.DNSFlagQR|llmnrFlagC, "DESKTOP-A", packet.DNSTypeA, hostA.IP))
+	if _, conflicts, err = h.ProcessLLMNR(frame); err != nil || len(conflicts) != 0 {
+		t.Fatalf("unexpected conflict for shared name %v err=%v", conflicts, err)
+	}
+
+	// another host answers for our name
+	frame = newUDPFrame(t, session, hostB, us, newLLMNRMessage(t, packet.DNSFlagQR, "PACKETD", packet.DNSTypeA, hostB.IP))
+	if _, conflicts, err = h.ProcessLLMNR(frame); err != nil || len(conflicts) != 1 || !bytes.Equal(conflicts[0].Addrs[0].MAC, us.MAC) {
+		t.Fatalf("invalid conflict for our name %v err=%v", conflicts, err)
+	}
+
+	// answer queries for our host name
+	for nextFrame(out, time.Millisecond*100) != nil { // discard mdns probes
+	}
+	frame = newUDPFrame(t, session, peer, llmnrIPv4Addr, newLLMNRMessage(t, 0, "Packetd", packet.DNSTypeA, netip.Addr{}))
+	if _, conflicts, err = h.ProcessLLMNR(frame); err != nil || len(conflicts) != 0 {
+		t.Fatalf("invalid query conflicts=%v err=%v", conflicts, err)
+	}
+	var ether packet.Ether
+	for ether = nextFrame(out, time.Second); ether != nil && packet.UDP(packet.IP4(ether.Payload()).Payload()).SrcPort() != 5355; ether = nextFrame(out, time.Second) {
+	}
+	if ether == nil {
+		t.Fatal("missing llmnr answer")
+	}
+	udp := packet.UDP(packet.IP4(ether.Payload()).Payload())
+	answer := packet.DNS(udp.Payload())
+	rrs := decodeRecords(t, answer)
+	if !bytes.Equal(ether.Dst(), peer.MAC) || udp.DstPort() != peer.Port || !answer.QR() || answer.TransactionID() != 0x1234 ||
+		answer.QDCount() != 1 || answer.ANCount() != 1 || rrs["Packetd/A"].IP() != us.IP {
+		t.Fatalf("invalid llmnr answer %s", answer)
+	}
+
+	// query with the conflict bit for our name
+	frame = newUDPFrame(t, session, peer, llmnrIPv4Addr, newLLMNRMessage(t, llmnrFlagC, "packetd", packet.DNSTypeA, netip.Addr{}))
+	if _, conflicts, err = h.ProcessLLMNR(frame); err != nil || len(conflicts) != 1 || conflicts[0].Name != "packetd" {
+		t.Fatalf("invalid conflict notification %v err=%v", conflicts, err)
+	}
+
+	// learn the name verified by the querier
+	frame = newUDPFrame(t, session, peer, llmnrIPv4Addr, newLLMNRMessage(t, 0, "LAPTOP", packet.DNSTypeA, netip.Addr{}))
+	if name, _, err = h.ProcessLLMNR(frame); err != nil || name.Name != "" {
+		t.Fatalf("unexpected name for unknown host name %+v err=%v", name, err)
+	}
+	frame.Host.UpdateDHCP4Name(packet.NameEntry{Type: "dhcp4", Name: "laptop"})
+	if name, _, err = h.ProcessLLMNR(frame); err != nil || name.Name != "LAPTOP" {
+		t.Fatalf("invalid name for verification query %+v err=%v", name, err)
+	}
+
+	// owners expire
+	h.MinuteTicker(time.Now().Add(llmnrOwnerExpiry + time.Minute))
+	frame = newUDPFrame(t, session, hostB, us, newLLMNRMessage(t, packet.DNSFlagQR, "DESKTOP-A", packet.DNSTypeA, hostB.IP))
+	if _, conflicts, err = h.ProcessLLMNR(frame); err != nil || len(conflicts) != 0 {
+		t.Fatalf("unexpected conflict after expiry %v err=%v", conflicts, err)
+	}
+}
+
+func TestDNSHandler_SendLLMNRQuery(t *testing.T) {
+	session, clientConn := testSession()
+	defer session.Close()
+	h, _ := New(session)
+	defer h.Close()
+
+	if err := h.SendLLMNRQuery("desktop-a"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, packet.EthMaxSize)
+	n, _, err := clientConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ether := packet.Ether(buf[:n])
+	ip4 := packet.IP4(ether.Payload())
+	udp := packet.UDP(ip4.Payload())
+	questions, _, err := packet.DecodeQuestions(packet.DNS(udp.Payload()))
+	if err != nil || ip4.Dst() != llmnrIPv4Addr.IP || !bytes.Equal(ether.Dst(), llmnrIPv4Addr.MAC) || udp.DstPort() != 5355 ||
+		len(questions) != 1 || string(questions[0].Name) != "desktop-a" || questions[0].Type != packet.DNSTypeA {
+		t.Fatalf("invalid llmnr query %s", ether)
+	}
+}
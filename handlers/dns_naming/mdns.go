@@ -1,6 +1,7 @@
 package dns_naming
 
 import (
+	"bytes"
 	"net"
 	"net/netip"
 	"strings"
@@ -57,8 +58,6 @@ var (
 	mdnsIPv4Addr = packet.Addr{MAC: packet.EthBroadcast, IP: netip.AddrFrom4([4]byte{224, 0, 0, 251}), Port: 5353}
 	mdnsIPv6Addr = packet.Addr{MAC: packet.EthBroadcast, IP: netip.MustParseAddr("ff02::fb"), Port: 5353}
 
-	// TODO: do we need LLMNR? perhaps useful when a new windows machine is pluggedin?
-
 	// Link Local Multicast Name Resolution
 	// https://datatracker.ietf.org/doc/html/rfc4795
 	//
@@ -70,8 +69,8 @@ var (
 	//
 	// Windows hosts will query a name on startup to prevent duplicates on the LAN
 	// https://docs.microsoft.com/en-us/previous-versions//bb878128(v=technet.10)
-	llmnrIPv4Addr = packet.Addr{MAC: packet.EthBroadcast, IP: netip.AddrFrom4([4]byte{224, 0, 0, 251}), Port: 5355}
-	llmnrIPv6Addr = packet.Addr{MAC: packet.EthBroadcast, IP: netip.MustParseAddr("FF02:0:0:0:0:0:1:3"), Port: 5355}
+	llmnrIPv4Addr = packet.Addr{MAC: net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfc}, IP: netip.AddrFrom4([4]byte{224, 0, 0, 252}), Port: 5355}
+	llmnrIPv6Addr = packet.Addr{MAC: net.HardwareAddr{0x33, 0x33, 0x00, 0x01, 0x00, 0x03}, IP: netip.MustParseAddr("FF02:0:0:0:0:0:1:3"), Port: 5355}
 )
 
 // SendMDNSQuery send a multicast DNS query
@@ -82,11 +81,6 @@ func (h *DNSHandler) SendMDNSQuery(name string) (err error) {
 	return h.sendMDNSQuery(h.session.NICInfo.HostAddr4, mdnsIPv4Addr, dnsmessage.TypeALL, name)
 }
 
-// SendLLMNRQuery send a multicast LLMNR query
-func (h *DNSHandler) SendLLMNRQuery(name string) (err error) {
-	return h.sendMDNSQuery(h.session.NICInfo.HostAddr4, llmnrIPv4Addr, dnsmessage.TypePTR, name)
-}
-
 func (h *DNSHandler) sendMDNSQuery(srcAddr packet.Addr, dstAddr packet.Addr, mtype dnsmessage.Type, name string) (err error) {
 	// TODO: mdns request unicast for response messages to minimise traffic. How???
 	//    To avoid large floods of potentially unnecessary responses in these
@@ -128,12 +122,19 @@ func (h *DNSHandler) sendMDNS(buf []byte, srcAddr packet.Addr, dstAddr packet.Ad
 	//  multicast address 224.0.0.251 or its IPv6 equivalent FF02::FB, except
 	//  when generating a reply to a query that explicitly requested a
 	//  unicast response
+	//
+	// Use the destination port if the source port is not set; replies to legacy unicast
+	// queries are sent from port 5353 to the query source port.
+	srcPort := srcAddr.Port
+	if srcPort == 0 {
+		srcPort = dstAddr.Port
+	}
 
 	// IP4
 	if srcAddr.IP.Is4() {
 		ether = packet.EncodeEther(ether, syscall.ETH_P_IP, h.session.NICInfo.HostAddr4.MAC, dstAddr.MAC)
 		ip4 := packet.EncodeIP4(ether.Payload(), 255, srcAddr.IP, dstAddr.IP)
-		udp := packet.EncodeUDP(ip4.Payload(), dstAddr.Port, dstAddr.Port) // same port number for src and dst
+		udp := packet.EncodeUDP(ip4.Payload(), srcPort, dstAddr.Port)
 		if udp, err = udp.AppendPayload(buf); err != nil {
 			return err
 		}
@@ -150,7 +151,7 @@ func (h *DNSHandler) sendMDNS(buf []byte, srcAddr packet.Addr, dstAddr packet.Ad
 	// IP6
 	ether = packet.EncodeEther(ether, syscall.ETH_P_IPV6, h.session.NICInfo.HostAddr4.MAC, dstAddr.MAC)
 	ip6 := packet.EncodeIP6(ether.Payload(), 255, srcAddr.IP, dstAddr.IP)
-	udp := packet.EncodeUDP(ip6.Payload(), dstAddr.Port, dstAddr.Port) // same port number for src and dst
+	udp := packet.EncodeUDP(ip6.Payload(), srcPort, dstAddr.Port)
 	if udp, err = udp.AppendPayload(buf); err != nil {
 		return err
 	}
@@ -162,6 +163,9 @@ func (h *DNSHandler) sendMDNS(buf []byte, srcAddr packet.Addr, dstAddr packet.Ad
 	return nil
 }
 
+// SendSleepProxyResponse sends a sleep proxy announcement with a fixed name.
+//
+// Deprecated: use EnableSleepProxy to publish the sleep proxy service and accept registrations.
 func (h *DNSHandler) SendSleepProxyResponse(srcAddr packet.Addr, dstAddr packet.Addr, id uint16, name string) (err error) {
 	if Debug {
 		LoggerMDNS.Msg("send sleep proxy announcement").Struct(dstAddr).Write()
@@ -323,6 +327,23 @@ func (h *DNSHandler) ProcessMDNS(frame packet.Frame) (ipv4 []packet.IPNameEntry,
 		addr = frame.Host.Addr
 	}
 
+	// registration from a host going to sleep
+	if packet.DNS(frame.Payload()).OpCode() == dnsOpCodeUpdate {
+		return ipv4, ipv6, h.processSleepProxyUpdate(frame)
+	}
+
+	// check for conflicts with the names published by our host and answer queries for our services
+	if !bytes.Equal(frame.SrcAddr.MAC, h.session.NICInfo.HostAddr4.MAC) {
+		if err := h.processMDNSConflicts(frame.SrcAddr.MAC, packet.DNS(frame.Payload())); err != nil && Debug {
+			LoggerMDNS.Msg("invalid records").MAC("mac", frame.SrcAddr.MAC).Error(err).Write()
+		}
+		if !dnsHeader.Response {
+			if err := h.processMDNSQuery(frame); err != nil {
+				LoggerMDNS.Msg("failed to answer query").MAC("mac", frame.SrcAddr.MAC).Error(err).Write()
+			}
+		}
+	}
+
 	// if query, we can infer some information.
 	if !dnsHeader.Response {
 		var line *fastlog.Line
@@ -363,6 +384,11 @@ func (h *DNSHandler) ProcessMDNS(frame packet.Frame) (ipv4 []packet.IPNameEntry,
 		LoggerMDNS.Msg("response rcvd").Struct(addr).Struct(packet.DNS(frame.Payload())).Write()
 	}
 
+	// process services before the cache check; responses from the same host share the same ID
+	if err := h.processMDNSServices(frame.SrcAddr.MAC, packet.DNS(frame.Payload()), time.Now()); err != nil && Debug {
+		LoggerMDNS.Msg("invalid service records").MAC("mac", frame.SrcAddr.MAC).Error(err).Write()
+	}
+
 	if _, found := h.getMDNSCache(frame.SrcAddr.MAC, dnsHeader.ID); found {
 		return nil, nil, nil
 	}
@@ -453,7 +479,7 @@ func (h *DNSHandler) ProcessMDNS(frame packet.Frame) (ipv4 []packet.IPNameEntry,
 			r, err := p.PTRResource()
 			if err != nil {
 				LoggerMDNS.Msg("invalid PTR resource").String("name", hdr.Name.String()).Error(err).Write()
-				p.SkipAnswer()
+				skipResource(&p, section)
 				continue
 			}
 			if Debug {
@@ -478,7 +504,7 @@ func (h *DNSHandler) ProcessMDNS(frame packet.Frame) (ipv4 []packet.IPNameEntry,
 				} else {
 					LoggerMDNS.Msg("invalid SRV resource").String("name", hdr.Name.String()).Error(err).Write()
 				}
-				p.SkipAnswer()
+				skipResource(&p, section)
 				continue
 			}
 			if Debug {
@@ -489,7 +515,7 @@ func (h *DNSHandler) ProcessMDNS(frame packet.Frame) (ipv4 []packet.IPNameEntry,
 			r, err := p.TXTResource()
 			if err != nil {
 				LoggerMDNS.Msg("invalid TXT resource").String("name", hdr.Name.String()).Error(err).Write()
-				p.SkipAnswer()
+				skipResource(&p, section)
 				continue
 			}
 			if m := parseTXT(r.TXT); m != "" {
@@ -504,7 +530,7 @@ func (h *DNSHandler) ProcessMDNS(frame packet.Frame) (ipv4 []packet.IPNameEntry,
 			if err != nil {
 				// fmt.Printf("mdns  : error invalid OPT resource name=%s error=[%s]\n", hdr.Name, err)
 				LoggerMDNS.Msg("invalid OPT resource").String("name", hdr.Name.String()).Error(err).Write()
-				p.SkipAnswer()
+				skipResource(&p, section)
 				continue
 			}
 			if Debug {
@@ -516,16 +542,28 @@ func (h *DNSHandler) ProcessMDNS(frame packet.Frame) (ipv4 []packet.IPNameEntry,
 				// fmt.Printf("mdns  : NSEC resource type not implemented %+v\n", hdr)
 				LoggerMDNS.Msg("NSEC resource not implemented").String("name", hdr.Name.String()).Sprintf("hdr", hdr).Write()
 			}
-			p.SkipAnswer()
+			skipResource(&p, section)
 
 		default:
 			// fmt.Printf("mdns  : error unexpected resource type %+v\n", hdr)
 			LoggerMDNS.Msg("ignoring unexpected resource type").String("name", hdr.Name.String()).Sprintf("hdr", hdr).Write()
-			p.SkipAnswer()
+			skipResource(&p, section)
 		}
 	}
 }
 
+// skipResource skips the current resource in section. Calling SkipAnswer outside
+// the answer section returns an error and leaves the parser in the same position.
+func skipResource(p *dnsmessage.Parser, section string) error {
+	switch section {
+	case "authority":
+		return p.SkipAuthority()
+	case "additional":
+		return p.SkipAdditional()
+	}
+	return p.SkipAnswer()
+}
+
 func mustNewName(name string) dnsmessage.Name {
 	n, err := dnsmessage.NewName(name)
 	if err != nil {
@@ -0,0 +1,458 @@
+package dns_naming
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+// DNS-SD service browser - RFC 6763
+//
+// The browser enumerates the service types on the LAN with a PTR query for
+// _services._dns-sd._udp.local and follows each answer to build the list of
+// service instances advertised by each host:
+//
+//    _services._dns-sd._udp.local  PTR  _sonos._tcp.local
+//    _sonos._tcp.local             PTR  Living Room._sonos._tcp.local
+//    Living Room._sonos._tcp.local SRV  0 0 1443 sonosB8E937524E2C.local
+//    Living Room._sonos._tcp.local TXT  "vers=3" "protovers=1.24.1"
+//    sonosB8E937524E2C.local       A    192.168.0.101
+//
+// Hosts usually send all records in the same response; the browser sends follow up queries
+// for missing SRV, TXT and A records only.
+//
+// A record with TTL zero is a goodbye record and removes the record from the inventory.
+// The top bit in the record class is the cache-flush bit; it tells the receiver that the record
+// replaces all previous records with the same name and type - RFC 6762 section 10.2.
+
+const (
+	mdnsCacheFlush     = 0x8000           // cache-flush bit in the mdns record class
+	mdnsBrowseInterval = time.Hour        // interval between service enumeration queries
+	mdnsFollowInterval = time.Minute * 10 // minimum interval between follow up queries for the same name
+	mdnsMaxServices    = 64               // maximum number of service instances per host
+)
+
+// MDNSService is a service instance advertised by a host.
+type MDNSService struct {
+	Instance string            // service instance name; i.e. "Living Room._sonos._tcp.local"
+	Service  string            // service type; i.e. "_sonos._tcp.local"
+	Host     string            // target host in SRV record; i.e. "sonosB8E937524E2C.local"
+	Port     uint16            // service port in SRV record
+	TXT      map[string]string // TXT key/value pairs; nil if TXT record not received
+	IPs      []netip.Addr      // target host addresses
+	Expire   time.Time
+}
+
+// MDNSServiceAction is the type of change in a service instance.
+type MDNSServiceAction int
+
+const (
+	MDNSServiceAdded MDNSServiceAction = iota + 1
+	MDNSServiceUpdated
+	MDNSServiceRemoved
+)
+
+func (a MDNSServiceAction) String() string {
+	switch a {
+	case MDNSServiceAdded:
+		return "added"
+	case MDNSServiceUpdated:
+		return "updated"
+	case MDNSServiceRemoved:
+		return "removed"
+	}
+	return "invalid"
+}
+
+// MDNSServiceEvent is sent to the event channel when a host service instance changes.
+type MDNSServiceEvent struct {
+	Action  MDNSServiceAction
+	MAC     net.HardwareAddr
+	Service MDNSService
+}
+
+// hostServices holds the service inventory for a MACEntry.
+type hostServices struct {
+	instances map[string]*MDNSService // key is lowercase instance name
+	addrs     map[string][]netip.Addr // target host addresses; key is lowercase host name
+}
+
+// mdnsQuestion is a follow up question for a missing record.
+type mdnsQuestion struct {
+	name  string
+	qType uint16
+}
+
+func (s *MDNSService) copy() MDNSService {
+	c := *s
+	if s.TXT != nil {
+		c.TXT = make(map[string]string, len(s.TXT))
+		for k, v := range s.TXT {
+			c.TXT[k] = v
+		}
+	}
+	c.IPs = append([]netip.Addr(nil), s.IPs...)
+	return c
+}
+
+func (s *MDNSService) equal(o *MDNSService) bool {
+	if s.Host != o.Host || s.Port != o.Port || len(s.TXT) != len(o.TXT) || (s.TXT == nil) != (o.TXT == nil) || len(s.IPs) != len(o.IPs) {
+		return false
+	}
+	for k, v := range s.TXT {
+		if ov, found := o.TXT[k]; !found || ov != v {
+			return false
+		}
+	}
+	for i := range s.IPs {
+		if s.IPs[i] != o.IPs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceType returns the service type for a service instance name or an empty string if name
+// is not a service instance. i.e. "Living Room._sonos._tcp.local" returns "_sonos._tcp.local".
+func serviceType(instance string) string {
+	lower := strings.ToLower(instance)
+	if !strings.HasSuffix(lower, "._tcp.local") && !strings.HasSuffix(lower, "._udp.local") {
+		return ""
+	}
+	start := strings.LastIndex(lower[:len(lower)-len("._tcp.local")], "._")
+	if start == -1 {
+		return ""
+	}
+	return instance[start+1:]
+}
+
+// isServiceType returns true if name is a service type; i.e. "_sonos._tcp.local".
+func isServiceType(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(lower, "_") && strings.Count(lower, ".") == 2 &&
+		(strings.HasSuffix(lower, "._tcp.local") || strings.HasSuffix(lower, "._udp.local"))
+}
+
+// parseTXTPairs returns the key/value pairs in a DNS-SD TXT record - RFC 6763 section 6.
+// Keys are case insensitive; only the first occurrence of a key is used. A key without '=' maps to "".
+func parseTXTPairs(txt []string) map[string]string {
+	m := make(map[string]string, len(txt))
+	for _, s := range txt {
+		key, value := s, ""
+		if n := strings.IndexByte(s, '='); n != -1 {
+			key, value = s[:n], s[n+1:]
+		}
+		key = strings.ToLower(key)
+		if key == "" {
+			continue
+		}
+		if _, found := m[key]; !found {
+			m[key] = value
+		}
+	}
+	return m
+}
+
+// BrowseMDNS sends a service enumeration query. Hosts answer with the list of service types
+// and the handler follows each type to build the service inventory for each host.
+func (h *DNSHandler) BrowseMDNS() error {
+	h.mutex.Lock()
+	h.lastBrowse = time.Now()
+	h.mutex.Unlock()
+	return h.sendMDNSQuestions([]mdnsQuestion{{name: strings.TrimSuffix(MDNSServiceDiscovery, "."), qType: packet.DNSTypePTR}})
+}
+
+// sendMDNSQuestions sends a single multicast query with all questions.
+func (h *DNSHandler) sendMDNSQuestions(questions []mdnsQuestion) error {
+	if len(questions) == 0 {
+		return nil
+	}
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, 512), 0, 0) // mdns queries have ID zero - RFC 6762 section 18.1
+	for _, q := range questions {
+		b.Question(q.name, q.qType, packet.DNSClassINET)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+	if Debug {
+		l := LoggerMDNS.Msg("send browse query")
+		for _, q := range questions {
+			l.String("qname", q.name).Uint16("qtype", q.qType)
+		}
+		l.Write()
+	}
+	return h.sendMDNS(msg, h.session.NICInfo.HostAddr4, mdnsIPv4Addr)
+}
+
+// processMDNSServices updates the service inventory for the host sending the response, notifies
+// the changes and sends follow up queries for missing records.
+func (h *DNSHandler) processMDNSServices(mac net.HardwareAddr, p packet.DNS, now time.Time) error {
+	events, questions, err := h.updateServices(mac, p, now)
+	h.notifyServices(events)
+	if err != nil {
+		return err
+	}
+	return h.sendMDNSQuestions(questions)
+}
+
+// updateServices decodes all records in the response and updates the host inventory.
+func (h *DNSHandler) updateServices(mac net.HardwareAddr, p packet.DNS, now time.Time) (events []MDNSServiceEvent, questions []mdnsQuestion, err error) {
+	offset, err := p.AnswerOffset()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	hs := h.services[string(mac)]
+	if hs == nil {
+		hs = &hostServices{instances: make(map[string]*MDNSService), addrs: make(map[string][]netip.Addr)}
+	}
+	before := make(map[string]MDNSService, len(hs.instances))
+	for k, v := range hs.instances {
+		before[k] = v.copy()
+	}
+
+	instance := func(name string, service string) *MDNSService {
+		key := strings.ToLower(name)
+		s := hs.instances[key]
+		if s == nil {
+			if len(hs.instances) >= mdnsMaxServices {
+				return nil
+			}
+			s = &MDNSService{Instance: name, Service: service}
+			hs.instances[key] = s
+		}
+		return s
+	}
+
+	flushed := make(map[string]bool)
+	txts := make(map[string]map[string]string) // TXT records may come before the PTR and SRV records
+	buffer := make([]byte, 0, 256)
+	count := int(p.ANCount()) + int(p.NSCount()) + int(p.ARCount())
+	for i := 0; i < count; i++ {
+		var rr packet.DNSResourceRecord
+		if rr, offset, err = packet.DecodeRR(p, offset, buffer[:0]); err != nil {
+			break // keep the records decoded so far
+		}
+		name := string(rr.Name)
+		key := strings.ToLower(name)
+		expire := now.Add(time.Duration(rr.TTL) * time.Second)
+
+		switch rr.Type {
+		case packet.DNSTypePTR:
+			target, err := rr.DecodeName(p, rr.Name[len(rr.Name):])
+			if err != nil {
+				continue
+			}
+			switch {
+			case key+"." == MDNSServiceDiscovery:
+				if rr.TTL > 0 && isServiceType(string(target)) {
+					questions = append(questions, mdnsQuestion{name: string(target), qType: packet.DNSTypePTR})
+				}
+			case isServiceType(name):
+				if rr.TTL == 0 {
+					delete(hs.instances, strings.ToLower(string(target)))
+					continue
+				}
+				if s := instance(string(target), name); s != nil && s.Expire.Before(expire) {
+					s.Expire = expire
+				}
+			}
+
+		case packet.DNSTypeSRV:
+			service := serviceType(name)
+			if service == "" {
+				continue
+			}
+			if rr.TTL == 0 {
+				delete(hs.instances, key)
+				continue
+			}
+			srv, err := rr.DecodeSRV(p, rr.Name[len(rr.Name):])
+			if err != nil {
+				continue
+			}
+			if s := instance(name, service); s != nil {
+				s.Host, s.Port = srv.Target, srv.Port
+				if s.Expire.Before(expire) {
+					s.Expire = expire
+				}
+			}
+
+		case packet.DNSTypeTXT:
+			service := serviceType(name)
+			if service == "" || rr.TTL == 0 { // TXT goodbye does not remove the instance
+				continue
+			}
+			txt, err := rr.DecodeTXT()
+			if err != nil {
+				continue
+			}
+			txts[key] = parseTXTPairs(txt)
+
+		case packet.DNSTypeA, packet.DNSTypeAAAA:
+			ip := rr.IP()
+			if !ip.IsValid() {
+				continue
+			}
+			if rr.TTL == 0 {
+				hs.addrs[key] = removeAddr(hs.addrs[key], ip)
+				continue
+			}
+			if flushKey := key + string(rune(rr.Type)); rr.Class&mdnsCacheFlush != 0 && !flushed[flushKey] {
+				flushed[flushKey] = true // flush A or AAAA records only
+				list := hs.addrs[key][:0]
+				for _, v := range hs.addrs[key] {
+					if v.Is4() != ip.Is4() {
+						list = append(list, v)
+					}
+				}
+				hs.addrs[key] = list
+			}
+			if !containsAddr(hs.addrs[key], ip) {
+				hs.addrs[key] = append(hs.addrs[key], ip)
+			}
+		}
+	}
+
+	// TXT records without PTR or SRV records are ignored; i.e. _device-info
+	for k, txt := range txts {
+		if s := hs.instances[k]; s != nil {
+			s.TXT = txt
+		}
+	}
+
+	// link instances to target host addresses and find missing records
+	for k, s := range hs.instances {
+		s.IPs = append(s.IPs[:0], hs.addrs[strings.ToLower(s.Host)]...)
+		switch {
+		case s.Host == "":
+			questions = append(questions, mdnsQuestion{name: s.Instance, qType: packet.DNSTypeSRV})
+		case len(s.IPs) == 0:
+			questions = append(questions, mdnsQuestion{name: s.Host, qType: packet.DNSTypeA})
+		}
+		if s.TXT == nil {
+			questions = append(questions, mdnsQuestion{name: s.Instance, qType: packet.DNSTypeTXT})
+		}
+		old, found := before[k]
+		switch {
+		case !found:
+			events = append(events, MDNSServiceEvent{Action: MDNSServiceAdded, MAC: mac, Service: s.copy()})
+		case !old.equal(s):
+			events = append(events, MDNSServiceEvent{Action: MDNSServiceUpdated, MAC: mac, Service: s.copy()})
+		}
+	}
+	for k, old := range before {
+		if _, found := hs.instances[k]; !found {
+			events = append(events, MDNSServiceEvent{Action: MDNSServiceRemoved, MAC: mac, Service: old})
+		}
+	}
+	if len(hs.instances) > 0 {
+		h.services[string(mac)] = hs
+	} else {
+		delete(h.services, string(mac))
+	}
+	return events, h.filterQuestions(questions, now), err
+}
+
+// filterQuestions removes questions sent recently to avoid flooding the LAN with queries.
+// Caller must hold the lock.
+func (h *DNSHandler) filterQuestions(questions []mdnsQuestion, now time.Time) []mdnsQuestion {
+	list := questions[:0]
+	for _, q := range questions {
+		key := strings.ToLower(q.name) + string([]byte{byte(q.qType >> 8), byte(q.qType)})
+		if last, found := h.mdnsQueried[key]; found && now.Sub(last) < mdnsFollowInterval {
+			continue
+		}
+		h.mdnsQueried[key] = now
+		list = append(list, q)
+	}
+	return list
+}
+
+// expireServices removes expired service instances and returns the removal events.
+// Caller must hold the lock.
+func (h *DNSHandler) expireServices(now time.Time) (events []MDNSServiceEvent) {
+	for mac, hs := range h.services {
+		for k, s := range hs.instances {
+			if now.After(s.Expire) {
+				delete(hs.instances, k)
+				events = append(events, MDNSServiceEvent{Action: MDNSServiceRemoved, MAC: net.HardwareAddr(mac), Service: *s})
+			}
+		}
+		if len(hs.instances) == 0 {
+			delete(h.services, mac)
+		}
+	}
+	for k, v := range h.mdnsQueried {
+		if now.Sub(v) >= mdnsFollowInterval {
+			delete(h.mdnsQueried, k)
+		}
+	}
+	return events
+}
+
+// notifyServices sends the events to the event channel if set. Events are discarded if the channel is full.
+func (h *DNSHandler) notifyServices(events []MDNSServiceEvent) {
+	for _, e := range events {
+		if Debug {
+			LoggerMDNS.Msg("service").String("action", e.Action.String()).MAC("mac", e.MAC).String("instance", e.Service.Instance).
+				String("host", e.Service.Host).Uint16("port", e.Service.Port).Write()
+		}
+		if h.serviceEvents == nil {
+			continue
+		}
+		select {
+		case h.serviceEvents <- e:
+		default:
+			LoggerMDNS.Msg("service event channel full").MAC("mac", e.MAC).String("instance", e.Service.Instance).Write()
+		}
+	}
+}
+
+// MDNSServices returns the service instances advertised by the host.
+func (h *DNSHandler) MDNSServices(mac net.HardwareAddr) []MDNSService {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	hs := h.services[string(mac)]
+	if hs == nil {
+		return nil
+	}
+	list := make([]MDNSService, 0, len(hs.instances))
+	for _, s := range hs.instances {
+		list = append(list, s.copy())
+	}
+	return list
+}
+
+// DeleteMDNSServices removes the service inventory for the host.
+func (h *DNSHandler) DeleteMDNSServices(mac net.HardwareAddr) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.services, string(mac))
+}
+
+func containsAddr(list []netip.Addr, ip netip.Addr) bool {
+	for _, v := range list {
+		if v == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func removeAddr(list []netip.Addr, ip netip.Addr) []netip.Addr {
+	for i, v := range list {
+		if v == ip {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
@@ -0,0 +1,266 @@
+package dns_naming
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// readQueries returns a channel with the questions in each mdns query sent by the handler.
+func readQueries(conn net.PacketConn) chan []mdnsQuestion {
+	out := make(chan []mdnsQuestion, 16)
+	go func() {
+		buf := make([]byte, packet.EthMaxSize)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil || n == 0 {
+				return
+			}
+			ether := packet.Ether(buf[:n])
+			udp := packet.UDP(packet.IP4(ether.Payload()).Payload())
+			if udp.DstPort() != 5353 {
+				continue
+			}
+			var p dnsmessage.Parser
+			if _, err := p.Start(udp.Payload()); err != nil {
+				continue
+			}
+			questions, _ := p.AllQuestions()
+			list := []mdnsQuestion{}
+			for _, q := range questions {
+				list = append(list, mdnsQuestion{name: strings.TrimSuffix(q.Name.String(), "."), qType: uint16(q.Type)})
+			}
+			out <- list
+		}
+	}()
+	return out
+}
+
+func nextQuery(t *testing.T, queries chan []mdnsQuestion) []mdnsQuestion {
+	t.Helper()
+	select {
+	case q := <-queries:
+		return q
+	case <-time.After(time.Millisecond * 100):
+		return nil
+	}
+}
+
+func nextEvent(t *testing.T, events chan MDNSServiceEvent) MDNSServiceEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Millisecond * 100):
+		t.Fatal("missing service event")
+	}
+	return MDNSServiceEvent{}
+}
+
+// newMDNSFrame returns an mdns response frame from mac with the records added by fn.
+func newMDNSFrame(t *testing.T, session *packet.Session, mac net.HardwareAddr, ip netip.Addr, fn func(b *packet.DNSBuilder)) packet.Frame {
+	return newMDNSPacket(t, session, packet.Addr{MAC: mac, IP: ip, Port: 5353}, 0, packet.DNSFlagQR|packet.DNSFlagAA, fn)
+}
+
+// newMDNSPacket returns an mdns frame from src with the questions and records added by fn.
+func newMDNSPacket(t *testing.T, session *packet.Session, src packet.Addr, id uint16, flags uint16, fn func(b *packet.DNSBuilder)) packet.Frame {
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, 512), id, flags)
+	fn(&b)
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, src.MAC, mdnsIPv4Addr.MAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 255, src.IP, mdnsIPv4Addr.IP)
+	udp := packet.EncodeUDP(ip4.Payload(), src.Port, 5353)
+	udp, _ = udp.AppendPayload(msg)
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := session.Parse(ether)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func findService(list []MDNSService, instance string) (MDNSService, bool) {
+	for _, s := range list {
+		if s.Instance == instance {
+			return s, true
+		}
+	}
+	return MDNSService{}, false
+}
+
+func TestMDNSBrowser_Inventory(t *testing.T) {
+	session, clientConn := testSession()
+	defer session.Close()
+	queries := readQueries(clientConn)
+	events := make(chan MDNSServiceEvent, 16)
+	h, err := Config{MDNSEventChan: events}.New(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	if err := h.BrowseMDNS(); err != nil {
+		t.Fatal(err)
+	}
+	if q := nextQuery(t, queries); len(q) != 1 || q[0].name != "_services._dns-sd._udp.local" || q[0].qType != packet.DNSTypePTR {
+		t.Fatalf("invalid browse query %+v", q)
+	}
+
+	frame, err := session.Parse(frameMacBook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := h.ProcessMDNS(frame); err != nil {
+		t.Fatal(err)
+	}
+	mac := frame.SrcAddr.MAC
+	list := h.MDNSServices(mac)
+	if len(list) != 2 {
+		t.Fatalf("invalid services %+v", list)
+	}
+	osc, _ := findService(list, "Goth._osc._udp.local")
+	if osc.Service != "_osc._udp.local" || osc.Host != "Goth.local" || osc.Port != 7000 || osc.TXT["applelogic"] != "LogicProX" ||
+		osc.TXT["mfk"] != "1" || len(osc.IPs) != 3 {
+		t.Errorf("invalid osc service %+v", osc)
+	}
+	remote, _ := findService(list, "3hhn4qluf9wvx._apple-lgremote._tcp.local")
+	if remote.Port != 53936 || remote.TXT["_d"] != "Goth" || remote.TXT["/hosttype"] != "0" {
+		t.Errorf("invalid remote service %+v", remote)
+	}
+	if e1, e2 := nextEvent(t, events), nextEvent(t, events); e1.Action != MDNSServiceAdded || e2.Action != MDNSServiceAdded {
+		t.Errorf("invalid events %v %v", e1.Action, e2.Action)
+	}
+
+	// follow the service types in the enumeration answers only; all other records are present
+	q := nextQuery(t, queries)
+	if len(q) != 2 || q[0].qType != packet.DNSTypePTR || q[1].qType != packet.DNSTypePTR {
+		t.Fatalf("invalid follow up query %+v", q)
+	}
+
+	// same response does not generate events or queries
+	h.ProcessMDNS(frame)
+	if q := nextQuery(t, queries); q != nil {
+		t.Errorf("unexpected query %+v", q)
+	}
+	if len(events) != 0 {
+		t.Errorf("unexpected events %d", len(events))
+	}
+
+	// goodbye removes the instance
+	ip := netip.MustParseAddr("192.168.0.110")
+	frame = newMDNSFrame(t, session, mac, ip, func(b *packet.DNSBuilder) {
+		b.PTR(packet.DNSRRHeader{Name: "_osc._udp.local", Class: packet.DNSClassINET, TTL: 0}, "Goth._osc._udp.local")
+	})
+	h.ProcessMDNS(frame)
+	if e := nextEvent(t, events); e.Action != MDNSServiceRemoved || e.Service.Instance != "Goth._osc._udp.local" {
+		t.Errorf("invalid goodbye event %+v", e)
+	}
+	if list := h.MDNSServices(mac); len(list) != 1 {
+		t.Fatalf("invalid services after goodbye %+v", list)
+	}
+
+	// cache flush replaces the A records and keeps AAAA records
+	newIP := netip.MustParseAddr("192.168.0.111")
+	frame = newMDNSFrame(t, session, mac, newIP, func(b *packet.DNSBuilder) {
+		b.A(packet.DNSRRHeader{Name: "Goth.local", Class: packet.DNSClassINET | mdnsCacheFlush, TTL: 120}, newIP)
+	})
+	h.ProcessMDNS(frame)
+	e := nextEvent(t, events)
+	if e.Action != MDNSServiceUpdated || len(e.Service.IPs) != 3 || !containsAddr(e.Service.IPs, newIP) || containsAddr(e.Service.IPs, ip) {
+		t.Errorf("invalid cache flush event %+v", e)
+	}
+
+	// expiry
+	h.MinuteTicker(time.Now().Add(time.Hour * 2))
+	if e := nextEvent(t, events); e.Action != MDNSServiceRemoved {
+		t.Errorf("invalid expire event %+v", e)
+	}
+	if list := h.MDNSServices(mac); len(list) != 0 {
+		t.Errorf("invalid services after expiry %+v", list)
+	}
+}
+
+func TestMDNSBrowser_FollowUp(t *testing.T) {
+	session, clientConn := testSession()
+	defer session.Close()
+	queries := readQueries(clientConn)
+	h, err := New(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	mac := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x06}
+	ip := netip.MustParseAddr("192.168.0.30")
+	frame := newMDNSFrame(t, session, mac, ip, func(b *packet.DNSBuilder) {
+		b.PTR(packet.DNSRRHeader{Name: "_ipp._tcp.local", Class: packet.DNSClassINET, TTL: 4500}, "Office Printer._ipp._tcp.local")
+	})
+	h.ProcessMDNS(frame)
+	q := nextQuery(t, queries)
+	if len(q) != 2 || q[0].name != "Office Printer._ipp._tcp.local" || q[0].qType != packet.DNSTypeSRV || q[1].qType != packet.DNSTypeTXT {
+		t.Fatalf("invalid srv query %+v", q)
+	}
+
+	frame = newMDNSFrame(t, session, mac, ip, func(b *packet.DNSBuilder) {
+		b.SRV(packet.DNSRRHeader{Name: "Office Printer._ipp._tcp.local", Class: packet.DNSClassINET | mdnsCacheFlush, TTL: 120},
+			packet.DNSSRV{Port: 631, Target: "printer.local"})
+	})
+	h.ProcessMDNS(frame)
+	q = nextQuery(t, queries)
+	if len(q) != 1 || q[0].name != "printer.local" || q[0].qType != packet.DNSTypeA {
+		t.Fatalf("invalid address query %+v", q)
+	}
+
+	frame = newMDNSFrame(t, session, mac, ip, func(b *packet.DNSBuilder) {
+		b.TXT(packet.DNSRRHeader{Name: "Office Printer._ipp._tcp.local", Class: packet.DNSClassINET | mdnsCacheFlush, TTL: 4500},
+			"txtvers=1", "ty=Brother HL-L2350DW", "Color=F", "duplex")
+		b.A(packet.DNSRRHeader{Name: "printer.local", Class: packet.DNSClassINET | mdnsCacheFlush, TTL: 120}, ip)
+	})
+	h.ProcessMDNS(frame)
+	if q := nextQuery(t, queries); q != nil {
+		t.Errorf("unexpected query %+v", q)
+	}
+	list := h.MDNSServices(mac)
+	if len(list) != 1 || list[0].Port != 631 || list[0].TXT["ty"] != "Brother HL-L2350DW" || list[0].TXT["color"] != "F" ||
+		list[0].TXT["duplex"] != "" || len(list[0].IPs) != 1 || list[0].IPs[0] != ip {
+		t.Fatalf("invalid service %+v", list)
+	}
+
+	// SRV goodbye removes the instance
+	frame = newMDNSFrame(t, session, mac, ip, func(b *packet.DNSBuilder) {
+		b.SRV(packet.DNSRRHeader{Name: "Office Printer._ipp._tcp.local", Class: packet.DNSClassINET | mdnsCacheFlush, TTL: 0},
+			packet.DNSSRV{Port: 631, Target: "printer.local"})
+	})
+	h.ProcessMDNS(frame)
+	if list := h.MDNSServices(mac); len(list) != 0 {
+		t.Fatalf("invalid services after goodbye %+v", list)
+	}
+}
+
+func TestServiceType(t *testing.T) {
+	tests := map[string]string{
+		"Living Room._sonos._tcp.local": "_sonos._tcp.local",
+		"Goth._osc._udp.local":          "_osc._udp.local",
+		"_sonos._tcp.local":             "",
+		"printer.local":                 "",
+	}
+	for name, want := range tests {
+		if got := serviceType(name); got != want {
+			t.Errorf("serviceType(%q) = %q want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,779 @@
+package dns_naming
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+// mDNS responder - RFC 6762 and RFC 6763
+//
+// The responder publishes services for our host. Each new service goes through three steps:
+//
+//   - probing: send three queries for the instance and host names, 250 milliseconds apart, with the
+//     proposed records in the authority section. Any answer for these names from another host is a
+//     conflict and the responder picks a new name; i.e. "Packet Manager (2)" - RFC 6762 section 8.1
+//   - announcing: send two unsolicited responses with all records, one second apart - RFC 6762 section 8.3
+//   - answering: answer queries for the service type, instance, host name and service enumeration.
+//
+// A conflict detected after probing restarts the process for the service. Services are removed
+// with goodbye records (TTL zero) on UnregisterMDNSService and Close.
+
+var (
+	mdnsProbeInterval    = time.Millisecond * 250 // interval between probes
+	mdnsAnnounceInterval = time.Second            // interval between announcements
+	mdnsTiebreakDelay    = time.Second            // delay before probing again after losing a simultaneous probe tiebreak
+)
+
+const (
+	mdnsHostTTL         = 120    // ttl for records with the host name - RFC 6762 section 10
+	mdnsServiceTTL      = 4500   // ttl for other records
+	mdnsLegacyTTL       = 10     // maximum ttl in replies to legacy unicast queries - RFC 6762 section 6.7
+	mdnsUnicastResponse = 0x8000 // unicast-response bit in the question class - RFC 6762 section 5.4
+	mdnsMaxRenames      = 15     // maximum number of names tried before failing
+	mdnsMaxPayload      = 1400
+)
+
+// MDNSServiceConfig describes a service published by the responder.
+type MDNSServiceConfig struct {
+	Instance string   // instance name; i.e. "Packet Manager"
+	Service  string   // service type; i.e. "_http._tcp"
+	Port     uint16   // service port
+	TXT      []string // TXT strings; i.e. "path=/admin"
+}
+
+// mdnsPublished is a service published by the responder.
+type mdnsPublished struct {
+	config   MDNSServiceConfig
+	instance string // full instance name; i.e. "Packet Manager._http._tcp.local"
+	service  string // full service type; i.e. "_http._tcp.local"
+	txt      []string
+	rename   int // rename count after conflicts; zero if using the config name
+}
+
+// mdnsResponder holds the names and services owned by our host.
+type mdnsResponder struct {
+	hostName    string                    // i.e. "mypc.local"
+	hostLabel   string                    // host name label before renaming; i.e. "mypc"
+	hostClaimed bool                      // true if the host name passed probing
+	services    map[string]*mdnsPublished // key is lowercase instance name
+	probing     map[string]*mdnsProbe     // key is lowercase name
+	closed      bool
+}
+
+// mdnsProbe holds the proposed records for a name we are probing.
+type mdnsProbe struct {
+	c       chan mdnsConflict
+	records []mdnsRecord // authority records for all probed names
+}
+
+// mdnsConflict is sent to the probing service when another host uses the name.
+type mdnsConflict struct {
+	name string
+	lost bool // lost a simultaneous probe tiebreak; probe again with the same name
+}
+
+// mdnsRecord is a resource record owned by our host.
+type mdnsRecord struct {
+	name   string
+	rrType uint16
+	unique bool // unique records have the cache-flush bit set
+	ttl    uint32
+	target string // PTR and SRV target
+	port   uint16
+	txt    []string
+	ip     netip.Addr
+}
+
+func (r mdnsRecord) key() string {
+	return strings.ToLower(r.name) + "/" + strconv.Itoa(int(r.rrType)) + "/" + strings.ToLower(r.target) + "/" + r.ip.String()
+}
+
+func (r mdnsRecord) write(b *packet.DNSBuilder, ttl uint32) {
+	hdr := packet.DNSRRHeader{Name: r.name, Class: packet.DNSClassINET, TTL: ttl}
+	if r.unique {
+		hdr.Class |= mdnsCacheFlush
+	}
+	switch r.rrType {
+	case packet.DNSTypePTR:
+		b.PTR(hdr, r.target)
+	case packet.DNSTypeSRV:
+		b.SRV(hdr, packet.DNSSRV{Port: r.port, Target: r.target})
+	case packet.DNSTypeTXT:
+		b.TXT(hdr, r.txt...)
+	case packet.DNSTypeA:
+		b.A(hdr, r.ip)
+	case packet.DNSTypeAAAA:
+		b.AAAA(hdr, r.ip)
+	}
+}
+
+// defaultMDNSHostName returns the host label from the os host name.
+func defaultMDNSHostName() string {
+	name, _ := os.Hostname()
+	if n := strings.IndexByte(name, '.'); n != -1 {
+		name = name[:n]
+	}
+	if name = strings.Trim(strings.ReplaceAll(name, " ", "-"), "-"); name == "" {
+		name = "packet"
+	}
+	return name
+}
+
+func newMDNSResponder(hostName string) mdnsResponder {
+	label := strings.TrimSuffix(strings.TrimSuffix(hostName, "."), ".local")
+	if label == "" {
+		label = defaultMDNSHostName()
+	}
+	return mdnsResponder{hostName: label + ".local", hostLabel: label,
+		services: make(map[string]*mdnsPublished), probing: make(map[string]*mdnsProbe)}
+}
+
+// hostRecords returns the address records for our host name. Caller must hold the lock.
+func (h *DNSHandler) hostRecords() []mdnsRecord {
+	list := []mdnsRecord{}
+	if ip := h.session.NICInfo.HostAddr4.IP; ip.Is4() {
+		list = append(list, mdnsRecord{name: h.responder.hostName, rrType: packet.DNSTypeA, unique: true, ttl: mdnsHostTTL, ip: ip})
+	}
+	if lla := h.session.NICInfo.HostLLA; lla.IsValid() {
+		list = append(list, mdnsRecord{name: h.responder.hostName, rrType: packet.DNSTypeAAAA, unique: true, ttl: mdnsHostTTL, ip: lla.Addr()})
+	}
+	return list
+}
+
+// serviceRecords returns the enumeration PTR, PTR, SRV and TXT records for the service.
+// Caller must hold the lock.
+func (h *DNSHandler) serviceRecords(s *mdnsPublished) []mdnsRecord {
+	return []mdnsRecord{
+		{name: strings.TrimSuffix(MDNSServiceDiscovery, "."), rrType: packet.DNSTypePTR, ttl: mdnsServiceTTL, target: s.service},
+		{name: s.service, rrType: packet.DNSTypePTR, ttl: mdnsServiceTTL, target: s.instance},
+		{name: s.instance, rrType: packet.DNSTypeSRV, unique: true, ttl: mdnsHostTTL, target: h.responder.hostName, port: s.config.Port},
+		{name: s.instance, rrType: packet.DNSTypeTXT, unique: true, ttl: mdnsServiceTTL, txt: s.txt},
+	}
+}
+
+// MDNSHostName returns the host name used by the responder; i.e. "mypc.local".
+func (h *DNSHandler) MDNSHostName() string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.responder.hostName
+}
+
+// RegisterMDNSService publishes the service for our host. It blocks while probing for a unique name
+// and returns the instance name in use, which differs from the requested name after a conflict;
+// i.e. "Packet Manager (2)._http._tcp.local".
+func (h *DNSHandler) RegisterMDNSService(config MDNSServiceConfig) (instance string, err error) {
+	service := strings.TrimSuffix(strings.TrimSuffix(config.Service, "."), ".local") + ".local"
+	if config.Instance == "" || len(config.Instance) > 63 || strings.Contains(config.Instance, ".") || !isServiceType(service) || config.Port == 0 {
+		return "", fmt.Errorf("invalid mdns service instance=%s service=%s port=%d: %w", config.Instance, config.Service, config.Port, packet.ErrInvalidParam)
+	}
+	s := &mdnsPublished{config: config, service: service, txt: config.TXT}
+	if len(s.txt) == 0 {
+		s.txt = []string{""} // every service must have a TXT record; a single empty string - RFC 6763 section 6.1
+	}
+	if err := h.publish(s); err != nil {
+		return "", err
+	}
+	return s.instance, nil
+}
+
+// publish probes the service names, renaming on conflict, and announces the service.
+func (h *DNSHandler) publish(s *mdnsPublished) error {
+	for attempt := 0; attempt < mdnsMaxRenames; attempt++ {
+		label := s.config.Instance
+		if s.rename > 0 {
+			label = s.config.Instance + " (" + strconv.Itoa(s.rename+1) + ")" // RFC 6763 appendix D
+		}
+		s.instance = label + "." + s.service
+
+		h.mutex.Lock()
+		_, exists := h.responder.services[strings.ToLower(s.instance)]
+		closed := h.responder.closed
+		h.mutex.Unlock()
+		if closed {
+			return packet.ErrHandlerClosed
+		}
+		if exists {
+			s.rename++
+			continue
+		}
+
+		conflict, err := h.probe(s)
+		if err != nil {
+			return err
+		}
+		switch {
+		case conflict.name == "":
+			h.mutex.Lock()
+			if h.responder.closed {
+				h.mutex.Unlock()
+				return packet.ErrHandlerClosed
+			}
+			h.responder.hostClaimed = true
+			h.responder.services[strings.ToLower(s.instance)] = s
+			h.mutex.Unlock()
+			if Debug {
+				LoggerMDNS.Msg("service published").String("instance", s.instance).String("host", h.MDNSHostName()).Uint16("port", s.config.Port).Write()
+			}
+			if err := h.announce(s); err != nil {
+				return err
+			}
+			time.AfterFunc(mdnsAnnounceInterval, func() { h.announce(s) })
+			return nil
+
+		case conflict.lost:
+			time.Sleep(mdnsTiebreakDelay)
+
+		case strings.EqualFold(conflict.name, s.instance):
+			s.rename++
+
+		default: // host name conflict
+			h.renameHost()
+		}
+		if Debug {
+			LoggerMDNS.Msg("mdns name conflict").String("name", conflict.name).Bool("tiebreak", conflict.lost).Write()
+		}
+	}
+	return fmt.Errorf("mdns name conflict instance=%s: %w", s.instance, packet.ErrInvalidParam)
+}
+
+// renameHost picks the next host name after a conflict; i.e. "mypc-2.local".
+func (h *DNSHandler) renameHost() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	n := 2
+	if i := strings.LastIndexByte(h.responder.hostName, '-'); i != -1 {
+		if v, err := strconv.Atoi(strings.TrimSuffix(h.responder.hostName[i+1:], ".local")); err == nil {
+			n = v + 1
+		}
+	}
+	h.responder.hostName = h.responder.hostLabel + "-" + strconv.Itoa(n) + ".local"
+	h.responder.hostClaimed = false
+}
+
+// probe sends three probes for the service and host names. It returns the conflicting name if
+// another host answers with these names.
+func (h *DNSHandler) probe(s *mdnsPublished) (conflict mdnsConflict, err error) {
+	c := make(chan mdnsConflict, 1)
+	h.mutex.Lock()
+	names := []string{s.instance}
+	authorities := h.serviceRecords(s)[2:] // SRV and TXT
+	if !h.responder.hostClaimed {
+		names = append(names, h.responder.hostName)
+		authorities = append(authorities, h.hostRecords()...)
+	}
+	for _, name := range names {
+		h.responder.probing[strings.ToLower(name)] = &mdnsProbe{c: c, records: authorities}
+	}
+	h.mutex.Unlock()
+	defer func() {
+		h.mutex.Lock()
+		for _, name := range names {
+			delete(h.responder.probing, strings.ToLower(name))
+		}
+		h.mutex.Unlock()
+	}()
+
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, mdnsMaxPayload), 0, 0)
+	for _, name := range names {
+		b.Question(name, packet.DNSTypeANY, packet.DNSClassINET|mdnsUnicastResponse)
+	}
+	b.StartAuthorities()
+	for _, r := range authorities {
+		r.write(&b, r.ttl)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return mdnsConflict{}, err
+	}
+
+	delay := time.Duration(rand.Int63n(int64(mdnsProbeInterval))) // random delay avoids simultaneous probes - RFC 6762 section 8.1
+	for i := 0; i < 4; i++ {
+		select {
+		case conflict = <-c:
+			return conflict, nil
+		case <-time.After(delay):
+		}
+		if i == 3 {
+			break // no answer to the third probe
+		}
+		if err := h.sendMDNS(msg, h.session.NICInfo.HostAddr4, mdnsIPv4Addr); err != nil {
+			return mdnsConflict{}, err
+		}
+		delay = mdnsProbeInterval
+	}
+	return mdnsConflict{}, nil
+}
+
+// announce sends an unsolicited response with all service records.
+func (h *DNSHandler) announce(s *mdnsPublished) error {
+	h.mutex.RLock()
+	if _, found := h.responder.services[strings.ToLower(s.instance)]; !found {
+		h.mutex.RUnlock()
+		return nil // unregistered
+	}
+	records := append(h.serviceRecords(s), h.hostRecords()...)
+	h.mutex.RUnlock()
+	return h.sendMDNSRecords(records, false)
+}
+
+// sendMDNSRecords sends a multicast response with the records. Goodbye sets the TTL to zero.
+func (h *DNSHandler) sendMDNSRecords(records []mdnsRecord, goodbye bool) error {
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, mdnsMaxPayload), 0, packet.DNSFlagQR|packet.DNSFlagAA)
+	b.StartAnswers()
+	for _, r := range records {
+		ttl := r.ttl
+		if goodbye {
+			ttl = 0
+		}
+		r.write(&b, ttl)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+	return h.sendMDNS(msg, h.session.NICInfo.HostAddr4, mdnsIPv4Addr)
+}
+
+// UnregisterMDNSService removes the service and sends goodbye records.
+func (h *DNSHandler) UnregisterMDNSService(instance string) error {
+	h.mutex.Lock()
+	key := strings.ToLower(strings.TrimSuffix(instance, "."))
+	s, found := h.responder.services[key]
+	if !found {
+		h.mutex.Unlock()
+		return packet.ErrNotFound
+	}
+	delete(h.responder.services, key)
+	records := h.serviceRecords(s)
+	for _, v := range h.responder.services {
+		if strings.EqualFold(v.service, s.service) {
+			records = records[1:] // keep the enumeration record; another service has the same type
+			break
+		}
+	}
+	h.mutex.Unlock()
+	return h.sendMDNSRecords(records, true)
+}
+
+// unpublishMDNS sends goodbye records for all services and stops the responder.
+func (h *DNSHandler) unpublishMDNS() error {
+	h.mutex.Lock()
+	h.responder.closed = true
+	if len(h.responder.services) == 0 {
+		h.mutex.Unlock()
+		return nil
+	}
+	records := []mdnsRecord{}
+	seen := make(map[string]bool)
+	for _, s := range h.responder.services {
+		for _, r := range h.serviceRecords(s) {
+			if !seen[r.key()] {
+				seen[r.key()] = true
+				records = append(records, r)
+			}
+		}
+	}
+	records = append(records, h.hostRecords()...)
+	h.responder.services = make(map[string]*mdnsPublished)
+	h.mutex.Unlock()
+	return h.sendMDNSRecords(records, true)
+}
+
+// processMDNSConflicts checks the records sent by another host for names we own or are probing.
+// Queries carry proposed records in the authority section when the other host is probing.
+func (h *DNSHandler) processMDNSConflicts(mac net.HardwareAddr, p packet.DNS) error {
+	offset, err := p.AnswerOffset()
+	if err != nil {
+		return err
+	}
+	count := int(p.ANCount()) + int(p.NSCount()) + int(p.ARCount())
+	if !p.QR() { // probe; check the authority section only
+		for i := 0; i < int(p.ANCount()); i++ {
+			if _, offset, err = packet.DecodeRR(p, offset, nil); err != nil {
+				return err
+			}
+		}
+		count = int(p.NSCount())
+	}
+
+	var republish []*mdnsPublished
+	hostConflict := false
+	buffer := make([]byte, 0, 256)
+	h.mutex.Lock()
+
+	// group the records by name; the tiebreak compares all records for the name
+	var names []string
+	theirs := make(map[string][]mdnsRData)
+	for i := 0; i < count; i++ {
+		var rr packet.DNSResourceRecord
+		if rr, offset, err = packet.DecodeRR(p, offset, buffer[:0]); err != nil {
+			break
+		}
+		key := strings.ToLower(string(rr.Name))
+		if (p.QR() && rr.TTL == 0) || !h.ownMDNSName(key) { // goodbye or not our name
+			continue
+		}
+		var d mdnsRData
+		if d, err = decodeMDNSRData(p, rr); err != nil {
+			break
+		}
+		if _, found := theirs[key]; !found {
+			names = append(names, key)
+		}
+		theirs[key] = append(theirs[key], d)
+	}
+
+	for _, key := range names {
+		if probe, found := h.responder.probing[key]; found {
+			ours := mdnsRecordsRData(probe.records, key)
+			conflict := mdnsConflict{name: key}
+			if !p.QR() { // simultaneous probe; the host with the lexicographically later data wins - RFC 6762 section 8.2
+				if compareMDNSRData(ours, theirs[key]) >= 0 {
+					continue
+				}
+				conflict.lost = true
+			} else if !mdnsConflicting(ours, theirs[key], true) { // any record for the name except our own - RFC 6762 section 8.1
+				continue
+			}
+			select {
+			case probe.c <- conflict:
+			default:
+			}
+			continue
+		}
+		if !p.QR() { // another host probing our name; answered by processMDNSQuery
+			continue
+		}
+		if s, found := h.responder.services[key]; found { // another host claims our unique records; probe again
+			if mdnsConflicting(mdnsRecordsRData(h.serviceRecords(s)[2:], key), theirs[key], false) {
+				delete(h.responder.services, key)
+				republish = append(republish, s)
+			}
+		}
+		if h.responder.hostClaimed && key == strings.ToLower(h.responder.hostName) &&
+			mdnsConflicting(mdnsRecordsRData(h.hostRecords(), key), theirs[key], false) {
+			h.responder.hostClaimed = false
+			hostConflict = true
+			for k, s := range h.responder.services {
+				delete(h.responder.services, k)
+				republish = append(republish, s)
+			}
+		}
+	}
+	h.mutex.Unlock()
+
+	if hostConflict {
+		h.renameHost()
+	}
+	if len(republish) > 0 {
+		go func() {
+			for _, s := range republish {
+				if Debug {
+					LoggerMDNS.Msg("mdns conflict after probing").String("instance", s.instance).MAC("mac", mac).Write()
+				}
+				if err := h.publish(s); err != nil {
+					LoggerMDNS.Msg("failed to republish service").String("instance", s.config.Instance).Error(err).Write()
+				}
+			}
+		}()
+	}
+	return err
+}
+
+// ownMDNSName returns true if name is a lowercase name we are probing or own.
+// Caller must hold the lock.
+func (h *DNSHandler) ownMDNSName(name string) bool {
+	if _, found := h.responder.probing[name]; found {
+		return true
+	}
+	if _, found := h.responder.services[name]; found {
+		return true
+	}
+	return h.responder.hostClaimed && name == strings.ToLower(h.responder.hostName)
+}
+
+// mdnsRData is the class, type and uncompressed rdata of a record used to compare records
+// from different hosts - RFC 6762 section 8.2.
+type mdnsRData struct {
+	class  uint16 // class without the cache-flush bit
+	rrType uint16
+	data   []byte
+}
+
+// compare returns -1, 0 or +1 if r is lexicographically earlier, equal or later than other.
+func (r mdnsRData) compare(other mdnsRData) int {
+	switch {
+	case r.class != other.class:
+		if r.class < other.class {
+			return -1
+		}
+		return 1
+	case r.rrType != other.rrType:
+		if r.rrType < other.rrType {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(r.data, other.data)
+}
+
+// rdata returns the record rdata as sent by DNSBuilder without name compression.
+func (r mdnsRecord) rdata() mdnsRData {
+	d := mdnsRData{class: packet.DNSClassINET, rrType: r.rrType}
+	switch r.rrType {
+	case packet.DNSTypePTR:
+		d.data = appendMDNSName(nil, r.target)
+	case packet.DNSTypeSRV:
+		d.data = appendMDNSName([]byte{0, 0, 0, 0, byte(r.port >> 8), byte(r.port)}, r.target) // priority and weight are zero
+	case packet.DNSTypeTXT:
+		for _, v := range r.txt {
+			d.data = append(append(d.data, byte(len(v))), v...)
+		}
+	case packet.DNSTypeA, packet.DNSTypeAAAA:
+		d.data = r.ip.AsSlice()
+	}
+	return d
+}
+
+// mdnsRecordsRData returns the rdata of the records with the lowercase name.
+func mdnsRecordsRData(records []mdnsRecord, name string) []mdnsRData {
+	var list []mdnsRData
+	for _, r := range records {
+		if strings.EqualFold(r.name, name) {
+			list = append(list, r.rdata())
+		}
+	}
+	return list
+}
+
+// decodeMDNSRData returns the record rdata with names uncompressed.
+func decodeMDNSRData(p packet.DNS, rr packet.DNSResourceRecord) (mdnsRData, error) {
+	d := mdnsRData{class: rr.Class &^ mdnsCacheFlush, rrType: rr.Type}
+	switch rr.Type {
+	case packet.DNSTypePTR, packet.DNSTypeCNAME, packet.DNSTypeNS:
+		name, err := rr.DecodeName(p, nil)
+		if err != nil {
+			return mdnsRData{}, err
+		}
+		d.data = appendMDNSName(nil, string(name))
+	case packet.DNSTypeSRV:
+		srv, err := rr.DecodeSRV(p, nil)
+		if err != nil {
+			return mdnsRData{}, err
+		}
+		d.data = appendMDNSName(append([]byte{}, rr.Data[:6]...), srv.Target)
+	default:
+		d.data = append([]byte{}, rr.Data...)
+	}
+	return d, nil
+}
+
+// appendMDNSName appends the name in wire format without compression.
+func appendMDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" {
+			b = append(append(b, byte(len(label))), label...)
+		}
+	}
+	return append(b, 0)
+}
+
+// compareMDNSRData compares our proposed records with the records in the other host probe. The records
+// are sorted and compared in turn; the first difference decides and if one list runs out first, the
+// other list is later. It returns a negative number if we lost - RFC 6762 section 8.2.
+func compareMDNSRData(ours []mdnsRData, theirs []mdnsRData) int {
+	sort.Slice(ours, func(i, j int) bool { return ours[i].compare(ours[j]) < 0 })
+	sort.Slice(theirs, func(i, j int) bool { return theirs[i].compare(theirs[j]) < 0 })
+	for i := 0; i < len(ours) && i < len(theirs); i++ {
+		if n := ours[i].compare(theirs[i]); n != 0 {
+			return n
+		}
+	}
+	return len(ours) - len(theirs)
+}
+
+// mdnsConflicting returns true if the other host sent a record that is not identical to one of ours.
+// If anyType is false, only records with the class and type of one of ours are compared; records
+// of another type, or identical records from a reflector or a proxy, are not a conflict - RFC 6762 section 9.
+func mdnsConflicting(ours []mdnsRData, theirs []mdnsRData, anyType bool) bool {
+	for _, t := range theirs {
+		sameType, identical := false, false
+		for _, o := range ours {
+			if o.class == t.class && o.rrType == t.rrType {
+				sameType = true
+				identical = identical || bytes.Equal(o.data, t.data)
+			}
+		}
+		if !identical && (sameType || anyType) {
+			return true
+		}
+	}
+	return false
+}
+
+// processMDNSQuery answers a query for records we own.
+func (h *DNSHandler) processMDNSQuery(frame packet.Frame) error {
+	p := packet.DNS(frame.Payload())
+	questions, offset, err := packet.DecodeQuestions(p)
+	if err != nil {
+		return err
+	}
+
+	legacy := frame.SrcAddr.Port != 5353 // legacy unicast query - RFC 6762 section 6.7
+	unicast := legacy
+	answers, additionals := []mdnsRecord{}, []mdnsRecord{}
+	seen := make(map[string]bool)
+	add := func(list *[]mdnsRecord, records ...mdnsRecord) {
+		for _, r := range records {
+			if !seen[r.key()] {
+				seen[r.key()] = true
+				*list = append(*list, r)
+			}
+		}
+	}
+
+	now := time.Now()
+	h.mutex.RLock()
+	if len(h.responder.services) == 0 && len(h.sleepProxy.hosts) == 0 {
+		h.mutex.RUnlock()
+		return nil
+	}
+	hostRecords := h.hostRecords()
+	for _, q := range questions {
+		name := strings.ToLower(string(q.Name))
+		match := func(rrType uint16) bool { return q.Type == rrType || q.Type == packet.DNSTypeANY }
+		found := false
+		if name == strings.ToLower(h.responder.hostName) {
+			for _, r := range hostRecords {
+				if match(r.rrType) {
+					add(&answers, r)
+				}
+			}
+			found = true
+		}
+		for _, s := range h.responder.services {
+			records := h.serviceRecords(s)
+			switch {
+			case name+"." == MDNSServiceDiscovery && match(packet.DNSTypePTR):
+				add(&answers, records[0])
+			case name == strings.ToLower(s.service) && match(packet.DNSTypePTR):
+				add(&answers, records[1])
+				add(&additionals, records[2], records[3])
+				add(&additionals, hostRecords...)
+			case name == strings.ToLower(s.instance):
+				if match(packet.DNSTypeSRV) {
+					add(&answers, records[2])
+					add(&additionals, hostRecords...)
+				}
+				if match(packet.DNSTypeTXT) {
+					add(&answers, records[3])
+				}
+			default:
+				continue
+			}
+			found = true
+		}
+		if proxied, extra := h.sleepProxyRecords(name, match, now); len(proxied) > 0 { // answer for sleeping hosts
+			add(&answers, proxied...)
+			add(&additionals, extra...)
+			found = true
+		}
+		if found && q.Class&mdnsUnicastResponse != 0 {
+			unicast = true
+		}
+	}
+	h.mutex.RUnlock()
+	if len(answers) == 0 {
+		return nil
+	}
+	answers = knownAnswerSuppression(p, offset, answers)
+	if len(answers) == 0 {
+		return nil
+	}
+
+	var b packet.DNSBuilder
+	var id uint16
+	if legacy {
+		id = p.TransactionID()
+	}
+	b.Reset(make([]byte, 0, mdnsMaxPayload), id, packet.DNSFlagQR|packet.DNSFlagAA)
+	if legacy {
+		for _, q := range questions {
+			b.Question(string(q.Name), q.Type, q.Class&^mdnsUnicastResponse)
+		}
+	}
+	b.StartAnswers()
+	for _, r := range answers {
+		r.write(&b, legacyTTL(r.ttl, legacy))
+	}
+	b.StartAdditionals()
+	for _, r := range additionals {
+		r.write(&b, legacyTTL(r.ttl, legacy))
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+
+	srcAddr, dstAddr := h.session.NICInfo.HostAddr4, mdnsIPv4Addr
+	if frame.SrcAddr.IP.Is6() {
+		if !h.session.NICInfo.HostLLA.IsValid() {
+			return nil
+		}
+		srcAddr, dstAddr = packet.Addr{MAC: h.session.NICInfo.HostAddr4.MAC, IP: h.session.NICInfo.HostLLA.Addr()}, mdnsIPv6Addr
+	}
+	if unicast {
+		srcAddr.Port, dstAddr = 5353, frame.SrcAddr
+	}
+	if Debug {
+		LoggerMDNS.Msg("send mdns answer").Struct(dstAddr).Int("answers", len(answers)).Int("additionals", len(additionals)).Write()
+	}
+	return h.sendMDNS(msg, srcAddr, dstAddr)
+}
+
+func legacyTTL(ttl uint32, legacy bool) uint32 {
+	if legacy && ttl > mdnsLegacyTTL {
+		return mdnsLegacyTTL
+	}
+	return ttl
+}
+
+// knownAnswerSuppression removes the answers listed in the query answer section with at least half
+// of the TTL remaining - RFC 6762 section 7.1.
+func knownAnswerSuppression(p packet.DNS, offset int, answers []mdnsRecord) []mdnsRecord {
+	buffer := make([]byte, 0, 256)
+	for i := 0; i < int(p.ANCount()); i++ {
+		var rr packet.DNSResourceRecord
+		var err error
+		if rr, offset, err = packet.DecodeRR(p, offset, buffer[:0]); err != nil {
+			break
+		}
+		if rr.Type != packet.DNSTypePTR {
+			continue
+		}
+		target, err := rr.DecodeName(p, rr.Name[len(rr.Name):])
+		if err != nil {
+			continue
+		}
+		for j, r := range answers {
+			if r.rrType == packet.DNSTypePTR && strings.EqualFold(r.name, string(rr.Name)) &&
+				strings.EqualFold(r.target, string(target)) && rr.TTL >= r.ttl/2 {
+				answers = append(answers[:j], answers[j+1:]...)
+				break
+			}
+		}
+	}
+	return answers
+}
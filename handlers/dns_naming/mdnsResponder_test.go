@@ -0,0 +1,355 @@
+package dns_naming
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+// mdnsSent is a dns message sent by the handler.
+type mdnsSent struct {
+	dst     packet.Addr
+	srcPort uint16
+	p       packet.DNS
+}
+
+func readMDNS(conn net.PacketConn) chan mdnsSent {
+	out := make(chan mdnsSent, 32)
+	go func() {
+		buf := make([]byte, packet.EthMaxSize)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil || n == 0 {
+				return
+			}
+			ether := packet.Ether(buf[:n])
+			ip4 := packet.IP4(ether.Payload())
+			udp := packet.UDP(ip4.Payload())
+			if udp.SrcPort() != 5353 && udp.DstPort() != 5353 {
+				continue
+			}
+			out <- mdnsSent{dst: packet.Addr{MAC: ether.Dst(), IP: ip4.Dst(), Port: udp.DstPort()}, srcPort: udp.SrcPort(),
+				p: packet.DNS(packet.CopyBytes(udp.Payload()))}
+		}
+	}()
+	return out
+}
+
+func nextMDNS(out chan mdnsSent, timeout time.Duration) (mdnsSent, bool) {
+	select {
+	case m := <-out:
+		return m, true
+	case <-time.After(timeout):
+		return mdnsSent{}, false
+	}
+}
+
+var testTypeNames = map[uint16]string{packet.DNSTypeA: "A", packet.DNSTypeAAAA: "AAAA", packet.DNSTypePTR: "PTR",
+	packet.DNSTypeSRV: "SRV", packet.DNSTypeTXT: "TXT"}
+
+// decodeRecords returns the records in all sections keyed by "name/type".
+func decodeRecords(t *testing.T, p packet.DNS) map[string]packet.DNSResourceRecord {
+	t.Helper()
+	offset, err := p.AnswerOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]packet.DNSResourceRecord)
+	for i := 0; i < int(p.ANCount())+int(p.NSCount())+int(p.ARCount()); i++ {
+		var rr packet.DNSResourceRecord
+		if rr, offset, err = packet.DecodeRR(p, offset, nil); err != nil {
+			t.Fatal(err)
+		}
+		m[string(rr.Name)+"/"+testTypeNames[rr.Type]] = rr
+	}
+	return m
+}
+
+var fastIntervals sync.Once
+
+// setFastIntervals shortens the responder intervals once; goroutines from previous tests may still read them.
+func setFastIntervals() {
+	fastIntervals.Do(func() {
+		mdnsProbeInterval, mdnsAnnounceInterval, mdnsTiebreakDelay = time.Millisecond*10, time.Millisecond*50, time.Millisecond*20
+	})
+}
+
+func setupResponder(t *testing.T) (*packet.Session, *DNSHandler, chan mdnsSent) {
+	setFastIntervals()
+	session, clientConn := testSession()
+	out := readMDNS(clientConn)
+	h, err := Config{MDNSHostName: "packetd"}.New(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, h, out
+}
+
+func TestMDNSResponder_Register(t *testing.T) {
+	session, h, out := setupResponder(t)
+	defer session.Close()
+
+	if _, err := h.RegisterMDNSService(MDNSServiceConfig{Instance: "Packet Manager", Service: "_http", Port: 80}); !errors.Is(err, packet.ErrInvalidParam) {
+		t.Fatal("expected invalid service error", err)
+	}
+	instance, err := h.RegisterMDNSService(MDNSServiceConfig{Instance: "Packet Manager", Service: "_http._tcp", Port: 8080, TXT: []string{"path=/admin"}})
+	if err != nil || instance != "Packet Manager._http._tcp.local" {
+		t.Fatalf("invalid instance=%s err=%v", instance, err)
+	}
+
+	// three probes with instance and host names
+	for i := 0; i < 3; i++ {
+		m, ok := nextMDNS(out, time.Second)
+		if !ok || m.p.QR() || m.p.QDCount() != 2 || m.p.NSCount() != 3 {
+			t.Fatalf("invalid probe %d %+v", i, m.p)
+		}
+		questions, _, _ := packet.DecodeQuestions(m.p)
+		if string(questions[0].Name) != instance || string(questions[1].Name) != "packetd.local" || questions[0].Type != packet.DNSTypeANY ||
+			questions[0].Class&mdnsUnicastResponse == 0 {
+			t.Errorf("invalid probe questions %+v", questions)
+		}
+	}
+
+	// two announcements
+	for i := 0; i < 2; i++ {
+		m, ok := nextMDNS(out, time.Second)
+		if !ok || !m.p.QR() || m.p.ANCount() != 5 || m.dst.IP != mdnsIPv4Addr.IP {
+			t.Fatalf("invalid announcement %d %+v", i, m.p)
+		}
+		records := decodeRecords(t, m.p)
+		srv, found := records[instance+"/SRV"]
+		if !found || srv.Class != packet.DNSClassINET|mdnsCacheFlush || srv.TTL != mdnsHostTTL {
+			t.Fatalf("invalid srv %+v", srv)
+		}
+		if v, _ := srv.DecodeSRV(m.p, nil); v.Port != 8080 || v.Target != "packetd.local" {
+			t.Errorf("invalid srv data %+v", v)
+		}
+		if txt, _ := records[instance+"/TXT"].DecodeTXT(); len(txt) != 1 || txt[0] != "path=/admin" {
+			t.Errorf("invalid txt %v", txt)
+		}
+		if ptr := records["_http._tcp.local/PTR"]; ptr.Class != packet.DNSClassINET || ptr.TTL != mdnsServiceTTL {
+			t.Errorf("invalid ptr %+v", ptr)
+		}
+	}
+
+	// multicast answer with additional records
+	peer := packet.Addr{MAC: net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x07}, IP: netip.MustParseAddr("192.168.0.40"), Port: 5353}
+	h.ProcessMDNS(newMDNSPacket(t, session, peer, 0, 0, func(b *packet.DNSBuilder) {
+		b.Question("_http._tcp.local", packet.DNSTypePTR, packet.DNSClassINET)
+	}))
+	m, ok := nextMDNS(out, time.Second)
+	if !ok || m.p.ANCount() != 1 || m.p.ARCount() != 3 || m.dst.IP != mdnsIPv4Addr.IP || m.p.QDCount() != 0 {
+		t.Fatalf("invalid answer %+v", m.p)
+	}
+	if rr := decodeRecords(t, m.p)["packetd.local/A"]; rr.IP() != session.NICInfo.HostAddr4.IP {
+		t.Errorf("invalid host address %s", rr.IP())
+	}
+
+	// known answer suppression
+	h.ProcessMDNS(newMDNSPacket(t, session, peer, 0, 0, func(b *packet.DNSBuilder) {
+		b.Question("_http._tcp.local", packet.DNSTypePTR, packet.DNSClassINET)
+		b.PTR(packet.DNSRRHeader{Name: "_http._tcp.local", Class: packet.DNSClassINET, TTL: 4000}, instance)
+	}))
+	if m, ok := nextMDNS(out, time.Millisecond*50); ok {
+		t.Fatalf("unexpected answer %+v", m.p)
+	}
+
+	// legacy unicast answer
+	legacy := packet.Addr{MAC: peer.MAC, IP: peer.IP, Port: 40000}
+	h.ProcessMDNS(newMDNSPacket(t, session, legacy, 0x1234, 0, func(b *packet.DNSBuilder) {
+		b.Question("packetd.local", packet.DNSTypeA, packet.DNSClassINET)
+	}))
+	m, ok = nextMDNS(out, time.Second)
+	if !ok || m.p.TransactionID() != 0x1234 || m.p.QDCount() != 1 || m.dst.IP != peer.IP || m.dst.Port != 40000 || m.srcPort != 5353 {
+		t.Fatalf("invalid legacy answer dst=%+v %+v", m.dst, m.p)
+	}
+	if rr := decodeRecords(t, m.p)["packetd.local/A"]; rr.TTL != mdnsLegacyTTL {
+		t.Errorf("invalid legacy ttl %d", rr.TTL)
+	}
+
+	// queries for other names are ignored
+	h.ProcessMDNS(newMDNSPacket(t, session, peer, 0, 0, func(b *packet.DNSBuilder) {
+		b.Question("_ipp._tcp.local", packet.DNSTypePTR, packet.DNSClassINET)
+	}))
+	if m, ok := nextMDNS(out, time.Millisecond*50); ok {
+		t.Fatalf("unexpected answer %+v", m.p)
+	}
+
+	// goodbye
+	if err := h.UnregisterMDNSService(instance); err != nil {
+		t.Fatal(err)
+	}
+	m, ok = nextMDNS(out, time.Second)
+	if !ok || m.p.ANCount() != 4 {
+		t.Fatalf("invalid goodbye %+v", m.p)
+	}
+	for k, rr := range decodeRecords(t, m.p) {
+		if rr.TTL != 0 {
+			t.Errorf("invalid goodbye ttl %s %d", k, rr.TTL)
+		}
+	}
+	if err := h.UnregisterMDNSService(instance); !errors.Is(err, packet.ErrNotFound) {
+		t.Error("expected not found", err)
+	}
+}
+
+func TestMDNSResponder_Conflict(t *testing.T) {
+	session, h, out := setupResponder(t)
+	defer session.Close()
+	peer := packet.Addr{MAC: net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x08}, IP: netip.MustParseAddr("192.168.0.41"), Port: 5353}
+
+	// another host answers the first probe
+	type result struct {
+		instance string
+		err      error
+	}
+	done := make(chan result)
+	go func() {
+		instance, err := h.RegisterMDNSService(MDNSServiceConfig{Instance: "Printer", Service: "_ipp._tcp.local.", Port: 631})
+		done <- result{instance, err}
+	}()
+	if m, ok := nextMDNS(out, time.Second); !ok || m.p.QR() {
+		t.Fatal("missing probe")
+	}
+	h.ProcessMDNS(newMDNSFrame(t, session, peer.MAC, peer.IP, func(b *packet.DNSBuilder) {
+		b.SRV(packet.DNSRRHeader{Name: "Printer._ipp._tcp.local", Class: packet.DNSClassINET | mdnsCacheFlush, TTL: 120},
+			packet.DNSSRV{Port: 631, Target: "office.local"})
+	}))
+	r := <-done
+	if r.err != nil || r.instance != "Printer (2)._ipp._tcp.local" {
+		t.Fatalf("invalid instance after conflict %s err=%v", r.instance, r.err)
+	}
+
+	// identical record from a reflector is not a conflict
+	h.ProcessMDNS(newMDNSFrame(t, session, peer.MAC, peer.IP, func(b *packet.DNSBuilder) {
+		b.A(packet.DNSRRHeader{Name: "PacketD.local", Class: packet.DNSClassINET | mdnsCacheFlush, TTL: 120}, session.NICInfo.HostAddr4.IP)
+	}))
+	if name := h.MDNSHostName(); name != "packetd.local" {
+		t.Fatalf("invalid host name after identical record %s", name)
+	}
+
+	// another host claims our host name after probing
+	h.ProcessMDNS(newMDNSFrame(t, session, peer.MAC, peer.IP, func(b *packet.DNSBuilder) {
+		b.A(packet.DNSRRHeader{Name: "packetd.local", Class: packet.DNSClassINET | mdnsCacheFlush, TTL: 120}, peer.IP)
+	}))
+	if name := h.MDNSHostName(); name != "packetd-2.local" {
+		t.Fatalf("invalid host name after conflict %s", name)
+	}
+	for i := 0; i < 20; i++ { // wait for the service to be published again with the new host name
+		m, ok := nextMDNS(out, time.Second)
+		if !ok {
+			t.Fatal("service not announced with new host name")
+		}
+		if srv, found := decodeRecords(t, m.p)["Printer (2)._ipp._tcp.local/SRV"]; found && m.p.QR() {
+			if v, _ := srv.DecodeSRV(m.p, nil); v.Target == "packetd-2.local" {
+				break
+			}
+		}
+	}
+
+	// goodbye on close
+	h.Close()
+	for i := 0; i < 20; i++ {
+		m, ok := nextMDNS(out, time.Second)
+		if !ok {
+			t.Fatal("missing goodbye")
+		}
+		if ptr, found := decodeRecords(t, m.p)["_ipp._tcp.local/PTR"]; found && m.p.QR() && ptr.TTL == 0 {
+			return
+		}
+	}
+	t.Fatal("missing goodbye")
+}
+
+func TestMDNSResponder_Tiebreak(t *testing.T) {
+	session, h, out := setupResponder(t)
+	defer session.Close()
+	peer := packet.Addr{MAC: net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x09}, IP: netip.MustParseAddr("192.168.0.42"), Port: 5353}
+
+	tests := []struct {
+		name     string
+		instance string
+		port     uint16
+		lost     bool
+	}{
+		{name: "won", instance: "Scanner", port: 80},
+		{name: "lost", instance: "Camera", port: 9000, lost: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan error)
+			go func() {
+				_, err := h.RegisterMDNSService(MDNSServiceConfig{Instance: tt.instance, Service: "_uscan._tcp", Port: 8080})
+				done <- err
+			}()
+			if m, ok := nextMDNS(out, time.Second); !ok || m.p.QR() {
+				t.Fatal("missing probe")
+			}
+
+			// simultaneous probe with the same txt record; the srv port decides
+			instance := tt.instance + "._uscan._tcp.local"
+			h.ProcessMDNS(newMDNSPacket(t, session, peer, 0, 0, func(b *packet.DNSBuilder) {
+				b.Question(instance, packet.DNSTypeANY, packet.DNSClassINET)
+				b.StartAuthorities()
+				b.TXT(packet.DNSRRHeader{Name: instance, Class: packet.DNSClassINET, TTL: 4500}, "")
+				b.SRV(packet.DNSRRHeader{Name: instance, Class: packet.DNSClassINET, TTL: 120}, packet.DNSSRV{Port: tt.port, Target: "other.local"})
+			}))
+
+			probes := 1
+			for {
+				m, ok := nextMDNS(out, time.Second)
+				if !ok {
+					t.Fatal("service not announced")
+				}
+				if m.p.QR() {
+					break
+				}
+				probes++
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if (probes > 3) != tt.lost {
+				t.Errorf("invalid tiebreak probes=%d lost=%v", probes, tt.lost)
+			}
+			for ok := true; ok; _, ok = nextMDNS(out, time.Millisecond*100) { // second announcement
+			}
+		})
+	}
+}
+
+func Test_compareMDNSRData(t *testing.T) {
+	a := mdnsRData{class: packet.DNSClassINET, rrType: packet.DNSTypeA, data: []byte{192, 168, 0, 1}}
+	a2 := mdnsRData{class: packet.DNSClassINET, rrType: packet.DNSTypeA, data: []byte{192, 168, 0, 2}}
+	txt := mdnsRData{class: packet.DNSClassINET, rrType: packet.DNSTypeTXT, data: []byte{0}}
+	srv := mdnsRecord{rrType: packet.DNSTypeSRV, port: 80, target: "host.local"}.rdata()
+	tests := []struct {
+		name   string
+		ours   []mdnsRData
+		theirs []mdnsRData
+		want   int
+	}{
+		{name: "equal", ours: []mdnsRData{a, txt}, theirs: []mdnsRData{txt, a}, want: 0},
+		{name: "rdata", ours: []mdnsRData{a}, theirs: []mdnsRData{a2}, want: -1},
+		{name: "type", ours: []mdnsRData{srv}, theirs: []mdnsRData{txt}, want: 1},
+		{name: "sorted", ours: []mdnsRData{a2, txt}, theirs: []mdnsRData{txt, a}, want: 1},
+		{name: "more records", ours: []mdnsRData{a}, theirs: []mdnsRData{a, a2}, want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compareMDNSRData(tt.ours, tt.theirs); (got > 0) != (tt.want > 0) || (got < 0) != (tt.want < 0) {
+				t.Errorf("compareMDNSRData() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if mdnsConflicting([]mdnsRData{a}, []mdnsRData{a, txt}, false) || !mdnsConflicting([]mdnsRData{a}, []mdnsRData{a2}, false) ||
+		!mdnsConflicting([]mdnsRData{a}, []mdnsRData{txt}, true) {
+		t.Error("invalid mdnsConflicting()")
+	}
+}
@@ -2,8 +2,11 @@ package dns_naming
 
 import (
 	"fmt"
+	"net"
 	"net/netip"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/irai/packet"
 )
@@ -49,6 +52,62 @@ func TestMDNSHandler_PTR(t *testing.T) {
 	}
 }
 
+// TestMDNSHandler_SkipAdditional checks that an unsupported record in the authority or
+// additional section is skipped; SkipAnswer would leave the parser stuck on the record.
+func TestMDNSHandler_SkipAdditional(t *testing.T) {
+	session, clientConn := testSession()
+	defer session.Close()
+	go packet.TestReadAndDiscardLoop(clientConn) // MUST read the out conn to avoid blocking the server
+
+	dnsHandler, _ := New(session)
+	mac := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x06}
+	ip := netip.MustParseAddr("192.168.0.101")
+	nsec := []byte{0xc0, 0x0c, 0x00, 0x05, 0x00, 0x00, 0x80, 0x00, 0x40}
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, 512), 0, packet.DNSFlagQR|packet.DNSFlagAA)
+	b.StartAnswers()
+	b.PTR(packet.DNSRRHeader{Name: "_sonos._tcp.local", Class: packet.DNSClassINET, TTL: 4500}, "Sonos-1._sonos._tcp.local")
+	b.StartAuthorities()
+	b.Raw(packet.DNSRRHeader{Name: "Sonos-1._sonos._tcp.local", Class: packet.DNSClassINET, TTL: 120}, 47, nsec)
+	b.StartAdditionals()
+	b.Raw(packet.DNSRRHeader{Name: "Sonos-1._sonos._tcp.local", Class: packet.DNSClassINET, TTL: 120}, 47, nsec)
+	b.A(packet.DNSRRHeader{Name: "Sonos-1.local", Class: packet.DNSClassINET, TTL: 120}, ip)
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, mac, mdnsIPv4Addr.MAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 255, ip, mdnsIPv4Addr.IP)
+	udp := packet.EncodeUDP(ip4.Payload(), 5353, 5353)
+	udp, _ = udp.AppendPayload(msg)
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := session.Parse(ether)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan []packet.IPNameEntry, 1)
+	go func() {
+		ipv4, _, err := dnsHandler.ProcessMDNS(frame)
+		if err != nil {
+			t.Error("unexpected error", err)
+		}
+		done <- ipv4
+	}()
+	select {
+	case ipv4 := <-done:
+		if len(ipv4) != 1 || ipv4[0].NameEntry.Name != "Sonos-1" || ipv4[0].Addr.IP != ip {
+			t.Fatal("invalid A record", ipv4)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("mdns parser did not skip the additional record")
+	}
+}
+
 // Sonos Play 3 packet
 // b8:e9:37:52:4e:2c > 01:00:5e:00:00:fb, ethertype IPv4 (0x0800), length 108: (tos 0x0, ttl 255, id 0, offset 0, flags [DF], proto UDP (17), length 94)
 // 192.168.0.101.5353 > 224.0.0.251.5353: [udp sum ok] 0*- [0q] 1/0/0 _services._dns-sd._udp.local. [1h15m] PTR _sonos._tcp.local. (66)
@@ -220,7 +220,13 @@ func processNBNSNodeStatusResponse(b []byte) (names []string, err error) {
 	return names, err
 }
 
+// ProcessNBNS decodes a name service response on port 137 and returns the netbios name entry.
+// Browser announcements sent to the datagram port 138 are passed to ProcessNBNSDatagram.
 func (h *DNSHandler) ProcessNBNS(host *packet.Host, ether packet.Ether, payload []byte) (name packet.NameEntry, err error) {
+	if ether != nil && ether.EtherType() == syscall.ETH_P_IP && packet.UDP(packet.IP4(ether.Payload()).Payload()).DstPort() == 138 {
+		name, _, err = h.ProcessNBNSDatagram(host, payload)
+		return name, err
+	}
 	dns := packet.DNS(payload)
 	if err := dns.IsValid(); err != nil {
 		return name, err
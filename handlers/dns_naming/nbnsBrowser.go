@@ -0,0 +1,226 @@
+package dns_naming
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+// NetBIOS datagram service and browser announcements
+//
+//	see https://datatracker.ietf.org/doc/html/rfc1002#section-4.4
+//	see https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-brws
+//
+// Windows and Samba hosts periodically broadcast a host announcement to UDP port 138. The announcement
+// is a SMB transaction sent to the \MAILSLOT\BROWSE mailslot carried in a NetBIOS datagram addressed to
+// the workgroup group name. It contains the host name, the OS version, the server type flags and a comment.
+//
+// Datagram header
+//
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|   MSG_TYPE    |     FLAGS     |           DGM_ID              |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                           SOURCE_IP                           |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|          SOURCE_PORT          |          DGM_LENGTH           |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|         PACKET_OFFSET         |                               |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+                               +
+//	/                    SOURCE_NAME (34 bytes)                     /
+//	/                 DESTINATION_NAME (34 bytes)                   /
+//	/                           USER_DATA                           /
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+const (
+	nbdsDirectUnique = 0x10
+	nbdsDirectGroup  = 0x11
+	nbdsBroadcast    = 0x12
+
+	nbdsHeaderLen = 14
+	nbdsNameLen   = 34 // length byte + 32 bytes encoded name + zero length terminator
+
+	smbHeaderLen      = 32
+	smbComTransaction = 0x25
+
+	browserAnnouncementLen = 32 // fixed fields before the comment
+)
+
+// Browser announcement opcodes
+const (
+	BrowserHostAnnouncement        = 1
+	BrowserDomainAnnouncement      = 12
+	BrowserLocalMasterAnnouncement = 15
+)
+
+// Server type flags in a browser announcement
+const (
+	SVTypeWorkstation   = 0x00000001
+	SVTypeServer        = 0x00000002
+	SVTypeDomainCtrl    = 0x00000008
+	SVTypePrintQueue    = 0x00000200
+	SVTypeServerUnix    = 0x00000800 // set by Samba
+	SVTypeNT            = 0x00001000
+	SVTypeServerNT      = 0x00008000
+	SVTypeMasterBrowser = 0x00040000
+	SVTypeWindows       = 0x00400000 // Windows 95 and later
+	SVTypeDomainEnum    = 0x80000000
+)
+
+// NBNSBrowserAnnouncement is a host, local master or domain announcement sent to the browse mailslot.
+type NBNSBrowserAnnouncement struct {
+	Opcode      uint8
+	ServerName  string // host name; the master browser name in a domain announcement
+	Workgroup   string // workgroup or domain name
+	OSMajor     uint8
+	OSMinor     uint8
+	ServerType  uint32 // SVType flags
+	Periodicity time.Duration
+	Comment     string
+}
+
+func (a NBNSBrowserAnnouncement) String() string {
+	return Logger.Msg("").Struct(a).ToString()
+}
+
+func (a NBNSBrowserAnnouncement) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.Uint8("opcode", a.Opcode)
+	l.String("server", a.ServerName)
+	l.String("workgroup", a.Workgroup)
+	l.String("version", fmt.Sprintf("%d.%d", a.OSMajor, a.OSMinor))
+	l.String("type", fmt.Sprintf("0x%08x", a.ServerType))
+	if a.Comment != "" {
+		l.String("comment", a.Comment)
+	}
+	return l
+}
+
+// OS returns the operating system derived from the version and server type flags.
+func (a NBNSBrowserAnnouncement) OS() string {
+	if a.ServerType&SVTypeServerUnix != 0 {
+		return "Unix"
+	}
+	if a.ServerType&(SVTypeNT|SVTypeWindows) == 0 {
+		return ""
+	}
+	switch uint16(a.OSMajor)<<8 | uint16(a.OSMinor) {
+	case 10 << 8:
+		return "Windows 10" // also Windows 11
+	case 6<<8 | 3:
+		return "Windows 8.1"
+	case 6<<8 | 2:
+		return "Windows 8"
+	case 6<<8 | 1:
+		return "Windows 7"
+	case 6 << 8:
+		return "Windows Vista"
+	case 5<<8 | 2:
+		return "Windows Server 2003"
+	case 5<<8 | 1:
+		return "Windows XP"
+	case 5 << 8:
+		return "Windows 2000"
+	}
+	return "Windows"
+}
+
+// decodeNetbiosName returns the name and suffix in a 34 bytes first level encoded name.
+func decodeNetbiosName(b []byte) (name string, suffix byte, err error) {
+	if len(b) < nbdsNameLen {
+		return "", 0, packet.ErrFrameLen
+	}
+	if b[0] != 0x20 || b[nbdsNameLen-1] != 0x00 {
+		return "", 0, packet.ErrParseFrame
+	}
+	var raw [netbiosMaxNameLen]byte
+	for i := range raw {
+		hi, lo := b[1+2*i]-'A', b[2+2*i]-'A'
+		if hi > 0x0f || lo > 0x0f {
+			return "", 0, packet.ErrParseFrame
+		}
+		raw[i] = hi<<4 | lo
+	}
+	return strings.TrimRight(string(raw[:netbiosMaxNameLen-1]), " \x00"), raw[netbiosMaxNameLen-1], nil
+}
+
+// decodeBrowserAnnouncement returns the announcement in a NetBIOS datagram.
+func decodeBrowserAnnouncement(b []byte) (a NBNSBrowserAnnouncement, err error) {
+	if len(b) < nbdsHeaderLen+2*nbdsNameLen+smbHeaderLen+1 {
+		return a, packet.ErrFrameLen
+	}
+	switch b[0] {
+	case nbdsDirectUnique, nbdsDirectGroup, nbdsBroadcast:
+	default:
+		return a, fmt.Errorf("unsupported datagram type=%#x: %w", b[0], packet.ErrParseProtocol)
+	}
+	b = b[nbdsHeaderLen:]
+	if _, _, err = decodeNetbiosName(b); err != nil {
+		return a, err
+	}
+	dstName, _, err := decodeNetbiosName(b[nbdsNameLen:])
+	if err != nil {
+		return a, err
+	}
+
+	// SMB transaction request to the mailslot
+	smb := b[2*nbdsNameLen:]
+	if !bytes.Equal(smb[0:4], []byte{0xff, 'S', 'M', 'B'}) || smb[4] != smbComTransaction {
+		return a, fmt.Errorf("not a smb transaction: %w", packet.ErrParseProtocol)
+	}
+	words := smb[smbHeaderLen+1:]
+	if int(smb[smbHeaderLen]) < 14 || len(words) < int(smb[smbHeaderLen])*2+2 {
+		return a, packet.ErrFrameLen
+	}
+	dataCount := int(binary.LittleEndian.Uint16(words[22:24]))
+	dataOffset := int(binary.LittleEndian.Uint16(words[24:26]))
+	mailslot := words[int(smb[smbHeaderLen])*2+2:]
+	if !bytes.HasPrefix(mailslot, []byte(`\MAILSLOT\BROWSE`)) && !bytes.HasPrefix(mailslot, []byte(`\MAILSLOT\LANMAN`)) {
+		return a, fmt.Errorf("unsupported mailslot: %w", packet.ErrParseProtocol)
+	}
+	if dataOffset+dataCount > len(smb) || dataCount < browserAnnouncementLen {
+		return a, packet.ErrFrameLen
+	}
+	data := smb[dataOffset : dataOffset+dataCount]
+
+	//   Opcode(1) UpdateCount(1) Periodicity(4) ServerName(16) OSMajor(1) OSMinor(1) ServerType(4)
+	//   BrowserVersionMajor(1) BrowserVersionMinor(1) Signature(2) Comment(null terminated)
+	a.Opcode = data[0]
+	switch a.Opcode {
+	case BrowserHostAnnouncement, BrowserLocalMasterAnnouncement, BrowserDomainAnnouncement:
+	default:
+		return NBNSBrowserAnnouncement{}, fmt.Errorf("unsupported browser opcode=%d: %w", a.Opcode, packet.ErrParseProtocol)
+	}
+	a.Periodicity = time.Duration(binary.LittleEndian.Uint32(data[2:6])) * time.Millisecond
+	a.ServerName = string(bytes.TrimRight(bytes.SplitN(data[6:22], []byte{0}, 2)[0], " "))
+	a.OSMajor, a.OSMinor = data[22], data[23]
+	a.ServerType = binary.LittleEndian.Uint32(data[24:28])
+	a.Comment = string(bytes.SplitN(data[browserAnnouncementLen:], []byte{0}, 2)[0])
+	a.Workgroup = dstName
+	if a.Opcode == BrowserDomainAnnouncement { // server name field carries the workgroup
+		a.Workgroup, a.ServerName = a.ServerName, a.Comment
+	}
+	return a, nil
+}
+
+// ProcessNBNSDatagram decodes a browser announcement sent to the NetBIOS datagram port 138 and
+// updates the host netbios name, OS and workgroup.
+func (h *DNSHandler) ProcessNBNSDatagram(host *packet.Host, payload []byte) (name packet.NameEntry, a NBNSBrowserAnnouncement, err error) {
+	if a, err = decodeBrowserAnnouncement(payload); err != nil {
+		return packet.NameEntry{}, NBNSBrowserAnnouncement{}, err
+	}
+	if Logger.IsDebug() {
+		Logger.Msg("nbns browser announcement").Struct(a).Write()
+	}
+	if a.Opcode == BrowserDomainAnnouncement { // sent by the master browser on behalf of the workgroup
+		return packet.NameEntry{}, a, nil
+	}
+	name = packet.NameEntry{Type: moduleNBNS, Name: a.ServerName, OS: a.OS(), Expire: time.Now().Add(a.Periodicity*3 + defaultExpiryTime)}
+	if host != nil {
+		host.UpdateNBNSName(name)
+		host.UpdateWorkgroup(a.Workgroup)
+	}
+	return name, a, nil
+}
@@ -0,0 +1,85 @@
+package dns_naming
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+// windowsAnnouncement returns frameNBNS138 changed to a host announcement from a Windows 10 host.
+func windowsAnnouncement() []byte {
+	ether := packet.Ether(packet.CopyBytes(frameNBNS138))
+	payload := packet.UDP(packet.IP4(ether.Payload()).Payload()).Payload()
+	data := payload[bytes.Index(payload, []byte("BROWSE\x00"))+7:]
+	data[0] = BrowserHostAnnouncement
+	copy(data[6:22], append([]byte("DESKTOP-1A2B3C"), 0, 0))
+	data[22], data[23] = 10, 0
+	binary.LittleEndian.PutUint32(data[24:28], SVTypeWorkstation|SVTypeServer|SVTypeNT|0x00010000)
+	return ether
+}
+
+func Test_decodeBrowserAnnouncement(t *testing.T) {
+	payload := func(b []byte) []byte {
+		return packet.UDP(packet.IP4(packet.Ether(b).Payload()).Payload()).Payload()
+	}
+	notMailslot := packet.CopyBytes(payload(frameNBNS138))
+	copy(notMailslot[bytes.Index(notMailslot, []byte("BROWSE")):], "XXXXXX")
+
+	tests := []struct {
+		name       string
+		p          []byte
+		wantErr    error
+		opcode     uint8
+		serverName string
+		workgroup  string
+		os         string
+		comment    string
+	}{
+		{name: "local master samba", p: payload(frameNBNS138), opcode: BrowserLocalMasterAnnouncement, serverName: "ARCHER_VR1600V",
+			workgroup: "WORKGROUP", os: "Unix", comment: "Archer_VR1600v"},
+		{name: "host windows", p: payload(windowsAnnouncement()), opcode: BrowserHostAnnouncement, serverName: "DESKTOP-1A2B3C",
+			workgroup: "WORKGROUP", os: "Windows 10", comment: "Archer_VR1600v"},
+		{name: "short", p: payload(frameNBNS138)[:100], wantErr: packet.ErrFrameLen},
+		{name: "mailslot", p: notMailslot, wantErr: packet.ErrParseProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := decodeBrowserAnnouncement(tt.p)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("decodeBrowserAnnouncement() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if a.Opcode != tt.opcode || a.ServerName != tt.serverName || a.Workgroup != tt.workgroup || a.OS() != tt.os || a.Comment != tt.comment {
+				t.Errorf("invalid announcement %+v os=%s", a, a.OS())
+			}
+		})
+	}
+}
+
+func TestDNSHandler_ProcessNBNSDatagram(t *testing.T) {
+	session, _ := testSession()
+	defer session.Close()
+	h, _ := New(session)
+	defer h.Close()
+
+	frame, err := session.Parse(windowsAnnouncement())
+	if err != nil || frame.PayloadID != packet.PayloadNBNS || frame.Host == nil {
+		t.Fatalf("invalid frame payloadID=%v err=%v", frame.PayloadID, err)
+	}
+	name, err := h.ProcessNBNS(frame.Host, frame.Ether(), frame.Payload())
+	if err != nil || name.Name != "DESKTOP-1A2B3C" || name.OS != "Windows 10" || name.Type != moduleNBNS || !name.Expire.After(time.Now()) {
+		t.Fatalf("invalid name %+v err=%v", name, err)
+	}
+	frame.Host.MACEntry.Row.RLock()
+	nbnsName, workgroup := frame.Host.MACEntry.NBNSName, frame.Host.MACEntry.Workgroup
+	frame.Host.MACEntry.Row.RUnlock()
+	if nbnsName.OS != "Windows 10" || workgroup != "WORKGROUP" {
+		t.Errorf("invalid host entry %+v workgroup=%s", nbnsName, workgroup)
+	}
+}
@@ -0,0 +1,226 @@
+package dns_naming
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+// ResolverConfig sets the reverse dns resolver options.
+type ResolverConfig struct {
+	Upstreams   []netip.AddrPort // dns servers queried in order; default to CloudFlare
+	Timeout     time.Duration    // timeout for each upstream query; default to 2 seconds
+	NegativeTTL time.Duration    // cache time for IPs without a PTR record if the answer has no SOA; default to 1 hour
+	MaxTTL      time.Duration    // maximum cache time; default to 24 hours
+	CacheSize   int              // maximum number of cached IPs; default to 4096
+}
+
+// Resolver queries PTR records and caches positive and negative answers for the answer TTL.
+type Resolver struct {
+	upstreams   []netip.AddrPort
+	timeout     time.Duration
+	negativeTTL time.Duration
+	maxTTL      time.Duration
+	cacheSize   int
+	cache       map[netip.Addr]ptrAnswer
+	mutex       sync.Mutex
+}
+
+type ptrAnswer struct {
+	names  []string // empty if ip has no PTR record
+	expire time.Time
+}
+
+// New returns a resolver using the configuration.
+func (config ResolverConfig) New() *Resolver {
+	r := &Resolver{upstreams: config.Upstreams, timeout: config.Timeout, negativeTTL: config.NegativeTTL,
+		maxTTL: config.MaxTTL, cacheSize: config.CacheSize}
+	if len(r.upstreams) == 0 {
+		r.upstreams = []netip.AddrPort{netip.AddrPortFrom(packet.DNSv4CloudFlare1, 53)}
+	}
+	if r.timeout <= 0 {
+		r.timeout = time.Second * 2
+	}
+	if r.negativeTTL <= 0 {
+		r.negativeTTL = time.Hour
+	}
+	if r.maxTTL <= 0 {
+		r.maxTTL = time.Hour * 24
+	}
+	if r.cacheSize <= 0 {
+		r.cacheSize = 4096
+	}
+	r.cache = make(map[netip.Addr]ptrAnswer, 256)
+	return r
+}
+
+// LookupPTR returns the PTR names for ip and the remaining time to live.
+// It returns ErrNotFound if there is no PTR record for ip.
+func (r *Resolver) LookupPTR(ctx context.Context, ip netip.Addr) (names []string, ttl time.Duration, err error) {
+	now := time.Now()
+	r.mutex.Lock()
+	a, found := r.cache[ip]
+	r.mutex.Unlock()
+	if !found || !now.Before(a.expire) {
+		if a, err = r.query(ctx, ip, now); err != nil {
+			return nil, 0, err
+		}
+		r.put(ip, a, now)
+	}
+	if len(a.names) == 0 {
+		return nil, a.expire.Sub(now), packet.ErrNotFound
+	}
+	return append([]string(nil), a.names...), a.expire.Sub(now), nil
+}
+
+func (r *Resolver) put(ip netip.Addr, a ptrAnswer, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, found := r.cache[ip]; !found && len(r.cache) >= r.cacheSize {
+		for k, v := range r.cache {
+			if !now.Before(v.expire) {
+				delete(r.cache, k)
+			}
+		}
+		for k := range r.cache { // delete a random entry if all entries are current
+			if len(r.cache) < r.cacheSize {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[ip] = a
+}
+
+// Purge deletes expired cache entries.
+func (r *Resolver) Purge(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for k, v := range r.cache {
+		if !now.Before(v.expire) {
+			delete(r.cache, k)
+		}
+	}
+}
+
+// query sends the PTR query to each upstream in turn until one returns a valid answer.
+func (r *Resolver) query(ctx context.Context, ip netip.Addr, now time.Time) (a ptrAnswer, err error) {
+	name := packet.DNSReverseName(ip)
+	for _, upstream := range r.upstreams {
+		if a, err = r.exchange(ctx, upstream, name, now); err == nil {
+			return a, nil
+		}
+		if Debug {
+			Logger.Msg("reverse dns upstream failed").String("upstream", upstream.String()).String("name", name).Error(err).Write()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return ptrAnswer{}, err
+}
+
+func (r *Resolver) exchange(ctx context.Context, upstream netip.AddrPort, name string, now time.Time) (ptrAnswer, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", upstream.String())
+	if err != nil {
+		return ptrAnswer{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	go func() { // unblock read if the parent context is cancelled
+		<-ctx.Done()
+		conn.SetDeadline(time.Now())
+	}()
+
+	var rnd [2]byte // unpredictable id prevents off-path spoofed answers
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return ptrAnswer{}, err
+	}
+	id := binary.BigEndian.Uint16(rnd[:])
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, 128), id, packet.DNSFlagRD)
+	b.Question(name, packet.DNSTypePTR, packet.DNSClassINET)
+	msg, err := b.Finish()
+	if err != nil {
+		return ptrAnswer{}, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return ptrAnswer{}, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return ptrAnswer{}, err
+		}
+		p := packet.DNS(buf[:n])
+		if p.IsValid() != nil || !p.QR() || p.TransactionID() != id {
+			continue // spurious answer
+		}
+		return r.decodeAnswer(p, now)
+	}
+}
+
+// decodeAnswer returns the PTR names in the answer. Negative answers are cached for the
+// SOA minimum TTL - RFC 2308.
+func (r *Resolver) decodeAnswer(p packet.DNS, now time.Time) (ptrAnswer, error) {
+	rcode := p.ResponseCode()
+	if rcode != packet.DNSRCodeSuccess && rcode != packet.DNSRCodeNameError {
+		return ptrAnswer{}, fmt.Errorf("reverse dns rcode=%d: %w", rcode, packet.ErrInvalidParam)
+	}
+	offset, err := p.AnswerOffset()
+	if err != nil {
+		return ptrAnswer{}, err
+	}
+	var a ptrAnswer
+	ttl, negativeTTL := r.maxTTL, r.negativeTTL
+	buffer := make([]byte, 0, 256)
+	count := int(p.ANCount()) + int(p.NSCount())
+	for i := 0; i < count; i++ {
+		var rr packet.DNSResourceRecord
+		if rr, offset, err = packet.DecodeRR(p, offset, buffer); err != nil {
+			return ptrAnswer{}, err
+		}
+		rrTTL := time.Duration(rr.TTL) * time.Second
+		switch {
+		case i < int(p.ANCount()) && rr.Type == packet.DNSTypePTR:
+			ptr, err := rr.DecodeName(p, rr.Name[len(rr.Name):])
+			if err != nil {
+				return ptrAnswer{}, err
+			}
+			a.names = append(a.names, string(ptr))
+			if rrTTL < ttl {
+				ttl = rrTTL
+			}
+		case rr.Type == packet.DNSTypeSOA:
+			soa, err := rr.DecodeSOA(p, rr.Name[len(rr.Name):])
+			if err != nil {
+				return ptrAnswer{}, err
+			}
+			if min := time.Duration(soa.Minimum) * time.Second; min < rrTTL {
+				rrTTL = min
+			}
+			negativeTTL = rrTTL
+		}
+	}
+	if len(a.names) == 0 {
+		ttl = negativeTTL
+	}
+	if ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	a.expire = now.Add(ttl)
+	return a, nil
+}
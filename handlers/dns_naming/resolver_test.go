@@ -0,0 +1,135 @@
+package dns_naming
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+// ptrServer is a local stand-in dns server answering PTR queries.
+type ptrServer struct {
+	conn    *net.UDPConn
+	records map[string]string // reverse name to ptr name
+	rcode   int               // answer every query with this rcode if not zero
+	count   int
+	sync.Mutex
+}
+
+func newPTRServer(t *testing.T, records map[string]string) *ptrServer {
+	s := &ptrServer{records: records}
+	var err error
+	if s.conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal("cannot listen udp", err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := s.conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := packet.DNS(buf[:n])
+			q, _, err := packet.DecodeQuestion(query, 12, nil)
+			if err != nil {
+				continue
+			}
+			s.Lock()
+			s.count++
+			rcode := s.rcode
+			s.Unlock()
+			name := string(q.Name)
+			var b packet.DNSBuilder
+			flags := packet.DNSFlagQR | packet.DNSFlagRD | packet.DNSFlagRA
+			ptr, found := s.records[name]
+			switch {
+			case rcode != 0:
+				b.Reset(make([]byte, 0, 512), query.TransactionID(), flags|uint16(rcode))
+				b.Question(name, q.Type, q.Class)
+			case found:
+				b.Reset(make([]byte, 0, 512), query.TransactionID(), flags)
+				b.Question(name, q.Type, q.Class)
+				b.PTR(packet.DNSRRHeader{Name: name, Class: packet.DNSClassINET, TTL: 300}, ptr)
+			default:
+				b.Reset(make([]byte, 0, 512), query.TransactionID(), flags|packet.DNSRCodeNameError)
+				b.Question(name, q.Type, q.Class)
+				b.StartAuthorities()
+				b.SOA(packet.DNSRRHeader{Name: "in-addr.arpa", Class: packet.DNSClassINET, TTL: 3600},
+					packet.DNSSOA{MName: "b.in-addr-servers.arpa", RName: "nstld.iana.org", Minimum: 120})
+			}
+			msg, _ := b.Finish()
+			s.conn.WriteTo(msg, addr)
+		}
+	}()
+	return s
+}
+
+func (s *ptrServer) addr() netip.AddrPort {
+	return s.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func (s *ptrServer) queries() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.count
+}
+
+func (s *ptrServer) setRCode(rcode int) {
+	s.Lock()
+	s.rcode = rcode
+	s.Unlock()
+}
+
+func TestResolver_LookupPTR(t *testing.T) {
+	server := newPTRServer(t, map[string]string{"118.167.217.172.in-addr.arpa": "syd09s22-in-f22.1e100.net"})
+	defer server.conn.Close()
+
+	// first upstream does not answer; second upstream is the stand-in server
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	r := ResolverConfig{Upstreams: []netip.AddrPort{silent.LocalAddr().(*net.UDPAddr).AddrPort(), server.addr()},
+		Timeout: time.Millisecond * 100}.New()
+
+	names, ttl, err := r.LookupPTR(context.Background(), netip.MustParseAddr("172.217.167.118"))
+	if err != nil || len(names) != 1 || names[0] != "syd09s22-in-f22.1e100.net" || ttl > time.Second*300 || ttl < time.Second*299 {
+		t.Fatalf("invalid lookup names=%v ttl=%v err=%v", names, ttl, err)
+	}
+
+	// negative answer uses soa minimum
+	_, ttl, err = r.LookupPTR(context.Background(), netip.MustParseAddr("13.76.219.18"))
+	if !errors.Is(err, packet.ErrNotFound) || ttl > time.Second*120 || ttl < time.Second*119 {
+		t.Fatalf("invalid negative lookup ttl=%v err=%v", ttl, err)
+	}
+
+	// cached answers
+	r.LookupPTR(context.Background(), netip.MustParseAddr("172.217.167.118"))
+	r.LookupPTR(context.Background(), netip.MustParseAddr("13.76.219.18"))
+	if n := server.queries(); n != 2 {
+		t.Errorf("invalid upstream queries=%d want=2", n)
+	}
+	r.Purge(time.Now().Add(time.Second * 121))
+	if len(r.cache) != 1 {
+		t.Errorf("invalid cache len=%d want=1", len(r.cache))
+	}
+
+	// server failure is not cached
+	server.setRCode(packet.DNSRCodeServerFailure)
+	if _, _, err = r.LookupPTR(context.Background(), netip.MustParseAddr("10.0.0.1")); err == nil || errors.Is(err, packet.ErrNotFound) {
+		t.Errorf("expected server failure error got %v", err)
+	}
+
+	// cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err = r.LookupPTR(ctx, netip.MustParseAddr("10.0.0.2")); err == nil {
+		t.Error("expected context error")
+	}
+}
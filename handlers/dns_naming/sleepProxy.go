@@ -0,0 +1,434 @@
+package dns_naming
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/irai/packet"
+	"golang.org/x/net/ipv6"
+)
+
+// Bonjour Sleep Proxy
+//    see http://www.cnpbagwell.com/mac-os-x/bonjour-sleep-proxy
+//    see https://datatracker.ietf.org/doc/html/draft-cheshire-edns0-owner-option
+//    see https://datatracker.ietf.org/doc/html/draft-sekar-dns-ul
+//
+// A Mac about to sleep registers its mDNS records with a sleep proxy using a unicast DNS Update
+// message (RFC 2136) sent to the proxy port. The records are in the update section and the
+// additional section has an OPT record with two options:
+//   - update lease: the time in seconds the proxy should keep the registration
+//   - owner: the sequence number, the host MAC, and an optional wakeup MAC and SecureOn password
+//
+// While the registration is valid, the proxy answers mDNS queries for the registered records and
+// answers ARP and NDP requests for the host addresses with the proxy MAC so that traffic for the host
+// comes to the proxy. A new TCP connection or UDP packet for a registered service port wakes the host
+// with a Wake-on-LAN magic packet.
+//
+// The registration is removed when the lease expires, on an update with lease zero, or when the host
+// sends traffic after waking up.
+
+const (
+	dnsOpCodeUpdate            = 5
+	ednsOptionUpdateLease      = 2
+	ednsOptionOwner            = 4
+	sleepProxyPort             = 5353
+	sleepProxyMaxLease         = time.Hour * 2
+	sleepProxyGrace            = time.Second * 10 // ignore traffic from the host right after registration
+	sleepProxyWakeInterval     = time.Second * 10 // minimum interval between magic packets
+	sleepProxyMaxRegistrations = 64
+)
+
+// SleepProxyRegistration holds the records registered by a sleeping host.
+type SleepProxyRegistration struct {
+	MAC        net.HardwareAddr // host primary MAC in owner option
+	WakeMAC    net.HardwareAddr // MAC in magic packet; same as MAC if not in owner option
+	Password   []byte           // SecureOn password; nil if not set
+	Seq        uint8            // owner option sequence number
+	IPs        []netip.Addr     // addresses in A and AAAA records
+	Ports      []uint16         // service ports in SRV records
+	Registered time.Time
+	Expire     time.Time
+	LastWake   time.Time // zero if the host was not woken
+	records    []mdnsRecord
+}
+
+type sleepProxy struct {
+	instance string                             // published sleep proxy instance; empty if disabled
+	hosts    map[string]*SleepProxyRegistration // key is host mac
+	count    int32                              // len(hosts); read without the lock on every frame
+}
+
+// add stores the registration. Caller must hold the lock.
+func (s *sleepProxy) add(reg *SleepProxyRegistration) {
+	s.hosts[string(reg.MAC)] = reg
+	atomic.StoreInt32(&s.count, int32(len(s.hosts)))
+}
+
+// remove deletes the registration for mac. Caller must hold the lock.
+func (s *sleepProxy) remove(mac string) {
+	delete(s.hosts, mac)
+	atomic.StoreInt32(&s.count, int32(len(s.hosts)))
+}
+
+// EnableSleepProxy publishes the _sleep-proxy._udp service and starts accepting registrations.
+// The instance name encodes the proxy capabilities:
+//
+//	<SPSType>-<SPSPortability>-<SPSMarginalPower>-<SPSTotalPower> <nicelabel>
+func (h *DNSHandler) EnableSleepProxy() (instance string, err error) {
+	h.mutex.RLock()
+	instance = h.sleepProxy.instance
+	h.mutex.RUnlock()
+	if instance != "" {
+		return instance, nil
+	}
+	label := "10-34-10-70 " + strings.TrimSuffix(h.MDNSHostName(), ".local")
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	if instance, err = h.RegisterMDNSService(MDNSServiceConfig{Instance: label, Service: "_sleep-proxy._udp", Port: sleepProxyPort}); err != nil {
+		return "", err
+	}
+	h.mutex.Lock()
+	h.sleepProxy.instance = instance
+	h.mutex.Unlock()
+	return instance, nil
+}
+
+// SleepProxyRegistrations returns the current registrations.
+func (h *DNSHandler) SleepProxyRegistrations() []SleepProxyRegistration {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	list := make([]SleepProxyRegistration, 0, len(h.sleepProxy.hosts))
+	for _, v := range h.sleepProxy.hosts {
+		list = append(list, *v)
+	}
+	return list
+}
+
+// decodeSleepProxyUpdate returns the registration in a DNS Update message. A lease of zero
+// means the host is removing the registration.
+func decodeSleepProxyUpdate(p packet.DNS, srcMAC net.HardwareAddr, now time.Time) (reg *SleepProxyRegistration, lease time.Duration, err error) {
+	offset, err := p.AnswerOffset()
+	if err != nil {
+		return nil, 0, err
+	}
+	reg = &SleepProxyRegistration{MAC: packet.CopyMAC(srcMAC), Registered: now}
+	lease = sleepProxyMaxLease
+	for i := 0; i < int(p.ANCount()); i++ { // prerequisites
+		if _, offset, err = packet.DecodeRR(p, offset, nil); err != nil {
+			return nil, 0, err
+		}
+	}
+	for i := 0; i < int(p.NSCount()); i++ { // updates
+		var rr packet.DNSResourceRecord
+		if rr, offset, err = packet.DecodeRR(p, offset, nil); err != nil {
+			return nil, 0, err
+		}
+		if rr.Class&^mdnsCacheFlush != packet.DNSClassINET || rr.TTL == 0 { // deletes
+			continue
+		}
+		r := mdnsRecord{name: string(rr.Name), rrType: rr.Type, unique: rr.Class&mdnsCacheFlush != 0, ttl: rr.TTL}
+		switch rr.Type {
+		case packet.DNSTypeA, packet.DNSTypeAAAA:
+			if r.ip = rr.IP(); !r.ip.IsValid() {
+				continue
+			}
+			if !containsAddr(reg.IPs, r.ip) {
+				reg.IPs = append(reg.IPs, r.ip)
+			}
+		case packet.DNSTypePTR:
+			target, err := rr.DecodeName(p, nil)
+			if err != nil {
+				return nil, 0, err
+			}
+			r.target = string(target)
+		case packet.DNSTypeSRV:
+			srv, err := rr.DecodeSRV(p, nil)
+			if err != nil {
+				return nil, 0, err
+			}
+			r.target, r.port = srv.Target, srv.Port
+			reg.Ports = append(reg.Ports, srv.Port)
+		case packet.DNSTypeTXT:
+			if r.txt, err = rr.DecodeTXT(); err != nil {
+				return nil, 0, err
+			}
+		default: // i.e. NSEC and HINFO
+			continue
+		}
+		reg.records = append(reg.records, r)
+	}
+	for i := 0; i < int(p.ARCount()); i++ {
+		var rr packet.DNSResourceRecord
+		if rr, offset, err = packet.DecodeRR(p, offset, nil); err != nil {
+			return nil, 0, err
+		}
+		if rr.Type != packet.DNSTypeOPT {
+			continue
+		}
+		opt, err := rr.DecodeOPT()
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, o := range opt.Options {
+			switch {
+			case o.Code == ednsOptionUpdateLease && len(o.Data) >= 4:
+				lease = time.Duration(binary.BigEndian.Uint32(o.Data[0:4])) * time.Second
+			case o.Code == ednsOptionOwner && len(o.Data) >= 8:
+				reg.Seq = o.Data[1]
+				reg.MAC = packet.CopyMAC(o.Data[2:8])
+				if len(o.Data) >= 14 {
+					reg.WakeMAC = packet.CopyMAC(o.Data[8:14])
+				}
+				if len(o.Data) == 18 || len(o.Data) == 20 {
+					reg.Password = packet.CopyBytes(o.Data[14:])
+				}
+			}
+		}
+	}
+	if reg.WakeMAC == nil {
+		reg.WakeMAC = reg.MAC
+	}
+	if lease > sleepProxyMaxLease {
+		lease = sleepProxyMaxLease
+	}
+	reg.Expire = now.Add(lease)
+	return reg, lease, nil
+}
+
+// processSleepProxyUpdate stores the registration in a DNS Update message sent to our host and
+// replies with the granted lease.
+func (h *DNSHandler) processSleepProxyUpdate(frame packet.Frame) error {
+	p := packet.DNS(frame.Payload())
+	if p.QR() || !bytes.Equal(frame.DstAddr.MAC, h.session.NICInfo.HostAddr4.MAC) {
+		return nil
+	}
+	h.mutex.RLock()
+	enabled := h.sleepProxy.instance != ""
+	h.mutex.RUnlock()
+	if !enabled {
+		return nil
+	}
+
+	now := time.Now()
+	rcode := packet.DNSRCodeSuccess
+	reg, lease, err := decodeSleepProxyUpdate(p, frame.SrcAddr.MAC, now)
+	owner := err == nil && h.sleepProxyOwner(frame.SrcAddr.MAC, reg.IPs)
+	h.mutex.Lock()
+	switch {
+	case err != nil:
+		rcode = packet.DNSRCodeFormatError
+	case lease == 0:
+		h.sleepProxy.remove(string(reg.MAC))
+	case !owner:
+		rcode = packet.DNSRCodeRefused
+	case h.sleepProxy.hosts[string(reg.MAC)] == nil && len(h.sleepProxy.hosts) >= sleepProxyMaxRegistrations:
+		rcode = packet.DNSRCodeRefused
+	default:
+		h.sleepProxy.add(reg)
+	}
+	h.mutex.Unlock()
+	if Debug || err != nil {
+		l := LoggerMDNS.Msg("sleep proxy registration").MAC("srcmac", frame.SrcAddr.MAC).Int("rcode", rcode)
+		if err != nil {
+			l = l.Error(err)
+		} else {
+			l = l.MAC("mac", reg.MAC).Uint8("seq", reg.Seq).Int("records", len(reg.records)).String("lease", lease.String())
+		}
+		l.Write()
+	}
+
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, 128), p.TransactionID(), packet.DNSFlagQR|dnsOpCodeUpdate<<11|uint16(rcode))
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(lease/time.Second))
+	b.OPT(packet.DNSOPT{UDPSize: mdnsMaxPayload, Options: []packet.DNSOption{{Code: ednsOptionUpdateLease, Data: data}}})
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+	srcAddr := packet.Addr{MAC: h.session.NICInfo.HostAddr4.MAC, IP: h.session.NICInfo.HostAddr4.IP, Port: sleepProxyPort}
+	if frame.SrcAddr.IP.Is6() {
+		srcAddr.IP = h.session.NICInfo.HostLLA.Addr()
+	}
+	return h.sendMDNS(msg, srcAddr, frame.SrcAddr)
+}
+
+// sleepProxyOwner returns true if every address in the registration belongs to the sender in the
+// session host table. Registering the router, our host or another host address would send their
+// traffic to us.
+func (h *DNSHandler) sleepProxyOwner(srcMAC net.HardwareAddr, ips []netip.Addr) bool {
+	nic := h.session.NICInfo
+	for _, ip := range ips {
+		switch ip {
+		case nic.HostAddr4.IP, nic.RouterAddr4.IP, nic.HostLLA.Addr(), nic.HostGUA.Addr(), nic.RouterLLA.Addr(), nic.RouterGUA.Addr():
+			return false
+		}
+		host := h.session.FindIP(ip)
+		if host == nil {
+			return false
+		}
+		host.MACEntry.Row.RLock()
+		found := bytes.Equal(host.MACEntry.MAC, srcMAC)
+		host.MACEntry.Row.RUnlock()
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// sleepingHost returns the registration for ip. Caller must hold the lock.
+func (h *DNSHandler) sleepingHost(ip netip.Addr, now time.Time) *SleepProxyRegistration {
+	for _, v := range h.sleepProxy.hosts {
+		if now.Before(v.Expire) && containsAddr(v.IPs, ip) {
+			return v
+		}
+	}
+	return nil
+}
+
+// sleepProxyRecords returns the records that match the question and the additional records.
+// Caller must hold the lock.
+func (h *DNSHandler) sleepProxyRecords(name string, match func(uint16) bool, now time.Time) (answers []mdnsRecord, additionals []mdnsRecord) {
+	for _, v := range h.sleepProxy.hosts {
+		if !now.Before(v.Expire) {
+			continue
+		}
+		for _, r := range v.records {
+			if !strings.EqualFold(r.name, name) || !match(r.rrType) {
+				continue
+			}
+			answers = append(answers, r)
+			targets := []string{r.target}                // SRV and TXT for PTR; address records for SRV
+			for i := 0; i < len(targets) && i < 3; i++ { // bound loops from records that point to themselves
+				if targets[i] == "" {
+					continue
+				}
+				for _, a := range v.records {
+					if strings.EqualFold(a.name, targets[i]) && a.rrType != packet.DNSTypePTR {
+						additionals = append(additionals, a)
+						if a.rrType == packet.DNSTypeSRV {
+							targets = append(targets, a.target)
+						}
+					}
+				}
+			}
+		}
+	}
+	return answers, additionals
+}
+
+// ProcessSleepProxy answers ARP and NDP requests for the addresses of sleeping hosts and wakes the host
+// when a new connection arrives for a registered service port. Call for every frame when the sleep
+// proxy is enabled.
+func (h *DNSHandler) ProcessSleepProxy(frame packet.Frame) error {
+	if atomic.LoadInt32(&h.sleepProxy.count) == 0 {
+		return nil
+	}
+	now := time.Now()
+	h.mutex.RLock()
+	// host is awake if it sends traffic after registration
+	if reg := h.sleepProxy.hosts[string(frame.SrcAddr.MAC)]; reg != nil && now.Sub(reg.Registered) > sleepProxyGrace {
+		h.mutex.RUnlock()
+		h.mutex.Lock()
+		if reg := h.sleepProxy.hosts[string(frame.SrcAddr.MAC)]; reg != nil && now.Sub(reg.Registered) > sleepProxyGrace {
+			h.sleepProxy.remove(string(frame.SrcAddr.MAC))
+		}
+		h.mutex.Unlock()
+		if Debug {
+			LoggerMDNS.Msg("sleep proxy host awake").MAC("mac", frame.SrcAddr.MAC).Write()
+		}
+		return nil
+	}
+
+	var reg *SleepProxyRegistration
+	var arp packet.ARP
+	var target netip.Addr
+	wake := false
+	switch {
+	case frame.PayloadID == packet.PayloadARP:
+		arp = packet.ARP(frame.Payload())
+		if arp.IsValid() == nil && arp.Operation() == packet.ARPOperationRequest {
+			reg = h.sleepingHost(arp.DstIP(), now)
+		}
+	case frame.PayloadID == packet.PayloadICMP6:
+		icmp := packet.ICMP(frame.Payload())
+		if icmp.IsValid() == nil && icmp.Type() == uint8(ipv6.ICMPTypeNeighborSolicitation) && !frame.SrcAddr.IP.IsUnspecified() {
+			if ns := packet.ICMP6NeighborSolicitation(icmp); ns.IsValid() == nil {
+				target = ns.TargetAddress()
+				reg = h.sleepingHost(target, now)
+			}
+		}
+	case frame.TCP() != nil && frame.TCP().SYN() && !frame.TCP().ACK(), frame.UDP() != nil && frame.PayloadID != packet.PayloadMDNS:
+		reg = h.sleepingHost(frame.DstAddr.IP, now)
+		wake = reg != nil && containsPort(reg.Ports, frame.DstAddr.Port) && now.Sub(reg.LastWake) > sleepProxyWakeInterval
+	}
+	var wakeMAC net.HardwareAddr
+	var password []byte
+	if reg != nil {
+		wakeMAC, password = reg.WakeMAC, reg.Password
+	}
+	h.mutex.RUnlock()
+	if reg == nil {
+		return nil
+	}
+	if wake { // upgrade the lock; another frame may have woken the host in between
+		h.mutex.Lock()
+		if wake = now.Sub(reg.LastWake) > sleepProxyWakeInterval; wake {
+			reg.LastWake = now
+		}
+		h.mutex.Unlock()
+	}
+
+	hostMAC := h.session.NICInfo.HostAddr4.MAC
+	switch {
+	case arp != nil:
+		b := packet.EtherBufferPool.Get().(*[packet.EthMaxSize]byte)
+		defer packet.EtherBufferPool.Put(b)
+		ether := packet.EncodeEther(packet.Ether(b[0:]), syscall.ETH_P_ARP, hostMAC, arp.SrcMAC())
+		reply := packet.EncodeARP(ether.Payload(), packet.ARPOperationReply, packet.Addr{MAC: hostMAC, IP: arp.DstIP()},
+			packet.Addr{MAC: arp.SrcMAC(), IP: arp.SrcIP()})
+		ether, err := ether.SetPayload(reply)
+		if err != nil {
+			return err
+		}
+		_, err = h.session.Conn.WriteTo(ether, &packet.Addr{MAC: arp.SrcMAC()})
+		return err
+
+	case target.IsValid():
+		return h.session.ICMP6SendNeighborAdvertisement(packet.Addr{MAC: hostMAC, IP: target},
+			packet.Addr{MAC: frame.SrcAddr.MAC, IP: frame.SrcAddr.IP}, packet.Addr{MAC: hostMAC, IP: target})
+
+	case wake:
+		if Debug {
+			LoggerMDNS.Msg("sleep proxy wake host").MAC("mac", wakeMAC).Struct(frame.SrcAddr).Struct(frame.DstAddr).Write()
+		}
+		return h.session.WakeOnLANSecureOn(wakeMAC, password)
+	}
+	return nil
+}
+
+// expireSleepProxy removes expired registrations. Caller must hold the lock.
+func (h *DNSHandler) expireSleepProxy(now time.Time) {
+	for k, v := range h.sleepProxy.hosts {
+		if !now.Before(v.Expire) {
+			h.sleepProxy.remove(k)
+		}
+	}
+}
+
+func containsPort(list []uint16, port uint16) bool {
+	for _, v := range list {
+		if v == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package dns_naming
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+func readFrames(conn net.PacketConn) chan packet.Ether {
+	out := make(chan packet.Ether, 32)
+	go func() {
+		buf := make([]byte, packet.EthMaxSize)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil || n == 0 {
+				return
+			}
+			out <- packet.Ether(packet.CopyBytes(buf[:n]))
+		}
+	}()
+	return out
+}
+
+func nextFrame(out chan packet.Ether, timeout time.Duration) packet.Ether {
+	select {
+	case ether := <-out:
+		return ether
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// newSleepProxyUpdate returns a dns update frame from src to our host with the records added by fn.
+func newSleepProxyUpdate(t *testing.T, session *packet.Session, src packet.Addr, lease uint32, owner []byte, fn func(b *packet.DNSBuilder)) packet.Frame {
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, 512), 0x4321, dnsOpCodeUpdate<<11)
+	b.Question("local", packet.DNSTypeSOA, packet.DNSClassINET)
+	b.StartAuthorities()
+	fn(&b)
+	b.StartAdditionals()
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, lease)
+	b.OPT(packet.DNSOPT{UDPSize: 1440, Options: []packet.DNSOption{{Code: ednsOptionUpdateLease, Data: data}, {Code: ednsOptionOwner, Data: owner}}})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, src.MAC, session.NICInfo.HostAddr4.MAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 255, src.IP, session.NICInfo.HostAddr4.IP)
+	udp := packet.EncodeUDP(ip4.Payload(), src.Port, sleepProxyPort)
+	udp, _ = udp.AppendPayload(msg)
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := session.Parse(ether)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func parseFrame(t *testing.T, session *packet.Session, ether packet.Ether) packet.Frame {
+	t.Helper()
+	frame, err := session.Parse(ether)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestSleepProxy(t *testing.T) {
+	setFastIntervals()
+	session, clientConn := testSession()
+	defer session.Close()
+	out := readFrames(clientConn)
+	h, err := Config{MDNSHostName: "packetd"}.New(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostMAC := session.NICInfo.HostAddr4.MAC
+	mac := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x09}
+	wakeMAC := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x0a}
+	ip := netip.MustParseAddr("192.168.0.50")
+	owner := append(append([]byte{0, 3}, mac...), wakeMAC...)
+	records := func(b *packet.DNSBuilder) {
+		b.PTR(packet.DNSRRHeader{Name: "_ssh._tcp.local", Class: packet.DNSClassINET, TTL: 4500}, "MacBook._ssh._tcp.local")
+		b.SRV(packet.DNSRRHeader{Name: "MacBook._ssh._tcp.local", Class: packet.DNSClassINET | mdnsCacheFlush, TTL: 120},
+			packet.DNSSRV{Port: 22, Target: "macbook.local"})
+		b.TXT(packet.DNSRRHeader{Name: "MacBook._ssh._tcp.local", Class: packet.DNSClassINET | mdnsCacheFlush, TTL: 4500}, "")
+		b.A(packet.DNSRRHeader{Name: "macbook.local", Class: packet.DNSClassINET | mdnsCacheFlush, TTL: 120}, ip)
+	}
+
+	// updates are ignored until enabled
+	h.ProcessMDNS(newSleepProxyUpdate(t, session, packet.Addr{MAC: mac, IP: ip, Port: 5353}, 7200, owner, records))
+	if list := h.SleepProxyRegistrations(); len(list) != 0 {
+		t.Fatalf("unexpected registration %+v", list)
+	}
+
+	instance, err := h.EnableSleepProxy()
+	if err != nil || instance != "10-34-10-70 packetd._sleep-proxy._udp.local" {
+		t.Fatalf("invalid instance=%s err=%v", instance, err)
+	}
+	for nextFrame(out, time.Millisecond*200) != nil { // probes and announcements
+	}
+
+	// registration
+	h.ProcessMDNS(newSleepProxyUpdate(t, session, packet.Addr{MAC: mac, IP: ip, Port: 5353}, 7200, owner, records))
+	ether := nextFrame(out, time.Second)
+	if ether == nil {
+		t.Fatal("missing update reply")
+	}
+	reply := packet.DNS(packet.UDP(packet.IP4(ether.Payload()).Payload()).Payload())
+	if !reply.QR() || reply.TransactionID() != 0x4321 || reply.OpCode() != dnsOpCodeUpdate || reply.ResponseCode() != packet.DNSRCodeSuccess ||
+		!bytes.Equal(ether.Dst(), mac) || packet.IP4(ether.Payload()).Dst() != ip {
+		t.Fatalf("invalid update reply %+v", reply)
+	}
+	list := h.SleepProxyRegistrations()
+	if len(list) != 1 || !bytes.Equal(list[0].MAC, mac) || !bytes.Equal(list[0].WakeMAC, wakeMAC) || list[0].Seq != 3 ||
+		len(list[0].IPs) != 1 || list[0].IPs[0] != ip || len(list[0].Ports) != 1 || list[0].Ports[0] != 22 || len(list[0].records) != 4 {
+		t.Fatalf("invalid registration %+v", list)
+	}
+
+	// spoofed registrations for another host address and the router address are refused
+	spoofMAC := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x0b}
+	spoofOwner := append([]byte{0, 1}, spoofMAC...)
+	for _, target := range []netip.Addr{ip, session.NICInfo.RouterAddr4.IP, session.NICInfo.HostAddr4.IP} {
+		h.ProcessMDNS(newSleepProxyUpdate(t, session, packet.Addr{MAC: spoofMAC, IP: netip.MustParseAddr("192.168.0.51"), Port: 5353}, 7200, spoofOwner,
+			func(b *packet.DNSBuilder) {
+				b.A(packet.DNSRRHeader{Name: "spoof.local", Class: packet.DNSClassINET | mdnsCacheFlush, TTL: 120}, target)
+			}))
+		if ether = nextFrame(out, time.Second); ether == nil {
+			t.Fatal("missing update reply")
+		}
+		if reply := packet.DNS(packet.UDP(packet.IP4(ether.Payload()).Payload()).Payload()); reply.ResponseCode() != packet.DNSRCodeRefused {
+			t.Fatalf("spoofed registration for %s rcode=%d", target, reply.ResponseCode())
+		}
+	}
+	if list := h.SleepProxyRegistrations(); len(list) != 1 {
+		t.Fatalf("invalid registrations after spoofed update %+v", list)
+	}
+
+	// mdns answer on behalf of the sleeping host
+	peer := packet.Addr{MAC: net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x07}, IP: netip.MustParseAddr("192.168.0.40"), Port: 5353}
+	h.ProcessMDNS(newMDNSPacket(t, session, peer, 0, 0, func(b *packet.DNSBuilder) {
+		b.Question("_ssh._tcp.local", packet.DNSTypePTR, packet.DNSClassINET)
+	}))
+	if ether = nextFrame(out, time.Second); ether == nil {
+		t.Fatal("missing mdns answer")
+	}
+	answer := packet.DNS(packet.UDP(packet.IP4(ether.Payload()).Payload()).Payload())
+	rrs := decodeRecords(t, answer)
+	if answer.ANCount() != 1 || answer.ARCount() != 3 || rrs["macbook.local/A"].IP() != ip {
+		t.Fatalf("invalid mdns answer %+v", answer)
+	}
+
+	// arp reply with our mac
+	b := packet.Ether(make([]byte, packet.EthMaxSize))
+	b = packet.EncodeEther(b, syscall.ETH_P_ARP, peer.MAC, packet.EthernetBroadcast)
+	arp := packet.EncodeARP(b.Payload(), packet.ARPOperationRequest, packet.Addr{MAC: peer.MAC, IP: peer.IP}, packet.Addr{MAC: packet.EthernetBroadcast, IP: ip})
+	b, _ = b.SetPayload(arp)
+	if err := h.ProcessSleepProxy(parseFrame(t, session, b)); err != nil {
+		t.Fatal(err)
+	}
+	if ether = nextFrame(out, time.Second); ether == nil || ether.EtherType() != syscall.ETH_P_ARP {
+		t.Fatal("missing arp reply")
+	}
+	if arp = packet.ARP(ether.Payload()); arp.Operation() != packet.ARPOperationReply || !bytes.Equal(arp.SrcMAC(), hostMAC) ||
+		arp.SrcIP() != ip || !bytes.Equal(arp.DstMAC(), peer.MAC) {
+		t.Fatalf("invalid arp reply %+v", arp)
+	}
+
+	// tcp syn to a registered port wakes the host once
+	syn := func(port uint16) packet.Frame {
+		b := packet.Ether(make([]byte, packet.EthMaxSize))
+		b = packet.EncodeEther(b, syscall.ETH_P_IP, peer.MAC, hostMAC)
+		ip4 := packet.EncodeIP4(b.Payload(), 50, peer.IP, ip)
+		tcp := ip4.Payload()[:20]
+		for i := range tcp {
+			tcp[i] = 0
+		}
+		binary.BigEndian.PutUint16(tcp[0:2], 50000)
+		binary.BigEndian.PutUint16(tcp[2:4], port)
+		tcp[12] = 5 << 4 // 20 bytes header
+		tcp[13] = 0x02   // syn
+		ip4 = ip4.SetPayload(tcp, syscall.IPPROTO_TCP)
+		b, _ = b.SetPayload(ip4)
+		return parseFrame(t, session, b)
+	}
+	h.ProcessSleepProxy(syn(80))
+	if ether = nextFrame(out, time.Millisecond*50); ether != nil {
+		t.Fatal("unexpected magic packet for unregistered port")
+	}
+	h.ProcessSleepProxy(syn(22))
+	if ether = nextFrame(out, time.Second); ether == nil {
+		t.Fatal("missing magic packet")
+	}
+	udp := packet.UDP(packet.IP4(ether.Payload()).Payload())
+	magic := udp.Payload()
+	if udp.DstPort() != 9 || len(magic) != 102 || !bytes.Equal(magic[:6], packet.EthernetBroadcast) || !bytes.Equal(magic[96:102], wakeMAC) {
+		t.Fatalf("invalid magic packet %x", magic)
+	}
+	h.ProcessSleepProxy(syn(22))
+	if ether = nextFrame(out, time.Millisecond*50); ether != nil {
+		t.Fatal("unexpected magic packet within wake interval")
+	}
+
+	// deregistration with lease zero
+	h.ProcessMDNS(newSleepProxyUpdate(t, session, packet.Addr{MAC: mac, IP: ip, Port: 5353}, 0, owner, func(b *packet.DNSBuilder) {}))
+	nextFrame(out, time.Second)
+	if list := h.SleepProxyRegistrations(); len(list) != 0 {
+		t.Fatalf("invalid registrations after lease zero %+v", list)
+	}
+
+	// expiry
+	h.ProcessMDNS(newSleepProxyUpdate(t, session, packet.Addr{MAC: mac, IP: ip, Port: 5353}, 7200, owner, records))
+	nextFrame(out, time.Second)
+	h.MinuteTicker(time.Now().Add(time.Hour * 3))
+	if list := h.SleepProxyRegistrations(); len(list) != 0 {
+		t.Fatalf("invalid registrations after expiry %+v", list)
+	}
+	h.Close()
+}
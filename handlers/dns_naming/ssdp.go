@@ -31,6 +31,28 @@ var wsd4IPv4Addr = packet.Addr{MAC: packet.EthBroadcast, IP: netip.AddrFrom4([4]
 
 const defaultExpiryTime = time.Second * 300
 
+// ssdpAdvert holds the advertisement fields in a NOTIFY message or M-SEARCH response.
+type ssdpAdvert struct {
+	usn      string        // unique service name
+	location string        // url for the upnp device description
+	maxAge   time.Duration // CACHE-CONTROL max-age; zero if not present
+	byebye   bool          // device is leaving the network
+}
+
+// ssdpMaxAge returns the max-age directive in a CACHE-CONTROL header or zero if not present.
+// Devices use any spacing around the equal sign, i.e. "max-age = 1800" and "max-age=300".
+func ssdpMaxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		kv := strings.SplitN(directive, "=", 2)
+		if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "max-age") {
+			if seconds, err := strconv.Atoi(strings.TrimSpace(kv[1])); err == nil && seconds > 0 {
+				return time.Second * time.Duration(seconds)
+			}
+		}
+	}
+	return 0
+}
+
 // processSSDPNotify process notify ssdp messages
 //
 // When a device is added to the network, it multicasts discovery messages to advertise its root device, any embedded devices, and
@@ -42,11 +64,12 @@ const defaultExpiryTime = time.Second * 300
 //
 //
 // see upnp spec: http://www.upnp.org/specs/arch/UPnP-arch-DeviceArchitecture-v1.0.pdf
-func processSSDPNotify(raw []byte) (name packet.NameEntry, location string, err error) {
+func processSSDPNotify(raw []byte) (name packet.NameEntry, ad ssdpAdvert, err error) {
 	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
 	if err != nil {
-		return packet.NameEntry{}, location, err
+		return packet.NameEntry{}, ad, err
 	}
+	ad.usn = req.Header.Get("USN")
 
 	switch nts := req.Header.Get("NTS"); nts {
 	case "ssdp:alive":
@@ -61,32 +84,22 @@ func processSSDPNotify(raw []byte) (name packet.NameEntry, location string, err
 		//    SERVER: OS/version UPnP/1.0 product/version
 		//    USN: advertisement UUID
 		if req.Method != "NOTIFY" {
-			return packet.NameEntry{}, location, packet.ErrParseFrame
-		}
-		seconds := 0
-		location = req.Header.Get("LOCATION")
-		cacheControl := req.Header.Get("CACHE-CONTROL")
-		options := strings.Split(cacheControl, "=")
-		if len(options)^2 == 0 { // make sure it is pairs of key / value
-			for i := range options {
-				if strings.ToLower(options[i]) == "max-age" {
-					seconds, _ = strconv.Atoi(options[i+1])
-					break
-				}
-			}
+			return packet.NameEntry{}, ad, packet.ErrParseFrame
 		}
+		ad.location = req.Header.Get("LOCATION")
+		ad.maxAge = ssdpMaxAge(req.Header.Get("CACHE-CONTROL"))
 		var expire time.Time
 		now := time.Now()
-		if seconds > 0 {
-			expire = now.Add(time.Second * time.Duration(seconds))
+		if ad.maxAge > 0 {
+			expire = now.Add(ad.maxAge)
 		} else {
 			expire = now.Add(defaultExpiryTime)
 		}
 
 		if ssdpLogger.IsDebug() {
-			ssdpLogger.Msg("ssdp:alive recv").String("location", location).Write()
+			ssdpLogger.Msg("ssdp:alive recv").String("location", ad.location).Write()
 		}
-		return packet.NameEntry{Expire: expire}, location, nil
+		return packet.NameEntry{Expire: expire}, ad, nil
 	case "ssdp:byebye":
 		// When a device is about to be removed from the network, it should explicitly revoke its discovery messages by sending one
 		// multicast request for each ssdp:alive message it sent. Each multicast request must have method NOTIFY and ssdp:byebye in the
@@ -99,11 +112,12 @@ func processSSDPNotify(raw []byte) (name packet.NameEntry, location string, err
 		if ssdpLogger.IsDebug() {
 			ssdpLogger.Msg("ssdp:byebye recv").Bytes("txt", raw).Write()
 		}
+		ad.byebye = true
 	default:
 		fmt.Printf("ssdp  : error unexpected NTS header %s\n", nts)
-		return packet.NameEntry{}, location, packet.ErrParseFrame
+		return packet.NameEntry{}, ad, packet.ErrParseFrame
 	}
-	return packet.NameEntry{}, location, nil
+	return packet.NameEntry{}, ad, nil
 }
 
 // processSSDPSearchRequest process M-SEARCH SSDP packet
@@ -120,14 +134,14 @@ func processSSDPNotify(raw []byte) (name packet.NameEntry, location string, err
 // According to section 1.3.2 of the UPnP Device Architecture 1.1 the value should have the following syntax:
 //   USER-AGENT: OS/version UPnP/1.1 product/version
 // but clearly not many follow this format.
-func processSSDPSearchRequest(raw []byte) (name packet.NameEntry, location string, err error) {
+func processSSDPSearchRequest(raw []byte) (name packet.NameEntry, ad ssdpAdvert, err error) {
 	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
 	if err != nil {
-		return packet.NameEntry{}, "", err
+		return packet.NameEntry{}, ad, err
 	}
 	man := req.Header.Get("MAN")
 	if man != `"ssdp:discover"` {
-		return packet.NameEntry{}, "", packet.ErrParseFrame
+		return packet.NameEntry{}, ad, packet.ErrParseFrame
 	}
 	// fmt.Printf("ssdp  : recv discover packet %s", string(raw))
 	ua := req.Header.Get("USER-AGENT")
@@ -136,7 +150,7 @@ func processSSDPSearchRequest(raw []byte) (name packet.NameEntry, location strin
 		ssdpLogger.Msg("ssdp:discover recv").String("user-agent", ua).Struct(name).Write()
 	}
 	name.Expire = time.Now().Add(defaultExpiryTime)
-	return name, "", nil
+	return name, ad, nil
 }
 
 func processUserAgent(ua string) (name packet.NameEntry) {
@@ -161,20 +175,22 @@ func processUserAgent(ua string) (name packet.NameEntry) {
 }
 
 // processSSDPResponse process a M-SEARCH http response
-func processSSDPResponse(raw []byte) (name packet.NameEntry, location string, err error) {
+func processSSDPResponse(raw []byte) (name packet.NameEntry, ad ssdpAdvert, err error) {
 	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
 	if err != nil {
-		return packet.NameEntry{}, location, err
+		return packet.NameEntry{}, ad, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return packet.NameEntry{}, "", packet.ErrParseFrame
+		return packet.NameEntry{}, ad, packet.ErrParseFrame
 	}
-	location = resp.Header.Get("LOCATION")
+	ad.usn = resp.Header.Get("USN")
+	ad.location = resp.Header.Get("LOCATION")
+	ad.maxAge = ssdpMaxAge(resp.Header.Get("CACHE-CONTROL"))
 	if ssdpLogger.IsDebug() {
-		ssdpLogger.Msg("response").String("location", location).Write()
+		ssdpLogger.Msg("response").String("location", ad.location).Write()
 	}
-	return packet.NameEntry{}, location, nil
+	return packet.NameEntry{}, ad, nil
 }
 
 // When a control point is added to the network, it should send a multicast request with method M-SEARCH in the following format.
@@ -197,6 +213,10 @@ ST: "ssdp:all"`), []byte{0x0d, 0x0a, 0x0d, 0x0a}...) // must have 0d0a,0d0a at t
 //       see: https://developer.samsung.com/smarttv/develop/legacy-platform-library/art00030/index.html#
 //
 func (h *DNSHandler) SendSSDPSearch() (err error) {
+	h.mutex.Lock()
+	h.lastSSDPSearch = time.Now()
+	h.mutex.Unlock()
+
 	b := packet.EtherBufferPool.Get().(*[packet.EthMaxSize]byte)
 	defer packet.EtherBufferPool.Put(b)
 	ether := packet.Ether(b[0:])
@@ -216,21 +236,32 @@ func (h *DNSHandler) SendSSDPSearch() (err error) {
 	return err
 }
 
+// ProcessSSDP decodes a SSDP message and returns the name entry and the location of the device description.
+// Advertisements are recorded in the upnp description cache; use UPNPServiceDiscovery to retrieve the description.
 func (h *DNSHandler) ProcessSSDP(host *packet.Host, ether packet.Ether, payload []byte) (name packet.NameEntry, location string, err error) {
-	if bytes.HasPrefix(payload, []byte("NOTIFY ")) {
+	var ad ssdpAdvert
+	switch {
+	case bytes.HasPrefix(payload, []byte("NOTIFY ")):
 		if ssdpLogger.IsDebug() {
 			ssdpLogger.Msg("notify rcvd").MAC("mac", ether.Src()).IP("ip", ether.SrcIP()).Write()
 		}
-		return processSSDPNotify(payload)
-	}
-	if bytes.HasPrefix(payload, []byte("M-SEARCH ")) {
+		name, ad, err = processSSDPNotify(payload)
+	case bytes.HasPrefix(payload, []byte("M-SEARCH ")):
 		if ssdpLogger.IsDebug() {
 			ssdpLogger.Msg("m-search rcvd").MAC("mac", ether.Src()).IP("ip", ether.SrcIP()).Write()
 		}
-		return processSSDPSearchRequest(payload)
+		name, ad, err = processSSDPSearchRequest(payload)
+	default:
+		if ssdpLogger.IsDebug() {
+			ssdpLogger.Msg("response rcvd").MAC("mac", ether.Src()).IP("ip", ether.SrcIP()).Write()
+		}
+		name, ad, err = processSSDPResponse(payload)
 	}
-	if ssdpLogger.IsDebug() {
-		ssdpLogger.Msg("response rcvd").MAC("mac", ether.Src()).IP("ip", ether.SrcIP()).Write()
+	if err != nil {
+		return name, "", err
+	}
+	if ad.usn != "" {
+		h.cacheUPNPAdvert(ether.Src(), ad, time.Now())
 	}
-	return processSSDPResponse(payload)
+	return name, ad.location, nil
 }
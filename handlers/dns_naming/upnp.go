@@ -1,10 +1,14 @@
 package dns_naming
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/irai/packet"
@@ -25,19 +29,61 @@ import (
 //     <modelNumber>S1</modelNumber>
 //     <modelDescription>Sonos Play:1</modelDescription>
 //     <modelName>Sonos Play:1</modelName>
+//     <UDN>uuid:RINCON_B8E93751898C01400</UDN>
+//     <serviceList>...</serviceList>
+//     <deviceList>...</deviceList>
 type UPNPDevice struct {
-	Name             string `xml:"friendlyName"`
-	Model            string `xml:"modelName"`
-	ModelNumber      string `xml:"modelNumber"`
-	ModelDescription string `xml:"modelDescription"`
-	Manufacturer     string `xml:"manufacturer"`
+	DeviceType       string              `xml:"deviceType"`
+	Name             string              `xml:"friendlyName"`
+	Model            string              `xml:"modelName"`
+	ModelNumber      string              `xml:"modelNumber"`
+	ModelDescription string              `xml:"modelDescription"`
+	Manufacturer     string              `xml:"manufacturer"`
+	SerialNumber     string              `xml:"serialNumber"`
+	UDN              string              `xml:"UDN"` // unique device name; usually uuid:<uuid>
+	PresentationURL  string              `xml:"presentationURL"`
+	Services         []UPNPDeviceService `xml:"serviceList>service"`
+	Devices          []UPNPDevice        `xml:"deviceList>device"` // embedded devices
+}
+
+// UPNPDeviceService is an entry in the device serviceList.
+type UPNPDeviceService struct {
+	ServiceType string `xml:"serviceType"`
+	ServiceID   string `xml:"serviceId"`
+	SCPDURL     string `xml:"SCPDURL"`
+	ControlURL  string `xml:"controlURL"`
+	EventSubURL string `xml:"eventSubURL"`
 }
 
 type UPNPService struct {
 	XMLName xml.Name   `xml:"root"`
+	URLBase string     `xml:"URLBase"` // deprecated in UPnP 1.1 but still used by some devices
 	Device  UPNPDevice `xml:"device"`
 }
 
+// resolveURLs converts relative urls in the device tree to absolute urls using base.
+func (d *UPNPDevice) resolveURLs(base *url.URL) {
+	resolve := func(s string) string {
+		if s == "" {
+			return s
+		}
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil {
+			return s
+		}
+		return base.ResolveReference(u).String()
+	}
+	d.PresentationURL = resolve(d.PresentationURL)
+	for i := range d.Services {
+		d.Services[i].SCPDURL = resolve(d.Services[i].SCPDURL)
+		d.Services[i].ControlURL = resolve(d.Services[i].ControlURL)
+		d.Services[i].EventSubURL = resolve(d.Services[i].EventSubURL)
+	}
+	for i := range d.Devices {
+		d.Devices[i].resolveURLs(base)
+	}
+}
+
 // unmarshalUPNPServiceDescriptor process a UPNP service description XML
 //
 // For a format and list of fields see section 2.3 service description
@@ -79,23 +125,144 @@ func getUPNPServiceDescription(location string) ([]byte, error) {
 	return body, nil
 }
 
-func (h *DNSHandler) UPNPServiceDiscovery(addr packet.Addr, location string) (name packet.NameEntry, err error) {
-	desc, err := getUPNPServiceDescription(location)
-	if err != nil {
-		return packet.NameEntry{}, err
+const (
+	ssdpSearchInterval = time.Minute * 30 // repeat M-SEARCH to keep the upnp inventory fresh
+	upnpMaxEntries     = 512
+)
+
+// UPNPDescription is a cached upnp device description for an advertised USN.
+type UPNPDescription struct {
+	USN      string // unique service name in the advertisement
+	Location string // url for the device description
+	MAC      net.HardwareAddr
+	Device   UPNPDevice // root device including embedded devices and services
+	Fetched  time.Time  // zero if the description was not retrieved yet
+	Expire   time.Time  // advertisement expiry from CACHE-CONTROL max-age
+}
+
+// cacheUPNPAdvert records an advertisement in the description cache. A new location invalidates the
+// description retrieved for the USN.
+func (h *DNSHandler) cacheUPNPAdvert(mac net.HardwareAddr, ad ssdpAdvert, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if ad.byebye {
+		delete(h.upnp, ad.usn)
+		return
 	}
-	service, err := unmarshalUPNPServiceDescriptor(desc)
-	if err != nil {
-		return packet.NameEntry{}, err
+	if ad.location == "" {
+		return
+	}
+	entry := h.upnp[ad.usn]
+	if entry == nil {
+		if len(h.upnp) >= upnpMaxEntries {
+			return
+		}
+		entry = &UPNPDescription{USN: ad.usn}
+		h.upnp[ad.usn] = entry
+	}
+	if entry.Location != ad.location {
+		entry.Location, entry.Device, entry.Fetched = ad.location, UPNPDevice{}, time.Time{}
 	}
-	if ssdpLogger.IsDebug() {
-		fmt.Printf("engine: retrieved upnp name=%s model=%s manufacturer=%s\n", service.Device.Name, service.Device.Model, service.Device.Manufacturer)
+	entry.MAC = packet.CopyMAC(mac)
+	if ad.maxAge == 0 {
+		ad.maxAge = defaultExpiryTime
+	}
+	entry.Expire = now.Add(ad.maxAge)
+}
+
+// findUPNPLocation returns a valid description for location. Caller must hold the lock.
+func (h *DNSHandler) findUPNPLocation(location string, now time.Time) (UPNPDevice, bool) {
+	for _, v := range h.upnp {
+		if v.Location == location && !v.Fetched.IsZero() && now.Before(v.Expire) {
+			return v.Device, true
+		}
+	}
+	return UPNPDevice{}, false
+}
+
+// UPNPServiceDiscovery returns the name entry for the upnp device description at location. The description is
+// retrieved once for all USNs advertising the same location and kept until the advertisements expire.
+// The name entry is also stored in the host entry for addr.
+func (h *DNSHandler) UPNPServiceDiscovery(addr packet.Addr, location string) (name packet.NameEntry, err error) {
+	now := time.Now()
+	h.mutex.RLock()
+	device, found := h.findUPNPLocation(location, now)
+	h.mutex.RUnlock()
+
+	if !found {
+		desc, err := getUPNPServiceDescription(location)
+		if err != nil {
+			return packet.NameEntry{}, err
+		}
+		service, err := unmarshalUPNPServiceDescriptor(desc)
+		if err != nil {
+			return packet.NameEntry{}, err
+		}
+		base, err := url.Parse(location)
+		if service.URLBase != "" {
+			base, err = url.Parse(strings.TrimSpace(service.URLBase))
+		}
+		if err == nil {
+			service.Device.resolveURLs(base)
+		}
+		device = service.Device
+		if ssdpLogger.IsDebug() {
+			fmt.Printf("engine: retrieved upnp name=%s model=%s manufacturer=%s\n", device.Name, device.Model, device.Manufacturer)
+		}
+
+		h.mutex.Lock()
+		found = false
+		for _, v := range h.upnp {
+			if v.Location == location {
+				v.Device, v.Fetched = device, now
+				found = true
+			}
+		}
+		if !found && len(h.upnp) < upnpMaxEntries { // description requested without an advertisement
+			usn := device.UDN
+			if usn == "" {
+				usn = location
+			}
+			h.upnp[usn] = &UPNPDescription{USN: usn, Location: location, MAC: packet.CopyMAC(addr.MAC), Device: device,
+				Fetched: now, Expire: now.Add(defaultExpiryTime)}
+		}
+		h.mutex.Unlock()
 	}
 
 	name.Type = moduleSSDP
-	name.Name = service.Device.Name
-	name.Model = service.Device.Model
-	name.Manufacturer = service.Device.Manufacturer
-	name.Expire = time.Now().Add(defaultExpiryTime)
+	name.Name = device.Name
+	name.Model = device.Model
+	name.Manufacturer = device.Manufacturer
+	name.Expire = now.Add(defaultExpiryTime)
+	if addr.IP.IsValid() {
+		if host := h.session.FindIP(addr.IP); host != nil {
+			host.UpdateSSDPName(name)
+		}
+	}
 	return name, nil
 }
+
+// UPNPDescriptions returns the device descriptions retrieved for mac, one per location.
+func (h *DNSHandler) UPNPDescriptions(mac net.HardwareAddr) (list []UPNPDescription) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	seen := make(map[string]bool)
+	for _, v := range h.upnp {
+		if bytes.Equal(v.MAC, mac) && !v.Fetched.IsZero() && !seen[v.Location] {
+			seen[v.Location] = true
+			list = append(list, *v)
+		}
+	}
+	return list
+}
+
+// expireUPNP deletes expired advertisements and reports whether the periodic M-SEARCH is due.
+// Caller must hold the lock.
+func (h *DNSHandler) expireUPNP(now time.Time) (search bool) {
+	for k, v := range h.upnp {
+		if now.After(v.Expire) {
+			delete(h.upnp, k)
+		}
+	}
+	return !h.lastSSDPSearch.IsZero() && now.Sub(h.lastSSDPSearch) >= ssdpSearchInterval
+}
@@ -0,0 +1,114 @@
+package dns_naming
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+func Test_ssdpMaxAge(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		want         time.Duration
+	}{
+		{name: "compact", cacheControl: "max-age=300", want: time.Second * 300},
+		{name: "spaces", cacheControl: "max-age = 1800", want: time.Second * 1800},
+		{name: "uppercase", cacheControl: "no-cache, MAX-AGE=120", want: time.Second * 120},
+		{name: "missing", cacheControl: "no-cache", want: 0},
+		{name: "invalid", cacheControl: "max-age=abc", want: 0},
+		{name: "empty", cacheControl: "", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ssdpMaxAge(tt.cacheControl); got != tt.want {
+				t.Errorf("ssdpMaxAge() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func newSSDPNotify(location string, usn string, nts string) []byte {
+	return []byte("NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nCACHE-CONTROL: max-age = 1800\r\n" +
+		"LOCATION: " + location + "\r\nNT: upnp:rootdevice\r\nNTS: " + nts + "\r\nSERVER: Linux UPnP/1.0 Sonos/57.3\r\nUSN: " + usn + "\r\n\r\n")
+}
+
+func TestDNSHandler_UPNPDescriptionCache(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write(serviceDefinitionSonos)
+	}))
+	defer server.Close()
+	location := server.URL + "/xml/device_description.xml"
+
+	session, clientConn := testSession()
+	defer session.Close()
+	out := readFrames(clientConn)
+	h, _ := New(session)
+	defer h.Close()
+
+	mac := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x40}
+	ip := netip.MustParseAddr("192.168.0.103")
+	ether := packet.EncodeEther(make([]byte, packet.EthMaxSize), syscall.ETH_P_IP, mac, session.NICInfo.HostAddr4.MAC)
+	for _, usn := range []string{"uuid:RINCON_B8E93751898C01400::upnp:rootdevice", "uuid:RINCON_B8E93751898C01400_MR::urn:schemas-upnp-org:service:AVTransport:1"} {
+		if _, got, err := h.ProcessSSDP(nil, ether, newSSDPNotify(location, usn, "ssdp:alive")); err != nil || got != location {
+			t.Fatalf("invalid notify location=%s err=%v", got, err)
+		}
+	}
+	if list := h.UPNPDescriptions(mac); len(list) != 0 {
+		t.Fatalf("unexpected description before retrieval %+v", list)
+	}
+
+	// both advertisements share a single retrieval
+	for i := 0; i < 2; i++ {
+		name, err := h.UPNPServiceDiscovery(packet.Addr{MAC: mac, IP: ip}, location)
+		if err != nil || name.Name != "192.168.0.103 - Sonos Play:1" || name.Model != "Sonos Play:1" || name.Type != moduleSSDP {
+			t.Fatalf("invalid name %+v err=%v", name, err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("invalid number of retrievals=%d", n)
+	}
+	list := h.UPNPDescriptions(mac)
+	if len(list) != 1 {
+		t.Fatalf("invalid descriptions %+v", list)
+	}
+	device := list[0].Device
+	if device.UDN != "uuid:RINCON_B8E93751898C01400" || device.DeviceType != "urn:schemas-upnp-org:device:ZonePlayer:1" ||
+		len(device.Services) != 7 || len(device.Devices) != 2 || device.Devices[0].UDN != "uuid:RINCON_B8E93751898C01400_MS" ||
+		len(device.Devices[1].Services) != 6 {
+		t.Fatalf("invalid device tree %+v", device)
+	}
+	if device.Services[0].SCPDURL != server.URL+"/xml/AlarmClock1.xml" || device.Devices[0].Services[0].SCPDURL != server.URL+"/xml/ContentDirectory1.xml" {
+		t.Errorf("invalid service urls %+v", device.Services[0])
+	}
+
+	// byebye removes the advertisement; the remaining usn keeps the description
+	h.ProcessSSDP(nil, ether, newSSDPNotify("", "uuid:RINCON_B8E93751898C01400::upnp:rootdevice", "ssdp:byebye"))
+	if list := h.UPNPDescriptions(mac); len(list) != 1 || list[0].USN != "uuid:RINCON_B8E93751898C01400_MR::urn:schemas-upnp-org:service:AVTransport:1" {
+		t.Fatalf("invalid descriptions after byebye %+v", list)
+	}
+
+	// max-age expiry and periodic search
+	if err := h.SendSSDPSearch(); err != nil {
+		t.Fatal(err)
+	}
+	if ether := nextFrame(out, time.Second); ether == nil || packet.UDP(packet.IP4(ether.Payload()).Payload()).DstPort() != 1900 {
+		t.Fatal("missing m-search")
+	}
+	h.MinuteTicker(time.Now().Add(time.Minute * 31))
+	if list := h.UPNPDescriptions(mac); len(list) != 0 {
+		t.Fatalf("invalid descriptions after expiry %+v", list)
+	}
+	if ether := nextFrame(out, time.Second); ether == nil || packet.UDP(packet.IP4(ether.Payload()).Payload()).DstPort() != 1900 {
+		t.Fatal("missing periodic m-search")
+	}
+}
@@ -0,0 +1,450 @@
+package dns_naming
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+// WS-Discovery
+//    see http://docs.oasis-open.org/ws-dd/discovery/1.1/os/wsdd-discovery-1.1-spec-os.html
+//    see https://specs.xmlsoap.org/ws/2005/04/discovery/ws-discovery.pdf
+//
+// Windows PCs, printers and scanners announce themselves with SOAP over UDP messages sent
+// to 239.255.255.250:3702 and [ff02::c]:3702. The body contains one of:
+//   - Hello: multicast when a device joins the network
+//   - Bye: multicast when a device leaves the network
+//   - Probe: multicast by a client searching for devices of a given type
+//   - ProbeMatches: unicast reply to a probe
+//   - Resolve and ResolveMatches: find the transport addresses for an endpoint reference
+//
+// Hello and match messages carry the device endpoint reference (usually urn:uuid), the device types,
+// the scopes and the transport addresses (XAddrs) used to retrieve the device metadata.
+//
+// Windows uses the 2005/04 version of the protocol and most printers support both versions; the parser
+// ignores the xml namespaces so it handles either.
+//
+// The device name is not in the discovery messages. It is in the device metadata returned by a
+// WS-Transfer Get sent to the transport address:
+//    see http://specs.xmlsoap.org/ws/2006/02/devprof/devicesprofile.pdf
+
+const moduleWSD = "wsd"
+
+var LoggerWSD = fastlog.New(moduleWSD)
+
+// WS-Discovery message actions
+const (
+	WSDHello          = "Hello"
+	WSDBye            = "Bye"
+	WSDProbe          = "Probe"
+	WSDProbeMatches   = "ProbeMatches"
+	WSDResolve        = "Resolve"
+	WSDResolveMatches = "ResolveMatches"
+)
+
+// WSDEndpoint describes a device in a WS-Discovery message.
+type WSDEndpoint struct {
+	Address         string   // endpoint reference address; usually urn:uuid:<uuid>
+	Types           []string // qualified type names, i.e. wsdp:Device pub:Computer
+	Scopes          []string
+	XAddrs          []string // transport addresses
+	MetadataVersion uint32
+}
+
+// WSDMessage is a decoded WS-Discovery message. A Probe has a single endpoint with the
+// requested types and no address.
+type WSDMessage struct {
+	Action    string // Hello, Bye, Probe, ProbeMatches, Resolve or ResolveMatches
+	MessageID string
+	RelatesTo string // message id of the probe or resolve in a match
+	Endpoints []WSDEndpoint
+}
+
+func (m WSDMessage) String() string {
+	return LoggerWSD.Msg("").Struct(m).ToString()
+}
+
+func (m WSDMessage) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.String("action", m.Action)
+	l.String("messageid", m.MessageID)
+	if m.RelatesTo != "" {
+		l.String("relatesto", m.RelatesTo)
+	}
+	for _, e := range m.Endpoints {
+		if e.Address != "" {
+			l.String("address", e.Address)
+		}
+		l.StringArray("types", e.Types)
+		if len(e.XAddrs) > 0 {
+			l.StringArray("xaddrs", e.XAddrs)
+		}
+	}
+	return l
+}
+
+type wsdEndpointXML struct {
+	Address         string `xml:"EndpointReference>Address"`
+	Types           string `xml:"Types"`
+	Scopes          string `xml:"Scopes"`
+	XAddrs          string `xml:"XAddrs"`
+	MetadataVersion uint32 `xml:"MetadataVersion"`
+}
+
+func (e wsdEndpointXML) endpoint() WSDEndpoint {
+	return WSDEndpoint{Address: strings.TrimSpace(e.Address), Types: strings.Fields(e.Types), Scopes: strings.Fields(e.Scopes),
+		XAddrs: strings.Fields(e.XAddrs), MetadataVersion: e.MetadataVersion}
+}
+
+// wsdEnvelope maps the SOAP envelope; tags have no namespace so elements match in any namespace.
+type wsdEnvelope struct {
+	XMLName   xml.Name `xml:"Envelope"`
+	Action    string   `xml:"Header>Action"`
+	MessageID string   `xml:"Header>MessageID"`
+	RelatesTo string   `xml:"Header>RelatesTo"`
+	Body      struct {
+		Hello          *wsdEndpointXML  `xml:"Hello"`
+		Bye            *wsdEndpointXML  `xml:"Bye"`
+		Probe          *wsdEndpointXML  `xml:"Probe"`
+		ProbeMatches   []wsdEndpointXML `xml:"ProbeMatches>ProbeMatch"`
+		Resolve        *wsdEndpointXML  `xml:"Resolve"`
+		ResolveMatches []wsdEndpointXML `xml:"ResolveMatches>ResolveMatch"`
+	} `xml:"Body"`
+}
+
+// decodeWSD returns the WS-Discovery message in the SOAP envelope.
+func decodeWSD(b []byte) (msg WSDMessage, err error) {
+	var v wsdEnvelope
+	if err := xml.Unmarshal(b, &v); err != nil {
+		return WSDMessage{}, fmt.Errorf("invalid soap envelope: %w", packet.ErrParseFrame)
+	}
+	msg.MessageID = strings.TrimSpace(v.MessageID)
+	msg.RelatesTo = strings.TrimSpace(v.RelatesTo)
+	msg.Action = strings.TrimSpace(v.Action)
+	if n := strings.LastIndexByte(msg.Action, '/'); n != -1 {
+		msg.Action = msg.Action[n+1:]
+	}
+	switch {
+	case v.Body.Hello != nil:
+		msg.Endpoints = []WSDEndpoint{v.Body.Hello.endpoint()}
+	case v.Body.Bye != nil:
+		msg.Endpoints = []WSDEndpoint{v.Body.Bye.endpoint()}
+	case v.Body.Probe != nil:
+		msg.Endpoints = []WSDEndpoint{v.Body.Probe.endpoint()}
+	case v.Body.Resolve != nil:
+		msg.Endpoints = []WSDEndpoint{v.Body.Resolve.endpoint()}
+	case v.Body.ProbeMatches != nil || v.Body.ResolveMatches != nil:
+		for _, e := range append(v.Body.ProbeMatches, v.Body.ResolveMatches...) {
+			msg.Endpoints = append(msg.Endpoints, e.endpoint())
+		}
+	}
+	switch msg.Action {
+	case WSDHello, WSDBye, WSDProbe, WSDProbeMatches, WSDResolve, WSDResolveMatches:
+	default:
+		return WSDMessage{}, fmt.Errorf("unsupported action=%s: %w", msg.Action, packet.ErrParseProtocol)
+	}
+	return msg, nil
+}
+
+// wsdNameEntry returns the name entry for the endpoints announced by a device. The name is the host
+// name in the first transport address that is not an IP literal, if any, and the model is derived from
+// the device types; the device name is set later from the device metadata.
+func wsdNameEntry(msg WSDMessage, now time.Time) (name packet.NameEntry) {
+	switch msg.Action {
+	case WSDHello, WSDProbeMatches, WSDResolveMatches:
+	default:
+		return packet.NameEntry{}
+	}
+	name.Type = moduleWSD
+	for _, e := range msg.Endpoints {
+		for _, t := range e.Types {
+			if n := strings.LastIndexByte(t, ':'); n != -1 {
+				t = t[n+1:]
+			}
+			switch t {
+			case "Computer": // Windows function discovery publication service
+				name.Model, name.OS = "Computer", "Windows"
+			case "PrintDeviceType":
+				name.Model = "Printer"
+			case "ScanDeviceType":
+				if name.Model == "" {
+					name.Model = "Scanner"
+				}
+			}
+		}
+		for _, x := range e.XAddrs {
+			u, err := url.Parse(x)
+			if err != nil || name.Name != "" {
+				continue
+			}
+			if host := u.Hostname(); host != "" {
+				if _, err := netip.ParseAddr(host); err != nil {
+					name.Name = host
+				}
+			}
+		}
+	}
+	if name.Name == "" && name.Model == "" {
+		return packet.NameEntry{}
+	}
+	name.Expire = now.Add(defaultExpiryTime)
+	return name
+}
+
+// ProcessWSD decodes a WS-Discovery message and updates the host name entry for devices announcing
+// themselves with Hello or answering a probe. The device metadata is retrieved in the background when
+// the device announces a new metadata version; a Bye expires the host name entry.
+func (h *DNSHandler) ProcessWSD(frame packet.Frame) (name packet.NameEntry, msg WSDMessage, err error) {
+	if msg, err = decodeWSD(frame.Payload()); err != nil {
+		return packet.NameEntry{}, WSDMessage{}, err
+	}
+	if LoggerWSD.IsDebug() {
+		LoggerWSD.Msg("message rcvd").Struct(frame.SrcAddr).Struct(msg).Write()
+	}
+	now := time.Now()
+	if msg.Action == WSDBye {
+		h.mutex.Lock()
+		for _, e := range msg.Endpoints {
+			delete(h.wsd, e.Address)
+		}
+		h.mutex.Unlock()
+		if frame.Host != nil {
+			frame.Host.ExpireWSDName(now)
+		}
+		return packet.NameEntry{}, msg, nil
+	}
+	name = wsdNameEntry(msg, now)
+	if frame.Host != nil && (name.Name != "" || name.Model != "") {
+		frame.Host.UpdateWSDName(name)
+	}
+	if name.Type != "" {
+		addr := packet.Addr{MAC: packet.CopyMAC(frame.SrcAddr.MAC), IP: frame.SrcAddr.IP}
+		for _, e := range msg.Endpoints {
+			if xaddr := h.wsdMetadataDue(addr, e, now); xaddr != "" {
+				go func(address string) {
+					if _, err := h.WSDMetadata(addr, xaddr, address); err != nil && LoggerWSD.IsInfo() {
+						LoggerWSD.Msg("failed to get metadata").Struct(addr).String("xaddr", xaddr).Error(err).Write()
+					}
+				}(e.Address)
+			}
+		}
+	}
+	return name, msg, nil
+}
+
+const wsdMaxEntries = 512
+
+// wsdDevice is a device endpoint with a metadata request.
+type wsdDevice struct {
+	version  uint32 // metadata version requested
+	lastSeen time.Time
+}
+
+// wsdMetadataDue returns the transport address to retrieve the endpoint metadata or an empty string if the
+// metadata version was already requested. Only http addresses for the sender ip are used so a message cannot
+// direct requests to other hosts.
+func (h *DNSHandler) wsdMetadataDue(addr packet.Addr, e WSDEndpoint, now time.Time) (xaddr string) {
+	for _, x := range e.XAddrs {
+		if u, err := url.Parse(x); err == nil && u.Scheme == "http" {
+			if ip, err := netip.ParseAddr(u.Hostname()); err == nil && ip == addr.IP {
+				xaddr = x
+				break
+			}
+		}
+	}
+	if xaddr == "" || e.Address == "" {
+		return ""
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	d := h.wsd[e.Address]
+	if d != nil && d.version == e.MetadataVersion {
+		d.lastSeen = now
+		return ""
+	}
+	if d == nil {
+		if len(h.wsd) >= wsdMaxEntries {
+			return ""
+		}
+		d = &wsdDevice{}
+		h.wsd[e.Address] = d
+	}
+	d.version, d.lastSeen = e.MetadataVersion, now
+	return xaddr
+}
+
+// expireWSD deletes endpoints not seen in the last 24 hours so the metadata is retrieved again.
+// Caller must hold the lock.
+func (h *DNSHandler) expireWSD(now time.Time) {
+	for k, v := range h.wsd {
+		if now.Sub(v.lastSeen) > defaultExpiryTime {
+			delete(h.wsd, k)
+		}
+	}
+}
+
+// wsdClient sends WS-Transfer requests.
+var wsdClient = &http.Client{Timeout: time.Second * 3}
+
+// wsdGetTemplate is a WS-Transfer Get for the device metadata; the To header is the endpoint address.
+const wsdGetTemplate = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing">` +
+	`<soap:Header><wsa:To>%s</wsa:To>` +
+	`<wsa:Action>http://schemas.xmlsoap.org/ws/2004/09/transfer/Get</wsa:Action>` +
+	`<wsa:MessageID>%s</wsa:MessageID>` +
+	`<wsa:ReplyTo><wsa:Address>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</wsa:Address></wsa:ReplyTo>` +
+	`</soap:Header><soap:Body/></soap:Envelope>`
+
+// wsdMetadataEnvelope maps the metadata sections in a GetResponse.
+type wsdMetadataEnvelope struct {
+	XMLName  xml.Name `xml:"Envelope"`
+	Sections []struct {
+		FriendlyName []string `xml:"ThisDevice>FriendlyName"`
+		Manufacturer []string `xml:"ThisModel>Manufacturer"`
+		ModelName    []string `xml:"ThisModel>ModelName"`
+		Computer     string   `xml:"Relationship>Host>Computer"` // Windows; i.e. DESKTOP-1A2B3C/Workgroup:WORKGROUP
+	} `xml:"Body>Metadata>MetadataSection"`
+}
+
+// decodeWSDMetadata returns the name entry for the device metadata. Windows computers use the computer
+// name as the device friendly name is the publication service.
+func decodeWSDMetadata(b []byte) (name packet.NameEntry, err error) {
+	var v wsdMetadataEnvelope
+	if err := xml.Unmarshal(b, &v); err != nil {
+		return packet.NameEntry{}, fmt.Errorf("invalid soap envelope: %w", packet.ErrParseFrame)
+	}
+	first := func(list []string) string {
+		if len(list) > 0 {
+			return strings.TrimSpace(list[0])
+		}
+		return ""
+	}
+	var computer string
+	for _, s := range v.Sections {
+		if c := strings.TrimSpace(s.Computer); c != "" {
+			computer = c
+		}
+		if name.Name == "" {
+			name.Name = first(s.FriendlyName)
+		}
+		if name.Model == "" {
+			name.Model = first(s.ModelName)
+		}
+		if name.Manufacturer == "" {
+			name.Manufacturer = first(s.Manufacturer)
+		}
+	}
+	if computer != "" {
+		if n := strings.IndexByte(computer, '/'); n != -1 {
+			computer = computer[:n]
+		}
+		name = packet.NameEntry{Name: computer, Model: "Computer", OS: "Windows"}
+	}
+	if name.Name == "" && name.Model == "" {
+		return packet.NameEntry{}, packet.ErrNotFound
+	}
+	name.Type = moduleWSD
+	return name, nil
+}
+
+// WSDMetadata sends a WS-Transfer Get to the device transport address and returns the name entry for the
+// device metadata. The name entry is also stored in the host entry for addr.
+func (h *DNSHandler) WSDMetadata(addr packet.Addr, xaddr string, address string) (name packet.NameEntry, err error) {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		return packet.NameEntry{}, err
+	}
+	var to bytes.Buffer
+	xml.EscapeText(&to, []byte(address))
+	msg := fmt.Sprintf(wsdGetTemplate, to.String(), fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]))
+	resp, err := wsdClient.Post(xaddr, "application/soap+xml; charset=utf-8", strings.NewReader(msg))
+	if err != nil {
+		return packet.NameEntry{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return packet.NameEntry{}, fmt.Errorf("metadata status=%d: %w", resp.StatusCode, packet.ErrNoReader)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return packet.NameEntry{}, err
+	}
+	if name, err = decodeWSDMetadata(body); err != nil {
+		return packet.NameEntry{}, err
+	}
+	name.Expire = time.Now().Add(defaultExpiryTime)
+	if LoggerWSD.IsInfo() {
+		LoggerWSD.Msg("device metadata").Struct(addr).Struct(name).Write()
+	}
+	if addr.IP.IsValid() {
+		if host := h.session.FindIP(addr.IP); host != nil {
+			host.UpdateWSDName(name)
+		}
+	}
+	return name, nil
+}
+
+// wsdProbeTemplate is a 2005/04 probe as sent by Windows; most devices answer this version.
+const wsdProbeTemplate = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" ` +
+	`xmlns:wsd="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:wsdp="http://schemas.xmlsoap.org/ws/2006/02/devprof" ` +
+	`xmlns:pub="http://schemas.microsoft.com/windows/pub/2005/07">` +
+	`<soap:Header><wsa:To>urn:schemas-xmlsoap-org:ws:2005:04:discovery</wsa:To>` +
+	`<wsa:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</wsa:Action>` +
+	`<wsa:MessageID>%s</wsa:MessageID></soap:Header>` +
+	`<soap:Body><wsd:Probe>%s</wsd:Probe></soap:Body></soap:Envelope>`
+
+// SendWSDProbe multicasts a WS-Discovery probe for devices of the given types and returns the
+// message id; matches carry this id in RelatesTo. Types are qualified names using the wsdp or pub
+// prefixes, i.e. "wsdp:Device" or "pub:Computer". Probe all devices if types is empty.
+func (h *DNSHandler) SendWSDProbe(types ...string) (messageID string, err error) {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		return "", err
+	}
+	uuid[6], uuid[8] = uuid[6]&0x0f|0x40, uuid[8]&0x3f|0x80 // version 4
+	messageID = fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+
+	var body bytes.Buffer
+	if len(types) > 0 {
+		body.WriteString("<wsd:Types>")
+		xml.EscapeText(&body, []byte(strings.Join(types, " ")))
+		body.WriteString("</wsd:Types>")
+	}
+	msg := fmt.Sprintf(wsdProbeTemplate, messageID, body.String())
+
+	b := packet.EtherBufferPool.Get().(*[packet.EthMaxSize]byte)
+	defer packet.EtherBufferPool.Put(b)
+	ether := packet.EncodeEther(packet.Ether(b[0:]), syscall.ETH_P_IP, h.session.NICInfo.HostAddr4.MAC, wsdIPv4MAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 1, h.session.NICInfo.HostAddr4.IP, wsd4IPv4Addr.IP)
+	udp := packet.EncodeUDP(ip4.Payload(), wsd4IPv4Addr.Port, wsd4IPv4Addr.Port)
+	if udp, err = udp.AppendPayload([]byte(msg)); err != nil {
+		return "", err
+	}
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		return "", err
+	}
+	if LoggerWSD.IsDebug() {
+		LoggerWSD.Msg("send probe").String("messageid", messageID).StringArray("types", types).Write()
+	}
+	if _, err := h.session.Conn.WriteTo(ether, &packet.Addr{MAC: wsdIPv4MAC, IP: wsd4IPv4Addr.IP, Port: wsd4IPv4Addr.Port}); err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
+
+// wsdIPv4MAC is the ethernet multicast address for 239.255.255.250
+var wsdIPv4MAC = net.HardwareAddr{0x01, 0x00, 0x5e, 0x7f, 0xff, 0xfa}
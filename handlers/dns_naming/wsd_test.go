@@ -0,0 +1,283 @@
+package dns_naming
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+// Hello multicast by a Windows 10 PC
+var wsdHelloWindows = []byte(`<?xml version="1.0" encoding="utf-8"?>` +
+	`<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" ` +
+	`xmlns:wsd="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:wsdp="http://schemas.xmlsoap.org/ws/2006/02/devprof" ` +
+	`xmlns:pub="http://schemas.microsoft.com/windows/pub/2005/07"><soap:Header>` +
+	`<wsa:To>urn:schemas-xmlsoap-org:ws:2005:04:discovery</wsa:To>` +
+	`<wsa:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/Hello</wsa:Action>` +
+	`<wsa:MessageID>urn:uuid:1f3e5a62-7c1d-4e2b-9b1a-2d6c8f0e4a11</wsa:MessageID>` +
+	`<wsd:AppSequence InstanceId="7" SequenceId="urn:uuid:4a0e8b1c-2f3d-4c5e-8a9b-0c1d2e3f4a5b" MessageNumber="1"></wsd:AppSequence>` +
+	`</soap:Header><soap:Body><wsd:Hello><wsa:EndpointReference><wsa:Address>urn:uuid:b6e3c0a2-5d4f-4e1a-9c8b-7a6f5e4d3c2b</wsa:Address>` +
+	`</wsa:EndpointReference><wsd:Types>wsdp:Device pub:Computer</wsd:Types>` +
+	`<wsd:XAddrs>http://192.168.0.20:5357/b6e3c0a2-5d4f-4e1a-9c8b-7a6f5e4d3c2b/</wsd:XAddrs>` +
+	`<wsd:MetadataVersion>2</wsd:MetadataVersion></wsd:Hello></soap:Body></soap:Envelope>`)
+
+// ProbeMatches unicast by a network printer using the 2009/01 namespaces
+var wsdProbeMatchesPrinter = []byte(`<?xml version="1.0" encoding="UTF-8"?>` +
+	`<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://www.w3.org/2005/08/addressing" ` +
+	`xmlns:wsd="http://docs.oasis-open.org/ws-dd/ns/discovery/2009/01" xmlns:wsdp="http://schemas.xmlsoap.org/ws/2006/02/devprof" ` +
+	`xmlns:wprt="http://schemas.microsoft.com/windows/2006/08/wdp/print" xmlns:wscn="http://schemas.microsoft.com/windows/2006/08/wdp/scan">` +
+	`<SOAP-ENV:Header><wsa:To>http://www.w3.org/2005/08/addressing/anonymous</wsa:To>` +
+	`<wsa:Action>http://docs.oasis-open.org/ws-dd/ns/discovery/2009/01/ProbeMatches</wsa:Action>` +
+	`<wsa:MessageID>urn:uuid:e1f2a3b4-c5d6-4e7f-8a9b-0c1d2e3f4a5b</wsa:MessageID>` +
+	`<wsa:RelatesTo>urn:uuid:0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d</wsa:RelatesTo></SOAP-ENV:Header>` +
+	`<SOAP-ENV:Body><wsd:ProbeMatches><wsd:ProbeMatch><wsa:EndpointReference>` +
+	`<wsa:Address>urn:uuid:e3248000-80ce-11db-8000-3c2af4d1e2f3</wsa:Address></wsa:EndpointReference>` +
+	`<wsd:Types>wsdp:Device wprt:PrintDeviceType wscn:ScanDeviceType</wsd:Types>` +
+	`<wsd:Scopes>http://schemas.microsoft.com/windows/2006/08/wdp/print/default</wsd:Scopes>` +
+	`<wsd:XAddrs>http://192.168.0.30:80/WebServices/Device http://BRN3C2AF4D1E2F3.local:80/WebServices/Device</wsd:XAddrs>` +
+	`<wsd:MetadataVersion>1</wsd:MetadataVersion></wsd:ProbeMatch></wsd:ProbeMatches></SOAP-ENV:Body></SOAP-ENV:Envelope>`)
+
+var wsdBye = []byte(`<?xml version="1.0" encoding="utf-8"?>` +
+	`<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" ` +
+	`xmlns:wsd="http://schemas.xmlsoap.org/ws/2005/04/discovery"><soap:Header>` +
+	`<wsa:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/Bye</wsa:Action>` +
+	`<wsa:MessageID>urn:uuid:9d8c7b6a-5f4e-4d3c-8b2a-1f0e9d8c7b6a</wsa:MessageID></soap:Header>` +
+	`<soap:Body><wsd:Bye><wsa:EndpointReference><wsa:Address>urn:uuid:b6e3c0a2-5d4f-4e1a-9c8b-7a6f5e4d3c2b</wsa:Address>` +
+	`</wsa:EndpointReference></wsd:Bye></soap:Body></soap:Envelope>`)
+
+// GetResponse from a Windows 10 PC
+var wsdMetadataWindows = []byte(`<?xml version="1.0" encoding="utf-8"?>` +
+	`<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" ` +
+	`xmlns:wsx="http://schemas.xmlsoap.org/ws/2004/09/mex" xmlns:wsdp="http://schemas.xmlsoap.org/ws/2006/02/devprof" ` +
+	`xmlns:pub="http://schemas.microsoft.com/windows/pub/2005/07"><soap:Header>` +
+	`<wsa:Action>http://schemas.xmlsoap.org/ws/2004/09/transfer/GetResponse</wsa:Action></soap:Header><soap:Body><wsx:Metadata>` +
+	`<wsx:MetadataSection Dialect="http://schemas.xmlsoap.org/ws/2006/02/devprof/ThisDevice"><wsdp:ThisDevice>` +
+	`<wsdp:FriendlyName xml:lang="en-US">Microsoft Publication Service Device Host</wsdp:FriendlyName></wsdp:ThisDevice></wsx:MetadataSection>` +
+	`<wsx:MetadataSection Dialect="http://schemas.xmlsoap.org/ws/2006/02/devprof/ThisModel"><wsdp:ThisModel>` +
+	`<wsdp:Manufacturer>Microsoft Corporation</wsdp:Manufacturer><wsdp:ModelName>Microsoft Publication Service</wsdp:ModelName>` +
+	`</wsdp:ThisModel></wsx:MetadataSection>` +
+	`<wsx:MetadataSection Dialect="http://schemas.xmlsoap.org/ws/2006/02/devprof/Relationship"><wsdp:Relationship>` +
+	`<wsdp:Host><wsa:EndpointReference><wsa:Address>urn:uuid:b6e3c0a2-5d4f-4e1a-9c8b-7a6f5e4d3c2b</wsa:Address></wsa:EndpointReference>` +
+	`<wsdp:Types>pub:Computer</wsdp:Types><pub:Computer>DESKTOP-1A2B3C/Workgroup:WORKGROUP</pub:Computer></wsdp:Host>` +
+	`</wsdp:Relationship></wsx:MetadataSection></wsx:Metadata></soap:Body></soap:Envelope>`)
+
+// GetResponse from a network printer
+var wsdMetadataPrinter = []byte(`<?xml version="1.0" encoding="UTF-8"?>` +
+	`<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://www.w3.org/2003/05/soap-envelope" xmlns:mex="http://schemas.xmlsoap.org/ws/2004/09/mex" ` +
+	`xmlns:wsdp="http://schemas.xmlsoap.org/ws/2006/02/devprof"><SOAP-ENV:Body><mex:Metadata>` +
+	`<mex:MetadataSection Dialect="http://schemas.xmlsoap.org/ws/2006/02/devprof/ThisModel"><wsdp:ThisModel>` +
+	`<wsdp:Manufacturer xml:lang="en">Brother</wsdp:Manufacturer><wsdp:Manufacturer xml:lang="ja">Brother</wsdp:Manufacturer>` +
+	`<wsdp:ModelName>MFC-L2750DW series</wsdp:ModelName></wsdp:ThisModel></mex:MetadataSection>` +
+	`<mex:MetadataSection Dialect="http://schemas.xmlsoap.org/ws/2006/02/devprof/ThisDevice"><wsdp:ThisDevice>` +
+	`<wsdp:FriendlyName>Brother MFC-L2750DW</wsdp:FriendlyName></wsdp:ThisDevice></mex:MetadataSection>` +
+	`</mex:Metadata></SOAP-ENV:Body></SOAP-ENV:Envelope>`)
+
+func Test_decodeWSDMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       []byte
+		wantErr error
+		want    packet.NameEntry
+	}{
+		{name: "windows", p: wsdMetadataWindows, want: packet.NameEntry{Type: moduleWSD, Name: "DESKTOP-1A2B3C", Model: "Computer", OS: "Windows"}},
+		{name: "printer", p: wsdMetadataPrinter, want: packet.NameEntry{Type: moduleWSD, Name: "Brother MFC-L2750DW", Model: "MFC-L2750DW series", Manufacturer: "Brother"}},
+		{name: "no metadata", p: []byte(`<Envelope><Body><Metadata></Metadata></Body></Envelope>`), wantErr: packet.ErrNotFound},
+		{name: "invalid xml", p: wsdMetadataPrinter[:100], wantErr: packet.ErrParseFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := decodeWSDMetadata(tt.p)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("decodeWSDMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if name != tt.want {
+				t.Errorf("decodeWSDMetadata() = %+v, want %+v", name, tt.want)
+			}
+		})
+	}
+}
+
+func Test_decodeWSD(t *testing.T) {
+	tests := []struct {
+		name      string
+		p         []byte
+		wantErr   error
+		action    string
+		address   string
+		types     int
+		xaddrs    int
+		wantName  string
+		wantModel string
+	}{
+		{name: "hello", p: wsdHelloWindows, action: WSDHello, address: "urn:uuid:b6e3c0a2-5d4f-4e1a-9c8b-7a6f5e4d3c2b", types: 2, xaddrs: 1, wantModel: "Computer"},
+		{name: "probematches", p: wsdProbeMatchesPrinter, action: WSDProbeMatches, address: "urn:uuid:e3248000-80ce-11db-8000-3c2af4d1e2f3", types: 3, xaddrs: 2,
+			wantName: "BRN3C2AF4D1E2F3.local", wantModel: "Printer"},
+		{name: "bye", p: wsdBye, action: WSDBye, address: "urn:uuid:b6e3c0a2-5d4f-4e1a-9c8b-7a6f5e4d3c2b"},
+		{name: "invalid xml", p: wsdHelloWindows[:200], wantErr: packet.ErrParseFrame},
+		{name: "unknown action", p: []byte(`<Envelope><Header><Action>urn:test/Get</Action></Header><Body></Body></Envelope>`), wantErr: packet.ErrParseProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := decodeWSD(tt.p)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("decodeWSD() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if msg.Action != tt.action || len(msg.Endpoints) != 1 || msg.Endpoints[0].Address != tt.address ||
+				len(msg.Endpoints[0].Types) != tt.types || len(msg.Endpoints[0].XAddrs) != tt.xaddrs {
+				t.Fatalf("invalid message %+v", msg)
+			}
+			name := wsdNameEntry(msg, time.Now())
+			if name.Name != tt.wantName || name.Model != tt.wantModel {
+				t.Errorf("invalid name entry %+v", name)
+			}
+		})
+	}
+}
+
+// newUDPFrame returns a udp frame from src to dst with payload.
+func newUDPFrame(t *testing.T, session *packet.Session, src packet.Addr, dst packet.Addr, payload []byte) packet.Frame {
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, src.MAC, dst.MAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 255, src.IP, dst.IP)
+	udp := packet.EncodeUDP(ip4.Payload(), src.Port, dst.Port)
+	udp, err := udp.AppendPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := session.Parse(ether)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestDNSHandler_ProcessWSD(t *testing.T) {
+	session, clientConn := testSession()
+	defer session.Close()
+	h, _ := New(session)
+	defer h.Close()
+
+	src := packet.Addr{MAC: net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x30}, IP: netip.MustParseAddr("192.168.0.30"), Port: 3702}
+	frame := newUDPFrame(t, session, src, packet.Addr{MAC: session.NICInfo.HostAddr4.MAC, IP: session.NICInfo.HostAddr4.IP, Port: 3702}, wsdProbeMatchesPrinter)
+	if frame.PayloadID != packet.PayloadWSDP || frame.Host == nil {
+		t.Fatalf("invalid frame payloadID=%v", frame.PayloadID)
+	}
+	name, msg, err := h.ProcessWSD(frame)
+	if err != nil || msg.RelatesTo != "urn:uuid:0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d" || name.Type != moduleWSD {
+		t.Fatalf("invalid probe matches %+v err=%v", msg, err)
+	}
+	frame.Host.MACEntry.Row.RLock()
+	wsdName := frame.Host.MACEntry.WSDName
+	frame.Host.MACEntry.Row.RUnlock()
+	if wsdName.Name != "BRN3C2AF4D1E2F3.local" || wsdName.Model != "Printer" {
+		t.Errorf("invalid host wsd name %+v", wsdName)
+	}
+
+	// probe
+	messageID, err := h.SendWSDProbe("wsdp:Device", "pub:Computer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, packet.EthMaxSize)
+	n, _, err := clientConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := packet.UDP(packet.IP4(packet.Ether(buf[:n]).Payload()).Payload())
+	if udp.DstPort() != 3702 || packet.IP4(packet.Ether(buf[:n]).Payload()).Dst() != wsd4IPv4Addr.IP {
+		t.Fatalf("invalid probe destination %s", packet.Ether(buf[:n]))
+	}
+	probe, err := decodeWSD(udp.Payload())
+	if err != nil || probe.Action != WSDProbe || probe.MessageID != messageID || len(probe.Endpoints) != 1 ||
+		len(probe.Endpoints[0].Types) != 2 || probe.Endpoints[0].Types[1] != "pub:Computer" {
+		t.Fatalf("invalid probe %+v err=%v", probe, err)
+	}
+}
+
+func TestDNSHandler_WSDMetadata(t *testing.T) {
+	session, _ := testSession()
+	defer session.Close()
+	h, _ := New(session)
+	defer h.Close()
+
+	// device metadata server; all requests are sent to the test server regardless of the transport address
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPost || !strings.Contains(string(body), "transfer/Get") ||
+			!strings.Contains(string(body), "<wsa:To>urn:uuid:b6e3c0a2-5d4f-4e1a-9c8b-7a6f5e4d3c2b</wsa:To>") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&gets, 1)
+		w.Write(wsdMetadataWindows)
+	}))
+	defer server.Close()
+	saved := wsdClient
+	defer func() { wsdClient = saved }()
+	wsdClient = &http.Client{Timeout: time.Second, Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}}
+
+	src := packet.Addr{MAC: net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x20}, IP: netip.MustParseAddr("192.168.0.20"), Port: 3702}
+	dst := packet.Addr{MAC: wsdIPv4MAC, IP: wsd4IPv4Addr.IP, Port: 3702}
+	wsdName := func(host *packet.Host) packet.NameEntry {
+		host.MACEntry.Row.RLock()
+		defer host.MACEntry.Row.RUnlock()
+		return host.WSDName
+	}
+
+	frame := newUDPFrame(t, session, src, dst, wsdHelloWindows)
+	if _, _, err := h.ProcessWSD(frame); err != nil {
+		t.Fatal(err)
+	}
+	host := frame.Host
+	for i := 0; i < 100 && wsdName(host).Name == ""; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if name := wsdName(host); name.Name != "DESKTOP-1A2B3C" || name.Model != "Computer" || name.OS != "Windows" {
+		t.Fatalf("invalid host wsd name %+v", name)
+	}
+
+	// same metadata version is not requested again
+	if _, _, err := h.ProcessWSD(newUDPFrame(t, session, src, dst, wsdHelloWindows)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf("invalid metadata requests=%d", n)
+	}
+
+	// bye expires the name
+	if _, _, err := h.ProcessWSD(newUDPFrame(t, session, src, dst, wsdBye)); err != nil {
+		t.Fatal(err)
+	}
+	if name := wsdName(host); name.Expire.After(time.Now()) {
+		t.Errorf("wsd name not expired %+v", name)
+	}
+	h.mutex.RLock()
+	n := len(h.wsd)
+	h.mutex.RUnlock()
+	if n != 0 {
+		t.Errorf("wsd endpoint not deleted %d", n)
+	}
+}
@@ -0,0 +1,224 @@
+package dns_zone
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+
+	"github.com/irai/packet"
+)
+
+// hostRecord holds the name and IP of a host in the session host table.
+type hostRecord struct {
+	label string
+	ip    netip.Addr
+}
+
+// Label returns the dns label for a device name; apostrophes are removed and other invalid
+// characters are replaced by '-'. It returns an empty string if the name has no valid characters.
+func Label(name string) string {
+	b := make([]byte, 0, len(name))
+	for i := 0; i < len(name) && len(b) < 63; i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			b = append(b, c)
+		case c >= 'A' && c <= 'Z':
+			b = append(b, c+('a'-'A'))
+		case c == '\'':
+		case len(b) > 0 && b[len(b)-1] != '-':
+			b = append(b, '-')
+		}
+	}
+	return strings.Trim(string(b), "-")
+}
+
+// hostLabel returns the label for the host using the first available name in order of preference.
+// Caller must hold the row lock.
+func hostLabel(host *packet.Host) string {
+	for _, n := range []string{host.DHCP4Name.Name, host.MDNSName.Name, host.LLMNRName.Name, host.NBNSName.Name, host.SSDPName.Name, host.WSDName.Name} {
+		if l := Label(n); l != "" {
+			return l
+		}
+	}
+	return ""
+}
+
+// hosts returns the labelled hosts in the session host table.
+func (h *Handler) hosts() []hostRecord {
+	table := h.session.GetHosts()
+	list := make([]hostRecord, 0, len(table))
+	for _, host := range table {
+		host.MACEntry.Row.RLock()
+		r := hostRecord{label: hostLabel(host), ip: host.Addr.IP}
+		host.MACEntry.Row.RUnlock()
+		if r.label != "" && r.ip.IsValid() && !r.ip.IsUnspecified() {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// Lookup returns the IPs for the fully qualified name in the local zone.
+func (h *Handler) Lookup(name string) (ips []netip.Addr) {
+	label, ok := h.hostPart(strings.ToLower(strings.TrimSuffix(name, ".")))
+	if !ok || label == "" {
+		return nil
+	}
+	for _, v := range h.hosts() {
+		if v.label == label {
+			ips = append(ips, v.ip)
+		}
+	}
+	return ips
+}
+
+// hostPart returns the label before the domain and true if name is in the zone.
+func (h *Handler) hostPart(name string) (string, bool) {
+	if name == h.domain {
+		return "", true
+	}
+	if strings.HasSuffix(name, h.domain) && len(name) > len(h.domain) && name[len(name)-len(h.domain)-1] == '.' {
+		return name[:len(name)-len(h.domain)-1], true
+	}
+	return "", false
+}
+
+// authoritativeReverse returns true if the handler answers PTR queries for ip; the handler is
+// authoritative for the home LAN and for IPv6 addresses of tracked hosts.
+func (h *Handler) authoritativeReverse(ip netip.Addr, found bool) bool {
+	if ip.Is4() {
+		return h.session.NICInfo.HomeLAN4.Contains(ip)
+	}
+	return found
+}
+
+// Authoritative returns true if the handler answers queries for name. Use it to stop another
+// server, i.e. the dns_forwarder handler, from sending local zone queries upstream.
+func (h *Handler) Authoritative(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if _, inZone := h.hostPart(name); inZone {
+		return true
+	}
+	ip, isReverse := packet.DNSReverseAddr(name)
+	if !isReverse {
+		return false
+	}
+	var found bool
+	if ip.Is6() {
+		for _, v := range h.hosts() {
+			if v.ip == ip {
+				found = true
+				break
+			}
+		}
+	}
+	return h.authoritativeReverse(ip, found)
+}
+
+// Answer returns the answer to a query for the local zone using buf to build the answer.
+// It returns false if the query is not for the local zone.
+func (h *Handler) Answer(query packet.DNS, buf []byte) (answer packet.DNS, ok bool, err error) {
+	if err := query.IsValid(); err != nil {
+		return nil, false, err
+	}
+	if query.QR() || query.QDCount() != 1 {
+		return nil, false, nil
+	}
+	q, _, err := packet.DecodeQuestion(query, 12, make([]byte, 0, 256))
+	if err != nil {
+		return nil, false, err
+	}
+	qname := string(q.Name) // echo the question name case; some resolvers randomise it
+	name := strings.ToLower(qname)
+	flags := packet.DNSFlagQR | packet.DNSFlagAA | (query.Flags() & packet.DNSFlagRD)
+
+	var b packet.DNSBuilder
+	b.Reset(buf, query.TransactionID(), flags)
+	b.Question(qname, q.Type, q.Class)
+	hdr := packet.DNSRRHeader{Name: qname, Class: packet.DNSClassINET, TTL: h.ttl}
+
+	label, inZone := h.hostPart(name)
+	switch {
+	case query.OpCode() != 0:
+		if !inZone {
+			return nil, false, nil
+		}
+		b.SetFlags(flags | packet.DNSRCodeNotImplemented)
+
+	case inZone && label == "": // zone apex
+		switch q.Type {
+		case packet.DNSTypeSOA, packet.DNSTypeANY:
+			b.SOA(packet.DNSRRHeader{Name: h.domain, Class: packet.DNSClassINET, TTL: h.ttl}, h.soa)
+		default:
+			h.noData(&b)
+		}
+
+	case inZone:
+		var found bool
+		var count int
+		for _, v := range h.hosts() {
+			if v.label != label {
+				continue
+			}
+			found = true
+			switch {
+			case v.ip.Is4() && (q.Type == packet.DNSTypeA || q.Type == packet.DNSTypeANY):
+				b.A(hdr, v.ip)
+				count++
+			case v.ip.Is6() && !v.ip.IsLinkLocalUnicast() && (q.Type == packet.DNSTypeAAAA || q.Type == packet.DNSTypeANY):
+				b.AAAA(hdr, v.ip)
+				count++
+			}
+		}
+		switch {
+		case !found:
+			b.SetFlags(flags | packet.DNSRCodeNameError)
+			h.noData(&b)
+		case count == 0:
+			h.noData(&b)
+		}
+
+	default:
+		ip, isReverse := packet.DNSReverseAddr(name)
+		if !isReverse {
+			return nil, false, nil
+		}
+		var ptr string
+		for _, v := range h.hosts() {
+			if v.ip == ip {
+				ptr = v.label + "." + h.domain
+				break
+			}
+		}
+		if !h.authoritativeReverse(ip, ptr != "") {
+			return nil, false, nil
+		}
+		switch {
+		case ptr == "":
+			b.SetFlags(flags | packet.DNSRCodeNameError)
+		case q.Type == packet.DNSTypePTR || q.Type == packet.DNSTypeANY:
+			b.PTR(hdr, ptr)
+		}
+	}
+
+	if answer, err = b.Finish(); errors.Is(err, packet.ErrPayloadTooBig) {
+		// answer does not fit; send the question only and let the client retry over tcp
+		b.Reset(buf, query.TransactionID(), flags|packet.DNSFlagTC)
+		b.Question(qname, q.Type, q.Class)
+		answer, err = b.Finish()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if Logger.IsDebug() {
+		Logger.Msg("answer").String("name", name).Uint16("type", q.Type).Int("rcode", answer.ResponseCode()).Write()
+	}
+	return answer, true, nil
+}
+
+// noData adds the zone SOA to the authority section for negative caching - RFC 2308.
+func (h *Handler) noData(b *packet.DNSBuilder) {
+	b.StartAuthorities()
+	b.SOA(packet.DNSRRHeader{Name: h.domain, Class: packet.DNSClassINET, TTL: h.ttl}, h.soa)
+}
@@ -0,0 +1,177 @@
+// Package dns_zone implements an authoritative dns server for LAN device names.
+//
+// The session learns names for each host from DHCP, mDNS, SSDP, LLMNR and NBNS. The handler serves
+// these names under a local domain, i.e. iphone.lan, answering A and AAAA queries from the session
+// host table and PTR queries for the home LAN reverse zone. Answers are built from the host table
+// at query time so they follow name and IP changes.
+//
+// The handler can process dns frames from the raw session via ProcessPacket or serve a standard
+// udp socket via ListenAndServe. Queries outside the zone are ignored so that another server, or the
+// dns_forwarder handler, can answer them.
+package dns_zone
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+const module = "dnszone"
+
+var Logger = fastlog.New(module)
+
+const maxUDPSize = 512 // answers without edns are limited to 512 bytes - rfc1035
+
+// Config holds the zone configuration.
+type Config struct {
+	Domain string        // local domain; default to "lan"
+	TTL    time.Duration // TTL for answers; default to 60 seconds
+}
+
+// Handler implements the authoritative server for the local domain.
+type Handler struct {
+	session *packet.Session
+	domain  string // lowercase domain without trailing dot
+	ttl     uint32
+	soa     packet.DNSSOA
+	conn    net.PacketConn // udp listener; nil if not listening
+	closed  bool
+	sync.Mutex
+}
+
+// New returns a zone handler for the default "lan" domain.
+func New(session *packet.Session) (*Handler, error) {
+	return Config{}.New(session)
+}
+
+// New accepts a configuration structure and returns a zone handler.
+func (config Config) New(session *packet.Session) (h *Handler, err error) {
+	h = &Handler{session: session}
+	h.domain = strings.ToLower(strings.Trim(config.Domain, "."))
+	if h.domain == "" {
+		h.domain = "lan"
+	}
+	if strings.Contains(h.domain, "..") || len(h.domain) > 200 {
+		return nil, fmt.Errorf("invalid domain=%s: %w", config.Domain, packet.ErrInvalidParam)
+	}
+	h.ttl = uint32(config.TTL / time.Second)
+	if h.ttl == 0 {
+		h.ttl = 60
+	}
+	h.soa = packet.DNSSOA{MName: "ns." + h.domain, RName: "hostmaster." + h.domain, Serial: uint32(time.Now().Unix()),
+		Refresh: 3600, Retry: 600, Expire: 86400, Minimum: h.ttl}
+	if Logger.IsInfo() {
+		Logger.Msg("new dns zone").String("domain", h.domain).Write()
+	}
+	return h, nil
+}
+
+// Close the handler and the udp listener if any.
+func (h *Handler) Close() error {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	if h.conn != nil {
+		return h.conn.Close()
+	}
+	return nil
+}
+
+// Domain returns the local domain name.
+func (h *Handler) Domain() string {
+	return h.domain
+}
+
+// ProcessPacket answers udp dns queries for the local zone sent to our host.
+func (h *Handler) ProcessPacket(frame packet.Frame) error {
+	if frame.PayloadID != packet.PayloadDNS || frame.UDP() == nil || frame.DstAddr.Port != packet.DNSPort ||
+		!frame.SrcAddr.IP.Is4() || !frame.DstAddr.IP.Is4() || !bytes.Equal(frame.DstAddr.MAC, h.session.NICInfo.HostAddr4.MAC) {
+		return nil
+	}
+	query := packet.DNS(frame.Payload())
+	if query.QR() {
+		return nil
+	}
+	buf := make([]byte, 0, maxUDPSize)
+	answer, ok, err := h.Answer(query, buf)
+	if err != nil || !ok {
+		return err
+	}
+	b := packet.EtherBufferPool.Get().(*[packet.EthMaxSize]byte)
+	defer packet.EtherBufferPool.Put(b)
+	ether := packet.Ether(b[0:])
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, frame.DstAddr.MAC, frame.SrcAddr.MAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 50, frame.DstAddr.IP, frame.SrcAddr.IP)
+	udp := packet.EncodeUDP(ip4.Payload(), frame.DstAddr.Port, frame.SrcAddr.Port)
+	if udp, err = udp.AppendPayload(answer); err != nil {
+		return err
+	}
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		return err
+	}
+	if _, err := h.session.Conn.WriteTo(ether, &frame.SrcAddr); err != nil {
+		Logger.Msg("failed to write").Error(err).Write()
+		return err
+	}
+	return nil
+}
+
+// ListenAndServe answers queries for the local zone received on the udp address, i.e. ":53".
+// It blocks until Close is called.
+func (h *Handler) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return h.Serve(conn)
+}
+
+// Serve answers queries for the local zone received on conn. It blocks until Close is called.
+func (h *Handler) Serve(conn net.PacketConn) error {
+	h.Lock()
+	if h.closed {
+		h.Unlock()
+		conn.Close()
+		return packet.ErrHandlerClosed
+	}
+	h.conn = conn
+	h.Unlock()
+
+	buf := make([]byte, 1500)
+	out := make([]byte, 0, maxUDPSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			h.Lock()
+			closed := h.closed
+			h.Unlock()
+			if closed || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		query := packet.DNS(buf[:n])
+		if query.IsValid() != nil || query.QR() {
+			continue
+		}
+		answer, ok, err := h.Answer(query, out)
+		if err != nil || !ok {
+			continue
+		}
+		if _, err := conn.WriteTo(answer, addr); err != nil {
+			Logger.Msg("failed to write").Error(err).Write()
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package dns_zone
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+var (
+	hostMAC   = net.HardwareAddr{0x00, 0x55, 0x55, 0x55, 0x55, 0x55}
+	hostIP4   = netip.MustParseAddr("192.168.0.129")
+	routerMAC = net.HardwareAddr{0x00, 0x66, 0x66, 0x66, 0x66, 0x66}
+	routerIP4 = netip.MustParseAddr("192.168.0.11")
+	homeLAN   = netip.MustParsePrefix("192.168.0.0/24")
+	mac1      = net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x01}
+	mac2      = net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x02}
+	ip1       = netip.MustParseAddr("192.168.0.1")
+	ip2       = netip.MustParseAddr("192.168.0.2")
+)
+
+type testContext struct {
+	session *packet.Session
+	h       *Handler
+	outConn net.PacketConn
+}
+
+func setupTest(t *testing.T) *testContext {
+	Logger.SetLevel(fastlog.LevelError)
+	tc := &testContext{}
+	var inConn net.PacketConn
+	inConn, tc.outConn = packet.TestNewBufferedConn()
+	nicInfo := &packet.NICInfo{RouterAddr4: packet.Addr{MAC: routerMAC, IP: routerIP4}, HostAddr4: packet.Addr{MAC: hostMAC, IP: hostIP4}, HomeLAN4: homeLAN}
+	var err error
+	if tc.session, err = (packet.Config{Conn: inConn, NICInfo: nicInfo}).NewSession(""); err != nil {
+		t.Fatal("cannot create session", err)
+	}
+	if tc.h, err = (Config{Domain: "Home.LAN."}).New(tc.session); err != nil {
+		t.Fatal("cannot create handler", err)
+	}
+	if err := tc.session.DHCPv4Update(mac1, ip1, packet.NameEntry{Type: "dhcp4", Name: "John's iPhone"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.session.DHCPv4Update(mac2, ip2, packet.NameEntry{}); err != nil {
+		t.Fatal(err)
+	}
+	tc.session.FindIP(ip2).UpdateMDNSName(packet.NameEntry{Type: "mdns", Name: "printer"})
+	return tc
+}
+
+func (tc *testContext) Close() {
+	tc.h.Close()
+	tc.session.Close()
+}
+
+func newQuery(id uint16, name string, qType uint16) packet.DNS {
+	var b packet.DNSBuilder
+	b.Reset(make([]byte, 0, 512), id, packet.DNSFlagRD)
+	b.Question(name, qType, packet.DNSClassINET)
+	msg, err := b.Finish()
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+func decodeAnswer(t *testing.T, p packet.DNS) (rr packet.DNSResourceRecord, target string) {
+	t.Helper()
+	offset, err := p.AnswerOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr, _, err = packet.DecodeRR(p, offset, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Type == packet.DNSTypePTR {
+		name, err := rr.DecodeName(p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target = string(name)
+	}
+	return rr, target
+}
+
+func TestHandler_Answer(t *testing.T) {
+	tc := setupTest(t)
+	defer tc.Close()
+
+	tests := []struct {
+		name      string
+		qname     string
+		qType     uint16
+		notZone   bool
+		rcode     int
+		wantIP    netip.Addr
+		wantPTR   string
+		wantNS    uint16
+		wantCount uint16
+	}{
+		{name: "a", qname: "johns-iphone.home.lan", qType: packet.DNSTypeA, wantIP: ip1, wantCount: 1},
+		{name: "case", qname: "JOHNS-iPhone.Home.Lan", qType: packet.DNSTypeA, wantIP: ip1, wantCount: 1},
+		{name: "mdns name", qname: "printer.home.lan", qType: packet.DNSTypeA, wantIP: ip2, wantCount: 1},
+		{name: "nodata", qname: "printer.home.lan", qType: packet.DNSTypeAAAA, wantNS: 1},
+		{name: "nxdomain", qname: "laptop.home.lan", qType: packet.DNSTypeA, rcode: packet.DNSRCodeNameError, wantNS: 1},
+		{name: "subdomain", qname: "www.printer.home.lan", qType: packet.DNSTypeA, rcode: packet.DNSRCodeNameError, wantNS: 1},
+		{name: "apex soa", qname: "home.lan", qType: packet.DNSTypeSOA, wantCount: 1},
+		{name: "ptr", qname: "1.0.168.192.in-addr.arpa", qType: packet.DNSTypePTR, wantPTR: "johns-iphone.home.lan", wantCount: 1},
+		{name: "ptr nxdomain", qname: "99.0.168.192.in-addr.arpa", qType: packet.DNSTypePTR, rcode: packet.DNSRCodeNameError},
+		{name: "ptr not lan", qname: "8.8.8.8.in-addr.arpa", qType: packet.DNSTypePTR, notZone: true},
+		{name: "not zone", qname: "www.google.com", qType: packet.DNSTypeA, notZone: true},
+		{name: "suffix not zone", qname: "printer.myhome.lan", qType: packet.DNSTypeA, notZone: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer, ok, err := tc.h.Answer(newQuery(uint16(i), tt.qname, tt.qType), make([]byte, 0, maxUDPSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok == tt.notZone {
+				t.Fatalf("invalid zone ok=%v", ok)
+			}
+			if tc.h.Authoritative(tt.qname) == tt.notZone {
+				t.Errorf("invalid authoritative for name=%s", tt.qname)
+			}
+			if tt.notZone {
+				return
+			}
+			if answer.TransactionID() != uint16(i) || !answer.QR() || !answer.AA() || !answer.RD() || answer.RA() {
+				t.Errorf("invalid header %s", answer)
+			}
+			if answer.ResponseCode() != tt.rcode || answer.ANCount() != tt.wantCount || answer.NSCount() != tt.wantNS {
+				t.Fatalf("invalid answer rcode=%d an=%d ns=%d", answer.ResponseCode(), answer.ANCount(), answer.NSCount())
+			}
+			q, _, _ := packet.DecodeQuestion(answer, 12, nil)
+			if string(q.Name) != tt.qname {
+				t.Errorf("invalid question name %s", q.Name)
+			}
+			if tt.wantCount == 0 {
+				return
+			}
+			rr, target := decodeAnswer(t, answer)
+			if tt.wantIP.IsValid() && rr.IP() != tt.wantIP {
+				t.Errorf("invalid ip %s", rr.IP())
+			}
+			if target != tt.wantPTR {
+				t.Errorf("invalid ptr %s", target)
+			}
+		})
+	}
+
+	// answers follow name changes
+	tc.session.FindIP(ip1).UpdateDHCP4Name(packet.NameEntry{Type: "dhcp4", Name: "kitchen-tablet"})
+	if ips := tc.h.Lookup("kitchen-tablet.home.lan."); len(ips) != 1 || ips[0] != ip1 {
+		t.Errorf("invalid lookup after name change %v", ips)
+	}
+	if ips := tc.h.Lookup("johns-iphone.home.lan"); len(ips) != 0 {
+		t.Errorf("invalid lookup for old name %v", ips)
+	}
+}
+
+func TestLabel(t *testing.T) {
+	tests := map[string]string{
+		"John's iPhone":      "johns-iphone",
+		"  Living Room TV  ": "living-room-tv",
+		"android-3f2a":       "android-3f2a",
+		"!!!":                "",
+	}
+	for name, want := range tests {
+		if got := Label(name); got != want {
+			t.Errorf("Label(%q) = %q want %q", name, got, want)
+		}
+	}
+}
+
+func TestHandler_Serve(t *testing.T) {
+	tc := setupTest(t)
+	defer tc.Close()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- tc.h.Serve(conn) }()
+
+	client, err := net.Dial("udp4", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write(newQuery(10, "printer.home.lan", packet.DNSTypeA)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr, _ := decodeAnswer(t, packet.DNS(buf[:n])); rr.IP() != ip2 {
+		t.Errorf("invalid answer ip %s", rr.IP())
+	}
+
+	tc.h.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("unexpected serve error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("serve did not return after close")
+	}
+}
+
+func TestHandler_ProcessPacket(t *testing.T) {
+	tc := setupTest(t)
+	defer tc.Close()
+
+	query := newQuery(20, "johns-iphone.home.lan", packet.DNSTypeA)
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, mac2, hostMAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 50, ip2, hostIP4)
+	udp := packet.EncodeUDP(ip4.Payload(), 40000, 53)
+	udp, _ = udp.AppendPayload(query)
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	ether, err := ether.SetPayload(ip4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := tc.session.Parse(ether)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.h.ProcessPacket(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, packet.EthMaxSize)
+	tc.outConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := tc.outConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("missing reply", err)
+	}
+	reply := packet.Ether(buf[:n])
+	ip := packet.IP4(reply.Payload())
+	if ip.Src() != hostIP4 || ip.Dst() != ip2 {
+		t.Fatalf("invalid reply ip %s", ip)
+	}
+	reply4 := packet.UDP(ip.Payload())
+	if reply4.SrcPort() != 53 || reply4.DstPort() != 40000 {
+		t.Fatalf("invalid reply udp %s", reply4)
+	}
+	if rr, _ := decodeAnswer(t, packet.DNS(reply4.Payload())); rr.IP() != ip1 {
+		t.Errorf("invalid answer ip %s", rr.IP())
+	}
+}
+
+func TestHandler_ProcessPacketTCP(t *testing.T) {
+	tc := setupTest(t)
+	defer tc.Close()
+
+	// dns over tcp is classified as PayloadDNS but the zone only answers udp queries
+	query := newQuery(21, "johns-iphone.home.lan", packet.DNSTypeA)
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, mac2, hostMAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 50, ip2, hostIP4)
+	tcp := ip4.Payload()[:20+2+len(query)]
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 53)
+	tcp[12] = 5 << 4 // header len
+	tcp[13] = 0x18   // PSH ACK
+	binary.BigEndian.PutUint16(tcp[20:22], uint16(len(query)))
+	copy(tcp[22:], query)
+	ip4 = ip4.SetPayload(tcp, syscall.IPPROTO_TCP)
+	ether, err := ether.SetPayload(ip4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := tc.session.Parse(ether)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.PayloadID != packet.PayloadDNS {
+		t.Fatal("invalid payload id", frame.PayloadID)
+	}
+	if err := tc.h.ProcessPacket(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	replies := make(chan packet.Ether, 1)
+	go func() {
+		buf := make([]byte, packet.EthMaxSize)
+		for {
+			n, _, err := tc.outConn.ReadFrom(buf)
+			if err != nil || n == 0 {
+				return
+			}
+			if ether := packet.Ether(buf[:n]); ether.EtherType() == syscall.ETH_P_IP && packet.IP4(ether.Payload()).Protocol() == syscall.IPPROTO_UDP {
+				replies <- ether
+				return
+			}
+		}
+	}()
+	select {
+	case reply := <-replies:
+		t.Fatalf("unexpected reply %s", reply)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
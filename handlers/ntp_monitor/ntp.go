@@ -0,0 +1,338 @@
+// Package ntp_monitor records the time servers used by each host and reports hosts with skewed clocks.
+//
+// Devices ship with the vendor time server configured, so the servers a host queries are a strong
+// hint of the device type: Apple devices use time.apple.com, Windows time.windows.com, Android
+// time.android.com and many embedded devices use a vendor zone in the NTP pool such as
+// 0.debian.pool.ntp.org or 1.amazon.pool.ntp.org. The server names are taken from the host dns
+// queries when a NameResolver is configured.
+//
+// A client sets the transmit timestamp to its local clock, so the difference to our clock is the host
+// clock offset plus the network delay. Some clients randomise the transmit timestamp to avoid
+// fingerprinting; the handler only reports a host as skewed when two consecutive requests agree on
+// the offset.
+package ntp_monitor
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+const module = "ntp"
+
+var Logger = fastlog.New(module)
+
+const (
+	DefaultMaxSkew = time.Minute
+
+	maxHosts          = 1024
+	maxServersPerHost = 16
+	hostExpiry        = time.Hour * 24
+	offsetTolerance   = time.Second // consecutive offsets must agree within this value
+)
+
+// NameResolver returns the name a host resolved to ip. The dns_naming handler implements this interface.
+type NameResolver interface {
+	ResolvedName(mac net.HardwareAddr, ip netip.Addr) (name string, found bool)
+}
+
+// Config holds the ntp monitor configuration.
+type Config struct {
+	Resolver NameResolver  // resolve server names from the host dns queries; optional
+	MaxSkew  time.Duration // report hosts with a clock offset greater than this; default 1 minute
+}
+
+// NTPServer is a time server queried by a host.
+type NTPServer struct {
+	Addr        netip.Addr
+	Name        string // name the host resolved to addr
+	Vendor      string // vendor derived from the name, i.e. Apple for time.apple.com
+	Stratum     uint8  // from the last server response
+	ReferenceID string // from the last server response
+	Requests    int
+	LastSeen    time.Time
+}
+
+func (s NTPServer) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.IP("server", s.Addr)
+	if s.Name != "" {
+		l.String("name", s.Name)
+	}
+	if s.Vendor != "" {
+		l.String("vendor", s.Vendor)
+	}
+	if s.Stratum != 0 {
+		l.Uint8("stratum", s.Stratum)
+		l.String("refid", s.ReferenceID)
+	}
+	l.Int("requests", s.Requests)
+	return l
+}
+
+// NTPHost holds the ntp state of a host.
+type NTPHost struct {
+	MAC      net.HardwareAddr
+	Addr     netip.Addr
+	Version  uint8         // ntp version in the last request
+	NTS      bool          // last request used Network Time Security
+	Offset   time.Duration // host clock minus our clock in the last request; includes the network delay
+	Skewed   bool          // offset is greater than the maximum skew
+	Servers  []NTPServer
+	LastSeen time.Time
+}
+
+func (e NTPHost) String() string {
+	return Logger.Msg("").Struct(e).ToString()
+}
+
+func (e NTPHost) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.MAC("mac", e.MAC)
+	l.IP("ip", e.Addr)
+	l.Uint8("version", e.Version)
+	if e.NTS {
+		l.Bool("nts", e.NTS)
+	}
+	l.Duration("offset", e.Offset)
+	l.Bool("skewed", e.Skewed)
+	for _, v := range e.Servers {
+		l.Struct(v)
+	}
+	return l
+}
+
+func (e *NTPHost) copy() NTPHost {
+	n := *e
+	n.MAC = packet.CopyMAC(e.MAC)
+	n.Servers = append([]NTPServer(nil), e.Servers...)
+	return n
+}
+
+// Handler implements the ntp monitor.
+type Handler struct {
+	session  *packet.Session
+	resolver NameResolver
+	maxSkew  time.Duration
+	hosts    map[string]*NTPHost // key is mac
+	mutex    sync.RWMutex
+}
+
+// New returns a ntp monitor with the default configuration.
+func New(session *packet.Session) (*Handler, error) {
+	return Config{}.New(session)
+}
+
+// New accepts a configuration structure and returns a ntp monitor.
+func (config Config) New(session *packet.Session) (h *Handler, err error) {
+	h = &Handler{session: session, resolver: config.Resolver, maxSkew: config.MaxSkew, hosts: make(map[string]*NTPHost)}
+	if h.maxSkew <= 0 {
+		h.maxSkew = DefaultMaxSkew
+	}
+	return h, nil
+}
+
+// Close the handler.
+func (h *Handler) Close() error {
+	return nil
+}
+
+// ProcessPacket records the server in a client request and the server stratum and reference id in
+// a response to a host. It returns ErrParseProtocol if the frame is not a ntp time packet.
+func (h *Handler) ProcessPacket(frame packet.Frame) error {
+	if frame.PayloadID != packet.PayloadNTP {
+		return packet.ErrParseProtocol
+	}
+	p := packet.NTP(frame.Payload())
+	if err := p.IsValid(); err != nil {
+		return err
+	}
+	if Logger.IsDebug() {
+		Logger.Msg("ntp rcvd").Struct(frame.SrcAddr).Struct(frame.DstAddr).Struct(p).Write()
+	}
+	switch p.Mode() {
+	case packet.NTPModeClient, packet.NTPModeSymmetricActive:
+		h.processRequest(frame, p, time.Now())
+	case packet.NTPModeServer, packet.NTPModeSymmetricPassive:
+		h.processResponse(frame, p)
+	}
+	return nil
+}
+
+// processRequest records the server queried by the source host and the host clock offset.
+func (h *Handler) processRequest(frame packet.Frame, p packet.NTP, now time.Time) {
+	if frame.Host == nil { // not a lan host
+		return
+	}
+	var name string
+	if h.resolver != nil {
+		name, _ = h.resolver.ResolvedName(frame.SrcAddr.MAC, frame.DstAddr.IP)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	e := h.hosts[string(frame.SrcAddr.MAC)]
+	if e == nil {
+		if len(h.hosts) >= maxHosts {
+			return
+		}
+		e = &NTPHost{MAC: packet.CopyMAC(frame.SrcAddr.MAC)}
+		h.hosts[string(e.MAC)] = e
+	}
+	e.Addr, e.Version, e.NTS, e.LastSeen = frame.SrcAddr.IP, p.Version(), p.IsNTS(), now
+
+	server := e.server(frame.DstAddr.IP, now)
+	if server != nil {
+		server.Requests++
+		server.LastSeen = now
+		if name != "" && server.Name != name {
+			server.Name, server.Vendor = name, ntpVendor(name)
+			if Logger.IsInfo() {
+				Logger.Msg("host ntp server").MAC("mac", e.MAC).Struct(server).Write()
+			}
+		}
+	}
+
+	transmit := p.TransmitTime()
+	if transmit.IsZero() { // sntp clients may not set the transmit time
+		return
+	}
+	offset := transmit.Sub(now)
+	consistent := abs(offset-e.Offset) <= offsetTolerance
+	e.Offset = offset
+	if !consistent { // randomised transmit time or first request
+		return
+	}
+	if skewed := abs(offset) > h.maxSkew; skewed != e.Skewed {
+		e.Skewed = skewed
+		if skewed {
+			Logger.Msg("host clock skewed").MAC("mac", e.MAC).IP("ip", e.Addr).Duration("offset", offset).Write()
+		} else if Logger.IsInfo() {
+			Logger.Msg("host clock in sync").MAC("mac", e.MAC).IP("ip", e.Addr).Duration("offset", offset).Write()
+		}
+	}
+}
+
+// processResponse updates the stratum and reference id of the server answering a host.
+func (h *Handler) processResponse(frame packet.Frame, p packet.NTP) {
+	if p.Stratum() == 0 { // kiss-o'-death
+		if Logger.IsInfo() {
+			Logger.Msg("ntp kiss code").IP("server", frame.SrcAddr.IP).MAC("mac", frame.DstAddr.MAC).String("code", p.ReferenceIDString()).Write()
+		}
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	e := h.hosts[string(frame.DstAddr.MAC)]
+	if e == nil {
+		return
+	}
+	for i := range e.Servers {
+		if e.Servers[i].Addr == frame.SrcAddr.IP {
+			e.Servers[i].Stratum, e.Servers[i].ReferenceID = p.Stratum(), p.ReferenceIDString()
+			return
+		}
+	}
+}
+
+// server returns the server entry for addr, adding a new entry if required. It returns nil if the
+// host has too many servers. Caller must hold the lock.
+func (e *NTPHost) server(addr netip.Addr, now time.Time) *NTPServer {
+	for i := range e.Servers {
+		if e.Servers[i].Addr == addr {
+			return &e.Servers[i]
+		}
+	}
+	if len(e.Servers) >= maxServersPerHost {
+		return nil
+	}
+	e.Servers = append(e.Servers, NTPServer{Addr: addr, LastSeen: now})
+	return &e.Servers[len(e.Servers)-1]
+}
+
+// Hosts returns a copy of all hosts using ntp.
+func (h *Handler) Hosts() (list []NTPHost) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, v := range h.hosts {
+		list = append(list, v.copy())
+	}
+	return list
+}
+
+// Host returns a copy of the ntp entry for mac.
+func (h *Handler) Host(mac net.HardwareAddr) (entry NTPHost, found bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if e := h.hosts[string(mac)]; e != nil {
+		return e.copy(), true
+	}
+	return NTPHost{}, false
+}
+
+// SkewedHosts returns a copy of the hosts with a clock offset greater than the maximum skew.
+func (h *Handler) SkewedHosts() (list []NTPHost) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, v := range h.hosts {
+		if v.Skewed {
+			list = append(list, v.copy())
+		}
+	}
+	return list
+}
+
+// MinuteTicker deletes hosts that made no ntp requests in the last 24 hours.
+func (h *Handler) MinuteTicker(now time.Time) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for k, v := range h.hosts {
+		if now.Sub(v.LastSeen) > hostExpiry {
+			delete(h.hosts, k)
+		}
+	}
+	return nil
+}
+
+// ntpVendors maps well known vendor time servers to the vendor name.
+var ntpVendors = map[string]string{
+	"time.apple.com":      "Apple",
+	"time.euro.apple.com": "Apple",
+	"time.asia.apple.com": "Apple",
+	"time.windows.com":    "Microsoft",
+	"time.android.com":    "Android",
+	"time.google.com":     "Google",
+	"ntp.ubuntu.com":      "Ubuntu",
+}
+
+// ntpVendor returns the vendor for a time server name. Vendor zones in the ntp pool have the form
+// [0-3].<vendor>.pool.ntp.org; country and continent zones return an empty vendor.
+func ntpVendor(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if v, found := ntpVendors[name]; found {
+		return v
+	}
+	if !strings.HasSuffix(name, ".pool.ntp.org") {
+		return ""
+	}
+	labels := strings.Split(strings.TrimSuffix(name, ".pool.ntp.org"), ".")
+	zone := labels[len(labels)-1]
+	switch {
+	case len(zone) <= 2: // country code or the pool number
+		return ""
+	case zone == "asia" || zone == "europe" || zone == "africa" || zone == "oceania" ||
+		zone == "north-america" || zone == "south-america":
+		return ""
+	}
+	return zone
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,143 @@
+package ntp_monitor
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+var (
+	hostMAC   = net.HardwareAddr{0x00, 0x55, 0x55, 0x55, 0x55, 0x55}
+	hostIP4   = netip.MustParseAddr("192.168.0.129")
+	routerMAC = net.HardwareAddr{0x00, 0x66, 0x66, 0x66, 0x66, 0x66}
+	routerIP4 = netip.MustParseAddr("192.168.0.11")
+	homeLAN   = netip.MustParsePrefix("192.168.0.0/24")
+	mac1      = net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x01}
+	ip1       = netip.MustParseAddr("192.168.0.1")
+	appleIP   = netip.MustParseAddr("17.253.66.125")
+	poolIP    = netip.MustParseAddr("162.159.200.1")
+)
+
+func testSession() *packet.Session {
+	nicInfo := &packet.NICInfo{
+		HomeLAN4:    homeLAN,
+		HostAddr4:   packet.Addr{MAC: hostMAC, IP: hostIP4},
+		RouterAddr4: packet.Addr{MAC: routerMAC, IP: routerIP4},
+	}
+	serverConn, _ := packet.TestNewBufferedConn()
+	session, _ := packet.Config{Conn: serverConn, NICInfo: nicInfo}.NewSession("")
+	return session
+}
+
+// resolver returns the names resolved by mac1.
+type resolver map[netip.Addr]string
+
+func (r resolver) ResolvedName(mac net.HardwareAddr, ip netip.Addr) (string, bool) {
+	name, found := r[ip]
+	return name, found
+}
+
+func newNTPFrame(t *testing.T, session *packet.Session, src packet.Addr, dst packet.Addr, p packet.NTP) packet.Frame {
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, src.MAC, dst.MAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 255, src.IP, dst.IP)
+	udp := packet.EncodeUDP(ip4.Payload(), src.Port, dst.Port)
+	udp, err := udp.AppendPayload(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := session.Parse(ether)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestHandler_ProcessPacket(t *testing.T) {
+	session := testSession()
+	defer session.Close()
+	h, _ := Config{Resolver: resolver{appleIP: "time.apple.com", poolIP: "2.debian.pool.ntp.org"}}.New(session)
+	defer h.Close()
+
+	host := packet.Addr{MAC: mac1, IP: ip1, Port: 123}
+	apple := packet.Addr{MAC: routerMAC, IP: appleIP, Port: 123}
+	pool := packet.Addr{MAC: routerMAC, IP: poolIP, Port: 123}
+	request := func(server packet.Addr, offset time.Duration) {
+		p := packet.EncodeNTP(make([]byte, 48), 4, packet.NTPModeClient, 0, time.Now().Add(offset))
+		frame := newNTPFrame(t, session, host, server, p)
+		if frame.PayloadID != packet.PayloadNTP {
+			t.Fatalf("invalid payload id=%s", frame.PayloadID)
+		}
+		if err := h.ProcessPacket(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request(apple, 0)
+	request(pool, time.Second)
+	response := packet.EncodeNTP(make([]byte, 48), 4, packet.NTPModeServer, 1, time.Now())
+	copy(response[12:16], "GPS\x00")
+	if err := h.ProcessPacket(newNTPFrame(t, session, apple, host, response)); err != nil {
+		t.Fatal(err)
+	}
+	e, found := h.Host(mac1)
+	if !found || e.Version != 4 || e.Skewed || len(e.Servers) != 2 {
+		t.Fatalf("invalid host %s", e)
+	}
+	if s := e.Servers[0]; s.Vendor != "Apple" || s.Stratum != 1 || s.ReferenceID != "GPS" || s.Requests != 1 {
+		t.Errorf("invalid apple server %+v", s)
+	}
+	if s := e.Servers[1]; s.Name != "2.debian.pool.ntp.org" || s.Vendor != "debian" {
+		t.Errorf("invalid pool server %+v", s)
+	}
+
+	// a single request with a large offset is ignored
+	request(apple, time.Hour*2)
+	if len(h.SkewedHosts()) != 0 {
+		t.Fatal("unexpected skewed host")
+	}
+	request(apple, time.Hour*2)
+	if list := h.SkewedHosts(); len(list) != 1 || list[0].Offset < time.Hour {
+		t.Fatalf("invalid skewed hosts %+v", list)
+	}
+	request(apple, 0)
+	request(apple, 0)
+	if len(h.SkewedHosts()) != 0 {
+		t.Fatal("host clock should be in sync")
+	}
+
+	h.MinuteTicker(time.Now().Add(time.Hour * 25))
+	if len(h.Hosts()) != 0 {
+		t.Fatal("host not expired")
+	}
+}
+
+func Test_ntpVendor(t *testing.T) {
+	tests := map[string]string{
+		"time.apple.com":               "Apple",
+		"time.windows.com.":            "Microsoft",
+		"0.amazon.pool.ntp.org":        "amazon",
+		"1.android.pool.ntp.org":       "android",
+		"pool.ntp.org":                 "",
+		"0.pool.ntp.org":               "",
+		"0.au.pool.ntp.org":            "",
+		"1.europe.pool.ntp.org":        "",
+		"ntp1.example.com":             "",
+		"0.openwrt.pool.ntp.org":       "openwrt",
+		"2.us.pool.ntp.org":            "",
+		"3.north-america.pool.ntp.org": "",
+	}
+	for name, want := range tests {
+		if got := ntpVendor(name); got != want {
+			t.Errorf("ntpVendor(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+// Package tls_monitor records the TLS server names and client fingerprints of each host.
+//
+// The ClientHello is the only TLS message sent in the clear. The server name indication (SNI) tells which
+// service a host contacts even when the host uses an encrypted or external dns resolver, and the JA3 and
+// JA4 fingerprints identify the TLS library of the client application: browsers, streaming apps and IoT
+// firmware each produce a few stable fingerprints.
+//
+// The handler processes tcp port 443 segments and QUIC client Initial packets sent to udp port 443. A
+// ClientHello larger than a segment or datagram, common with post quantum key shares, is reassembled from
+// consecutive tcp segments of the same flow or from the Initial packets with the same connection id.
+package tls_monitor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/irai/packet"
+	"github.com/irai/packet/fastlog"
+)
+
+const module = "tls"
+
+var Logger = fastlog.New(module)
+
+const (
+	maxHosts          = 1024
+	maxServersPerHost = 128
+	maxFingerprints   = 16
+	maxPending        = 256
+	maxClientHelloLen = packet.TLSRecordHeaderLen + 16384
+	pendingExpiry     = time.Second * 5
+	hostExpiry        = time.Hour * 24
+)
+
+// TLSServer is a server name contacted by a host.
+type TLSServer struct {
+	Name     string     // server name indication
+	Addr     netip.Addr // server address in the last connection
+	ALPN     []string   // application protocols offered in the last connection
+	JA4      string     // client fingerprint in the last connection
+	Count    int
+	LastSeen time.Time
+}
+
+func (s TLSServer) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.String("sni", s.Name)
+	l.IP("server", s.Addr)
+	if len(s.ALPN) > 0 {
+		l.StringArray("alpn", s.ALPN)
+	}
+	l.String("ja4", s.JA4)
+	l.Int("count", s.Count)
+	return l
+}
+
+// TLSFingerprint is a TLS client fingerprint seen on a host.
+type TLSFingerprint struct {
+	JA3      string
+	JA4      string
+	Count    int
+	LastSeen time.Time
+}
+
+// TLSHost holds the TLS connections of a host.
+type TLSHost struct {
+	MAC          net.HardwareAddr
+	Addr         netip.Addr
+	Fingerprints []TLSFingerprint
+	Servers      []TLSServer
+	LastSeen     time.Time
+}
+
+func (e TLSHost) String() string {
+	return Logger.Msg("").Struct(e).ToString()
+}
+
+func (e TLSHost) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.MAC("mac", e.MAC)
+	l.IP("ip", e.Addr)
+	for _, v := range e.Fingerprints {
+		l.String("ja4", v.JA4)
+	}
+	l.Int("servers", len(e.Servers))
+	return l
+}
+
+func (e *TLSHost) copy() TLSHost {
+	n := *e
+	n.MAC = packet.CopyMAC(e.MAC)
+	n.Fingerprints = append([]TLSFingerprint(nil), e.Fingerprints...)
+	n.Servers = append([]TLSServer(nil), e.Servers...)
+	return n
+}
+
+// pendingHello holds the first segments of a ClientHello spanning several tcp segments.
+type pendingHello struct {
+	buf    []byte
+	next   uint32 // expected sequence number
+	expire time.Time
+}
+
+// pendingQUIC holds the CRYPTO frames of a ClientHello spanning several QUIC Initial packets.
+type pendingQUIC struct {
+	frames []packet.QUICCryptoFrame
+	len    int
+	expire time.Time
+}
+
+// Handler implements the tls monitor.
+type Handler struct {
+	session *packet.Session
+	hosts   map[string]*TLSHost      // key is mac
+	pending map[string]*pendingHello // key is the tcp flow
+	quic    map[string]*pendingQUIC  // key is mac and destination connection id
+	mutex   sync.RWMutex
+}
+
+// New returns a tls monitor.
+func New(session *packet.Session) (h *Handler, err error) {
+	h = &Handler{session: session, hosts: make(map[string]*TLSHost), pending: make(map[string]*pendingHello),
+		quic: make(map[string]*pendingQUIC)}
+	return h, nil
+}
+
+// Close the handler.
+func (h *Handler) Close() error {
+	return nil
+}
+
+// ProcessPacket decodes a ClientHello sent by a lan host and records the server name and fingerprints.
+// Other TLS messages are ignored.
+func (h *Handler) ProcessPacket(frame packet.Frame) error {
+	if frame.PayloadID != packet.PayloadSSL {
+		return packet.ErrParseProtocol
+	}
+	if frame.Host == nil { // not a lan host
+		return nil
+	}
+	if frame.UDP() != nil {
+		return h.processQUIC(frame, time.Now())
+	}
+	return h.processTCP(frame, time.Now())
+}
+
+// processTCP decodes a ClientHello in a tcp segment, buffering the segment if the hello is incomplete.
+func (h *Handler) processTCP(frame packet.Frame, now time.Time) error {
+	payload := tcpPayload(frame)
+	if len(payload) == 0 {
+		return nil
+	}
+	seq := frame.TCP().Seq()
+
+	h.mutex.Lock()
+	if len(h.pending) > 0 {
+		key := flowKey(frame)
+		if p := h.pending[key]; p != nil {
+			if seq != p.next || len(p.buf)+len(payload) > maxClientHelloLen { // lost or out of order segment
+				delete(h.pending, key)
+				h.mutex.Unlock()
+				return nil
+			}
+			p.buf = append(p.buf, payload...)
+			p.next = seq + uint32(len(payload))
+			if packet.TLSRecord(p.buf).IsValid() == packet.ErrFrameLen {
+				h.mutex.Unlock()
+				return nil
+			}
+			delete(h.pending, key)
+			payload = p.buf
+		}
+	}
+	h.mutex.Unlock()
+
+	if len(payload) < 6 || payload[0] != packet.TLSContentHandshake || payload[5] != packet.TLSHandshakeClientHello {
+		return nil
+	}
+	hello, err := packet.DecodeTLSClientHello(payload)
+	if err != nil && packet.TLSRecord(payload).IsValid() == packet.ErrFrameLen && packet.TLSRecord(payload).Len() <= maxClientHelloLen { // record spans several segments
+		h.mutex.Lock()
+		if len(h.pending) < maxPending {
+			h.pending[flowKey(frame)] = &pendingHello{buf: packet.CopyBytes(payload), next: seq + uint32(len(payload)), expire: now.Add(pendingExpiry)}
+		}
+		h.mutex.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	h.recordHello(frame, hello, false, now)
+	return nil
+}
+
+// processQUIC decrypts the client Initial packets in a datagram and decodes the ClientHello in the CRYPTO
+// frames, joining the frames of earlier Initial packets with the same destination connection id.
+func (h *Handler) processQUIC(frame packet.Frame, now time.Time) error {
+	payload := frame.Payload()
+	if frame.DstAddr.Port != 443 || len(payload) == 0 || payload[0]&0x80 == 0 { // short header packets carry no ClientHello
+		return nil
+	}
+	list, err := packet.DecodeQUICInitials(payload)
+	if err != nil {
+		return err
+	}
+	var frames []packet.QUICCryptoFrame
+	n := 0
+	for _, v := range list {
+		for _, f := range v.Frames {
+			frames = append(frames, f)
+			n = n + len(f.Data)
+		}
+	}
+	if len(frames) == 0 { // ack only
+		return nil
+	}
+	key := string(frame.SrcAddr.MAC) + string(list[0].DCID)
+
+	h.mutex.Lock()
+	if p := h.quic[key]; p != nil {
+		frames, n = append(p.frames, frames...), p.len+n
+		delete(h.quic, key)
+	}
+	h.mutex.Unlock()
+
+	hello, err := packet.DecodeTLSHandshakeClientHello(packet.QUICCryptoStream(frames))
+	if errors.Is(err, packet.ErrFrameLen) && n < maxClientHelloLen { // continues in the next Initial packet
+		h.mutex.Lock()
+		if len(h.quic) < maxPending {
+			h.quic[key] = &pendingQUIC{frames: frames, len: n, expire: now.Add(pendingExpiry)}
+		}
+		h.mutex.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	h.recordHello(frame, hello, true, now)
+	return nil
+}
+
+// recordHello attributes the server name and fingerprints in hello to the sending host.
+func (h *Handler) recordHello(frame packet.Frame, hello packet.TLSClientHello, quic bool, now time.Time) {
+	sni, ja3, ja4 := hello.ServerName(), hello.JA3(), hello.JA4(quic)
+	if Logger.IsDebug() {
+		Logger.Msg("client hello").Struct(frame.SrcAddr).IP("server", frame.DstAddr.IP).Struct(hello).Write()
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	e := h.hosts[string(frame.SrcAddr.MAC)]
+	if e == nil {
+		if len(h.hosts) >= maxHosts {
+			return
+		}
+		e = &TLSHost{MAC: packet.CopyMAC(frame.SrcAddr.MAC)}
+		h.hosts[string(e.MAC)] = e
+	}
+	e.Addr, e.LastSeen = frame.SrcAddr.IP, now
+
+	found := false
+	for i := range e.Fingerprints {
+		if e.Fingerprints[i].JA4 == ja4 && e.Fingerprints[i].JA3 == ja3 {
+			e.Fingerprints[i].Count++
+			e.Fingerprints[i].LastSeen = now
+			found = true
+			break
+		}
+	}
+	if !found && len(e.Fingerprints) < maxFingerprints {
+		e.Fingerprints = append(e.Fingerprints, TLSFingerprint{JA3: ja3, JA4: ja4, Count: 1, LastSeen: now})
+		if Logger.IsInfo() {
+			Logger.Msg("new tls fingerprint").MAC("mac", e.MAC).String("ja3", ja3).String("ja4", ja4).String("sni", sni).Write()
+		}
+	}
+
+	if sni == "" {
+		return
+	}
+	var server *TLSServer
+	for i := range e.Servers {
+		if e.Servers[i].Name == sni {
+			server = &e.Servers[i]
+			break
+		}
+	}
+	if server == nil {
+		if len(e.Servers) >= maxServersPerHost { // replace the least recently used server
+			oldest := 0
+			for i := range e.Servers {
+				if e.Servers[i].LastSeen.Before(e.Servers[oldest].LastSeen) {
+					oldest = i
+				}
+			}
+			e.Servers = append(e.Servers[:oldest], e.Servers[oldest+1:]...)
+		}
+		e.Servers = append(e.Servers, TLSServer{Name: sni})
+		server = &e.Servers[len(e.Servers)-1]
+	}
+	server.Addr, server.ALPN, server.JA4 = frame.DstAddr.IP, hello.ALPN(), ja4
+	server.Count++
+	server.LastSeen = now
+}
+
+// Hosts returns a copy of all hosts using TLS.
+func (h *Handler) Hosts() (list []TLSHost) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, v := range h.hosts {
+		list = append(list, v.copy())
+	}
+	return list
+}
+
+// Host returns a copy of the TLS entry for mac.
+func (h *Handler) Host(mac net.HardwareAddr) (entry TLSHost, found bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if e := h.hosts[string(mac)]; e != nil {
+		return e.copy(), true
+	}
+	return TLSHost{}, false
+}
+
+// MinuteTicker deletes incomplete ClientHello messages and the hosts and servers not seen in the last 24 hours.
+func (h *Handler) MinuteTicker(now time.Time) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for k, v := range h.pending {
+		if now.After(v.expire) {
+			delete(h.pending, k)
+		}
+	}
+	for k, v := range h.quic {
+		if now.After(v.expire) {
+			delete(h.quic, k)
+		}
+	}
+	for k, e := range h.hosts {
+		if now.Sub(e.LastSeen) > hostExpiry {
+			delete(h.hosts, k)
+			continue
+		}
+		servers := e.Servers[:0]
+		for _, v := range e.Servers {
+			if now.Sub(v.LastSeen) <= hostExpiry {
+				servers = append(servers, v)
+			}
+		}
+		e.Servers = servers
+	}
+	return nil
+}
+
+// flowKey returns the map key for the tcp flow in frame.
+func flowKey(frame packet.Frame) string {
+	var b bytes.Buffer
+	b.Write(frame.SrcAddr.MAC)
+	b.Write(frame.SrcAddr.IP.AsSlice())
+	b.Write(frame.DstAddr.IP.AsSlice())
+	binary.Write(&b, binary.BigEndian, [2]uint16{frame.SrcAddr.Port, frame.DstAddr.Port})
+	return b.String()
+}
+
+// tcpPayload returns the tcp payload without the ethernet padding in short frames.
+func tcpPayload(frame packet.Frame) []byte {
+	payload := frame.Payload()
+	tcp := frame.TCP()
+	var n int
+	switch {
+	case frame.IP4() != nil:
+		n = frame.IP4().TotalLen() - frame.IP4().IHL() - tcp.HeaderLen()
+	case frame.IP6() != nil:
+		n = len(frame.IP6()) - packet.IP6HeaderLen - len(tcp) + int(frame.IP6().PayloadLen()) - tcp.HeaderLen()
+	}
+	if n < 0 {
+		return nil
+	}
+	if n < len(payload) {
+		return payload[:n]
+	}
+	return payload
+}
@@ -0,0 +1,208 @@
+package tls_monitor
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/irai/packet"
+)
+
+var (
+	hostMAC   = net.HardwareAddr{0x00, 0x55, 0x55, 0x55, 0x55, 0x55}
+	hostIP4   = netip.MustParseAddr("192.168.0.129")
+	routerMAC = net.HardwareAddr{0x00, 0x66, 0x66, 0x66, 0x66, 0x66}
+	routerIP4 = netip.MustParseAddr("192.168.0.11")
+	homeLAN   = netip.MustParsePrefix("192.168.0.0/24")
+	mac1      = net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x01}
+	ip1       = netip.MustParseAddr("192.168.0.1")
+	serverIP  = netip.MustParseAddr("142.250.66.238")
+)
+
+func testSession() *packet.Session {
+	nicInfo := &packet.NICInfo{
+		HomeLAN4:    homeLAN,
+		HostAddr4:   packet.Addr{MAC: hostMAC, IP: hostIP4},
+		RouterAddr4: packet.Addr{MAC: routerMAC, IP: routerIP4},
+	}
+	serverConn, _ := packet.TestNewBufferedConn()
+	session, _ := packet.Config{Conn: serverConn, NICInfo: nicInfo}.NewSession("")
+	return session
+}
+
+// testClientHello returns a TLS record with a ClientHello for sni; padding adds a padding extension.
+func testClientHello(sni string, padding int) []byte {
+	ext := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0} // server name
+	binary.BigEndian.PutUint16(ext[2:4], uint16(len(sni)+5))
+	binary.BigEndian.PutUint16(ext[4:6], uint16(len(sni)+3))
+	binary.BigEndian.PutUint16(ext[7:9], uint16(len(sni)))
+	ext = append(ext, sni...)
+	ext = append(ext, 0x00, 0x10, 0x00, 0x05, 0x00, 0x03, 0x02, 'h', '2') // alpn h2
+	ext = append(ext, 0x00, 0x2b, 0x00, 0x03, 0x02, 0x03, 0x04)           // supported versions tls 1.3
+	ext = append(ext, 0x00, 0x15, byte(padding>>8), byte(padding))        // padding
+	ext = append(ext, make([]byte, padding)...)
+
+	body := append([]byte{0x03, 0x03}, make([]byte, 32)...)
+	body = append(body, 0x00)                                     // session id
+	body = append(body, 0x00, 0x04, 0x13, 0x01, 0x13, 0x02, 1, 0) // ciphers and compression
+	body = append(body, byte(len(ext)>>8), byte(len(ext)))
+	body = append(body, ext...)
+	hs := append([]byte{packet.TLSHandshakeClientHello, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	return append([]byte{packet.TLSContentHandshake, 0x03, 0x01, byte(len(hs) >> 8), byte(len(hs))}, hs...)
+}
+
+func newTCPFrame(t *testing.T, session *packet.Session, src packet.Addr, dst packet.Addr, seq uint32, payload []byte) packet.Frame {
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, src.MAC, dst.MAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 64, src.IP, dst.IP)
+	tcp := ip4.Payload()[:20+len(payload)]
+	for i := range tcp[:20] {
+		tcp[i] = 0
+	}
+	binary.BigEndian.PutUint16(tcp[0:2], src.Port)
+	binary.BigEndian.PutUint16(tcp[2:4], dst.Port)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	tcp[12] = 5 << 4 // 20 bytes header
+	tcp[13] = 0x18   // psh ack
+	copy(tcp[20:], payload)
+	ip4 = ip4.SetPayload(tcp, syscall.IPPROTO_TCP)
+	ether, err := ether.SetPayload(ip4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := session.Parse(ether)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func newUDPFrame(t *testing.T, session *packet.Session, src packet.Addr, dst packet.Addr, payload []byte) packet.Frame {
+	ether := packet.Ether(make([]byte, packet.EthMaxSize))
+	ether = packet.EncodeEther(ether, syscall.ETH_P_IP, src.MAC, dst.MAC)
+	ip4 := packet.EncodeIP4(ether.Payload(), 64, src.IP, dst.IP)
+	udp := packet.EncodeUDP(ip4.Payload(), src.Port, dst.Port)
+	udp, err := udp.AppendPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := session.Parse(ether)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// testQUICInitial returns a client Initial packet with a CRYPTO frame carrying data at offset.
+func testQUICInitial(t *testing.T, dcid []byte, pn uint32, offset int, data []byte) []byte {
+	frame := []byte{0x06, 0x40 | byte(offset>>8), byte(offset), 0x40 | byte(len(data)>>8), byte(len(data))}
+	p, err := packet.EncodeQUICInitial(packet.QUICVersion1, dcid, []byte{1, 2, 3, 4}, pn, append(frame, data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHandler_ProcessPacket(t *testing.T) {
+	session := testSession()
+	defer session.Close()
+	h, _ := New(session)
+	defer h.Close()
+
+	src := packet.Addr{MAC: mac1, IP: ip1, Port: 50000}
+	dst := packet.Addr{MAC: hostMAC, IP: serverIP, Port: 443}
+
+	// single segment
+	frame := newTCPFrame(t, session, src, dst, 1000, testClientHello("www.youtube.com", 0))
+	if frame.PayloadID != packet.PayloadSSL {
+		t.Fatalf("invalid payload id=%s", frame.PayloadID)
+	}
+	if err := h.ProcessPacket(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	// client hello in two segments
+	hello := testClientHello("www.google.com", 1800)
+	src.Port = 50001
+	if err := h.ProcessPacket(newTCPFrame(t, session, src, dst, 2000, hello[:1400])); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := h.Host(mac1); len(e.Servers) != 1 {
+		t.Fatalf("unexpected server %+v", e.Servers)
+	}
+	if err := h.ProcessPacket(newTCPFrame(t, session, src, dst, 2000+1400, hello[1400:])); err != nil {
+		t.Fatal(err)
+	}
+
+	// application data is ignored
+	if err := h.ProcessPacket(newTCPFrame(t, session, src, dst, 5000, []byte{packet.TLSContentApplicationData, 3, 3, 0, 2, 1, 2})); err != nil {
+		t.Fatal(err)
+	}
+
+	e, found := h.Host(mac1)
+	if !found || len(e.Servers) != 2 || len(e.Fingerprints) != 1 || e.Fingerprints[0].Count != 2 {
+		t.Fatalf("invalid host %s servers=%+v", e, e.Servers)
+	}
+	if s := e.Servers[1]; s.Name != "www.google.com" || s.Addr != serverIP || len(s.ALPN) != 1 || s.ALPN[0] != "h2" || s.JA4[:10] != "t13d0204h2" {
+		t.Errorf("invalid server %+v", s)
+	}
+	if len(h.pending) != 0 {
+		t.Errorf("invalid pending segments %d", len(h.pending))
+	}
+
+	// out of order segment discards the pending hello
+	src.Port = 50002
+	h.ProcessPacket(newTCPFrame(t, session, src, dst, 9000, hello[:1400]))
+	h.ProcessPacket(newTCPFrame(t, session, src, dst, 9000+1500, hello[1400:]))
+	if e, _ := h.Host(mac1); e.Servers[1].Count != 1 || len(h.pending) != 0 {
+		t.Errorf("unexpected hello count=%d pending=%d", e.Servers[1].Count, len(h.pending))
+	}
+
+	h.MinuteTicker(time.Now().Add(time.Hour * 25))
+	if len(h.Hosts()) != 0 {
+		t.Fatal("host not expired")
+	}
+}
+
+func TestHandler_ProcessQUIC(t *testing.T) {
+	session := testSession()
+	defer session.Close()
+	h, _ := New(session)
+	defer h.Close()
+
+	src := packet.Addr{MAC: mac1, IP: ip1, Port: 50000}
+	dst := packet.Addr{MAC: hostMAC, IP: serverIP, Port: 443}
+	dcid := []byte{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+	hello := testClientHello("www.youtube.com", 1500)[packet.TLSRecordHeaderLen:] // quic has no record layer
+
+	// second half arrives first
+	frame := newUDPFrame(t, session, src, dst, testQUICInitial(t, dcid, 1, 1000, hello[1000:]))
+	if frame.PayloadID != packet.PayloadSSL {
+		t.Fatalf("invalid payload id=%s", frame.PayloadID)
+	}
+	if err := h.ProcessPacket(frame); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := h.Host(mac1); found || len(h.quic) != 1 {
+		t.Fatalf("unexpected host pending=%d", len(h.quic))
+	}
+	if err := h.ProcessPacket(newUDPFrame(t, session, src, dst, testQUICInitial(t, dcid, 0, 0, hello[:1000]))); err != nil {
+		t.Fatal(err)
+	}
+	e, found := h.Host(mac1)
+	if !found || len(e.Servers) != 1 || e.Servers[0].Name != "www.youtube.com" || e.Servers[0].JA4[0] != 'q' || len(h.quic) != 0 {
+		t.Fatalf("invalid host %s servers=%+v", e, e.Servers)
+	}
+
+	// short header packets are ignored
+	if err := h.ProcessPacket(newUDPFrame(t, session, src, dst, append([]byte{0x40}, dcid...))); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -34,6 +34,9 @@ type Host struct {
 	SSDPName     NameEntry
 	LLMNRName    NameEntry
 	NBNSName     NameEntry
+	WSDName      NameEntry
+	HTTPName     NameEntry
+	Workgroup    string // netbios workgroup or domain
 	dirty        bool
 }
 
@@ -53,6 +56,11 @@ func (e Host) FastLog(l *fastlog.Line) *fastlog.Line {
 	l.Struct(e.SSDPName)
 	l.Struct(e.LLMNRName)
 	l.Struct(e.NBNSName)
+	l.Struct(e.WSDName)
+	l.Struct(e.HTTPName)
+	if e.Workgroup != "" {
+		l.String("workgroup", e.Workgroup)
+	}
 	l.String("lastSeen", time.Since(e.LastSeen).String())
 	return l
 }
@@ -267,3 +275,52 @@ func (host *Host) UpdateNBNSName(name NameEntry) {
 		host.MACEntry.NBNSName, _ = host.MACEntry.NBNSName.Merge(host.NBNSName)
 	}
 }
+
+func (host *Host) UpdateWSDName(name NameEntry) {
+	host.MACEntry.Row.Lock()
+	defer host.MACEntry.Row.Unlock()
+	var notify bool
+	host.WSDName, notify = host.WSDName.Merge(name)
+	if notify {
+		host.dirty = true
+		Logger.Msg("updated wsd name").Struct(host.Addr).Struct(host.WSDName).Write()
+		host.MACEntry.WSDName, _ = host.MACEntry.WSDName.Merge(host.WSDName)
+	}
+}
+
+// ExpireWSDName sets the wsd name entry expiry; i.e. the device sent a Bye message.
+func (host *Host) ExpireWSDName(now time.Time) {
+	host.MACEntry.Row.Lock()
+	defer host.MACEntry.Row.Unlock()
+	if host.WSDName.Type == "" || !host.WSDName.Expire.After(now) {
+		return
+	}
+	host.WSDName.Expire = now
+	host.MACEntry.WSDName.Expire = now
+	host.dirty = true
+	Logger.Msg("expired wsd name").Struct(host.Addr).Struct(host.WSDName).Write()
+}
+
+func (host *Host) UpdateHTTPName(name NameEntry) {
+	host.MACEntry.Row.Lock()
+	defer host.MACEntry.Row.Unlock()
+	var notify bool
+	host.HTTPName, notify = host.HTTPName.Merge(name)
+	if notify {
+		host.dirty = true
+		Logger.Msg("updated http name").Struct(host.Addr).Struct(host.HTTPName).Write()
+		host.MACEntry.HTTPName, _ = host.MACEntry.HTTPName.Merge(host.HTTPName)
+	}
+}
+
+// UpdateWorkgroup sets the netbios workgroup announced by the host.
+func (host *Host) UpdateWorkgroup(workgroup string) {
+	host.MACEntry.Row.Lock()
+	defer host.MACEntry.Row.Unlock()
+	if workgroup != "" && host.Workgroup != workgroup {
+		host.Workgroup = workgroup
+		host.dirty = true
+		Logger.Msg("updated workgroup").Struct(host.Addr).String("workgroup", workgroup).Write()
+		host.MACEntry.Workgroup = workgroup
+	}
+}
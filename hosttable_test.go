@@ -224,6 +224,26 @@ func TestHost_UpdateSSDPName(t *testing.T) {
 	}
 }
 
+func TestHost_UpdateHTTPName(t *testing.T) {
+	session, _ := testSession()
+	host1, _ := session.findOrCreateHostWithLock(Addr{MAC: mac1, IP: ip1})
+	session.notify(Frame{Host: host1}) // first notification
+	name := NameEntry{Type: "http", Model: "SM-G991B", OS: "Android"}
+	host1.UpdateHTTPName(name)
+	session.notify(Frame{Host: host1}) // change of name notification
+	var notification Notification
+	for i := 0; i < 2; i++ { // must get have 2 notifications - online and change of name
+		select {
+		case notification = <-session.C:
+		case <-time.After(time.Second):
+			t.Fatal("did not receive notification number", i)
+		}
+	}
+	if notification.HTTPName.Model != name.Model || notification.HTTPName.OS != name.OS {
+		t.Error("unexpected name", notification.HTTPName)
+	}
+}
+
 func TestHost_UpdateNBNSName(t *testing.T) {
 	session, _ := testSession()
 	host1, _ := session.findOrCreateHostWithLock(Addr{MAC: mac1, IP: ip1})
@@ -243,3 +263,22 @@ func TestHost_UpdateNBNSName(t *testing.T) {
 		t.Error("unexpected name", notification.NBNSName)
 	}
 }
+
+func TestHost_UpdateWorkgroup(t *testing.T) {
+	session, _ := testSession()
+	host1, _ := session.findOrCreateHostWithLock(Addr{MAC: mac1, IP: ip1})
+	session.notify(Frame{Host: host1}) // first notification
+	host1.UpdateWorkgroup("WORKGROUP")
+	session.notify(Frame{Host: host1}) // change of workgroup notification
+	var notification Notification
+	for i := 0; i < 2; i++ {
+		select {
+		case notification = <-session.C:
+		case <-time.After(time.Second):
+			t.Fatal("did not receive notification number", i)
+		}
+	}
+	if notification.Workgroup != "WORKGROUP" {
+		t.Error("unexpected workgroup", notification.Workgroup)
+	}
+}
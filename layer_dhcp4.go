@@ -80,6 +80,8 @@ const (
 	DHCP4OptionTrailerEncapsulation               DHCP4OptionCode = 34
 	DHCP4OptionARPCacheTimeout                    DHCP4OptionCode = 35
 	DHCP4OptionEthernetEncapsulation              DHCP4OptionCode = 36
+	DHCP4OptionNTPServers                         DHCP4OptionCode = 42 // Application and Service Parameters
+	DHCP4OptionVendorSpecific                     DHCP4OptionCode = 43
 	DHCP4OptionRequestedIPAddress                 DHCP4OptionCode = 50 // DHCP Extensions
 	DHCP4OptionIPAddressLeaseTime                 DHCP4OptionCode = 51
 	DHCP4OptionOverload                           DHCP4OptionCode = 52
@@ -92,7 +94,10 @@ const (
 	DHCP4OptionRebindingTimeValue                 DHCP4OptionCode = 59
 	DHCP4OptionVendorClassIdentifier              DHCP4OptionCode = 60
 	DHCP4OptionClientIdentifier                   DHCP4OptionCode = 61
+	DHCP4OptionRelayAgentInformation              DHCP4OptionCode = 82  // rfc3046
+	DHCP4OptionDomainSearch                       DHCP4OptionCode = 119 // rfc3397
 	DHCP4OptionClasslessRouteFormat               DHCP4OptionCode = 121
+	DHCP4OptionWPAD                               DHCP4OptionCode = 252 // web proxy auto-discovery url
 )
 
 // DHCP4 represents a dhcp version 4 packet.
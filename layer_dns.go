@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/irai/packet/fastlog"
 )
@@ -13,6 +15,51 @@ import (
 // NbnsQuestionClass
 const questionClassInternet = 0x0001
 
+// DNS resource record types
+const (
+	DNSTypeA     uint16 = 1
+	DNSTypeNS    uint16 = 2
+	DNSTypeCNAME uint16 = 5
+	DNSTypeSOA   uint16 = 6
+	DNSTypePTR   uint16 = 12
+	DNSTypeMX    uint16 = 15
+	DNSTypeTXT   uint16 = 16
+	DNSTypeAAAA  uint16 = 28
+	DNSTypeSRV   uint16 = 33
+	DNSTypeOPT   uint16 = 41
+	DNSTypeSVCB  uint16 = 64
+	DNSTypeHTTPS uint16 = 65
+	DNSTypeANY   uint16 = 255
+)
+
+// DNS classes
+const (
+	DNSClassINET uint16 = 1
+	DNSClassANY  uint16 = 255
+)
+
+// DNS header flags; the response code is in the lower 4 bits
+const (
+	DNSFlagQR uint16 = 0x8000 // response
+	DNSFlagAA uint16 = 0x0400 // authoritative answer
+	DNSFlagTC uint16 = 0x0200 // truncated
+	DNSFlagRD uint16 = 0x0100 // recursion desired
+	DNSFlagRA uint16 = 0x0080 // recursion available
+)
+
+// DNS response codes
+const (
+	DNSRCodeSuccess        = 0
+	DNSRCodeFormatError    = 1
+	DNSRCodeServerFailure  = 2
+	DNSRCodeNameError      = 3 // NXDOMAIN
+	DNSRCodeNotImplemented = 4
+	DNSRCodeRefused        = 5
+)
+
+// DNSPort is the dns port for both udp and tcp.
+const DNSPort = 53
+
 // DNS represents a DNS packet as specified in RFC 1034 / RFC 1035
 // see : https://github.com/google/gopacket/blob/master/layers/dns.go
 //
@@ -69,6 +116,7 @@ func (p DNS) QDCount() uint16       { return binary.BigEndian.Uint16(p[4:6]) }
 func (p DNS) ANCount() uint16       { return binary.BigEndian.Uint16(p[6:8]) }   // answer count
 func (p DNS) NSCount() uint16       { return binary.BigEndian.Uint16(p[8:10]) }  // Authority record count
 func (p DNS) ARCount() uint16       { return binary.BigEndian.Uint16(p[10:12]) } // Additional information count
+func (p DNS) Flags() uint16         { return binary.BigEndian.Uint16(p[2:4]) }   // header flags including opcode and rcode
 
 func EncodeDNSQuery(tranID uint16, flags uint16, encodedName []byte, questionType uint16) DNS {
 	b := make([]byte, 512)
@@ -113,16 +161,134 @@ func DecodeQuestion(p DNS, index int, buffer []byte) (question Question, off int
 	return question, index, nil
 }
 
+// DecodeQuestions returns all questions in the DNS packet and the offset of the answer section.
+// Unlike unicast dns, mDNS queries often carry several questions.
+func DecodeQuestions(p DNS) (questions []Question, off int, err error) {
+	if err := p.IsValid(); err != nil {
+		return nil, -1, err
+	}
+	off = 12
+	for i := 0; i < int(p.QDCount()); i++ {
+		if off+6 > len(p) {
+			return nil, -1, ErrParseFrame
+		}
+		var buffer []byte
+		name, endq, err := decodeName(p, off, &buffer, 1)
+		if err != nil {
+			return nil, -1, err
+		}
+		if endq+4 > len(p) {
+			return nil, -1, ErrParseFrame
+		}
+		questions = append(questions, Question{Name: name, Type: binary.BigEndian.Uint16(p[endq : endq+2]), Class: binary.BigEndian.Uint16(p[endq+2 : endq+4])})
+		off = endq + 4
+	}
+	return questions, off, nil
+}
+
+// DNSReverseName returns the PTR query name for ip; i.e. 1.0.168.192.in-addr.arpa for 192.168.0.1
+// and the nibble format under ip6.arpa for IPv6 addresses.
+func DNSReverseName(ip netip.Addr) string {
+	const hex = "0123456789abcdef"
+	if ip.Is4() || ip.Is4In6() {
+		b := ip.As4()
+		return strconv.Itoa(int(b[3])) + "." + strconv.Itoa(int(b[2])) + "." + strconv.Itoa(int(b[1])) + "." + strconv.Itoa(int(b[0])) + ".in-addr.arpa"
+	}
+	b := ip.As16()
+	name := make([]byte, 0, 72)
+	for i := len(b) - 1; i >= 0; i-- {
+		name = append(name, hex[b[i]&0x0f], '.', hex[b[i]>>4], '.')
+	}
+	return string(append(name, "ip6.arpa"...))
+}
+
+// DNSReverseAddr returns the IP address for a PTR query name. It is the reverse of DNSReverseName.
+func DNSReverseAddr(name string) (ip netip.Addr, ok bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if s := strings.TrimSuffix(name, ".in-addr.arpa"); len(s) < len(name) {
+		labels := strings.Split(s, ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		var b [4]byte
+		for i, v := range labels {
+			n, err := strconv.ParseUint(v, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			b[3-i] = byte(n)
+		}
+		return netip.AddrFrom4(b), true
+	}
+	if s := strings.TrimSuffix(name, ".ip6.arpa"); len(s) < len(name) {
+		if len(s) != 63 {
+			return netip.Addr{}, false
+		}
+		var b [16]byte
+		for i := 0; i < 32; i++ {
+			c := s[i*2]
+			if i < 31 && s[i*2+1] != '.' {
+				return netip.Addr{}, false
+			}
+			var n byte
+			switch {
+			case c >= '0' && c <= '9':
+				n = c - '0'
+			case c >= 'a' && c <= 'f':
+				n = c - 'a' + 10
+			default:
+				return netip.Addr{}, false
+			}
+			if i%2 == 0 {
+				b[15-i/2] |= n
+			} else {
+				b[15-i/2] |= n << 4
+			}
+		}
+		return netip.AddrFrom16(b), true
+	}
+	return netip.Addr{}, false
+}
+
+// Resource records store the TTL received in the answer and the time the record expires.
+// Expire is refreshed every time the record is seen in a new answer.
 type NameResourceRecord struct {
-	Name  string
-	CName string
-	TTL   uint32
+	Name   string
+	CName  string
+	TTL    uint32
+	Expire time.Time
 }
 
 type IPResourceRecord struct {
-	Name string
-	IP   netip.Addr
-	TTL  uint32
+	Name   string
+	IP     netip.Addr
+	TTL    uint32
+	Expire time.Time
+}
+
+type SRVResourceRecord struct {
+	Name     string
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+	TTL      uint32
+	Expire   time.Time
+}
+
+type MXResourceRecord struct {
+	Name       string
+	Host       string
+	Preference uint16
+	TTL        uint32
+	Expire     time.Time
+}
+
+type TXTResourceRecord struct {
+	Name   string
+	TXT    []string
+	TTL    uint32
+	Expire time.Time
 }
 
 type DNSEntry struct {
@@ -131,6 +297,10 @@ type DNSEntry struct {
 	IP6Records   map[netip.Addr]IPResourceRecord
 	CNameRecords map[string]NameResourceRecord
 	PTRRecords   map[string]IPResourceRecord
+	SRVRecords   map[string]SRVResourceRecord  // key is target:port
+	MXRecords    map[string]MXResourceRecord   // key is host
+	NSRecords    map[string]NameResourceRecord // key is name server; CName holds the name server
+	TXTRecords   map[string]TXTResourceRecord  // key is the record name
 }
 
 func NewDNSEntry() (entry DNSEntry) {
@@ -138,6 +308,10 @@ func NewDNSEntry() (entry DNSEntry) {
 	entry.IP6Records = make(map[netip.Addr]IPResourceRecord)
 	entry.CNameRecords = make(map[string]NameResourceRecord)
 	entry.PTRRecords = make(map[string]IPResourceRecord)
+	entry.SRVRecords = make(map[string]SRVResourceRecord)
+	entry.MXRecords = make(map[string]MXResourceRecord)
+	entry.NSRecords = make(map[string]NameResourceRecord)
+	entry.TXTRecords = make(map[string]TXTResourceRecord)
 	return entry
 }
 
@@ -172,63 +346,139 @@ func (e *DNSEntry) DecodeAnswers(p DNS, offset int, buffer []byte) (int, bool, e
 //  +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
 func (e *DNSEntry) decodeRRs(count int, p DNS, offset int, buffer []byte) (int, bool, error) {
 	var updated bool
-	var tmpBuf []byte // temporary buffer to avoid allocation
+	now := time.Now()
 	for i := 0; i < count; i++ {
-		tmpBuf = buffer
-		name, endq, err := decodeName(p, offset, &tmpBuf, 1)
+		rr, next, err := DecodeRR(p, offset, buffer)
 		if err != nil {
-			return 0, false, fmt.Errorf("invalid label: %w", err)
+			return 0, false, err
 		}
-
-		t := binary.BigEndian.Uint16(p[endq : endq+2]) // type
-		// class = binary.BigEndian.Uint16(p[endq+2 : endq+4])
-		ttl := binary.BigEndian.Uint32(p[endq+4 : endq+8]) // number of seconds the RR can be cached
-		dataLen := binary.BigEndian.Uint16(p[endq+8 : endq+10])
-		offset = endq + 10 + int(dataLen)
-		if offset > len(p) {
-			return 0, false, fmt.Errorf("invalid resource record len: %w", ErrInvalidLen)
+		offset = next
+		expire := now.Add(time.Duration(rr.TTL) * time.Second)
+		name := rr.Name
+		rdataBuf := buffer // decode rdata names after the record name to avoid overwriting it
+		if name != nil {
+			rdataBuf = name[len(name):]
 		}
 
-		switch t {
-		case 1: // A
-			if dataLen != 4 {
+		switch rr.Type {
+		case DNSTypeA:
+			if len(rr.Data) != 4 {
 				return 0, false, fmt.Errorf("invalid A data len: %w", ErrInvalidLen)
 			}
-			ip, _ := netip.AddrFromSlice(net.IP(p[endq+10 : endq+10+4]))
-			if _, found := e.IP4Records[ip]; !found {
-				e.IP4Records[ip] = IPResourceRecord{Name: string(name), IP: ip, TTL: ttl}
+			ip := rr.IP()
+			if r, found := e.IP4Records[ip]; found {
+				r.TTL, r.Expire = rr.TTL, expire
+				e.IP4Records[ip] = r
+			} else {
+				e.IP4Records[ip] = IPResourceRecord{Name: string(name), IP: ip, TTL: rr.TTL, Expire: expire}
 				updated = true
 			}
 
-		case 28: // AAAA
-			if dataLen != 16 {
+		case DNSTypeAAAA:
+			if len(rr.Data) != 16 {
 				return 0, false, fmt.Errorf("invalid AAAA data len: %w", ErrInvalidLen)
 			}
-			ip, _ := netip.AddrFromSlice(net.IP(p[endq+10 : endq+10+16]))
-			if _, found := e.IP6Records[ip]; !found {
-				e.IP6Records[ip] = IPResourceRecord{Name: string(name), IP: ip, TTL: ttl}
+			ip := rr.IP()
+			if r, found := e.IP6Records[ip]; found {
+				r.TTL, r.Expire = rr.TTL, expire
+				e.IP6Records[ip] = r
+			} else {
+				e.IP6Records[ip] = IPResourceRecord{Name: string(name), IP: ip, TTL: rr.TTL, Expire: expire}
 				updated = true
 			}
 
-		case 5: // CNAME
+		case DNSTypeCNAME:
 			var cname []byte
-			tmpBuf = buffer
-			cname, _, err = decodeName(p, endq+10, &tmpBuf, 1)
+			cname, err = rr.DecodeName(p, rdataBuf)
 			if err != nil {
 				return 0, false, fmt.Errorf("invalid CNAME data: %w", err)
 			}
-			if _, found := e.CNameRecords[string(name)]; !found {
-				r := NameResourceRecord{Name: string(name), TTL: ttl, CName: string(cname)}
+			if r, found := e.CNameRecords[string(name)]; found && r.CName == string(cname) {
+				r.TTL, r.Expire = rr.TTL, expire
+				e.CNameRecords[r.Name] = r
+			} else {
+				r := NameResourceRecord{Name: string(name), TTL: rr.TTL, CName: string(cname), Expire: expire}
 				e.CNameRecords[r.Name] = r
 				updated = true
 			}
 
-		case 15: // MX record
-			if Logger.IsDebug() {
-				fmt.Println("dns   : received MX record response - ignoring", string(name))
+		case DNSTypeMX:
+			pref, host, err := rr.DecodeMX(p, rdataBuf)
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid MX data: %w", err)
+			}
+			if r, found := e.MXRecords[string(host)]; found {
+				r.TTL, r.Expire = rr.TTL, expire
+				e.MXRecords[r.Host] = r
+			} else {
+				r := MXResourceRecord{Name: string(name), Host: string(host), Preference: pref, TTL: rr.TTL, Expire: expire}
+				e.MXRecords[r.Host] = r
+				updated = true
+			}
+
+		case DNSTypeNS:
+			ns, err := rr.DecodeName(p, rdataBuf)
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid NS data: %w", err)
+			}
+			if r, found := e.NSRecords[string(ns)]; found {
+				r.TTL, r.Expire = rr.TTL, expire
+				e.NSRecords[r.CName] = r
+			} else {
+				r := NameResourceRecord{Name: string(name), CName: string(ns), TTL: rr.TTL, Expire: expire}
+				e.NSRecords[r.CName] = r
+				updated = true
+			}
+
+		case DNSTypeSRV:
+			srv, err := rr.DecodeSRV(p, rdataBuf)
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid SRV data: %w", err)
+			}
+			key := net.JoinHostPort(srv.Target, strconv.Itoa(int(srv.Port)))
+			if r, found := e.SRVRecords[key]; found {
+				r.TTL, r.Expire = rr.TTL, expire
+				e.SRVRecords[key] = r
+			} else {
+				e.SRVRecords[key] = SRVResourceRecord{Name: string(name), Target: srv.Target, Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight, TTL: rr.TTL, Expire: expire}
+				updated = true
+			}
+
+		case DNSTypeTXT:
+			txt, err := rr.DecodeTXT()
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid TXT data: %w", err)
+			}
+			if r, found := e.TXTRecords[string(name)]; found && equalStrings(r.TXT, txt) {
+				r.TTL, r.Expire = rr.TTL, expire
+				e.TXTRecords[r.Name] = r
+			} else {
+				e.TXTRecords[string(name)] = TXTResourceRecord{Name: string(name), TXT: txt, TTL: rr.TTL, Expire: expire}
+				updated = true
+			}
+
+		case DNSTypeSVCB, DNSTypeHTTPS:
+			// record ip hints so that clients connecting to hinted addresses can be named
+			svcb, err := rr.DecodeSVCB()
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid SVCB data: %w", err)
+			}
+			for _, ip := range svcb.IPv4Hint() {
+				if _, found := e.IP4Records[ip]; !found {
+					e.IP4Records[ip] = IPResourceRecord{Name: string(name), IP: ip, TTL: rr.TTL, Expire: expire}
+					updated = true
+				}
 			}
+			for _, ip := range svcb.IPv6Hint() {
+				if _, found := e.IP6Records[ip]; !found {
+					e.IP6Records[ip] = IPResourceRecord{Name: string(name), IP: ip, TTL: rr.TTL, Expire: expire}
+					updated = true
+				}
+			}
+
+		case DNSTypeSOA, DNSTypeOPT: // negative answers and edns; nothing to record
 
-		case 12: // PTR record
+		case DNSTypePTR:
 			s := strings.TrimSuffix(string(name), ".in-addr.arpa")
 			tmp := net.ParseIP(s)
 			if tmp == nil {
@@ -240,27 +490,38 @@ func (e *DNSEntry) decodeRRs(count int, p DNS, offset int, buffer []byte) (int,
 			}
 			ip, _ := netip.AddrFromSlice([]byte{tmp[3], tmp[2], tmp[1], tmp[0]})
 			var ptr []byte
-			tmpBuf = buffer
-			ptr, _, err = decodeName(p, endq+10, &tmpBuf, 1)
+			ptr, err = rr.DecodeName(p, rdataBuf)
 			if err != nil {
 				return 0, false, fmt.Errorf("invalid PTR data: %w", err)
 			}
-			r := IPResourceRecord{Name: string(ptr), TTL: ttl, IP: ip}
+			r := IPResourceRecord{Name: string(ptr), TTL: rr.TTL, IP: ip, Expire: expire}
 			if _, found := e.PTRRecords[r.Name]; !found {
-				e.PTRRecords[r.Name] = r
 				updated = true
 			}
+			e.PTRRecords[r.Name] = r
 			if Logger.IsDebug() {
 				fmt.Printf("dns   : received PTR record response ptr=%s ip=%s\n", r.Name, r.IP)
 			}
 		default:
-			fmt.Println("dns   : unexpected dns resource record ", t, string(name))
+			fmt.Println("dns   : unexpected dns resource record ", rr.Type, string(name))
 		}
 	}
 
 	return offset, updated, nil
 }
 
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // copy returns a deep copy of DNSEntry
 func (d DNSEntry) Copy() DNSEntry {
 	e := DNSEntry{Name: d.Name}
@@ -280,9 +541,77 @@ func (d DNSEntry) Copy() DNSEntry {
 	for k, v := range d.PTRRecords {
 		e.PTRRecords[k] = v
 	}
+	e.SRVRecords = make(map[string]SRVResourceRecord, len(d.SRVRecords))
+	e.MXRecords = make(map[string]MXResourceRecord, len(d.MXRecords))
+	e.NSRecords = make(map[string]NameResourceRecord, len(d.NSRecords))
+	e.TXTRecords = make(map[string]TXTResourceRecord, len(d.TXTRecords))
+	for k, v := range d.SRVRecords {
+		e.SRVRecords[k] = v
+	}
+	for k, v := range d.MXRecords {
+		e.MXRecords[k] = v
+	}
+	for k, v := range d.NSRecords {
+		e.NSRecords[k] = v
+	}
+	for k, v := range d.TXTRecords {
+		v.TXT = append([]string(nil), v.TXT...)
+		e.TXTRecords[k] = v
+	}
 	return e
 }
 
+// Expire deletes records that expired before now and returns the number of records left.
+func (d DNSEntry) Expire(now time.Time) (count int) {
+	for k, v := range d.IP4Records {
+		if now.After(v.Expire) {
+			delete(d.IP4Records, k)
+		}
+	}
+	for k, v := range d.IP6Records {
+		if now.After(v.Expire) {
+			delete(d.IP6Records, k)
+		}
+	}
+	for k, v := range d.CNameRecords {
+		if now.After(v.Expire) {
+			delete(d.CNameRecords, k)
+		}
+	}
+	for k, v := range d.PTRRecords {
+		if now.After(v.Expire) {
+			delete(d.PTRRecords, k)
+		}
+	}
+	for k, v := range d.SRVRecords {
+		if now.After(v.Expire) {
+			delete(d.SRVRecords, k)
+		}
+	}
+	for k, v := range d.MXRecords {
+		if now.After(v.Expire) {
+			delete(d.MXRecords, k)
+		}
+	}
+	for k, v := range d.NSRecords {
+		if now.After(v.Expire) {
+			delete(d.NSRecords, k)
+		}
+	}
+	for k, v := range d.TXTRecords {
+		if now.After(v.Expire) {
+			delete(d.TXTRecords, k)
+		}
+	}
+	return d.Len()
+}
+
+// Len returns the number of records in the entry.
+func (d DNSEntry) Len() int {
+	return len(d.IP4Records) + len(d.IP6Records) + len(d.CNameRecords) + len(d.PTRRecords) +
+		len(d.SRVRecords) + len(d.MXRecords) + len(d.NSRecords) + len(d.TXTRecords)
+}
+
 func (d DNSEntry) IP4List() []netip.Addr {
 	list := make([]netip.Addr, 0, len(d.IP4Records))
 	for _, v := range d.IP4Records {
@@ -469,3 +798,816 @@ loop:
 	}
 	return (*buffer)[start+1:], index + 1, nil
 }
+
+// DNSResourceRecord references a resource record in a dns message.
+// Name references the name buffer and Data references the message; both are only
+// valid while the buffer and message are not modified.
+type DNSResourceRecord struct {
+	Name       []byte
+	Type       uint16
+	Class      uint16
+	TTL        uint32
+	Data       []byte // rdata
+	dataOffset int    // rdata offset in message; names in rdata may point anywhere in the message
+}
+
+// DecodeRR decodes the resource record at offset returning the offset of the next record.
+// The record name is appended to buffer to avoid allocation if buffer has enough capacity.
+func DecodeRR(p DNS, offset int, buffer []byte) (rr DNSResourceRecord, next int, err error) {
+	name, endq, err := decodeName(p, offset, &buffer, 1)
+	if err != nil {
+		return DNSResourceRecord{}, -1, fmt.Errorf("invalid label: %w", err)
+	}
+	if endq+10 > len(p) {
+		return DNSResourceRecord{}, -1, fmt.Errorf("invalid resource record header len: %w", ErrInvalidLen)
+	}
+	rr.Name = name
+	rr.Type = binary.BigEndian.Uint16(p[endq : endq+2])
+	rr.Class = binary.BigEndian.Uint16(p[endq+2 : endq+4])
+	rr.TTL = binary.BigEndian.Uint32(p[endq+4 : endq+8]) // number of seconds the RR can be cached
+	dataLen := int(binary.BigEndian.Uint16(p[endq+8 : endq+10]))
+	next = endq + 10 + dataLen
+	if next > len(p) {
+		return DNSResourceRecord{}, -1, fmt.Errorf("invalid resource record len: %w", ErrInvalidLen)
+	}
+	rr.dataOffset = endq + 10
+	rr.Data = p[rr.dataOffset:next]
+	return rr, next, nil
+}
+
+// IP returns the address in an A or AAAA record or an invalid address for other records.
+func (rr DNSResourceRecord) IP() netip.Addr {
+	ip, _ := netip.AddrFromSlice(rr.Data)
+	return ip
+}
+
+// DecodeName returns the name in a CNAME, PTR or NS record.
+func (rr DNSResourceRecord) DecodeName(p DNS, buffer []byte) ([]byte, error) {
+	if len(rr.Data) < 1 {
+		return nil, ErrInvalidLen
+	}
+	name, _, err := decodeName(p, rr.dataOffset, &buffer, 1)
+	return name, err
+}
+
+// DecodeMX returns the preference and mail exchange host in a MX record.
+func (rr DNSResourceRecord) DecodeMX(p DNS, buffer []byte) (preference uint16, host []byte, err error) {
+	if len(rr.Data) < 3 {
+		return 0, nil, ErrInvalidLen
+	}
+	host, _, err = decodeName(p, rr.dataOffset+2, &buffer, 1)
+	return binary.BigEndian.Uint16(rr.Data[0:2]), host, err
+}
+
+// DNSSRV holds the rdata of a SRV record - RFC 2782
+type DNSSRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// DecodeSRV returns the content of a SRV record.
+func (rr DNSResourceRecord) DecodeSRV(p DNS, buffer []byte) (srv DNSSRV, err error) {
+	if len(rr.Data) < 7 {
+		return DNSSRV{}, ErrInvalidLen
+	}
+	srv.Priority = binary.BigEndian.Uint16(rr.Data[0:2])
+	srv.Weight = binary.BigEndian.Uint16(rr.Data[2:4])
+	srv.Port = binary.BigEndian.Uint16(rr.Data[4:6])
+	target, _, err := decodeName(p, rr.dataOffset+6, &buffer, 1)
+	if err != nil {
+		return DNSSRV{}, err
+	}
+	srv.Target = string(target)
+	return srv, nil
+}
+
+// DecodeTXT returns the list of character strings in a TXT record.
+func (rr DNSResourceRecord) DecodeTXT() ([]string, error) {
+	list := []string{}
+	for i := 0; i < len(rr.Data); {
+		n := int(rr.Data[i])
+		if i+1+n > len(rr.Data) {
+			return nil, ErrInvalidLen
+		}
+		list = append(list, string(rr.Data[i+1:i+1+n]))
+		i = i + 1 + n
+	}
+	return list, nil
+}
+
+// DNSSOA holds the rdata of a SOA record.
+type DNSSOA struct {
+	MName   string // primary name server
+	RName   string // mailbox of the responsible person
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32 // negative caching ttl - RFC 2308
+}
+
+// DecodeSOA returns the content of a SOA record.
+func (rr DNSResourceRecord) DecodeSOA(p DNS, buffer []byte) (soa DNSSOA, err error) {
+	if len(rr.Data) < 22 {
+		return DNSSOA{}, ErrInvalidLen
+	}
+	mname, off, err := decodeName(p, rr.dataOffset, &buffer, 1)
+	if err != nil {
+		return DNSSOA{}, err
+	}
+	soa.MName = string(mname)
+	rname, off, err := decodeName(p, off, &buffer, 1)
+	if err != nil {
+		return DNSSOA{}, err
+	}
+	soa.RName = string(rname)
+	end := rr.dataOffset + len(rr.Data)
+	if off+20 > end {
+		return DNSSOA{}, ErrInvalidLen
+	}
+	soa.Serial = binary.BigEndian.Uint32(p[off : off+4])
+	soa.Refresh = binary.BigEndian.Uint32(p[off+4 : off+8])
+	soa.Retry = binary.BigEndian.Uint32(p[off+8 : off+12])
+	soa.Expire = binary.BigEndian.Uint32(p[off+12 : off+16])
+	soa.Minimum = binary.BigEndian.Uint32(p[off+16 : off+20])
+	return soa, nil
+}
+
+// SVCB and HTTPS service parameter keys - RFC 9460
+const (
+	DNSSVCParamALPN          uint16 = 1
+	DNSSVCParamNoDefaultALPN uint16 = 2
+	DNSSVCParamPort          uint16 = 3
+	DNSSVCParamIPv4Hint      uint16 = 4
+	DNSSVCParamECH           uint16 = 5
+	DNSSVCParamIPv6Hint      uint16 = 6
+)
+
+// DNSSVCParam is a service parameter in a SVCB or HTTPS record.
+type DNSSVCParam struct {
+	Key   uint16
+	Value []byte
+}
+
+// DNSSVCB holds the rdata of a SVCB or HTTPS record. A zero priority indicates alias mode.
+type DNSSVCB struct {
+	Priority uint16
+	Target   string // "" is the owner name
+	Params   []DNSSVCParam
+}
+
+// DecodeSVCB returns the content of a SVCB or HTTPS record. Param values reference the message.
+func (rr DNSResourceRecord) DecodeSVCB() (svcb DNSSVCB, err error) {
+	if len(rr.Data) < 3 {
+		return DNSSVCB{}, ErrInvalidLen
+	}
+	svcb.Priority = binary.BigEndian.Uint16(rr.Data[0:2])
+	var buffer []byte
+	target, off, err := decodeName(rr.Data, 2, &buffer, 1) // target name must not be compressed
+	if err != nil {
+		return DNSSVCB{}, err
+	}
+	svcb.Target = string(target)
+	for off < len(rr.Data) {
+		if off+4 > len(rr.Data) {
+			return DNSSVCB{}, ErrInvalidLen
+		}
+		key := binary.BigEndian.Uint16(rr.Data[off : off+2])
+		n := int(binary.BigEndian.Uint16(rr.Data[off+2 : off+4]))
+		if off+4+n > len(rr.Data) {
+			return DNSSVCB{}, ErrInvalidLen
+		}
+		svcb.Params = append(svcb.Params, DNSSVCParam{Key: key, Value: rr.Data[off+4 : off+4+n]})
+		off = off + 4 + n
+	}
+	return svcb, nil
+}
+
+// Param returns the value for key or nil if not present.
+func (s DNSSVCB) Param(key uint16) []byte {
+	for _, v := range s.Params {
+		if v.Key == key {
+			return v.Value
+		}
+	}
+	return nil
+}
+
+// ALPN returns the list of application protocols; i.e. "h2", "h3".
+func (s DNSSVCB) ALPN() (list []string) {
+	b := s.Param(DNSSVCParamALPN)
+	for i := 0; i < len(b); {
+		n := int(b[i])
+		if i+1+n > len(b) {
+			break
+		}
+		list = append(list, string(b[i+1:i+1+n]))
+		i = i + 1 + n
+	}
+	return list
+}
+
+// Port returns the alternative port or zero if not present.
+func (s DNSSVCB) Port() uint16 {
+	if b := s.Param(DNSSVCParamPort); len(b) == 2 {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// IPv4Hint returns the list of ipv4 address hints.
+func (s DNSSVCB) IPv4Hint() (list []netip.Addr) {
+	b := s.Param(DNSSVCParamIPv4Hint)
+	for i := 0; i+4 <= len(b); i = i + 4 {
+		list = append(list, netip.AddrFrom4([4]byte{b[i], b[i+1], b[i+2], b[i+3]}))
+	}
+	return list
+}
+
+// IPv6Hint returns the list of ipv6 address hints.
+func (s DNSSVCB) IPv6Hint() (list []netip.Addr) {
+	b := s.Param(DNSSVCParamIPv6Hint)
+	for i := 0; i+16 <= len(b); i = i + 16 {
+		var ip [16]byte
+		copy(ip[:], b[i:i+16])
+		list = append(list, netip.AddrFrom16(ip))
+	}
+	return list
+}
+
+// EDNS option codes
+const (
+	DNSOptionClientSubnet uint16 = 8  // RFC 7871
+	DNSOptionCookie       uint16 = 10 // RFC 7873
+	DNSOptionPadding      uint16 = 12 // RFC 7830
+)
+
+// DNSOption is an EDNS option in the OPT pseudo record.
+type DNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// DNSOPT holds the content of the EDNS0 OPT pseudo record - RFC 6891
+type DNSOPT struct {
+	UDPSize  uint16 // requestor's udp payload size
+	ExtRCode uint8  // upper 8 bits of the extended response code
+	Version  uint8
+	DO       bool // dnssec ok
+	Options  []DNSOption
+}
+
+// DecodeOPT returns the content of an OPT record. Option data references the message.
+func (rr DNSResourceRecord) DecodeOPT() (opt DNSOPT, err error) {
+	if rr.Type != DNSTypeOPT {
+		return DNSOPT{}, ErrParseProtocol
+	}
+	opt.UDPSize = rr.Class
+	opt.ExtRCode = uint8(rr.TTL >> 24)
+	opt.Version = uint8(rr.TTL >> 16)
+	opt.DO = rr.TTL&0x8000 != 0
+	for i := 0; i < len(rr.Data); {
+		if i+4 > len(rr.Data) {
+			return DNSOPT{}, ErrInvalidLen
+		}
+		code := binary.BigEndian.Uint16(rr.Data[i : i+2])
+		n := int(binary.BigEndian.Uint16(rr.Data[i+2 : i+4]))
+		if i+4+n > len(rr.Data) {
+			return DNSOPT{}, ErrInvalidLen
+		}
+		opt.Options = append(opt.Options, DNSOption{Code: code, Data: rr.Data[i+4 : i+4+n]})
+		i = i + 4 + n
+	}
+	return opt, nil
+}
+
+// ClientSubnet returns the client subnet option if present.
+func (o DNSOPT) ClientSubnet() (DNSClientSubnet, bool) {
+	for _, v := range o.Options {
+		if v.Code == DNSOptionClientSubnet {
+			ecs, err := DecodeDNSClientSubnet(v.Data)
+			return ecs, err == nil
+		}
+	}
+	return DNSClientSubnet{}, false
+}
+
+// DNSClientSubnet is the EDNS client subnet option - RFC 7871
+type DNSClientSubnet struct {
+	Prefix      netip.Prefix // source prefix
+	ScopePrefix uint8        // scope prefix length set by the server
+}
+
+// DecodeDNSClientSubnet decodes the client subnet option data.
+func DecodeDNSClientSubnet(b []byte) (DNSClientSubnet, error) {
+	if len(b) < 4 {
+		return DNSClientSubnet{}, ErrInvalidLen
+	}
+	family := binary.BigEndian.Uint16(b[0:2])
+	bits := int(b[2])
+	addrLen := 4
+	if family == 2 {
+		addrLen = 16
+	} else if family != 1 {
+		return DNSClientSubnet{}, fmt.Errorf("invalid client subnet family=%d: %w", family, ErrParseFrame)
+	}
+	n := (bits + 7) / 8
+	if bits > addrLen*8 || len(b) != 4+n {
+		return DNSClientSubnet{}, ErrInvalidLen
+	}
+	var ip [16]byte
+	copy(ip[:], b[4:4+n])
+	addr := netip.AddrFrom16(ip)
+	if addrLen == 4 {
+		addr = netip.AddrFrom4([4]byte{ip[0], ip[1], ip[2], ip[3]})
+	}
+	return DNSClientSubnet{Prefix: netip.PrefixFrom(addr, bits), ScopePrefix: b[3]}, nil
+}
+
+// Encode appends the client subnet option data to b and returns the option.
+func (c DNSClientSubnet) Encode(b []byte) DNSOption {
+	family := uint16(1)
+	if c.Prefix.Addr().Is6() {
+		family = 2
+	}
+	bits := c.Prefix.Bits()
+	ip := c.Prefix.Masked().Addr().AsSlice()
+	b = append(b[:0], byte(family>>8), byte(family), byte(bits), c.ScopePrefix)
+	b = append(b, ip[:(bits+7)/8]...)
+	return DNSOption{Code: DNSOptionClientSubnet, Data: b}
+}
+
+// skipName returns the offset after the name at offset without decoding it.
+func skipName(p []byte, offset int) (int, error) {
+	for i := 0; offset < len(p) && i < maxRecursionLevel; i++ {
+		switch p[offset] & 0xc0 {
+		case 0x00:
+			if p[offset] == 0 {
+				return offset + 1, nil
+			}
+			offset = offset + int(p[offset]) + 1
+		case 0xc0:
+			if offset+2 > len(p) {
+				return -1, ErrParseFrame
+			}
+			return offset + 2, nil
+		default:
+			return -1, ErrParseFrame
+		}
+	}
+	return -1, ErrParseFrame
+}
+
+// AnswerOffset returns the offset of the first answer skipping all questions.
+func (p DNS) AnswerOffset() (int, error) {
+	if err := p.IsValid(); err != nil {
+		return -1, err
+	}
+	offset := 12
+	for i := 0; i < int(p.QDCount()); i++ {
+		end, err := skipName(p, offset)
+		if err != nil || end+4 > len(p) {
+			return -1, ErrParseFrame
+		}
+		offset = end + 4
+	}
+	return offset, nil
+}
+
+// DecodeOPT returns the EDNS OPT record in the additional section if present.
+func DecodeOPT(p DNS) (opt DNSOPT, found bool, err error) {
+	offset, err := p.AnswerOffset()
+	if err != nil {
+		return DNSOPT{}, false, err
+	}
+	count := int(p.ANCount()) + int(p.NSCount()) + int(p.ARCount())
+	for i := 0; i < count; i++ {
+		end, err := skipName(p, offset)
+		if err != nil || end+10 > len(p) {
+			return DNSOPT{}, false, ErrParseFrame
+		}
+		next := end + 10 + int(binary.BigEndian.Uint16(p[end+8:end+10]))
+		if next > len(p) {
+			return DNSOPT{}, false, ErrInvalidLen
+		}
+		if binary.BigEndian.Uint16(p[end:end+2]) == DNSTypeOPT && i >= count-int(p.ARCount()) {
+			rr := DNSResourceRecord{Type: DNSTypeOPT, Class: binary.BigEndian.Uint16(p[end+2 : end+4]),
+				TTL: binary.BigEndian.Uint32(p[end+4 : end+8]), Data: p[end+10 : next], dataOffset: end + 10}
+			opt, err = rr.DecodeOPT()
+			return opt, err == nil, err
+		}
+		offset = next
+	}
+	return DNSOPT{}, false, nil
+}
+
+const dnsMaxCompression = 64 // maximum number of compression targets per message
+
+// DNSBuilder encodes a dns message in a caller supplied buffer without allocation.
+// Names are compressed when the same suffix was previously written to the message.
+//
+// Records are appended to the current section and sections must be added in order: questions,
+// answers, authorities then additionals. Errors are sticky and returned by Finish; a record that
+// does not fit in the buffer returns ErrPayloadTooBig and the caller may send a truncated response
+// instead.
+//
+//	var b DNSBuilder
+//	b.Reset(buf, id, DNSFlagQR|DNSFlagRD|DNSFlagRA)
+//	b.Question("www.example.com", DNSTypeA, DNSClassINET)
+//	b.StartAnswers()
+//	b.A(DNSRRHeader{Name: "www.example.com", Class: DNSClassINET, TTL: 60}, ip)
+//	msg, err := b.Finish()
+type DNSBuilder struct {
+	buf     []byte
+	section int // 0 questions; 1 answers; 2 authorities; 3 additionals
+	names   [dnsMaxCompression]uint16
+	nnames  int
+	err     error
+}
+
+// DNSRRHeader is the common header of a resource record to encode. The record type is set
+// by the builder function.
+type DNSRRHeader struct {
+	Name  string
+	Class uint16
+	TTL   uint32
+}
+
+// Reset starts a new message in buf with the transaction id and flags.
+func (b *DNSBuilder) Reset(buf []byte, tranID uint16, flags uint16) {
+	b.buf = buf[:0]
+	b.section = 0
+	b.nnames = 0
+	b.err = nil
+	if cap(b.buf) < 12 {
+		b.err = ErrPayloadTooBig
+		return
+	}
+	b.buf = b.buf[:12]
+	binary.BigEndian.PutUint16(b.buf[0:2], tranID)
+	binary.BigEndian.PutUint16(b.buf[2:4], flags)
+	for i := 4; i < 12; i++ {
+		b.buf[i] = 0
+	}
+}
+
+// Len returns the current message length.
+func (b *DNSBuilder) Len() int { return len(b.buf) }
+
+// Err returns the first error encountered.
+func (b *DNSBuilder) Err() error { return b.err }
+
+// SetFlags changes the header flags; use it to set DNSFlagTC after ErrPayloadTooBig.
+func (b *DNSBuilder) SetFlags(flags uint16) {
+	if len(b.buf) >= 12 {
+		binary.BigEndian.PutUint16(b.buf[2:4], flags)
+	}
+}
+
+// Finish returns the encoded message.
+func (b *DNSBuilder) Finish() (DNS, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return DNS(b.buf), nil
+}
+
+func (b *DNSBuilder) startSection(section int) {
+	if b.err == nil && section < b.section {
+		b.err = fmt.Errorf("dns section out of order: %w", ErrInvalidParam)
+		return
+	}
+	b.section = section
+}
+
+// StartAnswers appends subsequent records to the answer section.
+func (b *DNSBuilder) StartAnswers() { b.startSection(1) }
+
+// StartAuthorities appends subsequent records to the authority section.
+func (b *DNSBuilder) StartAuthorities() { b.startSection(2) }
+
+// StartAdditionals appends subsequent records to the additional section.
+func (b *DNSBuilder) StartAdditionals() { b.startSection(3) }
+
+func (b *DNSBuilder) incCount() {
+	off := 4 + b.section*2
+	binary.BigEndian.PutUint16(b.buf[off:off+2], binary.BigEndian.Uint16(b.buf[off:off+2])+1)
+}
+
+func (b *DNSBuilder) append(data ...byte) {
+	if b.err != nil {
+		return
+	}
+	if len(b.buf)+len(data) > cap(b.buf) {
+		b.err = ErrPayloadTooBig
+		return
+	}
+	b.buf = append(b.buf, data...)
+}
+
+func (b *DNSBuilder) appendUint16(v uint16) { b.append(byte(v>>8), byte(v)) }
+func (b *DNSBuilder) appendUint32(v uint32) {
+	b.append(byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (b *DNSBuilder) appendString(s string) {
+	if b.err != nil {
+		return
+	}
+	if len(b.buf)+len(s) > cap(b.buf) {
+		b.err = ErrPayloadTooBig
+		return
+	}
+	b.buf = append(b.buf, s...)
+}
+
+// appendName encodes the dotted name. The name is compressed if compress is true and a previous
+// name in the message has the same suffix.
+func (b *DNSBuilder) appendName(name string, compress bool) {
+	if b.err != nil {
+		return
+	}
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		b.err = fmt.Errorf("dns name too long len=%d: %w", len(name), ErrInvalidLen)
+		return
+	}
+	for name != "" && b.err == nil {
+		if compress {
+			if ptr, found := b.findName(name); found {
+				b.appendUint16(0xc000 | ptr)
+				return
+			}
+		}
+		label, rest := name, ""
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			label, rest = name[:i], name[i+1:]
+		}
+		if len(label) == 0 || len(label) > 63 {
+			b.err = fmt.Errorf("invalid dns label len=%d: %w", len(label), ErrInvalidLen)
+			return
+		}
+		if off := len(b.buf); off < 0x4000 && b.nnames < len(b.names) {
+			b.names[b.nnames] = uint16(off)
+			b.nnames++
+		}
+		b.append(byte(len(label)))
+		b.appendString(label)
+		name = rest
+	}
+	b.append(0)
+}
+
+// findName returns the offset of a previous name equal to name.
+func (b *DNSBuilder) findName(name string) (uint16, bool) {
+	for _, off := range b.names[:b.nnames] {
+		if dnsNameEqual(b.buf, int(off), name) {
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+// dnsNameEqual compares the encoded name at offset with the dotted name ignoring case.
+func dnsNameEqual(msg []byte, offset int, name string) bool {
+	for i := 0; i < maxRecursionLevel && offset < len(msg); i++ {
+		n := int(msg[offset])
+		switch {
+		case n == 0:
+			return name == ""
+		case n&0xc0 == 0xc0:
+			if offset+2 > len(msg) {
+				return false
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:offset+2]) & 0x3fff)
+			continue
+		case offset+1+n > len(msg) || len(name) < n:
+			return false
+		}
+		for j := 0; j < n; j++ {
+			if toLowerASCII(msg[offset+1+j]) != toLowerASCII(name[j]) {
+				return false
+			}
+		}
+		name = name[n:]
+		if len(name) > 0 {
+			if name[0] != '.' {
+				return false
+			}
+			name = name[1:]
+		}
+		offset = offset + 1 + n
+	}
+	return false
+}
+
+func toLowerASCII(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// Question appends a question. Questions must be added before any record.
+func (b *DNSBuilder) Question(name string, qType uint16, qClass uint16) {
+	if b.err == nil && b.section != 0 {
+		b.err = fmt.Errorf("dns question after records: %w", ErrInvalidParam)
+		return
+	}
+	b.appendName(name, true)
+	b.appendUint16(qType)
+	b.appendUint16(qClass)
+	if b.err == nil {
+		b.incCount()
+	}
+}
+
+// startRR appends the record header and returns the offset of the rdata length.
+func (b *DNSBuilder) startRR(h DNSRRHeader, rrType uint16) int {
+	if b.err == nil && b.section == 0 {
+		b.section = 1 // records without StartAnswers are answers
+	}
+	b.appendName(h.Name, true)
+	b.appendUint16(rrType)
+	b.appendUint16(h.Class)
+	b.appendUint32(h.TTL)
+	b.appendUint16(0) // rdata length
+	return len(b.buf) - 2
+}
+
+// endRR sets the rdata length and increments the section count.
+func (b *DNSBuilder) endRR(off int) {
+	if b.err != nil {
+		return
+	}
+	n := len(b.buf) - off - 2
+	if n > 0xffff {
+		b.err = ErrPayloadTooBig
+		return
+	}
+	binary.BigEndian.PutUint16(b.buf[off:off+2], uint16(n))
+	b.incCount()
+}
+
+// A appends an ipv4 address record.
+func (b *DNSBuilder) A(h DNSRRHeader, ip netip.Addr) {
+	if b.err != nil {
+		return
+	}
+	if !ip.Is4() {
+		b.err = fmt.Errorf("invalid A record ip=%s: %w", ip, ErrInvalidIP)
+		return
+	}
+	off := b.startRR(h, DNSTypeA)
+	a := ip.As4()
+	b.append(a[:]...)
+	b.endRR(off)
+}
+
+// AAAA appends an ipv6 address record.
+func (b *DNSBuilder) AAAA(h DNSRRHeader, ip netip.Addr) {
+	if b.err != nil {
+		return
+	}
+	if !ip.Is6() {
+		b.err = fmt.Errorf("invalid AAAA record ip=%s: %w", ip, ErrInvalidIP)
+		return
+	}
+	off := b.startRR(h, DNSTypeAAAA)
+	a := ip.As16()
+	b.append(a[:]...)
+	b.endRR(off)
+}
+
+// CNAME appends a canonical name record.
+func (b *DNSBuilder) CNAME(h DNSRRHeader, target string) { b.nameRR(h, DNSTypeCNAME, target) }
+
+// PTR appends a pointer record.
+func (b *DNSBuilder) PTR(h DNSRRHeader, target string) { b.nameRR(h, DNSTypePTR, target) }
+
+// NS appends a name server record.
+func (b *DNSBuilder) NS(h DNSRRHeader, host string) { b.nameRR(h, DNSTypeNS, host) }
+
+func (b *DNSBuilder) nameRR(h DNSRRHeader, rrType uint16, target string) {
+	off := b.startRR(h, rrType)
+	b.appendName(target, true)
+	b.endRR(off)
+}
+
+// MX appends a mail exchange record.
+func (b *DNSBuilder) MX(h DNSRRHeader, preference uint16, host string) {
+	off := b.startRR(h, DNSTypeMX)
+	b.appendUint16(preference)
+	b.appendName(host, true)
+	b.endRR(off)
+}
+
+// TXT appends a text record with one character string per txt entry.
+func (b *DNSBuilder) TXT(h DNSRRHeader, txt ...string) {
+	off := b.startRR(h, DNSTypeTXT)
+	for _, v := range txt {
+		if b.err != nil {
+			return
+		}
+		if len(v) > 255 {
+			b.err = fmt.Errorf("txt string too long len=%d: %w", len(v), ErrInvalidLen)
+			return
+		}
+		b.append(byte(len(v)))
+		b.appendString(v)
+	}
+	b.endRR(off)
+}
+
+// SRV appends a service record. The target is not compressed as required by RFC 2782.
+func (b *DNSBuilder) SRV(h DNSRRHeader, srv DNSSRV) {
+	off := b.startRR(h, DNSTypeSRV)
+	b.appendUint16(srv.Priority)
+	b.appendUint16(srv.Weight)
+	b.appendUint16(srv.Port)
+	b.appendName(srv.Target, false)
+	b.endRR(off)
+}
+
+// SOA appends a start of authority record; typically in the authority section of negative answers.
+func (b *DNSBuilder) SOA(h DNSRRHeader, soa DNSSOA) {
+	off := b.startRR(h, DNSTypeSOA)
+	b.appendName(soa.MName, true)
+	b.appendName(soa.RName, true)
+	b.appendUint32(soa.Serial)
+	b.appendUint32(soa.Refresh)
+	b.appendUint32(soa.Retry)
+	b.appendUint32(soa.Expire)
+	b.appendUint32(soa.Minimum)
+	b.endRR(off)
+}
+
+// SVCB appends a service binding record; use DNSTypeHTTPS or DNSTypeSVCB for rrType.
+// Params must be sorted in ascending key order.
+func (b *DNSBuilder) SVCB(h DNSRRHeader, rrType uint16, svcb DNSSVCB) {
+	off := b.startRR(h, rrType)
+	b.appendUint16(svcb.Priority)
+	b.appendName(svcb.Target, false)
+	for _, v := range svcb.Params {
+		b.appendUint16(v.Key)
+		b.appendUint16(uint16(len(v.Value)))
+		b.append(v.Value...)
+	}
+	b.endRR(off)
+}
+
+// OPT appends the EDNS0 pseudo record to the additional section.
+func (b *DNSBuilder) OPT(opt DNSOPT) {
+	b.startSection(3)
+	ttl := uint32(opt.ExtRCode)<<24 | uint32(opt.Version)<<16
+	if opt.DO {
+		ttl |= 0x8000
+	}
+	off := b.startRR(DNSRRHeader{Name: "", Class: opt.UDPSize, TTL: ttl}, DNSTypeOPT)
+	for _, v := range opt.Options {
+		b.appendUint16(v.Code)
+		b.appendUint16(uint16(len(v.Data)))
+		b.append(v.Data...)
+	}
+	b.endRR(off)
+}
+
+// Raw appends a record with pre-encoded rdata.
+func (b *DNSBuilder) Raw(h DNSRRHeader, rrType uint16, rdata []byte) {
+	off := b.startRR(h, rrType)
+	b.append(rdata...)
+	b.endRR(off)
+}
+
+// DecodeDNSTCP returns the first dns message in a tcp stream and the remaining bytes.
+// Each message in a tcp stream is preceded by a two byte length field - RFC 1035 4.2.2.
+// It returns ErrInvalidLen if the stream does not contain a full message.
+func DecodeDNSTCP(b []byte) (msg DNS, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, b, ErrInvalidLen
+	}
+	n := int(binary.BigEndian.Uint16(b[0:2]))
+	if len(b) < 2+n {
+		return nil, b, ErrInvalidLen
+	}
+	msg = DNS(b[2 : 2+n])
+	if err := msg.IsValid(); err != nil {
+		return nil, b, err
+	}
+	return msg, b[2+n:], nil
+}
+
+// EncodeDNSTCP copies msg to b preceded by the two byte tcp length field.
+// msg may start at b[2:] in which case the copy is a no-op; this allows the
+// DNSBuilder to encode directly in the tcp buffer.
+func EncodeDNSTCP(b []byte, msg DNS) ([]byte, error) {
+	if len(msg) > 0xffff || cap(b) < 2+len(msg) {
+		return nil, ErrPayloadTooBig
+	}
+	b = b[:2+len(msg)]
+	copy(b[2:], msg)
+	binary.BigEndian.PutUint16(b[0:2], uint16(len(msg)))
+	return b, nil
+}
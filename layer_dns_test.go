@@ -1,6 +1,12 @@
 package packet
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -101,3 +107,278 @@ func BenchmarkEncode(b *testing.B) {
 		}
 	})
 }
+
+func testDNSResponse(t *testing.T, buf []byte) DNS {
+	var b DNSBuilder
+	b.Reset(buf, 0x1234, DNSFlagQR|DNSFlagRD|DNSFlagRA)
+	b.Question("www.example.com", DNSTypeA, DNSClassINET)
+	b.StartAnswers()
+	b.CNAME(DNSRRHeader{Name: "www.example.com", Class: DNSClassINET, TTL: 300}, "web.example.com")
+	b.A(DNSRRHeader{Name: "web.example.com", Class: DNSClassINET, TTL: 60}, netip.MustParseAddr("192.0.2.1"))
+	b.AAAA(DNSRRHeader{Name: "web.example.com", Class: DNSClassINET, TTL: 60}, netip.MustParseAddr("2001:db8::1"))
+	b.MX(DNSRRHeader{Name: "example.com", Class: DNSClassINET, TTL: 60}, 10, "mail.example.com")
+	b.TXT(DNSRRHeader{Name: "example.com", Class: DNSClassINET, TTL: 60}, "v=spf1 -all", "hello")
+	b.SRV(DNSRRHeader{Name: "_sip._udp.example.com", Class: DNSClassINET, TTL: 60}, DNSSRV{Priority: 1, Weight: 2, Port: 5060, Target: "sip.example.com"})
+	b.SVCB(DNSRRHeader{Name: "example.com", Class: DNSClassINET, TTL: 60}, DNSTypeHTTPS, DNSSVCB{Priority: 1, Params: []DNSSVCParam{
+		{Key: DNSSVCParamALPN, Value: []byte("\x02h2\x02h3")},
+		{Key: DNSSVCParamIPv4Hint, Value: []byte{192, 0, 2, 2}},
+	}})
+	b.StartAuthorities()
+	b.NS(DNSRRHeader{Name: "example.com", Class: DNSClassINET, TTL: 3600}, "ns1.example.com")
+	b.SOA(DNSRRHeader{Name: "example.com", Class: DNSClassINET, TTL: 3600}, DNSSOA{MName: "ns1.example.com", RName: "admin.example.com", Serial: 2022010101, Minimum: 300})
+	b.OPT(DNSOPT{UDPSize: 1232, DO: true, Options: []DNSOption{DNSClientSubnet{Prefix: netip.MustParsePrefix("198.51.100.0/24")}.Encode(nil)}})
+	p, err := b.Finish()
+	if err != nil {
+		t.Fatal("builder error", err)
+	}
+	return p
+}
+
+func TestDNSBuilder(t *testing.T) {
+	p := testDNSResponse(t, make([]byte, 0, 512))
+	if p.TransactionID() != 0x1234 || !p.QR() || !p.RD() || !p.RA() || p.QDCount() != 1 || p.ANCount() != 7 || p.NSCount() != 2 || p.ARCount() != 1 {
+		t.Fatalf("invalid header %s", p)
+	}
+	if bytes.Count(p, []byte("\x07example\x03com")) != 2 { // question and uncompressed srv target
+		t.Error("name not compressed")
+	}
+
+	buffer := make([]byte, 0, 256)
+	question, offset, err := DecodeQuestion(p, 12, buffer)
+	if err != nil || string(question.Name) != "www.example.com" || question.Type != DNSTypeA {
+		t.Fatalf("invalid question %+v %v", question, err)
+	}
+	if off, err := p.AnswerOffset(); err != nil || off != offset {
+		t.Errorf("invalid answer offset %d want %d err %v", off, offset, err)
+	}
+	var rr DNSResourceRecord
+	next := func(wantType uint16, wantName string) {
+		t.Helper()
+		if rr, offset, err = DecodeRR(p, offset, buffer); err != nil || rr.Type != wantType || string(rr.Name) != wantName {
+			t.Fatalf("invalid rr type=%d name=%s err=%v", rr.Type, rr.Name, err)
+		}
+	}
+	next(DNSTypeCNAME, "www.example.com")
+	if name, err := rr.DecodeName(p, nil); err != nil || string(name) != "web.example.com" || rr.TTL != 300 {
+		t.Errorf("invalid cname %s %v", name, err)
+	}
+	next(DNSTypeA, "web.example.com")
+	if rr.IP() != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("invalid A %s", rr.IP())
+	}
+	next(DNSTypeAAAA, "web.example.com")
+	if rr.IP() != netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("invalid AAAA %s", rr.IP())
+	}
+	next(DNSTypeMX, "example.com")
+	if pref, host, err := rr.DecodeMX(p, nil); err != nil || pref != 10 || string(host) != "mail.example.com" {
+		t.Errorf("invalid mx %d %s %v", pref, host, err)
+	}
+	next(DNSTypeTXT, "example.com")
+	if txt, err := rr.DecodeTXT(); err != nil || len(txt) != 2 || txt[0] != "v=spf1 -all" || txt[1] != "hello" {
+		t.Errorf("invalid txt %v %v", txt, err)
+	}
+	next(DNSTypeSRV, "_sip._udp.example.com")
+	if srv, err := rr.DecodeSRV(p, nil); err != nil || srv != (DNSSRV{Priority: 1, Weight: 2, Port: 5060, Target: "sip.example.com"}) {
+		t.Errorf("invalid srv %+v %v", srv, err)
+	}
+	next(DNSTypeHTTPS, "example.com")
+	svcb, err := rr.DecodeSVCB()
+	if alpn := svcb.ALPN(); err != nil || svcb.Priority != 1 || svcb.Target != "" || len(alpn) != 2 || alpn[1] != "h3" ||
+		len(svcb.IPv4Hint()) != 1 || svcb.IPv4Hint()[0] != netip.MustParseAddr("192.0.2.2") {
+		t.Errorf("invalid svcb %+v %v", svcb, err)
+	}
+	next(DNSTypeNS, "example.com")
+	next(DNSTypeSOA, "example.com")
+	if soa, err := rr.DecodeSOA(p, nil); err != nil || soa.MName != "ns1.example.com" || soa.RName != "admin.example.com" || soa.Serial != 2022010101 || soa.Minimum != 300 {
+		t.Errorf("invalid soa %+v %v", soa, err)
+	}
+	next(DNSTypeOPT, "")
+	if offset != len(p) {
+		t.Errorf("invalid final offset %d len %d", offset, len(p))
+	}
+
+	opt, found, err := DecodeOPT(p)
+	if err != nil || !found || opt.UDPSize != 1232 || !opt.DO || opt.Version != 0 {
+		t.Fatalf("invalid opt %+v %v", opt, err)
+	}
+	if ecs, ok := opt.ClientSubnet(); !ok || ecs.Prefix != netip.MustParsePrefix("198.51.100.0/24") {
+		t.Errorf("invalid client subnet %+v", ecs)
+	}
+
+	// dns entry tracks the new record types
+	e := NewDNSEntry()
+	if _, _, err := e.DecodeAnswers(p, 12+len("www.example.com")+2+4, buffer); err != nil {
+		t.Fatal("decode answers", err)
+	}
+	if len(e.IP4Records) != 2 || len(e.IP6Records) != 1 || len(e.CNameRecords) != 1 || len(e.MXRecords) != 1 || len(e.SRVRecords) != 1 || len(e.TXTRecords) != 1 {
+		t.Errorf("invalid entry %+v", e)
+	}
+	if r := e.CNameRecords["www.example.com"]; r.CName != "web.example.com" {
+		t.Errorf("invalid cname record %+v", r)
+	}
+	if c := e.Copy(); len(c.SRVRecords) != 1 || c.TXTRecords["example.com"].TXT[1] != "hello" {
+		t.Errorf("invalid copy %+v", c)
+	}
+}
+
+func TestDNSBuilder_Errors(t *testing.T) {
+	var b DNSBuilder
+	b.Reset(make([]byte, 0, 40), 1, DNSFlagQR)
+	b.Question("www.example.com", DNSTypeA, DNSClassINET)
+	b.A(DNSRRHeader{Name: "www.example.com", Class: DNSClassINET, TTL: 60}, netip.MustParseAddr("192.0.2.1"))
+	if _, err := b.Finish(); !errors.Is(err, ErrPayloadTooBig) {
+		t.Error("expected payload too big", err)
+	}
+
+	b.Reset(make([]byte, 0, 512), 1, DNSFlagQR)
+	b.StartAdditionals()
+	b.StartAnswers()
+	if _, err := b.Finish(); !errors.Is(err, ErrInvalidParam) {
+		t.Error("expected section order error", err)
+	}
+
+	b.Reset(make([]byte, 0, 512), 1, DNSFlagQR)
+	b.A(DNSRRHeader{Name: "a..com", Class: DNSClassINET}, netip.MustParseAddr("192.0.2.1"))
+	if _, err := b.Finish(); !errors.Is(err, ErrInvalidLen) {
+		t.Error("expected invalid label", err)
+	}
+
+	// the first error is kept
+	b.Reset(make([]byte, 0, 512), 1, DNSFlagQR)
+	b.StartAnswers()
+	b.A(DNSRRHeader{Name: "www.example.com", Class: DNSClassINET}, netip.MustParseAddr("2001:db8::1"))
+	b.AAAA(DNSRRHeader{Name: "www.example.com", Class: DNSClassINET}, netip.MustParseAddr("192.0.2.1"))
+	b.TXT(DNSRRHeader{Name: "www.example.com", Class: DNSClassINET}, strings.Repeat("a", 256))
+	b.PTR(DNSRRHeader{Name: "www.example.com", Class: DNSClassINET}, "a..com")
+	if _, err := b.Finish(); !errors.Is(err, ErrInvalidIP) || !strings.Contains(err.Error(), "invalid A record") {
+		t.Error("expected first error", err)
+	}
+}
+
+func TestDNSBuilder_Allocs(t *testing.T) {
+	buf := make([]byte, 0, 512)
+	ip := netip.MustParseAddr("192.0.2.1")
+	allocs := testing.AllocsPerRun(100, func() {
+		var b DNSBuilder
+		b.Reset(buf, 1, DNSFlagQR)
+		b.Question("www.example.com", DNSTypeA, DNSClassINET)
+		b.CNAME(DNSRRHeader{Name: "www.example.com", Class: DNSClassINET, TTL: 60}, "web.example.com")
+		b.A(DNSRRHeader{Name: "web.example.com", Class: DNSClassINET, TTL: 60}, ip)
+		if _, err := b.Finish(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("builder allocations=%v", allocs)
+	}
+}
+
+func TestDNSClientSubnet(t *testing.T) {
+	for _, prefix := range []string{"198.51.100.0/24", "2001:db8::/56", "0.0.0.0/0"} {
+		want := netip.MustParsePrefix(prefix)
+		opt := DNSClientSubnet{Prefix: want, ScopePrefix: 0}.Encode(nil)
+		got, err := DecodeDNSClientSubnet(opt.Data)
+		if err != nil || got.Prefix != want {
+			t.Errorf("invalid client subnet want=%s got=%s err=%v", want, got.Prefix, err)
+		}
+	}
+	if _, err := DecodeDNSClientSubnet([]byte{0, 1, 24, 0, 1, 2}); err == nil {
+		t.Error("expected invalid len")
+	}
+}
+
+func TestDNS_TCP(t *testing.T) {
+	session, _ := testSession()
+	defer session.Close()
+
+	p := testDNSResponse(t, make([]byte, 0, 512))
+	stream, err := EncodeDNSTCP(make([]byte, 0, 1024), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream = append(stream, stream...) // two messages in the same segment
+	msg, rest, err := DecodeDNSTCP(stream)
+	if err != nil || !bytes.Equal(msg, p) || len(rest) != len(p)+2 {
+		t.Fatalf("invalid tcp decode len=%d rest=%d err=%v", len(msg), len(rest), err)
+	}
+	if _, _, err := DecodeDNSTCP(rest[:len(rest)-1]); !errors.Is(err, ErrInvalidLen) {
+		t.Error("expected partial message error", err)
+	}
+
+	// tcp frame from port 53 is classified as dns
+	ether := Ether(make([]byte, EthMaxSize))
+	ether = EncodeEther(ether, syscall.ETH_P_IP, routerMAC, hostMAC)
+	ip4 := EncodeIP4(ether.Payload(), 50, routerIP4, hostIP4)
+	tcp := ip4.Payload()[:20+len(stream)]
+	for i := range tcp[:20] {
+		tcp[i] = 0
+	}
+	binary.BigEndian.PutUint16(tcp[0:2], 53)
+	binary.BigEndian.PutUint16(tcp[2:4], 40000)
+	tcp[12] = 5 << 4 // 20 bytes header
+	tcp[13] = 0x18   // psh ack
+	copy(tcp[20:], stream)
+	ip4 = ip4.SetPayload(tcp, syscall.IPPROTO_TCP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := session.Parse(ether)
+	if err != nil || frame.PayloadID != PayloadDNS || frame.TCP() == nil {
+		t.Fatalf("invalid tcp dns frame payloadID=%v err=%v", frame.PayloadID, err)
+	}
+	if got := DNS(frame.Payload()); got.TransactionID() != 0x1234 || got.ANCount() != 7 {
+		t.Errorf("invalid tcp dns payload %s", got)
+	}
+}
+
+func TestDNSReverseName(t *testing.T) {
+	tests := []struct {
+		ip   netip.Addr
+		want string
+	}{
+		{ip: netip.MustParseAddr("192.168.0.1"), want: "1.0.168.192.in-addr.arpa"},
+		{ip: netip.MustParseAddr("::ffff:10.0.0.2"), want: "2.0.0.10.in-addr.arpa"},
+		{ip: netip.MustParseAddr("2001:db8::567:89ab"), want: "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+	for _, tt := range tests {
+		if got := DNSReverseName(tt.ip); got != tt.want {
+			t.Errorf("DNSReverseName(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+		if ip, ok := DNSReverseAddr(tt.want + "."); !ok || ip != tt.ip.Unmap() {
+			t.Errorf("DNSReverseAddr(%s) = %s, want %s", tt.want, ip, tt.ip)
+		}
+	}
+	for _, name := range []string{"1.0.168.in-addr.arpa", "256.0.168.192.in-addr.arpa", "x.0.168.192.in-addr.arpa", "1.0.ip6.arpa", "www.example.com"} {
+		if ip, ok := DNSReverseAddr(name); ok {
+			t.Errorf("DNSReverseAddr(%s) unexpected ip=%s", name, ip)
+		}
+	}
+}
+
+func TestDecodeQuestions(t *testing.T) {
+	var b DNSBuilder
+	b.Reset(make([]byte, 0, 512), 0, 0)
+	b.Question("_http._tcp.local", DNSTypePTR, DNSClassINET)
+	b.Question("printer._http._tcp.local", DNSTypeSRV, DNSClassINET|0x8000)
+	b.StartAnswers()
+	b.PTR(DNSRRHeader{Name: "_http._tcp.local", Class: DNSClassINET, TTL: 4500}, "printer._http._tcp.local")
+	p, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	questions, offset, err := DecodeQuestions(p)
+	if err != nil || len(questions) != 2 {
+		t.Fatalf("invalid questions %+v err=%v", questions, err)
+	}
+	if string(questions[0].Name) != "_http._tcp.local" || string(questions[1].Name) != "printer._http._tcp.local" ||
+		questions[1].Type != DNSTypeSRV || questions[1].Class != DNSClassINET|0x8000 {
+		t.Errorf("invalid questions %+v", questions)
+	}
+	if off, _ := p.AnswerOffset(); off != offset {
+		t.Errorf("invalid answer offset %d want %d", offset, off)
+	}
+	if _, _, err := DecodeQuestions(p[:len(p)-40]); err == nil {
+		t.Error("expected error for short frame")
+	}
+}
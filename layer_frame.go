@@ -44,8 +44,13 @@ const (
 	PayloadIEEE1905      PayloadID = 27
 	PayloadSonos         PayloadID = 28
 	Payload880a          PayloadID = 29
+	PayloadWakeOnLAN     PayloadID = 30
+	PayloadHTTP          PayloadID = 31
 )
 
+// PayloadMax is the size of the session statistics table; update it when adding a PayloadID.
+const PayloadMax = int(PayloadHTTP) + 1
+
 // Frame describes a network packet and the various protocol layers within it.
 // It maintains a reference to common protocols like IP4, IP6, UDP, TCP.
 type Frame struct {
@@ -294,6 +299,14 @@ func (h *Session) Parse(p []byte) (frame Frame, err error) {
 		frame.offsetPayload = frame.Ether().HeaderLen()
 		return frame, nil
 
+	case EthTypeWakeOnLAN: // Wake-on-LAN magic packet
+		frame.PayloadID = PayloadWakeOnLAN
+		if err := WakeOnLAN(frame.Payload()).IsValid(); err != nil {
+			return frame, err
+		}
+		h.Statistics[PayloadWakeOnLAN].Count++
+		return frame, nil
+
 	case 0x880a: // not sure what this is but seen often on home LANs
 		frame.PayloadID = Payload880a
 		h.Statistics[Payload880a].Count++
@@ -354,6 +367,9 @@ func (h *Session) Parse(p []byte) (frame Frame, err error) {
 		case frame.SrcAddr.Port == 10001 || frame.DstAddr.Port == 10001: // Ubiquiti device discovery protocol
 			frame.PayloadID = PayloadUbiquiti
 			h.Statistics[PayloadUbiquiti].Count++
+		case (frame.DstAddr.Port == 7 || frame.DstAddr.Port == WakeOnLANPort) && WakeOnLAN(udp.Payload()).IsValid() == nil: // Wake-on-LAN magic packet
+			frame.PayloadID = PayloadWakeOnLAN
+			h.Statistics[PayloadWakeOnLAN].Count++
 		}
 		frame.offsetPayload = frame.offsetPayload + udp.HeaderLen() // only update offset if known header
 		return frame, nil
@@ -368,6 +384,27 @@ func (h *Session) Parse(p []byte) (frame Frame, err error) {
 		frame.offsetTCP = frame.offsetPayload
 		frame.SrcAddr.Port = tcp.SrcPort()
 		frame.DstAddr.Port = tcp.DstPort()
+		if frame.SrcAddr.Port == DNSPort || frame.DstAddr.Port == DNSPort { // DNS over TCP
+			// only classify segments starting with a full message; payload skips the two byte length field
+			if _, _, err := DecodeDNSTCP(tcp.Payload()); err != nil {
+				return frame, nil
+			}
+			frame.PayloadID = PayloadDNS
+			h.Statistics[PayloadDNS].Count++
+			frame.offsetPayload = frame.offsetPayload + tcp.HeaderLen() + 2
+			return frame, nil
+		}
+		switch {
+		case frame.SrcAddr.Port == 443 || frame.DstAddr.Port == 443: // SSL
+			frame.PayloadID = PayloadSSL
+			h.Statistics[PayloadSSL].Count++
+			frame.offsetPayload = frame.offsetPayload + tcp.HeaderLen()
+		case frame.SrcAddr.Port == HTTPPort || frame.DstAddr.Port == HTTPPort ||
+			frame.SrcAddr.Port == HTTPAltPort || frame.DstAddr.Port == HTTPAltPort: // plain http
+			frame.PayloadID = PayloadHTTP
+			h.Statistics[PayloadHTTP].Count++
+			frame.offsetPayload = frame.offsetPayload + tcp.HeaderLen()
+		}
 		return frame, nil
 
 	case syscall.IPPROTO_ICMP:
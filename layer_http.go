@@ -0,0 +1,134 @@
+package packet
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/irai/packet/fastlog"
+)
+
+// HTTP/1.x request
+//
+//	see https://datatracker.ietf.org/doc/html/rfc9112#section-3
+//
+// Plain http requests from IoT devices carry the server host, the request path and the user agent
+// in the clear; firmware update checks often include the device model and version in the path or
+// the user agent. The request line and headers of a small request fit in the first tcp segment.
+//
+//	Request: Method SP Path SP Version CRLF *(FieldName ":" OWS FieldValue OWS CRLF) CRLF Body
+//
+// DecodeHTTPRequest returns slices into the segment so the fast path does not allocate.
+const (
+	HTTPPort    = 80
+	HTTPAltPort = 8080
+)
+
+// HTTPRequest holds the request fields of interest. Each field is a slice into the tcp payload and
+// is only valid until the frame buffer is reused; copy the values to keep them.
+type HTTPRequest struct {
+	Method    []byte
+	Path      []byte
+	Version   []byte
+	Host      []byte
+	UserAgent []byte
+}
+
+func (r HTTPRequest) String() string {
+	return Logger.Msg("").Struct(r).ToString()
+}
+
+func (r HTTPRequest) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.Bytes("method", r.Method)
+	l.Bytes("host", r.Host)
+	l.Bytes("path", r.Path)
+	l.Bytes("version", r.Version)
+	if r.UserAgent != nil {
+		l.Bytes("useragent", r.UserAgent)
+	}
+	return l
+}
+
+var httpMethods = [...]string{"GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "PATCH", "CONNECT"}
+
+// IsHTTPRequest returns true if b starts with a http method followed by a space. Use it to
+// discard tcp segments that do not start a request before calling DecodeHTTPRequest.
+func IsHTTPRequest(b []byte) bool {
+	for _, m := range httpMethods {
+		if len(b) > len(m) && b[len(m)] == ' ' && string(b[:len(m)]) == m {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeHTTPRequest decodes the request line and the Host and User-Agent headers in b.
+//
+// It returns ErrParseProtocol if b is not the start of a HTTP/1.x request and ErrFrameLen if
+// the headers continue past the end of b; in this case the fields found so far are set.
+func DecodeHTTPRequest(b []byte) (req HTTPRequest, err error) {
+	if !IsHTTPRequest(b) {
+		return HTTPRequest{}, ErrParseProtocol
+	}
+	line, b, found := httpLine(b)
+	if !found {
+		return HTTPRequest{}, ErrFrameLen
+	}
+	n := bytes.IndexByte(line, ' ')
+	req.Method, line = line[:n], line[n+1:]
+	if n = bytes.LastIndexByte(line, ' '); n <= 0 {
+		return HTTPRequest{}, fmt.Errorf("invalid request line: %w", ErrParseProtocol)
+	}
+	req.Path, req.Version = line[:n], line[n+1:]
+	if len(req.Version) != 8 || string(req.Version[:7]) != "HTTP/1." {
+		return HTTPRequest{}, fmt.Errorf("invalid http version: %w", ErrParseProtocol)
+	}
+
+	for {
+		if line, b, found = httpLine(b); !found {
+			return req, ErrFrameLen
+		}
+		if len(line) == 0 { // end of headers
+			return req, nil
+		}
+		n = bytes.IndexByte(line, ':')
+		if n <= 0 {
+			return HTTPRequest{}, fmt.Errorf("invalid header field: %w", ErrParseProtocol)
+		}
+		switch {
+		case httpFieldName(line[:n], "host"):
+			req.Host = bytes.TrimSpace(line[n+1:])
+		case httpFieldName(line[:n], "user-agent"):
+			req.UserAgent = bytes.TrimSpace(line[n+1:])
+		}
+	}
+}
+
+// httpLine returns the line up to the next LF without the line terminator.
+func httpLine(b []byte) (line []byte, rest []byte, found bool) {
+	n := bytes.IndexByte(b, '\n')
+	if n < 0 {
+		return nil, b, false
+	}
+	line, rest = b[:n], b[n+1:]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, rest, true
+}
+
+// httpFieldName compares a field name with a lowercase name ignoring case.
+func httpFieldName(b []byte, name string) bool {
+	if len(b) != len(name) {
+		return false
+	}
+	for i := range b {
+		c := b[i]
+		if c >= 'A' && c <= 'Z' {
+			c = c + 'a' - 'A'
+		}
+		if c != name[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package packet
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeHTTPRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		p         string
+		wantErr   error
+		method    string
+		path      string
+		host      string
+		userAgent string
+	}{
+		{name: "get", p: "GET /firmware/v2/check?model=C200 HTTP/1.1\r\nHost: update.tplinkcloud.com\r\nUser-Agent: Dalvik/2.1.0 (Linux; U; Android 11; SM-G991B Build/RP1A)\r\nAccept: */*\r\n\r\n",
+			method: "GET", path: "/firmware/v2/check?model=C200", host: "update.tplinkcloud.com", userAgent: "Dalvik/2.1.0 (Linux; U; Android 11; SM-G991B Build/RP1A)"},
+		{name: "case and spaces", p: "POST /api HTTP/1.0\nhOsT:example.com \nUSER-AGENT:   curl/7.68.0\n\nbody",
+			method: "POST", path: "/api", host: "example.com", userAgent: "curl/7.68.0"},
+		{name: "no user agent", p: "HEAD / HTTP/1.1\r\nHost: 192.168.0.1\r\n\r\n", method: "HEAD", path: "/", host: "192.168.0.1"},
+		{name: "headers continue", p: "GET /index.html HTTP/1.1\r\nHost: example.com\r\nCookie: abc", wantErr: ErrFrameLen,
+			method: "GET", path: "/index.html", host: "example.com"},
+		{name: "request line continues", p: "GET /index.html HT", wantErr: ErrFrameLen},
+		{name: "response", p: "HTTP/1.1 200 OK\r\n\r\n", wantErr: ErrParseProtocol},
+		{name: "lowercase method", p: "get / HTTP/1.1\r\n\r\n", wantErr: ErrParseProtocol},
+		{name: "http2 preface", p: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", wantErr: ErrParseProtocol},
+		{name: "invalid version", p: "GET / HTTP/2.0\r\n\r\n", wantErr: ErrParseProtocol},
+		{name: "no path", p: "GET HTTP/1.1\r\n\r\n", wantErr: ErrParseProtocol},
+		{name: "invalid header", p: "GET / HTTP/1.1\r\nHost\r\n\r\n", wantErr: ErrParseProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeHTTPRequest([]byte(tt.p))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DecodeHTTPRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got.Method) != tt.method || string(got.Path) != tt.path || string(got.Host) != tt.host || string(got.UserAgent) != tt.userAgent {
+				t.Errorf("DecodeHTTPRequest() invalid request %s", got)
+			}
+		})
+	}
+}
+
+func TestDecodeHTTPRequest_allocs(t *testing.T) {
+	p := []byte("GET /check HTTP/1.1\r\nHost: example.com\r\nUser-Agent: Roku/DVP-9.10 (519.10E04111A)\r\n\r\n")
+	allocs := testing.AllocsPerRun(100, func() {
+		if req, err := DecodeHTTPRequest(p); err != nil || req.UserAgent == nil {
+			t.Fatal("invalid request", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("DecodeHTTPRequest() allocs=%v", allocs)
+	}
+}
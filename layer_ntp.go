@@ -0,0 +1,200 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/irai/packet/fastlog"
+)
+
+// Network Time Protocol version 4
+//
+//	see https://datatracker.ietf.org/doc/html/rfc5905
+//	see https://datatracker.ietf.org/doc/html/rfc7822 - extension fields
+//	see https://datatracker.ietf.org/doc/html/rfc8915 - Network Time Security
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|LI | VN  |Mode |    Stratum     |     Poll      |  Precision   |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                         Root Delay                            |
+//	|                         Root Dispersion                       |
+//	|                          Reference ID                         |
+//	|                     Reference Timestamp (64)                  |
+//	|                      Origin Timestamp (64)                    |
+//	|                      Receive Timestamp (64)                   |
+//	|                      Transmit Timestamp (64)                  |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	.                    Extension Fields (variable)                .
+//	|                          Key Identifier                       |
+//	|                            dgst (128)                         |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+const (
+	NTPPort      = 123
+	ntpHeaderLen = 48
+
+	NTPModeSymmetricActive  = 1
+	NTPModeSymmetricPassive = 2
+	NTPModeClient           = 3
+	NTPModeServer           = 4
+	NTPModeBroadcast        = 5
+	NTPModeControl          = 6
+	NTPModePrivate          = 7
+)
+
+// NTP extension field types
+const (
+	NTPExtUniqueIdentifier     = 0x0104
+	NTPExtNTSCookie            = 0x0204
+	NTPExtNTSCookiePlaceholder = 0x0304
+	NTPExtNTSAuthenticator     = 0x0404 // NTS authenticator and encrypted extension fields
+)
+
+// ntpEpochOffset is the number of seconds between 1900 (NTP era 0) and 1970 (unix epoch).
+const ntpEpochOffset = 2208988800
+
+// NTP provides access to the NTP packet fields.
+type NTP []byte
+
+// IsValid returns nil if the packet is a time packet. Control and private mode packets use a
+// different format and return ErrParseProtocol.
+func (p NTP) IsValid() error {
+	if len(p) < ntpHeaderLen {
+		return ErrFrameLen
+	}
+	if v := p.Version(); v < 1 || v > 4 {
+		return ErrParseProtocol
+	}
+	if m := p.Mode(); m == 0 || m == NTPModeControl || m == NTPModePrivate {
+		return ErrParseProtocol
+	}
+	return nil
+}
+
+func (p NTP) LeapIndicator() uint8          { return p[0] >> 6 }
+func (p NTP) Version() uint8                { return (p[0] >> 3) & 0x07 }
+func (p NTP) Mode() uint8                   { return p[0] & 0x07 }
+func (p NTP) Stratum() uint8                { return p[1] } // 0 kiss-o'-death; 1 primary server; 2-15 secondary server
+func (p NTP) Poll() int8                    { return int8(p[2]) }
+func (p NTP) Precision() int8               { return int8(p[3]) }
+func (p NTP) RootDelay() time.Duration      { return ntpShort(binary.BigEndian.Uint32(p[4:8])) }
+func (p NTP) RootDispersion() time.Duration { return ntpShort(binary.BigEndian.Uint32(p[8:12])) }
+func (p NTP) ReferenceID() []byte           { return p[12:16] }
+func (p NTP) ReferenceTime() time.Time      { return NTPTime(binary.BigEndian.Uint64(p[16:24])) }
+func (p NTP) OriginTime() time.Time         { return NTPTime(binary.BigEndian.Uint64(p[24:32])) }
+func (p NTP) ReceiveTime() time.Time        { return NTPTime(binary.BigEndian.Uint64(p[32:40])) }
+func (p NTP) TransmitTime() time.Time       { return NTPTime(binary.BigEndian.Uint64(p[40:48])) }
+
+// ReferenceIDString returns the reference id in readable form: the kiss code when stratum is 0,
+// the reference source when stratum is 1 (i.e. "GPS") and the server IPv4 address otherwise.
+// IPv6 servers use the first four bytes of the address hash which are also shown as an IPv4 address.
+func (p NTP) ReferenceIDString() string {
+	if p.Stratum() <= 1 {
+		return strings.TrimRight(string(p[12:16]), "\x00 ")
+	}
+	return netip.AddrFrom4([4]byte{p[12], p[13], p[14], p[15]}).String()
+}
+
+func (p NTP) String() string {
+	return Logger.Msg("").Struct(p).ToString()
+}
+
+func (p NTP) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.Uint8("version", p.Version())
+	l.Uint8("mode", p.Mode())
+	l.Uint8("stratum", p.Stratum())
+	if p.Mode() != NTPModeClient {
+		l.String("refid", p.ReferenceIDString())
+	}
+	l.Time("transmit", p.TransmitTime())
+	if ext, err := p.Extensions(); err == nil && len(ext) > 0 {
+		l.Int("extensions", len(ext))
+	}
+	return l
+}
+
+// NTPExtension is an extension field after the NTP header.
+type NTPExtension struct {
+	Type  uint16
+	Value []byte
+}
+
+// Extensions returns the extension fields in the packet. A legacy MAC of 20 or 24 bytes after the
+// header or the last extension field is ignored.
+func (p NTP) Extensions() (list []NTPExtension, err error) {
+	b := p[ntpHeaderLen:]
+	for len(b) > 0 {
+		if len(b) == 20 || len(b) == 24 { // key identifier and md5 or sha1 digest
+			break
+		}
+		if len(b) < 4 {
+			return nil, ErrFrameLen
+		}
+		n := int(binary.BigEndian.Uint16(b[2:4]))
+		if n < 4 || n%4 != 0 || n > len(b) {
+			return nil, fmt.Errorf("invalid extension field len=%d: %w", n, ErrFrameLen)
+		}
+		list = append(list, NTPExtension{Type: binary.BigEndian.Uint16(b[0:2]), Value: b[4:n]})
+		b = b[n:]
+	}
+	return list, nil
+}
+
+// IsNTS returns true if the packet is protected with Network Time Security.
+func (p NTP) IsNTS() bool {
+	list, _ := p.Extensions()
+	for _, v := range list {
+		if v.Type == NTPExtNTSAuthenticator {
+			return true
+		}
+	}
+	return false
+}
+
+// ntpShort converts a 16.16 fixed point seconds value to a duration.
+func ntpShort(v uint32) time.Duration {
+	return time.Duration(uint64(v) * uint64(time.Second) >> 16)
+}
+
+// NTPTime converts a 64 bits NTP timestamp to time. Timestamps with the most significant bit
+// clear are in era 1, after February 2036. Zero returns the zero time.
+func NTPTime(ts uint64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	seconds := int64(ts >> 32)
+	if seconds&0x80000000 == 0 {
+		seconds = seconds + 1<<32 // era 1
+	}
+	nanoseconds := (ts & 0xffffffff) * uint64(time.Second) >> 32
+	return time.Unix(seconds-ntpEpochOffset, int64(nanoseconds))
+}
+
+// NTPTimestamp converts t to a 64 bits NTP timestamp; zero time returns zero.
+func NTPTimestamp(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	seconds := uint64(t.Unix()+ntpEpochOffset) & 0xffffffff
+	fraction := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// EncodeNTP writes a NTP header with mode, stratum and transmit time to b and returns the packet.
+// Other fields are set to zero.
+func EncodeNTP(b []byte, version uint8, mode uint8, stratum uint8, transmit time.Time) NTP {
+	if len(b) < ntpHeaderLen {
+		return nil
+	}
+	for i := range b[:ntpHeaderLen] {
+		b[i] = 0
+	}
+	b[0] = (version&0x07)<<3 | mode&0x07
+	b[1] = stratum
+	binary.BigEndian.PutUint64(b[40:48], NTPTimestamp(transmit))
+	return b[:ntpHeaderLen]
+}
@@ -0,0 +1,93 @@
+package packet
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// testNTPResponse returns a stratum 3 server response; nts appends the unique identifier and NTS authenticator fields.
+func testNTPResponse(nts bool) NTP {
+	transmit := time.Date(2021, 7, 8, 11, 25, 8, 500000000, time.UTC)
+	p := EncodeNTP(make([]byte, 200), 4, NTPModeServer, 3, transmit)
+	copy(p[12:16], []byte{10, 21, 8, 251})
+	binary.BigEndian.PutUint32(p[4:8], 0x00008000) // 0.5 seconds
+	if nts {
+		ext := make([]byte, 40)
+		binary.BigEndian.PutUint16(ext[0:2], NTPExtUniqueIdentifier)
+		binary.BigEndian.PutUint16(ext[2:4], 36)
+		binary.BigEndian.PutUint16(ext[36:38], NTPExtNTSAuthenticator)
+		binary.BigEndian.PutUint16(ext[38:40], 4)
+		p = append(p, ext...)
+	}
+	return p
+}
+
+func TestNTP(t *testing.T) {
+	kiss := EncodeNTP(make([]byte, 48), 4, NTPModeServer, 0, time.Time{})
+	copy(kiss[12:16], "RATE")
+	gps := EncodeNTP(make([]byte, 48), 3, NTPModeServer, 1, time.Now())
+	copy(gps[12:16], "GPS\x00")
+	legacyMAC := append(EncodeNTP(make([]byte, 48), 4, NTPModeClient, 0, time.Now()), make([]byte, 20)...)
+	badExt := append(EncodeNTP(make([]byte, 48), 4, NTPModeClient, 0, time.Now()), 0x01, 0x04, 0x00, 0x30)
+
+	tests := []struct {
+		name    string
+		p       NTP
+		wantErr error
+		mode    uint8
+		refID   string
+		nts     bool
+		extErr  bool
+	}{
+		{name: "server", p: testNTPResponse(false), mode: NTPModeServer, refID: "10.21.8.251"},
+		{name: "nts", p: testNTPResponse(true), mode: NTPModeServer, refID: "10.21.8.251", nts: true},
+		{name: "kiss", p: kiss, mode: NTPModeServer, refID: "RATE"},
+		{name: "gps", p: gps, mode: NTPModeServer, refID: "GPS"},
+		{name: "legacy mac", p: legacyMAC, mode: NTPModeClient, refID: ""},
+		{name: "invalid extension", p: badExt, mode: NTPModeClient, refID: "", extErr: true},
+		{name: "short", p: kiss[:47], wantErr: ErrFrameLen},
+		{name: "control", p: EncodeNTP(make([]byte, 48), 2, NTPModeControl, 0, time.Time{}), wantErr: ErrParseProtocol},
+		{name: "version", p: EncodeNTP(make([]byte, 48), 0, NTPModeClient, 0, time.Time{}), wantErr: ErrParseProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.IsValid(); err != tt.wantErr {
+				t.Fatalf("NTP.IsValid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if tt.p.Mode() != tt.mode || tt.p.ReferenceIDString() != tt.refID || tt.p.IsNTS() != tt.nts {
+				t.Errorf("invalid ntp %s", tt.p)
+			}
+			if _, err := tt.p.Extensions(); (err != nil) != tt.extErr {
+				t.Errorf("NTP.Extensions() error = %v, wantErr %v", err, tt.extErr)
+			}
+		})
+	}
+
+	p := testNTPResponse(true)
+	if p.Version() != 4 || p.Stratum() != 3 || p.RootDelay() != time.Millisecond*500 ||
+		!p.TransmitTime().Equal(time.Date(2021, 7, 8, 11, 25, 8, 500000000, time.UTC)) {
+		t.Errorf("invalid ntp fields %s delay=%v transmit=%v", p, p.RootDelay(), p.TransmitTime())
+	}
+	if ext, _ := p.Extensions(); len(ext) != 2 || ext[0].Type != NTPExtUniqueIdentifier || len(ext[0].Value) != 32 {
+		t.Errorf("invalid extensions %+v", ext)
+	}
+}
+
+func TestNTPTime(t *testing.T) {
+	for _, v := range []time.Time{
+		time.Unix(0, 0),
+		time.Date(2021, 7, 8, 11, 25, 8, 250000000, time.UTC),
+		time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC), // era 1
+	} {
+		if got := NTPTime(NTPTimestamp(v)); !got.Equal(v) {
+			t.Errorf("NTPTime() = %v, want %v", got, v)
+		}
+	}
+	if !NTPTime(0).IsZero() || NTPTimestamp(time.Time{}) != 0 {
+		t.Error("invalid zero timestamp")
+	}
+}
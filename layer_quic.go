@@ -0,0 +1,434 @@
+package packet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/irai/packet/fastlog"
+)
+
+// QUIC long header packets and Initial packet protection
+//
+//	see https://datatracker.ietf.org/doc/html/rfc9000#section-17.2
+//	see https://datatracker.ietf.org/doc/html/rfc9001#section-5 - packet protection
+//	see https://datatracker.ietf.org/doc/html/rfc9369 - QUIC version 2
+//
+// Initial packets are encrypted with keys derived from the destination connection id chosen by the
+// client, so anyone on the path can decrypt them. The client Initial packets carry the TLS ClientHello
+// in CRYPTO frames; a ClientHello larger than a datagram, common with post quantum key shares, spans
+// several Initial packets and browsers split and reorder the CRYPTO frames.
+//
+//	Long Header Packet {
+//	  Header Form (1) = 1, Fixed Bit (1) = 1, Long Packet Type (2), Type-Specific Bits (4),
+//	  Version (32), Destination Connection ID Length (8), Destination Connection ID (0..160),
+//	  Source Connection ID Length (8), Source Connection ID (0..160), Type-Specific Payload (..)
+//	}
+//	Initial Packet {
+//	  ..., Token Length (i), Token (..), Length (i), Packet Number (8..32), Packet Payload (8..)
+//	}
+const (
+	QUICVersion1 = 0x00000001
+	QUICVersion2 = 0x6b3343cf
+
+	QUICInitial   = 0
+	QUIC0RTT      = 1
+	QUICHandshake = 2
+	QUICRetry     = 3
+
+	quicMaxConnIDLen = 20
+	quicSampleLen    = 16
+)
+
+var (
+	quicSaltV1 = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	quicSaltV2 = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+)
+
+// QUIC provides access to the fields of a QUIC long header packet. The slice may contain further
+// coalesced packets after this packet.
+type QUIC []byte
+
+// IsValid returns nil if the packet has a long header with valid connection id lengths.
+func (p QUIC) IsValid() error {
+	if len(p) < 7 {
+		return ErrFrameLen
+	}
+	if !p.IsLongHeader() || p[0]&0x40 == 0 {
+		return fmt.Errorf("not a quic long header: %w", ErrParseProtocol)
+	}
+	n := int(p[5])
+	if n > quicMaxConnIDLen || len(p) < 7+n {
+		return fmt.Errorf("invalid quic dcid len=%d: %w", n, ErrFrameLen)
+	}
+	if m := int(p[6+n]); m > quicMaxConnIDLen || len(p) < 7+n+m {
+		return fmt.Errorf("invalid quic scid len=%d: %w", m, ErrFrameLen)
+	}
+	return nil
+}
+
+func (p QUIC) IsLongHeader() bool { return p[0]&0x80 != 0 }
+func (p QUIC) Version() uint32    { return binary.BigEndian.Uint32(p[1:5]) }
+func (p QUIC) DCID() []byte       { return p[6 : 6+int(p[5])] }
+func (p QUIC) SCID() []byte       { n := 6 + int(p[5]); return p[n+1 : n+1+int(p[n])] }
+
+// PacketType returns the long packet type using the version 1 values; version 2 uses different
+// type bits for the same packets.
+func (p QUIC) PacketType() uint8 {
+	t := (p[0] >> 4) & 0x03
+	if p.Version() == QUICVersion2 {
+		return (t + 3) & 0x03 // v2: initial 1, 0-rtt 2, handshake 3, retry 0
+	}
+	return t
+}
+
+func (p QUIC) String() string {
+	return Logger.Msg("").Struct(p).ToString()
+}
+
+func (p QUIC) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.String("version", fmt.Sprintf("0x%08x", p.Version()))
+	l.Uint8("type", p.PacketType())
+	l.ByteArray("dcid", p.DCID())
+	l.ByteArray("scid", p.SCID())
+	return l
+}
+
+// QUICVarint returns the variable length integer at the start of b and its length in bytes.
+func QUICVarint(b []byte) (v uint64, n int, err error) {
+	if len(b) < 1 {
+		return 0, 0, ErrFrameLen
+	}
+	n = 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0, ErrFrameLen
+	}
+	v = uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n, nil
+}
+
+// QUICCryptoFrame is the data in a CRYPTO frame at offset in the crypto stream.
+type QUICCryptoFrame struct {
+	Offset uint64
+	Data   []byte
+}
+
+// QUICInitialPacket is a decrypted client Initial packet.
+type QUICInitialPacket struct {
+	Version      uint32
+	DCID         []byte
+	SCID         []byte
+	Token        []byte
+	PacketNumber uint64
+	Frames       []QUICCryptoFrame // CRYPTO frames in the order received
+}
+
+// DecodeQUICInitials decrypts the client Initial packets coalesced in a datagram. Packets of other
+// types are skipped. The returned packets reference a copy of the datagram.
+func DecodeQUICInitials(datagram []byte) (list []QUICInitialPacket, err error) {
+	b := CopyBytes(datagram)
+	for len(b) > 0 && b[0]&0x80 != 0 { // remaining bytes may be a short header packet or padding
+		p := QUIC(b)
+		if err := p.IsValid(); err != nil {
+			return nil, err
+		}
+		if v := p.Version(); v != QUICVersion1 && v != QUICVersion2 {
+			return nil, fmt.Errorf("unsupported quic version=0x%08x: %w", v, ErrParseProtocol)
+		}
+		if p.PacketType() == QUICRetry {
+			break
+		}
+		n := 7 + len(p.DCID()) + len(p.SCID())
+		if p.PacketType() == QUICInitial {
+			token, m, err := quicToken(b[n:])
+			if err != nil {
+				return nil, err
+			}
+			n = n + m
+			if len(token) == 0 {
+				token = nil
+			}
+			pkt := QUICInitialPacket{Version: p.Version(), DCID: p.DCID(), SCID: p.SCID(), Token: token}
+			length, m, err := QUICVarint(b[n:])
+			if err != nil {
+				return nil, err
+			}
+			if uint64(len(b)-n-m) < length {
+				return nil, fmt.Errorf("invalid quic packet len=%d: %w", length, ErrFrameLen)
+			}
+			payload, pn, err := quicDecryptInitial(b[:n+m+int(length)], n+m)
+			if err != nil {
+				return nil, err
+			}
+			pkt.PacketNumber = pn
+			if pkt.Frames, err = quicCryptoFrames(payload); err != nil {
+				return nil, err
+			}
+			list = append(list, pkt)
+			b = b[n+m+int(length):]
+			continue
+		}
+		// skip 0-rtt and handshake packets
+		length, m, err := QUICVarint(b[n:])
+		if err != nil || uint64(len(b)-n-m) < length {
+			return list, ErrFrameLen
+		}
+		b = b[n+m+int(length):]
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no quic initial packet: %w", ErrParseProtocol)
+	}
+	return list, nil
+}
+
+// quicToken returns the token in an Initial packet and the number of bytes used by the token fields.
+func quicToken(b []byte) (token []byte, n int, err error) {
+	l, n, err := QUICVarint(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if uint64(len(b)-n) < l {
+		return nil, 0, ErrFrameLen
+	}
+	return b[n : n+int(l)], n + int(l), nil
+}
+
+// quicKeys returns the Initial packet protection key, iv and header protection key.
+func quicKeys(version uint32, dcid []byte, client bool) (key []byte, iv []byte, hp []byte) {
+	salt, prefix := quicSaltV1, "quic "
+	if version == QUICVersion2 {
+		salt, prefix = quicSaltV2, "quicv2 "
+	}
+	initialSecret := hkdfExtract(salt, dcid)
+	label := "server in"
+	if client {
+		label = "client in"
+	}
+	secret := hkdfExpandLabel(initialSecret, label, sha256.Size)
+	return hkdfExpandLabel(secret, prefix+"key", 16), hkdfExpandLabel(secret, prefix+"iv", 12), hkdfExpandLabel(secret, prefix+"hp", 16)
+}
+
+// quicDecryptInitial removes the header protection in place and returns the decrypted payload and packet
+// number of a client Initial packet. b contains a single packet and pnOffset is the offset to the packet number.
+func quicDecryptInitial(b []byte, pnOffset int) (payload []byte, pn uint64, err error) {
+	p := QUIC(b)
+	key, iv, hpKey := quicKeys(p.Version(), p.DCID(), true)
+	if len(b) < pnOffset+4+quicSampleLen {
+		return nil, 0, ErrFrameLen
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	var mask [16]byte
+	hp.Encrypt(mask[:], b[pnOffset+4:pnOffset+4+quicSampleLen])
+	b[0] ^= mask[0] & 0x0f
+	pnLen := int(b[0]&0x03) + 1
+	for i := 0; i < pnLen; i++ {
+		b[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(b[pnOffset+i])
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, 0, err
+	}
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	header := b[:pnOffset+pnLen]
+	payload, err = aead.Open(b[pnOffset+pnLen:pnOffset+pnLen], nonce, b[pnOffset+pnLen:], header)
+	if err != nil {
+		return nil, 0, fmt.Errorf("quic initial decrypt: %w", ErrParseFrame)
+	}
+	return payload, pn, nil
+}
+
+// EncodeQUICInitial returns a protected client Initial packet carrying frames with the packet number
+// encoded in four bytes. The frames are padded so the packet is 1200 bytes, the minimum size of a
+// datagram with a client Initial packet.
+func EncodeQUICInitial(version uint32, dcid []byte, scid []byte, pn uint32, frames []byte) (QUIC, error) {
+	if len(dcid) > quicMaxConnIDLen || len(scid) > quicMaxConnIDLen || len(frames) > 0x3fff-4-16 {
+		return nil, ErrInvalidLen
+	}
+	typeBits := byte(0xc0)
+	if version == QUICVersion2 {
+		typeBits = 0xd0
+	}
+	b := make([]byte, 0, 1200+len(frames))
+	b = append(b, typeBits|0x03, byte(version>>24), byte(version>>16), byte(version>>8), byte(version), byte(len(dcid)))
+	b = append(b, dcid...)
+	b = append(b, byte(len(scid)))
+	b = append(b, scid...)
+	b = append(b, 0) // token len
+	if n := 1200 - len(b) - 2 - 4 - len(frames) - 16; n > 0 {
+		frames = append(append([]byte(nil), frames...), make([]byte, n)...) // padding frames
+	}
+	length := 4 + len(frames) + 16
+	b = append(b, 0x40|byte(length>>8), byte(length))
+	pnOffset := len(b)
+	b = append(b, byte(pn>>24), byte(pn>>16), byte(pn>>8), byte(pn))
+
+	key, iv, hpKey := quicKeys(version, dcid, true)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+	for i := 0; i < 4; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	b = aead.Seal(b, nonce, frames, b)
+
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+	var mask [16]byte
+	hp.Encrypt(mask[:], b[pnOffset+4:pnOffset+4+quicSampleLen])
+	b[0] ^= mask[0] & 0x0f
+	for i := 0; i < 4; i++ {
+		b[pnOffset+i] ^= mask[1+i]
+	}
+	return b, nil
+}
+
+// quicCryptoFrames returns the CRYPTO frames in an Initial packet payload. Initial packets contain
+// only PADDING, PING, ACK, CRYPTO and CONNECTION_CLOSE frames - RFC 9000 section 12.4.
+func quicCryptoFrames(b []byte) (list []QUICCryptoFrame, err error) {
+	varints := func(count int) error {
+		for i := 0; i < count; i++ {
+			_, n, err := QUICVarint(b)
+			if err != nil {
+				return err
+			}
+			b = b[n:]
+		}
+		return nil
+	}
+	for len(b) > 0 {
+		frameType := b[0]
+		b = b[1:]
+		switch frameType {
+		case 0x00, 0x01: // padding and ping
+		case 0x02, 0x03: // ack: largest, delay, range count, first range, ranges and ecn counts
+			if err := varints(2); err != nil {
+				return nil, err
+			}
+			count, n, err := QUICVarint(b)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+			if count > uint64(len(b)) {
+				return nil, ErrFrameLen
+			}
+			ecn := 0
+			if frameType == 0x03 {
+				ecn = 3
+			}
+			if err := varints(1 + int(count)*2 + ecn); err != nil {
+				return nil, err
+			}
+		case 0x06: // crypto
+			offset, n, err := QUICVarint(b)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+			length, n, err := QUICVarint(b)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+			if uint64(len(b)) < length {
+				return nil, ErrFrameLen
+			}
+			list = append(list, QUICCryptoFrame{Offset: offset, Data: b[:length]})
+			b = b[length:]
+		case 0x1c: // connection close: error code, frame type and reason phrase
+			if err := varints(2); err != nil {
+				return nil, err
+			}
+			l, n, err := QUICVarint(b)
+			if err != nil || uint64(len(b)-n) < l {
+				return nil, ErrFrameLen
+			}
+			b = b[n+int(l):]
+		default:
+			return nil, fmt.Errorf("invalid quic initial frame type=%#x: %w", frameType, ErrParseProtocol)
+		}
+	}
+	return list, nil
+}
+
+// QUICCryptoStream returns the contiguous crypto stream data from offset zero. Overlapping and
+// duplicate frames are accepted; data after a gap is not returned.
+func QUICCryptoStream(frames []QUICCryptoFrame) []byte {
+	sorted := append([]QUICCryptoFrame(nil), frames...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+	var stream []byte
+	for _, f := range sorted {
+		if f.Offset > uint64(len(stream)) { // gap
+			break
+		}
+		if end := f.Offset + uint64(len(f.Data)); end > uint64(len(stream)) {
+			stream = append(stream, f.Data[uint64(len(stream))-f.Offset:]...)
+		}
+	}
+	return stream
+}
+
+// DecodeQUICClientHello returns the ClientHello in the client Initial packets of a datagram. It returns
+// ErrFrameLen if the ClientHello continues in the next datagram; use QUICCryptoStream to join the
+// CRYPTO frames of several datagrams and DecodeTLSHandshakeClientHello to decode the result.
+func DecodeQUICClientHello(datagram []byte) (TLSClientHello, error) {
+	list, err := DecodeQUICInitials(datagram)
+	if err != nil {
+		return nil, err
+	}
+	var frames []QUICCryptoFrame
+	for _, v := range list {
+		frames = append(frames, v.Frames...)
+	}
+	return DecodeTLSHandshakeClientHello(QUICCryptoStream(frames))
+}
+
+// hkdfExtract implements HKDF-Extract with sha256 - RFC 5869.
+func hkdfExtract(salt []byte, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel implements the TLS 1.3 HKDF-Expand-Label with an empty context for lengths up to
+// the sha256 size - RFC 8446 section 7.1.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0) // context
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
@@ -0,0 +1,129 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// testQUICInitial returns a client Initial packet without a source connection id.
+func testQUICInitial(version uint32, dcid []byte, pn uint32, frames []byte) []byte {
+	p, err := EncodeQUICInitial(version, dcid, nil, pn, frames)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// testQUICCrypto returns a CRYPTO frame.
+func testQUICCrypto(offset int, data []byte) []byte {
+	b := []byte{0x06, 0x40 | byte(offset>>8), byte(offset), 0x40 | byte(len(data)>>8), byte(len(data))}
+	return append(b, data...)
+}
+
+func TestQUICKeys(t *testing.T) {
+	dcid := mustHex([]byte("8394c8f03e515708")) // RFC 9001 appendix A
+	tests := []struct {
+		name    string
+		version uint32
+		client  bool
+		key     string
+		iv      string
+		hp      string
+	}{
+		{name: "v1 client", version: QUICVersion1, client: true, key: "1f369613dd76d5467730efcbe3b1a22d", iv: "fa044b2f42a3fd3b46fb255c", hp: "9f50449e04a0e810283a1e9933adedd2"},
+		{name: "v1 server", version: QUICVersion1, client: false, key: "cf3a5331653c364c88f0f379b6067e37", iv: "0ac1493ca1905853b0bba03e", hp: "c206b8d9b9f0f37644430b490eeaa314"},
+		{name: "v2 client", version: QUICVersion2, client: true, key: "8b1a0bc121284290a29e0971b5cd045d", iv: "91f73e2351d8fa91660e909f", hp: "45b95e15235d6f45a6b19cbcb0294ba9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, iv, hp := quicKeys(tt.version, dcid, tt.client)
+			if hex.EncodeToString(key) != tt.key || hex.EncodeToString(iv) != tt.iv || hex.EncodeToString(hp) != tt.hp {
+				t.Errorf("quicKeys() key=%x iv=%x hp=%x", key, iv, hp)
+			}
+		})
+	}
+
+	// header protection mask for the sample in RFC 9001 appendix A.2
+	_, _, hpKey := quicKeys(QUICVersion1, dcid, true)
+	hp, _ := aes.NewCipher(hpKey)
+	var mask [16]byte
+	hp.Encrypt(mask[:], mustHex([]byte("d1b1c98dd7689fb8ec11d242b123dc9b")))
+	if hex.EncodeToString(mask[:5]) != "437b9aec36" {
+		t.Errorf("invalid header protection mask %x", mask[:5])
+	}
+}
+
+func TestDecodeQUICClientHello(t *testing.T) {
+	hello := testTLSChrome()
+	dcid := mustHex([]byte("8394c8f03e515708"))
+	ack := []byte{0x02, 0x00, 0x00, 0x00, 0x00}
+
+	for _, version := range []uint32{QUICVersion1, QUICVersion2} {
+		// crypto frames out of order with ping and ack frames
+		frames := append(testQUICCrypto(100, hello[100:]), 0x01)
+		frames = append(frames, ack...)
+		frames = append(frames, testQUICCrypto(0, hello[:100])...)
+		datagram := testQUICInitial(version, dcid, 2, frames)
+		if p := QUIC(datagram); p.IsValid() != nil || p.PacketType() != QUICInitial || p.Version() != version || !bytes.Equal(p.DCID(), dcid) {
+			t.Fatalf("invalid quic header %s", p)
+		}
+		got, err := DecodeQUICClientHello(datagram)
+		if err != nil {
+			t.Fatalf("version=%x DecodeQUICClientHello() error = %v", version, err)
+		}
+		if got.ServerName() != "www.google.com" || got.JA4(true) != "q13d1516h2_8daaf6152771_e5627efa2ab1" {
+			t.Errorf("invalid client hello %s", got)
+		}
+	}
+
+	// client hello in two datagrams
+	first := testQUICInitial(QUICVersion1, dcid, 0, testQUICCrypto(0, hello[:150]))
+	second := testQUICInitial(QUICVersion1, dcid, 1, testQUICCrypto(150, hello[150:]))
+	if _, err := DecodeQUICClientHello(first); !errors.Is(err, ErrFrameLen) {
+		t.Fatalf("expected incomplete client hello error=%v", err)
+	}
+	p1, err1 := DecodeQUICInitials(first)
+	p2, err2 := DecodeQUICInitials(second)
+	if err1 != nil || err2 != nil || p2[0].PacketNumber != 1 {
+		t.Fatal(err1, err2)
+	}
+	stream := QUICCryptoStream(append(p2[0].Frames, p1[0].Frames...))
+	if got, err := DecodeTLSHandshakeClientHello(stream); err != nil || got.ServerName() != "www.google.com" {
+		t.Errorf("invalid reassembled client hello err=%v", err)
+	}
+
+	// errors
+	corrupted := testQUICInitial(QUICVersion1, dcid, 0, testQUICCrypto(0, hello))
+	corrupted[len(corrupted)-20] ^= 0xff
+	version := append([]byte(nil), first...)
+	version[4] = 0x02
+	tests := []struct {
+		name    string
+		p       []byte
+		wantErr error
+	}{
+		{name: "corrupted", p: corrupted, wantErr: ErrParseFrame},
+		{name: "version", p: version, wantErr: ErrParseProtocol},
+		{name: "short header", p: append([]byte{0x40}, dcid...), wantErr: ErrParseProtocol},
+		{name: "truncated", p: first[:600], wantErr: ErrFrameLen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeQUICClientHello(tt.p); !errors.Is(err, tt.wantErr) {
+				t.Errorf("DecodeQUICClientHello() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQUICVarint(t *testing.T) {
+	// RFC 9000 appendix A.1 examples
+	for s, want := range map[string]uint64{"c2197c5eff14e88c": 151288809941952652, "9d7f3e7d": 494878333, "7bbd": 15293, "25": 37} {
+		if v, n, err := QUICVarint(mustHex([]byte(s))); err != nil || v != want || n != len(s)/2 {
+			t.Errorf("QUICVarint(%s) = %d, %d, %v", s, v, n, err)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package packet
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/irai/packet/fastlog"
+)
+
+// TLS record and ClientHello
+//
+//	see https://datatracker.ietf.org/doc/html/rfc8446#section-4.1.2
+//	see https://github.com/salesforce/ja3
+//	see https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+//
+// The first message a client sends in a TLS connection is a ClientHello in the clear. It contains the
+// server name (SNI), the application protocols (ALPN) and the list of ciphers and extensions the client
+// supports. The order and content of these lists depends on the TLS library, so the JA3 and JA4 hashes
+// of the lists identify the client application independently of the server it connects to.
+//
+//	Record:    ContentType(1) Version(2) Length(2) Fragment
+//	Handshake: Type(1) Length(3) Body
+//	Body:      Version(2) Random(32) SessionID(1+n) CipherSuites(2+n) CompressionMethods(1+n) Extensions(2+n)
+const (
+	TLSContentChangeCipherSpec = 20
+	TLSContentAlert            = 21
+	TLSContentHandshake        = 22
+	TLSContentApplicationData  = 23
+
+	TLSHandshakeClientHello = 1
+	TLSHandshakeServerHello = 2
+
+	TLSRecordHeaderLen    = 5
+	tlsHandshakeHeaderLen = 4
+	tlsMaxRecordLen       = 16384 + 2048 // maximum ciphertext record
+)
+
+// TLS extension types
+const (
+	TLSExtServerName          = 0
+	TLSExtSupportedGroups     = 10
+	TLSExtECPointFormats      = 11
+	TLSExtSignatureAlgorithms = 13
+	TLSExtALPN                = 16
+	TLSExtSupportedVersions   = 43
+)
+
+// TLSRecord provides access to the TLS record layer fields.
+type TLSRecord []byte
+
+// IsValid returns ErrParseProtocol if the record header is not a TLS header and ErrFrameLen if the
+// record is incomplete. A record may span several tcp segments.
+func (p TLSRecord) IsValid() error {
+	if len(p) < TLSRecordHeaderLen {
+		return ErrFrameLen
+	}
+	if p.ContentType() < TLSContentChangeCipherSpec || p.ContentType() > 24 || p[1] != 0x03 { // 24 is heartbeat
+		return ErrParseProtocol
+	}
+	if p.Len() > tlsMaxRecordLen {
+		return fmt.Errorf("tls record len=%d: %w", p.Len(), ErrParseProtocol)
+	}
+	if len(p) < TLSRecordHeaderLen+p.Len() {
+		return ErrFrameLen
+	}
+	return nil
+}
+
+func (p TLSRecord) ContentType() uint8 { return p[0] }
+func (p TLSRecord) Version() uint16    { return binary.BigEndian.Uint16(p[1:3]) }
+func (p TLSRecord) Len() int           { return int(binary.BigEndian.Uint16(p[3:5])) }
+func (p TLSRecord) Fragment() []byte   { return p[TLSRecordHeaderLen : TLSRecordHeaderLen+p.Len()] }
+
+// TLSHandshake provides access to a handshake message.
+type TLSHandshake []byte
+
+func (p TLSHandshake) IsValid() error {
+	if len(p) < tlsHandshakeHeaderLen || len(p) < tlsHandshakeHeaderLen+p.Len() {
+		return ErrFrameLen
+	}
+	return nil
+}
+
+func (p TLSHandshake) Type() uint8  { return p[0] }
+func (p TLSHandshake) Len() int     { return int(p[1])<<16 | int(p[2])<<8 | int(p[3]) }
+func (p TLSHandshake) Body() []byte { return p[tlsHandshakeHeaderLen : tlsHandshakeHeaderLen+p.Len()] }
+
+// TLSClientHello provides access to the ClientHello handshake body. Fields reference the underlying
+// packet; copy any values retained after the packet buffer is reused.
+type TLSClientHello []byte
+
+// DecodeTLSClientHello returns the ClientHello in a TLS record. The record must contain the full handshake message.
+func DecodeTLSClientHello(record []byte) (TLSClientHello, error) {
+	r := TLSRecord(record)
+	if err := r.IsValid(); err != nil {
+		return nil, err
+	}
+	if r.ContentType() != TLSContentHandshake {
+		return nil, ErrParseProtocol
+	}
+	return DecodeTLSHandshakeClientHello(r.Fragment())
+}
+
+// DecodeTLSHandshakeClientHello returns the ClientHello in a handshake message. QUIC carries the handshake
+// messages in CRYPTO frames without the record layer.
+func DecodeTLSHandshakeClientHello(b []byte) (TLSClientHello, error) {
+	h := TLSHandshake(b)
+	if err := h.IsValid(); err != nil {
+		return nil, err
+	}
+	if h.Type() != TLSHandshakeClientHello {
+		return nil, ErrParseProtocol
+	}
+	p := TLSClientHello(h.Body())
+	if err := p.IsValid(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// fields returns the variable length fields; ok is false if a field overflows the message.
+func (p TLSClientHello) fields() (sessionID []byte, ciphers []byte, compression []byte, extensions []byte, ok bool) {
+	if len(p) < 35 {
+		return nil, nil, nil, nil, false
+	}
+	n := 35 + int(p[34])
+	if len(p) < n+2 {
+		return nil, nil, nil, nil, false
+	}
+	sessionID = p[35:n]
+	l := int(binary.BigEndian.Uint16(p[n : n+2]))
+	if len(p) < n+2+l+1 || l%2 != 0 {
+		return nil, nil, nil, nil, false
+	}
+	ciphers = p[n+2 : n+2+l]
+	n = n + 2 + l
+	l = int(p[n])
+	if len(p) < n+1+l {
+		return nil, nil, nil, nil, false
+	}
+	compression = p[n+1 : n+1+l]
+	n = n + 1 + l
+	if len(p) == n { // no extensions
+		return sessionID, ciphers, compression, nil, true
+	}
+	if len(p) < n+2 {
+		return nil, nil, nil, nil, false
+	}
+	l = int(binary.BigEndian.Uint16(p[n : n+2]))
+	if len(p) < n+2+l {
+		return nil, nil, nil, nil, false
+	}
+	return sessionID, ciphers, compression, p[n+2 : n+2+l], true
+}
+
+// IsValid returns nil if all length fields are within the message.
+func (p TLSClientHello) IsValid() error {
+	_, _, _, ext, ok := p.fields()
+	if !ok {
+		return fmt.Errorf("invalid client hello: %w", ErrFrameLen)
+	}
+	for len(ext) > 0 {
+		if len(ext) < 4 || len(ext) < 4+int(binary.BigEndian.Uint16(ext[2:4])) {
+			return fmt.Errorf("invalid client hello extension: %w", ErrFrameLen)
+		}
+		ext = ext[4+int(binary.BigEndian.Uint16(ext[2:4])):]
+	}
+	return nil
+}
+
+// TLSExtension is an extension in a hello message.
+type TLSExtension struct {
+	Type uint16
+	Data []byte
+}
+
+func (p TLSClientHello) Version() uint16   { return binary.BigEndian.Uint16(p[0:2]) } // legacy version; 0x0303 for TLS 1.3
+func (p TLSClientHello) Random() []byte    { return p[2:34] }
+func (p TLSClientHello) SessionID() []byte { sid, _, _, _, _ := p.fields(); return sid }
+
+// CipherSuites returns the cipher suites including GREASE values.
+func (p TLSClientHello) CipherSuites() []uint16 {
+	_, ciphers, _, _, _ := p.fields()
+	return uint16List(ciphers)
+}
+
+// Extensions returns the extensions in the order sent by the client.
+func (p TLSClientHello) Extensions() (list []TLSExtension) {
+	_, _, _, ext, _ := p.fields()
+	for len(ext) >= 4 {
+		n := 4 + int(binary.BigEndian.Uint16(ext[2:4]))
+		if n > len(ext) {
+			break
+		}
+		list = append(list, TLSExtension{Type: binary.BigEndian.Uint16(ext[0:2]), Data: ext[4:n]})
+		ext = ext[n:]
+	}
+	return list
+}
+
+// Extension returns the data for the extension type or nil if not present.
+func (p TLSClientHello) Extension(extType uint16) []byte {
+	_, _, _, ext, _ := p.fields()
+	for len(ext) >= 4 {
+		n := 4 + int(binary.BigEndian.Uint16(ext[2:4]))
+		if n > len(ext) {
+			break
+		}
+		if binary.BigEndian.Uint16(ext[0:2]) == extType {
+			return ext[4:n]
+		}
+		ext = ext[n:]
+	}
+	return nil
+}
+
+// ServerName returns the host name in the server name indication extension.
+func (p TLSClientHello) ServerName() string {
+	b := p.Extension(TLSExtServerName)
+	if len(b) < 2 {
+		return ""
+	}
+	b = b[2:]
+	for len(b) >= 3 {
+		n := 3 + int(binary.BigEndian.Uint16(b[1:3]))
+		if n > len(b) {
+			break
+		}
+		if b[0] == 0 { // host_name
+			return string(b[3:n])
+		}
+		b = b[n:]
+	}
+	return ""
+}
+
+// ALPN returns the application protocols offered by the client, i.e. "h2" and "http/1.1".
+func (p TLSClientHello) ALPN() (list []string) {
+	b := p.Extension(TLSExtALPN)
+	if len(b) < 2 {
+		return nil
+	}
+	for b = b[2:]; len(b) > 0 && len(b) >= 1+int(b[0]); b = b[1+int(b[0]):] {
+		list = append(list, string(b[1:1+int(b[0])]))
+	}
+	return list
+}
+
+// SupportedVersions returns the versions in the supported versions extension including GREASE values.
+func (p TLSClientHello) SupportedVersions() []uint16 {
+	b := p.Extension(TLSExtSupportedVersions)
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil
+	}
+	return uint16List(b[1 : 1+int(b[0])])
+}
+
+// SupportedGroups returns the named groups (elliptic curves) including GREASE values.
+func (p TLSClientHello) SupportedGroups() []uint16 {
+	return uint16Vector(p.Extension(TLSExtSupportedGroups))
+}
+
+// SignatureAlgorithms returns the signature algorithms in the order sent by the client.
+func (p TLSClientHello) SignatureAlgorithms() []uint16 {
+	return uint16Vector(p.Extension(TLSExtSignatureAlgorithms))
+}
+
+// ECPointFormats returns the elliptic curve point formats.
+func (p TLSClientHello) ECPointFormats() []uint8 {
+	b := p.Extension(TLSExtECPointFormats)
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil
+	}
+	return b[1 : 1+int(b[0])]
+}
+
+// MaxVersion returns the highest version offered in the supported versions extension or the legacy
+// version if the extension is not present.
+func (p TLSClientHello) MaxVersion() (version uint16) {
+	for _, v := range p.SupportedVersions() {
+		if !isTLSGrease(v) && v > version {
+			version = v
+		}
+	}
+	if version == 0 {
+		return p.Version()
+	}
+	return version
+}
+
+// JA3String returns the JA3 fingerprint before hashing: version, ciphers, extensions, groups and point
+// formats in decimal with GREASE values removed.
+func (p TLSClientHello) JA3String() string {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(p.Version())))
+	b.WriteByte(',')
+	writeDecimalList(&b, p.CipherSuites())
+	b.WriteByte(',')
+	var ext []uint16
+	for _, v := range p.Extensions() {
+		ext = append(ext, v.Type)
+	}
+	writeDecimalList(&b, ext)
+	b.WriteByte(',')
+	writeDecimalList(&b, p.SupportedGroups())
+	b.WriteByte(',')
+	for i, v := range p.ECPointFormats() {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(v)))
+	}
+	return b.String()
+}
+
+// JA3 returns the md5 hash of the JA3 string in hex.
+func (p TLSClientHello) JA3() string {
+	h := md5.Sum([]byte(p.JA3String()))
+	return hex.EncodeToString(h[:])
+}
+
+// JA4 returns the JA4 fingerprint, i.e. t13d1516h2_8daaf6152771_e5627efa2ab1. Set quic if the
+// ClientHello was carried in a QUIC Initial packet.
+func (p TLSClientHello) JA4(quic bool) string {
+	var b strings.Builder
+	if quic {
+		b.WriteByte('q')
+	} else {
+		b.WriteByte('t')
+	}
+	switch p.MaxVersion() {
+	case 0x0304:
+		b.WriteString("13")
+	case 0x0303:
+		b.WriteString("12")
+	case 0x0302:
+		b.WriteString("11")
+	case 0x0301:
+		b.WriteString("10")
+	case 0x0300:
+		b.WriteString("s3")
+	default:
+		b.WriteString("00")
+	}
+	if p.Extension(TLSExtServerName) != nil {
+		b.WriteByte('d')
+	} else {
+		b.WriteByte('i')
+	}
+
+	ciphers := removeTLSGrease(p.CipherSuites())
+	var ext []uint16
+	count := 0
+	for _, v := range p.Extensions() {
+		if isTLSGrease(v.Type) {
+			continue
+		}
+		count++
+		if v.Type != TLSExtServerName && v.Type != TLSExtALPN {
+			ext = append(ext, v.Type)
+		}
+	}
+	b.WriteString(fmt.Sprintf("%02d%02d", min99(len(ciphers)), min99(count)))
+	alpn := "00"
+	if list := p.ALPN(); len(list) > 0 && len(list[0]) > 0 {
+		v := list[0]
+		alpn = string([]byte{v[0], v[len(v)-1]})
+		if !isAlphanumeric(v[0]) || !isAlphanumeric(v[len(v)-1]) {
+			h := hex.EncodeToString([]byte(v))
+			alpn = string([]byte{h[0], h[len(h)-1]})
+		}
+	}
+	b.WriteString(alpn)
+
+	b.WriteByte('_')
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	b.WriteString(ja4Hash(hexList(ciphers)))
+	b.WriteByte('_')
+	sort.Slice(ext, func(i, j int) bool { return ext[i] < ext[j] })
+	s := hexList(ext)
+	if sig := removeTLSGrease(p.SignatureAlgorithms()); len(sig) > 0 && s != "" {
+		s = s + "_" + hexList(sig)
+	}
+	b.WriteString(ja4Hash(s))
+	return b.String()
+}
+
+func (p TLSClientHello) String() string {
+	return Logger.Msg("").Struct(p).ToString()
+}
+
+func (p TLSClientHello) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.Uint16Hex("version", p.MaxVersion())
+	l.String("sni", p.ServerName())
+	if alpn := p.ALPN(); len(alpn) > 0 {
+		l.StringArray("alpn", alpn)
+	}
+	l.String("ja3", p.JA3())
+	l.String("ja4", p.JA4(false))
+	return l
+}
+
+// isTLSGrease returns true for the reserved GREASE values 0x0a0a, 0x1a1a ... 0xfafa - RFC 8701.
+func isTLSGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func removeTLSGrease(list []uint16) []uint16 {
+	n := make([]uint16, 0, len(list))
+	for _, v := range list {
+		if !isTLSGrease(v) {
+			n = append(n, v)
+		}
+	}
+	return n
+}
+
+// uint16List returns the big endian uint16 values in b.
+func uint16List(b []byte) []uint16 {
+	list := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i = i + 2 {
+		list = append(list, binary.BigEndian.Uint16(b[i:i+2]))
+	}
+	return list
+}
+
+// uint16Vector returns the values in a vector with a two byte length prefix.
+func uint16Vector(b []byte) []uint16 {
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b[0:2])) {
+		return nil
+	}
+	return uint16List(b[2 : 2+int(binary.BigEndian.Uint16(b[0:2]))])
+}
+
+func writeDecimalList(b *strings.Builder, list []uint16) {
+	first := true
+	for _, v := range list {
+		if isTLSGrease(v) {
+			continue
+		}
+		if !first {
+			b.WriteByte('-')
+		}
+		first = false
+		b.WriteString(strconv.Itoa(int(v)))
+	}
+}
+
+func hexList(list []uint16) string {
+	s := make([]string, 0, len(list))
+	for _, v := range list {
+		s = append(s, fmt.Sprintf("%04x", v))
+	}
+	return strings.Join(s, ",")
+}
+
+// ja4Hash returns the first 12 hex characters of the sha256 hash of s or zeros if s is empty.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:6])
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
@@ -0,0 +1,154 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// testTLSExtension returns an extension with a vector of uint16 values; prefix is the length field size.
+func testTLSExtension(extType uint16, prefix int, values ...uint16) TLSExtension {
+	b := make([]byte, prefix, prefix+len(values)*2)
+	for _, v := range values {
+		b = appendUint16(b, v)
+	}
+	switch prefix {
+	case 1:
+		b[0] = byte(len(values) * 2)
+	case 2:
+		binary.BigEndian.PutUint16(b[0:2], uint16(len(values)*2))
+	}
+	return TLSExtension{Type: extType, Data: b}
+}
+
+func testTLSServerName(name string) TLSExtension {
+	b := []byte{0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(b[0:2], uint16(len(name)+3))
+	binary.BigEndian.PutUint16(b[3:5], uint16(len(name)))
+	return TLSExtension{Type: TLSExtServerName, Data: append(b, name...)}
+}
+
+func testTLSALPN(protocols ...string) TLSExtension {
+	b := []byte{0, 0}
+	for _, v := range protocols {
+		b = append(append(b, byte(len(v))), v...)
+	}
+	binary.BigEndian.PutUint16(b[0:2], uint16(len(b)-2))
+	return TLSExtension{Type: TLSExtALPN, Data: b}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// testTLSClientHello returns a handshake message with the ciphers and extensions.
+func testTLSClientHello(ciphers []uint16, extensions ...TLSExtension) []byte {
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 32)                  // session id
+	body = append(body, make([]byte, 32)...)
+	body = appendUint16(body, uint16(len(ciphers)*2))
+	for _, v := range ciphers {
+		body = appendUint16(body, v)
+	}
+	body = append(body, 1, 0) // null compression
+	var ext []byte
+	for _, v := range extensions {
+		ext = appendUint16(ext, v.Type)
+		ext = appendUint16(ext, uint16(len(v.Data)))
+		ext = append(ext, v.Data...)
+	}
+	body = appendUint16(body, uint16(len(ext)))
+	body = append(body, ext...)
+	return append([]byte{TLSHandshakeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// testTLSRecord wraps the handshake message in a record.
+func testTLSRecord(handshake []byte) []byte {
+	b := []byte{TLSContentHandshake, 0x03, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(b[3:5], uint16(len(handshake)))
+	return append(b, handshake...)
+}
+
+// testTLSChrome returns the client hello used in the JA4 technical details; it includes GREASE values.
+func testTLSChrome() []byte {
+	ciphers := []uint16{0x1a1a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+	return testTLSClientHello(ciphers,
+		TLSExtension{Type: 0x2a2a},
+		testTLSServerName("www.google.com"),
+		TLSExtension{Type: 0x0017},
+		TLSExtension{Type: 0xff01, Data: []byte{0}},
+		testTLSExtension(TLSExtSupportedGroups, 2, 0x3a3a, 0x001d, 0x0017, 0x0018),
+		TLSExtension{Type: TLSExtECPointFormats, Data: []byte{1, 0}},
+		TLSExtension{Type: 0x0023},
+		testTLSALPN("h2", "http/1.1"),
+		TLSExtension{Type: 0x0005, Data: []byte{1, 0, 0, 0, 0}},
+		testTLSExtension(TLSExtSignatureAlgorithms, 2, 0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601),
+		TLSExtension{Type: 0x0012},
+		TLSExtension{Type: 0x0033, Data: []byte{0, 0}},
+		TLSExtension{Type: 0x002d, Data: []byte{1, 1}},
+		testTLSExtension(TLSExtSupportedVersions, 1, 0x4a4a, 0x0304, 0x0303),
+		TLSExtension{Type: 0x001b, Data: []byte{2, 0, 2}},
+		TLSExtension{Type: 0x4469, Data: []byte{0, 3, 2, 'h', '2'}},
+		TLSExtension{Type: 0x0015, Data: make([]byte, 16)},
+	)
+}
+
+func TestTLSClientHello(t *testing.T) {
+	hello, err := DecodeTLSClientHello(testTLSRecord(testTLSChrome()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ServerName() != "www.google.com" || len(hello.ALPN()) != 2 || hello.ALPN()[1] != "http/1.1" ||
+		hello.MaxVersion() != 0x0304 || len(hello.CipherSuites()) != 16 || len(hello.SessionID()) != 32 {
+		t.Errorf("invalid client hello %s", hello)
+	}
+	if got, want := hello.JA4(false), "t13d1516h2_8daaf6152771_e5627efa2ab1"; got != want {
+		t.Errorf("JA4() = %s, want %s", got, want)
+	}
+	if got := hello.JA4(true); got[0] != 'q' {
+		t.Errorf("JA4() = %s, want quic prefix", got)
+	}
+	want := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	if got := hello.JA3String(); got != want {
+		t.Errorf("JA3String() = %s, want %s", got, want)
+	}
+	if len(hello.JA3()) != 32 {
+		t.Errorf("invalid JA3 %s", hello.JA3())
+	}
+
+	// tls 1.2 client without sni and alpn
+	hello, err = DecodeTLSClientHello(testTLSRecord(testTLSClientHello([]uint16{0xc02f, 0x009c})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ServerName() != "" || hello.ALPN() != nil || hello.JA4(false) != "t12i020000_"+ja4Hash("009c,c02f")+"_000000000000" {
+		t.Errorf("invalid client hello %s ja4=%s", hello, hello.JA4(false))
+	}
+}
+
+func TestDecodeTLSClientHello_errors(t *testing.T) {
+	record := testTLSRecord(testTLSChrome())
+	overflow := testTLSRecord(testTLSClientHello(nil, TLSExtension{Type: 0, Data: []byte{0, 0}}))
+	binary.BigEndian.PutUint16(overflow[len(overflow)-4:], 10) // extension len past the end of the message
+	tests := []struct {
+		name    string
+		p       []byte
+		wantErr error
+	}{
+		{name: "truncated record", p: record[:len(record)-1], wantErr: ErrFrameLen},
+		{name: "header only", p: record[:4], wantErr: ErrFrameLen},
+		{name: "application data", p: append([]byte{TLSContentApplicationData}, record[1:]...), wantErr: ErrParseProtocol},
+		{name: "not tls", p: []byte("GET / HTTP/1.1\r\n\r\n"), wantErr: ErrParseProtocol},
+		{name: "server hello", p: testTLSRecord(append([]byte{TLSHandshakeServerHello}, testTLSChrome()[1:]...)), wantErr: ErrParseProtocol},
+		{name: "extension overflow", p: overflow, wantErr: ErrFrameLen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeTLSClientHello(tt.p); !errors.Is(err, tt.wantErr) {
+				t.Errorf("DecodeTLSClientHello() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package packet
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/irai/packet/fastlog"
+)
+
+// Wake-on-LAN magic packet
+//
+// The magic packet is six bytes of 0xff followed by sixteen repetitions of the target MAC
+// and an optional SecureOn password of four or six bytes. The packet is sent either
+// as the payload of an ethernet frame with EtherType 0x0842 or as the payload of a UDP
+// packet to port 7 or 9, usually to the broadcast address.
+//
+//	see https://en.wikipedia.org/wiki/Wake-on-LAN
+//	see https://www.amd.com/system/files/TechDocs/20213.pdf
+const (
+	EthTypeWakeOnLAN = 0x0842
+	WakeOnLANPort    = 9
+	wakeOnLANLen     = 6 + 16*6
+)
+
+// WakeOnLAN provides access to the magic packet fields.
+type WakeOnLAN []byte
+
+// IsValid returns true if the payload starts with the synchronisation stream followed by
+// sixteen repetitions of the same MAC.
+func (p WakeOnLAN) IsValid() error {
+	if len(p) < wakeOnLANLen {
+		return ErrFrameLen
+	}
+	if !bytes.Equal(p[0:6], EthBroadcast) {
+		return ErrParseProtocol
+	}
+	for i := 12; i < wakeOnLANLen; i = i + 6 {
+		if !bytes.Equal(p[6:12], p[i:i+6]) {
+			return ErrParseProtocol
+		}
+	}
+	return nil
+}
+
+// TargetMAC returns the MAC of the device to wake up.
+func (p WakeOnLAN) TargetMAC() net.HardwareAddr { return net.HardwareAddr(p[6:12]) }
+
+// Password returns the SecureOn password or nil if the packet has no password.
+func (p WakeOnLAN) Password() []byte {
+	if n := len(p) - wakeOnLANLen; n == 4 || n == 6 {
+		return p[wakeOnLANLen:]
+	}
+	return nil
+}
+
+func (p WakeOnLAN) String() string {
+	return Logger.Msg("").Struct(p).ToString()
+}
+
+func (p WakeOnLAN) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.MAC("target", p.TargetMAC())
+	if password := p.Password(); password != nil {
+		l.Int("passwordlen", len(password))
+	}
+	return l
+}
+
+// EncodeWakeOnLAN writes a magic packet for mac to b and returns the packet. The password is
+// optional and must be nil or four or six bytes long.
+func EncodeWakeOnLAN(b []byte, mac net.HardwareAddr, password []byte) WakeOnLAN {
+	if len(b) < wakeOnLANLen+len(password) || len(mac) != 6 {
+		return nil
+	}
+	copy(b[0:6], EthBroadcast)
+	for i := 6; i < wakeOnLANLen; i = i + 6 {
+		copy(b[i:i+6], mac)
+	}
+	copy(b[wakeOnLANLen:], password)
+	return b[:wakeOnLANLen+len(password)]
+}
+
+// WakeOnLANEvent records a magic packet seen on the LAN.
+type WakeOnLANEvent struct {
+	SrcAddr Addr             // host that sent the magic packet
+	Target  net.HardwareAddr // device to wake up
+	Time    time.Time
+}
+
+func (e WakeOnLANEvent) String() string {
+	return Logger.Msg("").Struct(e).ToString()
+}
+
+func (e WakeOnLANEvent) FastLog(l *fastlog.Line) *fastlog.Line {
+	l.Struct(e.SrcAddr)
+	l.MAC("target", e.Target)
+	l.Time("time", e.Time)
+	return l
+}
+
+// WakeOnLAN sends a magic packet to wake up the device with mac. The packet is sent to the
+// UDP broadcast address and port 9 as this form is forwarded by most switches and access points.
+func (h *Session) WakeOnLAN(mac net.HardwareAddr) error {
+	return h.WakeOnLANSecureOn(mac, nil)
+}
+
+// WakeOnLANSecureOn sends a magic packet with a SecureOn password to wake up the device with mac.
+func (h *Session) WakeOnLANSecureOn(mac net.HardwareAddr, password []byte) (err error) {
+	if len(mac) != 6 || (password != nil && len(password) != 4 && len(password) != 6) {
+		return ErrInvalidParam
+	}
+	b := EtherBufferPool.Get().(*[EthMaxSize]byte)
+	defer EtherBufferPool.Put(b)
+	ether := EncodeEther(b[0:], syscall.ETH_P_IP, h.NICInfo.HostAddr4.MAC, EthBroadcast)
+	ip4 := EncodeIP4(ether.Payload(), 64, h.NICInfo.HostAddr4.IP, IP4Broadcast)
+	udp := EncodeUDP(ip4.Payload(), WakeOnLANPort, WakeOnLANPort)
+	var magic [wakeOnLANLen + 6]byte
+	if udp, err = udp.AppendPayload(EncodeWakeOnLAN(magic[:], mac, password)); err != nil {
+		return err
+	}
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	if ether, err = ether.SetPayload(ip4); err != nil {
+		return err
+	}
+	if Logger.IsInfo() {
+		Logger.Msg("send wake on lan").MAC("target", mac).Write()
+	}
+	_, err = h.Conn.WriteTo(ether, &Addr{MAC: EthBroadcast, IP: IP4Broadcast, Port: WakeOnLANPort})
+	return err
+}
+
+// notifyWakeOnLAN logs the magic packet in frame and sends the event to the wake channel.
+func (h *Session) notifyWakeOnLAN(frame Frame) {
+	event := WakeOnLANEvent{SrcAddr: frame.SrcAddr, Target: CopyMAC(WakeOnLAN(frame.Payload()).TargetMAC()), Time: time.Now()}
+	if Logger.IsInfo() {
+		Logger.Msg("wake on lan").Struct(event).Write()
+	}
+	select {
+	case h.WakeC <- event:
+	default: // discard if caller is not reading
+	}
+}
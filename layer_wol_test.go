@@ -0,0 +1,123 @@
+package packet
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWakeOnLAN_IsValid(t *testing.T) {
+	target := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x06}
+	b := make([]byte, 200)
+	tests := []struct {
+		name     string
+		p        WakeOnLAN
+		wantErr  error
+		password []byte
+	}{
+		{name: "magic", p: EncodeWakeOnLAN(b, target, nil)},
+		{name: "password4", p: EncodeWakeOnLAN(make([]byte, 200), target, []byte{1, 2, 3, 4}), password: []byte{1, 2, 3, 4}},
+		{name: "password6", p: EncodeWakeOnLAN(make([]byte, 200), target, []byte{1, 2, 3, 4, 5, 6}), password: []byte{1, 2, 3, 4, 5, 6}},
+		{name: "short", p: EncodeWakeOnLAN(make([]byte, 200), target, nil)[:101], wantErr: ErrFrameLen},
+		{name: "sync", p: append([]byte{0}, EncodeWakeOnLAN(make([]byte, 200), target, nil)[1:]...), wantErr: ErrParseProtocol},
+		{name: "repetition", p: append(EncodeWakeOnLAN(make([]byte, 200), target, nil)[:101], 0x07), wantErr: ErrParseProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.IsValid(); err != tt.wantErr {
+				t.Fatalf("IsValid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if !bytes.Equal(tt.p.TargetMAC(), target) || !bytes.Equal(tt.p.Password(), tt.password) {
+				t.Errorf("invalid magic packet %s", tt.p)
+			}
+		})
+	}
+}
+
+func TestSession_WakeOnLAN(t *testing.T) {
+	session, outConn := testSession()
+	defer session.Close()
+	target := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x06}
+
+	if err := session.WakeOnLANSecureOn(target, []byte{1, 2, 3}); err != ErrInvalidParam {
+		t.Fatal("expected invalid password error", err)
+	}
+	if err := session.WakeOnLAN(target); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, EthMaxSize)
+	n, _, err := outConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ether := Ether(buf[:n])
+	udp := UDP(IP4(ether.Payload()).Payload())
+	if !bytes.Equal(ether.Dst(), EthBroadcast) || IP4(ether.Payload()).Dst() != IP4Broadcast || udp.DstPort() != WakeOnLANPort {
+		t.Fatalf("invalid wake on lan frame %s", ether)
+	}
+	if magic := WakeOnLAN(udp.Payload()); magic.IsValid() != nil || !bytes.Equal(magic.TargetMAC(), target) || magic.Password() != nil {
+		t.Fatalf("invalid magic packet %s", magic)
+	}
+}
+
+func TestSession_ParseWakeOnLAN(t *testing.T) {
+	session, _ := testSession()
+	defer session.Close()
+	target := net.HardwareAddr{0x00, 0x02, 0x03, 0x04, 0x05, 0x06}
+	magic := EncodeWakeOnLAN(make([]byte, 200), target, []byte{1, 2, 3, 4, 5, 6})
+
+	// ethertype 0x0842 form
+	ether := EncodeEther(make([]byte, EthMaxSize), EthTypeWakeOnLAN, mac1, EthBroadcast)
+	ether, _ = ether.AppendPayload(magic)
+	frame, err := session.Parse(ether)
+	if err != nil || frame.PayloadID != PayloadWakeOnLAN {
+		t.Fatalf("invalid ether frame payloadID=%v err=%v", frame.PayloadID, err)
+	}
+	session.Notify(frame)
+	select {
+	case e := <-session.WakeC:
+		if !bytes.Equal(e.SrcAddr.MAC, mac1) || !bytes.Equal(e.Target, target) {
+			t.Errorf("invalid event %s", e)
+		}
+	case <-time.After(time.Millisecond * 10):
+		t.Fatal("missing wake on lan event")
+	}
+
+	// udp port 7 and 9 forms
+	for _, port := range []uint16{7, 9} {
+		ether = EncodeEther(make([]byte, EthMaxSize), syscall.ETH_P_IP, mac2, EthBroadcast)
+		ip4 := EncodeIP4(ether.Payload(), 64, ip2, IP4Broadcast)
+		udp := EncodeUDP(ip4.Payload(), 40000, port)
+		udp, _ = udp.AppendPayload(magic)
+		ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+		ether, _ = ether.SetPayload(ip4)
+		if frame, err = session.Parse(ether); err != nil || frame.PayloadID != PayloadWakeOnLAN {
+			t.Fatalf("invalid udp frame port=%d payloadID=%v err=%v", port, frame.PayloadID, err)
+		}
+		session.Notify(frame)
+		select {
+		case e := <-session.WakeC:
+			if !bytes.Equal(e.SrcAddr.MAC, mac2) || e.SrcAddr.IP != ip2 || !bytes.Equal(e.Target, target) {
+				t.Errorf("invalid event %s", e)
+			}
+		case <-time.After(time.Millisecond * 10):
+			t.Fatal("missing wake on lan event")
+		}
+	}
+
+	// udp port 9 without a magic packet is not classified
+	ether = EncodeEther(make([]byte, EthMaxSize), syscall.ETH_P_IP, mac2, EthBroadcast)
+	ip4 := EncodeIP4(ether.Payload(), 64, ip2, IP4Broadcast)
+	udp := EncodeUDP(ip4.Payload(), 40000, WakeOnLANPort)
+	udp, _ = udp.AppendPayload([]byte("discard"))
+	ip4 = ip4.SetPayload(udp, syscall.IPPROTO_UDP)
+	ether, _ = ether.SetPayload(ip4)
+	if frame, err = session.Parse(ether); err != nil || frame.PayloadID != PayloadUDP {
+		t.Fatalf("invalid discard frame payloadID=%v err=%v", frame.PayloadID, err)
+	}
+}
@@ -31,6 +31,9 @@ type MACEntry struct {
 	SSDPName     NameEntry
 	LLMNRName    NameEntry
 	NBNSName     NameEntry
+	WSDName      NameEntry
+	HTTPName     NameEntry
+	Workgroup    string // netbios workgroup or domain
 	LastSeen     time.Time
 }
 
@@ -63,6 +66,11 @@ func (e *MACEntry) FastLog(l *fastlog.Line) *fastlog.Line {
 	l.Struct(e.SSDPName)
 	l.Struct(e.LLMNRName)
 	l.Struct(e.NBNSName)
+	l.Struct(e.WSDName)
+	l.Struct(e.HTTPName)
+	if e.Workgroup != "" {
+		l.String("workgroup", e.Workgroup)
+	}
 	return l
 }
 
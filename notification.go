@@ -13,6 +13,9 @@ type Notification struct {
 	SSDPName     NameEntry
 	LLMNRName    NameEntry
 	NBNSName     NameEntry
+	WSDName      NameEntry
+	HTTPName     NameEntry
+	Workgroup    string
 	IsRouter     bool
 }
 
@@ -33,6 +36,11 @@ func (n Notification) FastLog(l *fastlog.Line) *fastlog.Line {
 	l.Struct(n.SSDPName)
 	l.Struct(n.LLMNRName)
 	l.Struct(n.NBNSName)
+	l.Struct(n.WSDName)
+	l.Struct(n.HTTPName)
+	if n.Workgroup != "" {
+		l.String("workgroup", n.Workgroup)
+	}
 	l.Bool("router", n.IsRouter)
 	return l
 }
@@ -41,8 +49,8 @@ func toNotification(host *Host) Notification {
 	// send the MACEntry name as there can be many IPv6 hosts, some with name entries not populated yet
 	return Notification{Addr: host.Addr, Online: host.Online, Manufacturer: host.MACEntry.Manufacturer,
 		DHCP4Name: host.MACEntry.DHCP4Name, MDNSName: host.MACEntry.MDNSName, SSDPName: host.MACEntry.SSDPName,
-		LLMNRName: host.LLMNRName, NBNSName: host.MACEntry.NBNSName,
-		IsRouter: host.MACEntry.IsRouter}
+		LLMNRName: host.LLMNRName, NBNSName: host.MACEntry.NBNSName, WSDName: host.MACEntry.WSDName,
+		HTTPName: host.MACEntry.HTTPName, Workgroup: host.MACEntry.Workgroup, IsRouter: host.MACEntry.IsRouter}
 }
 
 func (h *Session) sendNotification(notification Notification) {
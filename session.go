@@ -85,19 +85,20 @@ var (
 
 // Session holds the session context for a given network interface.
 type Session struct {
-	Conn            net.PacketConn    // the underlaying raw connection used for all read and write
-	NICInfo         *NICInfo          // keep interface information
-	ProbeDeadline   time.Duration     // send IP probe if no traffic received for this long
-	OfflineDeadline time.Duration     // mark Host offline if no traffic for this long
-	PurgeDeadline   time.Duration     // delete Host if no traffic for this long
-	HostTable       HostTable         // store MAC/IP list - one for each IP host
-	MACTable        MACTable          // store mac list
-	mutex           sync.RWMutex      // global session mutex
-	Statistics      []ProtoStats      // keep per protocol statistics
-	C               chan Notification // channel for online & offline notifications
-	closeChan       chan bool         // channel to end all go routines
-	closed          bool              // indicate the session is closed
-	ipHeartBeat     uint32            // ipHeartBeat is set to 1 when we receive an IP packet
+	Conn            net.PacketConn      // the underlaying raw connection used for all read and write
+	NICInfo         *NICInfo            // keep interface information
+	ProbeDeadline   time.Duration       // send IP probe if no traffic received for this long
+	OfflineDeadline time.Duration       // mark Host offline if no traffic for this long
+	PurgeDeadline   time.Duration       // delete Host if no traffic for this long
+	HostTable       HostTable           // store MAC/IP list - one for each IP host
+	MACTable        MACTable            // store mac list
+	mutex           sync.RWMutex        // global session mutex
+	Statistics      []ProtoStats        // keep per protocol statistics
+	C               chan Notification   // channel for online & offline notifications
+	WakeC           chan WakeOnLANEvent // channel for wake-on-lan magic packets seen by Notify
+	closeChan       chan bool           // channel to end all go routines
+	closed          bool                // indicate the session is closed
+	ipHeartBeat     uint32              // ipHeartBeat is set to 1 when we receive an IP packet
 }
 
 // Config contains configurable parameters that overide package defaults
@@ -131,6 +132,7 @@ func (config Config) NewSession(nic string) (session *Session, err error) {
 	session.MACTable = newMACTable()
 	session.HostTable = newHostTable()
 	session.C = make(chan Notification, 128) // plenty of capacity to prevent blocking
+	session.WakeC = make(chan WakeOnLANEvent, 16)
 	session.closeChan = make(chan bool)
 
 	if session.NICInfo = config.NICInfo; session.NICInfo == nil {
@@ -148,7 +150,7 @@ func (config Config) NewSession(nic string) (session *Session, err error) {
 	}
 
 	// create and populate stats table
-	session.Statistics = make([]ProtoStats, 32)
+	session.Statistics = make([]ProtoStats, PayloadMax)
 	for i := 1; i < len(session.Statistics); i++ {
 		session.Statistics[i].Proto = PayloadID(i)
 	}
@@ -386,7 +388,12 @@ func (h *Session) arpRequest(dst net.HardwareAddr, sender Addr, target Addr) (er
 //
 // Notify will only send a notification via the notification channel if a change is pending as a result
 // of processing the packet. It returns silently if there is no notification pending.
+//
+// Notify also sends a WakeOnLANEvent via the wake channel when the frame is a magic packet.
 func (h *Session) Notify(frame Frame) {
+	if frame.PayloadID == PayloadWakeOnLAN {
+		h.notifyWakeOnLAN(frame)
+	}
 	if frame.Host == nil {
 		if frame.PayloadID != PayloadDHCP4 {
 			return